@@ -0,0 +1,398 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Anty0/tello"
+	"github.com/mattn/go-gtk/glib"
+)
+
+// The optional HTTP API lets other programs on this machine read the telemetry and fly the drone.
+//
+//   GET  /api/status          connection, recording etc.
+//   GET  /api/flightdata      the latest FlightData
+//   GET  /api/track           the current track
+//   GET  /api/stream          WebSocket, FlightData every fdPeriodMs
+//   POST /api/takeoff         only if the pre-flight checklist passes, unless ?override=true
+//   POST /api/land, /api/rth, /api/cancel, /api/photo, /api/record/start, /api/record/stop
+//   POST /api/sticks          {"lx":0,"ly":0.5,"rx":0,"ry":0} in the range -1..1
+//
+// The POST endpoints need an "Authorization: Bearer <token>" header with the token from the settings.
+
+const (
+	defaultAPIPort   = 8890
+	apiListenAddr    = "127.0.0.1"
+	apiStickTimeout  = 500 * time.Millisecond // sticks are centred if the client stops sending
+	apiStickClaimant = "the HTTP API"
+	apiTokenBytes    = 16
+)
+
+// apiSettingsT is kept in the settings.
+type apiSettingsT struct {
+	Enabled bool
+	Port    int
+	Token   string
+}
+
+type apiServerT struct {
+	apiMu     sync.Mutex
+	srv       *http.Server
+	port      int
+	token     string             // copied from the settings, which are not safe to read from the handlers
+	preflight preflightSettingsT // likewise
+	stickTmr  *time.Timer
+}
+
+var apiServer apiServerT
+
+func newAPIToken() string {
+	b := make([]byte, apiTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("Could not generate API token: %v\n", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// start runs the HTTP server on port, any previous server is stopped first.
+func (as *apiServerT) start(port int) error {
+	as.stop()
+	ln, err := net.Listen("tcp", net.JoinHostPort(apiListenAddr, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/status", apiStatus)
+	mux.HandleFunc("/api/flightdata", apiFlightData)
+	mux.HandleFunc("/api/track", apiTrack)
+	mux.HandleFunc("/api/stream", apiStream)
+	mux.HandleFunc("/api/takeoff", apiTakeoff)
+	mux.HandleFunc("/api/land", apiControl(func() error { drone.Land(); return nil }))
+	mux.HandleFunc("/api/rth", apiControl(func() error {
+		if !drone.IsHomeSet() {
+			return errors.New("home is not set")
+		}
+		_, err := drone.AutoFlyToXY(0, 0)
+		return err
+	}))
+	mux.HandleFunc("/api/cancel", apiControl(func() error {
+		failsafe.override()
+		scripter.abort()
+		drone.CancelAutoFlyToXY()
+		return nil
+	}))
+	mux.HandleFunc("/api/photo", apiControl(takePhoto))
+	mux.HandleFunc("/api/record/start", apiControl(func() error {
+		if isRecordingVideo() {
+			return errors.New("already recording")
+		}
+		onGtkThread(recordVideoCB)
+		return nil
+	}))
+	mux.HandleFunc("/api/record/stop", apiControl(func() error {
+		if !isRecordingVideo() {
+			return errors.New("not recording")
+		}
+		onGtkThread(stopRecordingVideoCB)
+		return nil
+	}))
+	mux.HandleFunc("/api/sticks", apiSticks)
+
+	as.apiMu.Lock()
+	as.srv = &http.Server{Handler: mux}
+	as.port = port
+	srv := as.srv
+	as.apiMu.Unlock()
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("API server error: %v\n", err)
+		}
+	}()
+	log.Printf("API server listening on %s\n", ln.Addr())
+	return nil
+}
+
+// stop shuts down the HTTP server, if it is running.
+func (as *apiServerT) stop() {
+	as.apiMu.Lock()
+	srv := as.srv
+	as.srv = nil
+	as.apiMu.Unlock()
+	if srv != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		srv.Shutdown(ctx)
+		cancel()
+		log.Println("API server stopped")
+	}
+}
+
+// running returns true if the server is up.
+func (as *apiServerT) running() bool {
+	as.apiMu.Lock()
+	defer as.apiMu.Unlock()
+	return as.srv != nil
+}
+
+// applyAPISettings starts, restarts or stops the server to match the settings.
+func applyAPISettings() error {
+	s := settings.API
+	apiServer.apiMu.Lock()
+	apiServer.token = s.Token
+	apiServer.preflight = settings.Preflight.clone()
+	apiServer.apiMu.Unlock()
+	if !s.Enabled {
+		apiServer.stop()
+		return nil
+	}
+	apiServer.apiMu.Lock()
+	same := apiServer.srv != nil && apiServer.port == s.Port
+	apiServer.apiMu.Unlock()
+	if same {
+		return nil
+	}
+	return apiServer.start(s.Port)
+}
+
+// onGtkThread runs f in the GTK main loop and waits for it to finish.
+func onGtkThread(f func()) {
+	done := make(chan bool)
+	glib.IdleAdd(func() bool {
+		f()
+		close(done)
+		return false
+	})
+	<-done
+}
+
+func isRecordingVideo() bool {
+	return videoRecorder.Recording()
+}
+
+func apiConnected() bool {
+	active, _, _, _ := linkWatchdog.status()
+	return active
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("API error encoding response: %v\n", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// authorised checks the bearer token of a control request.
+func authorised(r *http.Request) bool {
+	apiServer.apiMu.Lock()
+	token := apiServer.token
+	apiServer.apiMu.Unlock()
+	auth := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
+// checkControl validates a control request, writing the error response if it is not allowed.
+func checkControl(w http.ResponseWriter, r *http.Request) bool {
+	switch {
+	case r.Method != http.MethodPost:
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+	case !authorised(r):
+		writeError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+	case !apiConnected():
+		writeError(w, http.StatusConflict, errors.New("not connected to a drone"))
+	default:
+		return true
+	}
+	return false
+}
+
+// apiControl returns a handler for a simple control endpoint which calls action.
+func apiControl(action func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !checkControl(w, r) {
+			return
+		}
+		if err := action(); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+	}
+}
+
+// apiTakeoff only takes off if the pre-flight checklist passes, or "?override=true" is given.
+func apiTakeoff(w http.ResponseWriter, r *http.Request) {
+	if !checkControl(w, r) {
+		return
+	}
+	apiServer.apiMu.Lock()
+	ps := apiServer.preflight
+	apiServer.apiMu.Unlock()
+	fd := currentFlightData()
+	if !ps.Disabled && !fd.Flying {
+		res := evalChecklist(fd, ps)
+		res.Via = "api"
+		if !res.Passed {
+			if r.URL.Query().Get("override") != "true" {
+				writeJSON(w, http.StatusConflict, map[string]interface{}{
+					"error":  "pre-flight checklist failed",
+					"failed": res.failures(),
+				})
+				return
+			}
+			res.Overridden = true
+		}
+		logChecklist(res)
+	}
+	drone.TakeOff()
+	writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
+
+func apiStatus(w http.ResponseWriter, r *http.Request) {
+	active, lost, fdAge, _ := linkWatchdog.status()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"app":             appName + " " + appVersion,
+		"connected":       active,
+		"linkLost":        lost,
+		"flightDataAgeMs": fdAge.Nanoseconds() / 1e6,
+		"homeSet":         active && drone.IsHomeSet(),
+		"failsafe":        failsafe.status(),
+		"geofence":        fenceGuard.status(),
+		"flightRecording": flightRecorder.recording(),
+		"videoRecording":  isRecordingVideo(),
+	})
+}
+
+func currentFlightData() tello.FlightData {
+	return fdListener.Latest()
+}
+
+func apiFlightData(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentFlightData())
+}
+
+type apiPosT struct {
+	Time   time.Time `json:"time"`
+	X      float32   `json:"x"`
+	Y      float32   `json:"y"`
+	Height float32   `json:"height"`
+	Yaw    int16     `json:"yaw"`
+}
+
+func apiTrack(w http.ResponseWriter, r *http.Request) {
+	trk := liveTrack
+	trk.RLock()
+	positions := make([]apiPosT, len(trk.Positions))
+	for i, tp := range trk.Positions {
+		positions[i] = apiPosT{tp.TimeStamp, tp.MvoX, tp.MvoY, float32(tp.HeightDm) / 10, tp.ImuYaw}
+	}
+	trk.RUnlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"positions": positions})
+}
+
+// apiStream sends the FlightData to a WebSocket client until it goes away.
+func apiStream(w http.ResponseWriter, r *http.Request) {
+	ws, err := wsUpgrade(w, r)
+	if err != nil {
+		log.Printf("API stream: %v\n", err)
+		return
+	}
+	defer ws.close()
+	gone := make(chan bool)
+	go func() {
+		ws.readLoop()
+		close(gone)
+	}()
+	ticker := time.NewTicker(fdPeriodMs * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-gone:
+			return
+		case <-ticker.C:
+			msg, err := json.Marshal(currentFlightData())
+			if err != nil {
+				log.Printf("API stream: %v\n", err)
+				return
+			}
+			if err = ws.writeFrame(wsOpText, msg); err != nil {
+				return
+			}
+		}
+	}
+}
+
+type apiSticksT struct {
+	Lx, Ly, Rx, Ry float64
+}
+
+// apiSticks moves the sticks, Lx/Ly move the drone right/forward, Rx turns and Ry climbs.
+// Clients must keep sending at least every apiStickTimeout or the sticks are centred.
+// The joystick and keyboard are ignored while the API is moving the sticks.
+func apiSticks(w http.ResponseWriter, r *http.Request) {
+	if !checkControl(w, r) {
+		return
+	}
+	var in apiSticksT
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid stick message: %v", err))
+		return
+	}
+	stickRelayMu.Lock()
+	on := stickRelayOn
+	stickRelayMu.Unlock()
+	if !on {
+		writeError(w, http.StatusConflict, errors.New("the stick listener is not running"))
+		return
+	}
+	toStick := func(v float64) int16 {
+		return int16(math.Max(-1, math.Min(1, v)) * maxVal)
+	}
+	if err := claimSticks(apiStickClaimant, apiStickTimeout); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	sm := tello.StickMessage{Lx: toStick(in.Lx), Ly: toStick(in.Ly), Rx: toStick(in.Rx), Ry: toStick(in.Ry)}
+	stickChan <- fenceGuard.limit(sm)
+
+	apiServer.apiMu.Lock()
+	if apiServer.stickTmr == nil {
+		apiServer.stickTmr = time.AfterFunc(apiStickTimeout, func() {
+			if claimSticks(apiStickClaimant, 0) == nil { // unless a script has taken over
+				stickChan <- tello.StickMessage{}
+				releaseSticks(apiStickClaimant)
+			}
+		})
+	} else {
+		apiServer.stickTmr.Reset(apiStickTimeout)
+	}
+	apiServer.apiMu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
@@ -0,0 +1,108 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The drone has no microphone, so sound is optionally recorded from this computer.
+// Video is recorded without any external programs, but sound needs ffmpeg, which records
+// alongside the video and is then used to add the sound to the MP4 file.
+
+const audioStopWait = 15 * time.Second
+
+var audioMerges sync.WaitGroup // mergeAudio Goroutines still running
+
+type audioRecT struct {
+	filename string
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	started  time.Time
+}
+
+// audioInputArgs returns the ffmpeg arguments for recording the default input on this OS.
+func audioInputArgs() ([]string, error) {
+	switch runtime.GOOS {
+	case "linux":
+		return []string{"-f", "pulse", "-i", "default"}, nil
+	case "darwin":
+		return []string{"-f", "avfoundation", "-i", ":0"}, nil
+	default:
+		return nil, fmt.Errorf("recording sound is not supported on %s", runtime.GOOS)
+	}
+}
+
+// startAudioRecorder starts recording sound to a file named after the video file.
+func startAudioRecorder(videoFilename string) (ar *audioRecT, err error) {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, errors.New("ffmpeg is needed to record sound, but it was not found")
+	}
+	input, err := audioInputArgs()
+	if err != nil {
+		return nil, err
+	}
+	ar = &audioRecT{filename: strings.TrimSuffix(videoFilename, ".mp4") + ".m4a"}
+	args := append([]string{"-y", "-loglevel", "error"}, input...)
+	ar.cmd = exec.Command(ffmpeg, append(args, "-c:a", "aac", ar.filename)...)
+	if ar.stdin, err = ar.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	if err = ar.cmd.Start(); err != nil {
+		return nil, err
+	}
+	ar.started = time.Now()
+	return ar, nil
+}
+
+// stop asks ffmpeg to finish the sound file, it is killed if it doesn't.
+func (ar *audioRecT) stop() {
+	ar.stdin.Write([]byte("q"))
+	ar.stdin.Close()
+	done := make(chan error)
+	go func() { done <- ar.cmd.Wait() }()
+	select {
+	case <-time.After(audioStopWait):
+		ar.cmd.Process.Kill()
+		log.Println("Failed to gracefully stop sound recorder")
+	case <-done:
+	}
+}
+
+// mergeAudio adds the recorded sound to the video file, lining it up using the time the sound
+// recorder started and the arrival of the first video frame.  Should anything go wrong both
+// files are left as they are.  It is run as a Goroutine, after audioMerges.Add(1).
+func mergeAudio(videoFilename string, ar *audioRecT, firstFrame time.Time) {
+	defer audioMerges.Done()
+	merged := strings.TrimSuffix(videoFilename, ".mp4") + ".tmp.mp4"
+	offset := ar.started.Sub(firstFrame).Seconds()
+	out, err := exec.Command(ar.cmd.Path, "-y", "-loglevel", "error",
+		"-i", videoFilename, "-itsoffset", fmt.Sprintf("%.3f", offset), "-i", ar.filename,
+		"-map", "0:v", "-map", "1:a", "-c", "copy", merged).CombinedOutput()
+	if err != nil {
+		log.Printf("Could not add sound to %s: %v %s\n", videoFilename, err, out)
+		os.Remove(merged)
+		return
+	}
+	if err = os.Rename(merged, videoFilename); err != nil {
+		log.Printf("Could not add sound to %s: %v\n", videoFilename, err)
+		return
+	}
+	os.Remove(ar.filename)
+	log.Printf("Added sound to %s\n", videoFilename)
+}
@@ -0,0 +1,330 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Anty0/tello"
+	"github.com/mattn/go-gtk/glib"
+	"github.com/mattn/go-gtk/gtk"
+)
+
+const (
+	defaultDroneAddr   = "192.168.10.1"
+	defaultControlPort = 8889
+	defaultLocalPort   = 8800
+	defaultVideoPort   = 6038
+
+	connectAttempts     = 8
+	connectFirstBackoff = 500 * time.Millisecond
+	connectMaxBackoff   = 5 * time.Second
+	connectResponseWait = 2 * time.Second // for the drone to answer after each attempt
+	connectPollPeriod   = 100 * time.Millisecond
+	connectTCBPeriodMs  = 200
+	ssidWait            = 10 * time.Second // for the drone to tell us its SSID after connecting
+	maxRecentDrones     = 8
+)
+
+// connectionT is where to find a drone, zero values mean the defaults.
+type connectionT struct {
+	Address     string
+	ControlPort int
+	LocalPort   int
+	VideoPort   int
+}
+
+// recentDroneT is a drone we have connected to before.
+type recentDroneT struct {
+	SSID     string
+	Conn     connectionT
+	LastUsed string // RFC3339
+}
+
+// droneConn is the connection in use (or last used).
+var droneConn = defaultConnection()
+
+func defaultConnection() connectionT {
+	return connectionT{defaultDroneAddr, defaultControlPort, defaultLocalPort, defaultVideoPort}
+}
+
+// withDefaults returns c with any unset fields set to their defaults.
+func (c connectionT) withDefaults() connectionT {
+	d := defaultConnection()
+	if c.Address == "" {
+		c.Address = d.Address
+	}
+	if c.ControlPort == 0 {
+		c.ControlPort = d.ControlPort
+	}
+	if c.LocalPort == 0 {
+		c.LocalPort = d.LocalPort
+	}
+	if c.VideoPort == 0 {
+		c.VideoPort = d.VideoPort
+	}
+	return c
+}
+
+func (c connectionT) String() string {
+	return c.Address + ":" + strconv.Itoa(c.ControlPort)
+}
+
+// droneResponding is true once the drone has sent us anything.
+func droneResponding(fd tello.FlightData) bool {
+	return fd.SSID != "" || fd.Version != "" || fd.BatteryPercentage > 0 || fd.WifiStrength > 0
+}
+
+// connectorT makes repeated attempts to connect to the drone in the background,
+// connectTCB reports its progress and starts the session when it succeeds.
+type connectorT struct {
+	connMu   sync.Mutex
+	running  bool
+	conn     connectionT
+	attempt  int
+	done     bool
+	err      error
+	stopChan chan bool // nil once cancelled
+}
+
+var connector connectorT
+
+// start begins connecting to the real drone at conn.
+func (cr *connectorT) start(conn connectionT) {
+	cr.connMu.Lock()
+	if cr.running {
+		cr.connMu.Unlock()
+		return
+	}
+	cr.running, cr.done, cr.err, cr.attempt = true, false, nil, 0
+	cr.conn = conn
+	stop := make(chan bool)
+	cr.stopChan = stop
+	cr.connMu.Unlock()
+
+	drone = &realDrone
+	menuBar.connectingMenus()
+	go cr.run(conn, stop)
+	glib.TimeoutAdd(connectTCBPeriodMs, cr.connectTCB)
+}
+
+// cancel abandons any connection attempts in progress, it returns false if there were none.
+func (cr *connectorT) cancel() bool {
+	cr.connMu.Lock()
+	defer cr.connMu.Unlock()
+	if !cr.running || cr.done {
+		return false
+	}
+	if cr.stopChan != nil { // not already cancelled
+		close(cr.stopChan)
+		cr.stopChan = nil
+	}
+	return true
+}
+
+// run should be run as a Goroutine, it tries to connect with increasing delays between attempts.
+func (cr *connectorT) run(conn connectionT, stop chan bool) {
+	err := retryConnect(conn, stop, func(attempt int) {
+		cr.connMu.Lock()
+		cr.attempt = attempt
+		cr.connMu.Unlock()
+	})
+	cr.connMu.Lock()
+	cr.done, cr.err = true, err
+	cr.connMu.Unlock()
+}
+
+// retryConnect makes up to connectAttempts to connect, calling onAttempt before each one.
+func retryConnect(conn connectionT, stop chan bool, onAttempt func(attempt int)) (err error) {
+	backoff := connectFirstBackoff
+	for attempt := 1; attempt <= connectAttempts; attempt++ {
+		onAttempt(attempt)
+		if err = attemptConnect(conn, stop); err == nil || err == errCancelled {
+			break
+		}
+		log.Printf("Connection attempt %d to %s failed: %v\n", attempt, conn, err)
+		if attempt == connectAttempts {
+			break
+		}
+		select {
+		case <-stop:
+			err = errCancelled
+		case <-time.After(backoff):
+		}
+		if err == errCancelled {
+			break
+		}
+		if backoff *= 2; backoff > connectMaxBackoff {
+			backoff = connectMaxBackoff
+		}
+	}
+	return err
+}
+
+var errCancelled = errors.New("cancelled")
+
+// attemptConnect makes a single connection attempt and waits for the drone to respond.
+func attemptConnect(conn connectionT, stop chan bool) error {
+	if err := drone.ControlConnect(conn.Address, conn.ControlPort, conn.LocalPort); err != nil {
+		return err
+	}
+	drone.GetSSID()
+	drone.GetVersion()
+	deadline := time.Now().Add(connectResponseWait)
+	for time.Now().Before(deadline) {
+		if droneResponding(drone.GetFlightData()) {
+			return nil
+		}
+		select {
+		case <-stop:
+			drone.ControlDisconnect()
+			return errCancelled
+		case <-time.After(connectPollPeriod):
+		}
+	}
+	drone.ControlDisconnect()
+	return errors.New("no response from drone")
+}
+
+// connectTCB is to be run at intervals (not as a goroutine) while we are connecting.
+func (cr *connectorT) connectTCB() bool {
+	cr.connMu.Lock()
+	done, err, attempt, conn := cr.done, cr.err, cr.attempt, cr.conn
+	if done {
+		cr.running = false
+	}
+	cr.connMu.Unlock()
+
+	switch {
+	case !done:
+		statusBar.connectionLab.SetText(fmt.Sprintf("Connecting to %s (%d/%d)...", conn.Address, attempt, connectAttempts))
+		return true
+	case err == errCancelled:
+		menuBar.disableFlightMenus()
+		statusBar.connectionLab.SetText(" Disconnected ")
+	case err != nil:
+		menuBar.disableFlightMenus()
+		statusBar.connectionLab.SetText(" Disconnected ")
+		messageDialog(win, gtk.MESSAGE_ERROR, fmt.Sprintf(`Could not connect to Drone at %s
+after %d attempts.
+
+Check that you have a Wifi connection
+to the Tello network.
+
+%v`, conn, connectAttempts, err))
+	default:
+		droneConn = conn
+		startDroneSession()
+		statusBar.connectionLab.SetText("Connected")
+		rememberDrone(conn)
+	}
+	return false
+}
+
+// rememberDrone adds the drone at conn to the recently-used list in the settings
+// as soon as we know its SSID.
+func rememberDrone(conn connectionT) {
+	giveUp := time.Now().Add(ssidWait)
+	glib.TimeoutAdd(500, func() bool {
+		ssid := drone.GetFlightData().SSID
+		if ssid == "" {
+			return time.Now().Before(giveUp)
+		}
+		recent := []recentDroneT{{SSID: ssid, Conn: conn, LastUsed: time.Now().Format(time.RFC3339)}}
+		for _, rd := range settings.RecentDrones {
+			if rd.SSID != ssid && len(recent) < maxRecentDrones {
+				recent = append(recent, rd)
+			}
+		}
+		settings.RecentDrones = recent
+		settings.Connection = conn
+		if err := saveSettings(settings, appSettingsFile); err != nil {
+			log.Printf("Could not save settings: %v", err)
+		}
+		return false
+	})
+}
+
+// connectToCB lets the user choose a recent drone or enter the address of one to connect to.
+func connectToCB() {
+	cd := gtk.NewDialog()
+	cd.SetTitle(appName + " Connect To Drone")
+	cd.SetIcon(iconPixbuf)
+	cd.SetPosition(gtk.WIN_POS_CENTER_ON_PARENT)
+
+	table := gtk.NewTable(5, 2, false)
+	table.SetColSpacings(5)
+	table.SetRowSpacings(5)
+	addRow := func(row uint, label string, w gtk.IWidget) {
+		lab := gtk.NewLabel(label)
+		lab.SetAlignment(1, 0.5)
+		table.AttachDefaults(lab, 0, 1, row, row+1)
+		table.AttachDefaults(w, 1, 2, row, row+1)
+	}
+	newPortSpin := func() *gtk.SpinButton {
+		return gtk.NewSpinButtonWithRange(1, 65535, 1)
+	}
+	recentCombo := gtk.NewComboBoxText()
+	for _, rd := range settings.RecentDrones {
+		recentCombo.AppendText(fmt.Sprintf("%s (%s)", rd.SSID, rd.Conn))
+	}
+	addRow(0, "Recent Drones :", recentCombo)
+	addrEntry := gtk.NewEntry()
+	addRow(1, "Drone Address :", addrEntry)
+	ctrlSpin := newPortSpin()
+	addRow(2, "Drone Control Port :", ctrlSpin)
+	localSpin := newPortSpin()
+	addRow(3, "Local Control Port :", localSpin)
+	videoSpin := newPortSpin()
+	addRow(4, "Local Video Port :", videoSpin)
+
+	setFields := func(c connectionT) {
+		c = c.withDefaults()
+		addrEntry.SetText(c.Address)
+		ctrlSpin.SetValue(float64(c.ControlPort))
+		localSpin.SetValue(float64(c.LocalPort))
+		videoSpin.SetValue(float64(c.VideoPort))
+	}
+	setFields(settings.Connection)
+	recentCombo.Connect("changed", func() {
+		if ix := recentCombo.GetActive(); ix >= 0 && ix < len(settings.RecentDrones) {
+			setFields(settings.RecentDrones[ix].Conn)
+		}
+	})
+
+	cd.GetVBox().PackStart(table, true, true, 5)
+	cd.AddButton("Defaults", gtk.RESPONSE_APPLY)
+	cd.AddButton("Cancel", gtk.RESPONSE_CANCEL)
+	cd.AddButton("Connect", gtk.RESPONSE_OK)
+	cd.SetDefaultResponse(gtk.RESPONSE_OK)
+	cd.ShowAll()
+	for {
+		response := cd.Run()
+		if response == gtk.RESPONSE_APPLY {
+			setFields(defaultConnection())
+			continue
+		}
+		if response == gtk.RESPONSE_OK {
+			conn := connectionT{
+				Address:     addrEntry.GetText(),
+				ControlPort: ctrlSpin.GetValueAsInt(),
+				LocalPort:   localSpin.GetValueAsInt(),
+				VideoPort:   videoSpin.GetValueAsInt(),
+			}.withDefaults()
+			settings.Connection = conn
+			connector.start(conn)
+		}
+		break
+	}
+	cd.Destroy()
+}
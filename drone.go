@@ -0,0 +1,69 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package main
+
+import (
+	"time"
+
+	"github.com/Anty0/tello"
+)
+
+// droneT is the subset of the tello package's API used by TelloDesk.
+// It is satisfied by *tello.Tello and by the simulator's *simDroneT.
+type droneT interface {
+	ControlConnect(udpAddr string, droneUDPPort int, localUDPPort int) error
+	ControlConnectDefault() error
+	ControlDisconnect()
+	VideoConnect(udpAddr string, droneUDPPort int) (<-chan []byte, error)
+	VideoConnectDefault() (<-chan []byte, error)
+	VideoDisconnect()
+	StartStickListener() (chan<- tello.StickMessage, error)
+	StopStickListener()
+	StreamFlightData(asAvailable bool, periodMs time.Duration) (<-chan tello.FlightData, error)
+	GetFlightData() tello.FlightData
+
+	TakeOff()
+	ThrowTakeOff()
+	Land()
+	PalmLand()
+	ForwardFlip()
+	BackFlip()
+	LeftFlip()
+	RightFlip()
+	SetSportsMode(sports bool)
+	SetFastMode()
+	SetSlowMode()
+
+	SetHome() error
+	IsHomeSet() bool
+	AutoFlyToXY(x, y float32) (chan bool, error)
+	CancelAutoFlyToXY()
+	AutoFlyToHeight(dm int16) (chan bool, error)
+	CancelAutoFlyToHeight()
+	AutoTurnToYaw(yaw int16) (chan bool, error)
+	CancelAutoTurn()
+
+	TakePicture() error
+	NumPics() int
+	SaveAllPics(prefix string) (int, error)
+
+	GetVideoSpsPps()
+	SetVideoBitrate(vbr tello.VBR)
+	SetVideoWide()
+	SetVideoNormal()
+
+	GetLowBatteryThreshold()
+	GetMaxHeight()
+	GetSSID()
+	GetVersion()
+}
+
+var (
+	realDrone tello.Tello
+	simDrone  *simDroneT // created on first use, it keeps its state between connections
+)
@@ -12,38 +12,59 @@ import (
 	"github.com/mattn/go-gtk/gtk"
 )
 
+// connectCB connects to the drone last used, retrying until it responds (see connection.go)
 func connectCB() {
+	connector.start(settings.Connection.withDefaults())
+}
 
-	err := drone.ControlConnectDefault()
-	if err != nil {
-		messageDialog(win, gtk.MESSAGE_ERROR,
-			`Could not connect to Drone.
-
-Check that you have a Wifi connection 
-to the Tello network.`)
-		return // Comment this for GUI testing
+// connectSimCB connects to the built-in simulated drone instead of a real one
+func connectSimCB() {
+	if simDrone == nil {
+		simDrone = newSimDrone()
 	}
+	drone = simDrone
+	if err := drone.ControlConnectDefault(); err != nil {
+		messageDialog(win, gtk.MESSAGE_ERROR, "Could not start the simulator.\n\n"+err.Error())
+		return
+	}
+	startDroneSession()
+	statusBar.connectionLab.SetText("Simulator")
+}
+
+// startDroneSession starts everything that runs while we are connected to drone
+func startDroneSession() {
+	var err error
 
 	videoWgt.startVideo()
 
+	useJoystick := false
 	if len(settings.JoystickType) > 0 {
 		err = openJoystick(settings.JoystickID, settings.JoystickType)
 		if err != nil {
 			messageDialog(win, gtk.MESSAGE_ERROR, "Could not open configured joystick.")
+		} else {
+			useJoystick = true
 		}
-		stickChan, err = drone.StartStickListener()
-		if err != nil {
+	}
+	// the keyboard is only used for flight control if there is no joystick,
+	// the API may send sticks whichever is in use
+	if useJoystick || settings.KeyboardControl || settings.API.Enabled {
+		if err = startStickRelay(); err != nil {
 			messageDialog(win, gtk.MESSAGE_ERROR, err.Error())
-		} else {
+		} else if useJoystick {
 			go readJoystick(false)
+		} else if settings.KeyboardControl {
+			kbActive = true
+			go readKeyboard()
 		}
 	}
 
 	// trackChart.track = newTrack()
 	glib.TimeoutAdd(500, liveTrackerTCB) // start the live tracker, cancelled via liveTrackStopChan
 
-	fdChan, _ = drone.StreamFlightData(false, fdPeriodMs)
-	go fdListener()
+	fdStream, _ := drone.StreamFlightData(false, fdPeriodMs)
+	fdListener.Start(fdStream)
+	linkWatchdog.start()
 
 	// TODO: test SetMaxHeight
 	//drone.SetMaxHeight(30) // Set max height to 30
@@ -55,22 +76,29 @@ to the Tello network.`)
 	drone.GetVersion()
 
 	menuBar.enableFlightMenus()
-	statusBar.connectionLab.SetText("Connected")
 }
 
 func disconnectCB() {
+	if connector.cancel() { // we were still trying to connect
+		return
+	}
 	drone.VideoDisconnect()
 	drone.ControlDisconnect()
 
-	if len(settings.JoystickType) > 0 {
+	if kbActive {
+		kbActive = false
+		kbStopChan <- true // stop the keyboard reader before its stick channel goes
+		keyReleaseAll()
+	} else if len(settings.JoystickType) > 0 && js != nil {
 		js.Close()
-		drone.StopStickListener()
 	}
+	stopStickRelay()
 
-	select {
-	case fdStopChan <- true: // stop the flight data listener goroutine
-	default:
-	}
+	linkWatchdog.stop() // its timer ends at the next tick
+	fdListener.Stop()
+	flightRecorder.stop()
+	failsafe.reset()
+	fenceGuard.reset()
 	select {
 	case vrStopChan <- true: // stop the video restarter goroutine
 	default:
@@ -79,6 +107,8 @@ func disconnectCB() {
 	case liveTrackStopChan <- true: // stop the live tracker
 	default:
 	}
+	abortFlyingMission()
+	scripter.abort()
 	select {
 	case stopFeedImageChan <- true: // stop the video image updater goroutine
 	default:
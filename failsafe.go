@@ -0,0 +1,143 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Anty0/tello"
+)
+
+// Battery failsafe actions, the zero values are the safest and so are the defaults.
+const (
+	fsLowReturnHome = iota // or hover if no home is set
+	fsLowHover
+	fsLowWarnOnly
+)
+
+const (
+	fsCriticalLand = iota
+	fsCriticalWarnOnly
+)
+
+var (
+	fsLowActions      = []string{"Return Home", "Hover", "Warn Only"}
+	fsCriticalActions = []string{"Land", "Warn Only"}
+)
+
+// stages of a battery failsafe during a flight
+const (
+	fsStageNone = iota
+	fsStageLow
+	fsStageCritical
+)
+
+// fsLandRepeat is how often the Land command is repeated while the battery is critical
+const fsLandRepeat = 3 * time.Second
+
+// failsafeT acts on the drone's low and critical battery warnings.  On BatteryLow it
+// returns home (or hovers if there is no home), on BatteryCritical it lands.  The pilot
+// can override the current stage with the Cancel Auto-Flight button, key or menu item.
+type failsafeT struct {
+	fsMu       sync.Mutex
+	stage      int
+	overridden int // the stage the pilot overrode
+	lastLand   time.Time
+	msg        string
+}
+
+var failsafe failsafeT
+
+// check is called with every FlightData sample received from the drone.
+func (fs *failsafeT) check(fd tello.FlightData) {
+	fs.fsMu.Lock()
+	defer fs.fsMu.Unlock()
+	if !fd.Flying {
+		fs.stage, fs.overridden, fs.msg = fsStageNone, fsStageNone, ""
+		fs.lastLand = time.Time{}
+		return
+	}
+	switch {
+	case fd.BatteryCritical:
+		if fs.stage != fsStageCritical {
+			fs.stage = fsStageCritical
+			log.Printf("Failsafe: battery critical (%d%%)\n", fd.BatteryPercentage)
+			if settings.FailsafeCritical == fsCriticalWarnOnly {
+				fs.msg = "Battery Critical - Land Now!"
+			}
+		}
+		if settings.FailsafeCritical != fsCriticalLand || fs.overridden == fsStageCritical {
+			return
+		}
+		if time.Since(fs.lastLand) >= fsLandRepeat {
+			if fs.lastLand.IsZero() {
+				log.Println("Failsafe: landing")
+			}
+			fs.lastLand = time.Now()
+			fs.msg = "Battery Critical - Landing"
+			go func() {
+				stopAutomation()
+				drone.CancelAutoFlyToXY()
+				drone.Land()
+			}()
+		}
+	case fd.BatteryLow && fs.stage == fsStageNone:
+		fs.stage = fsStageLow
+		log.Printf("Failsafe: battery low (%d%%)\n", fd.BatteryPercentage)
+		switch settings.FailsafeLow {
+		case fsLowReturnHome, fsLowHover:
+			home := settings.FailsafeLow == fsLowReturnHome && drone.IsHomeSet()
+			if home {
+				fs.msg = "Battery Low - Returning Home"
+			} else {
+				fs.msg = "Battery Low - Hovering, Land Now!"
+			}
+			log.Println("Failsafe: " + fs.msg)
+			go func() {
+				stopAutomation()
+				drone.CancelAutoFlyToXY()
+				if home {
+					if _, err := drone.AutoFlyToXY(0, 0); err != nil {
+						log.Printf("Failsafe: could not return home: %v\n", err)
+					}
+				}
+			}()
+		default:
+			fs.msg = "Battery Low - Return Home Now!"
+		}
+	}
+}
+
+// override cancels the failsafe action in progress, the pilot takes responsibility.
+// A later stage (ie. BatteryCritical after BatteryLow) will still trigger.
+func (fs *failsafeT) override() {
+	fs.fsMu.Lock()
+	if fs.stage != fsStageNone && fs.overridden != fs.stage {
+		fs.overridden = fs.stage
+		fs.msg = "Battery Failsafe Overridden"
+		log.Println("Failsafe: overridden by pilot")
+	}
+	fs.fsMu.Unlock()
+}
+
+// status returns the message to display about any failsafe in progress, or "".
+func (fs *failsafeT) status() string {
+	fs.fsMu.Lock()
+	defer fs.fsMu.Unlock()
+	return fs.msg
+}
+
+// reset clears the failsafe state, eg. when we disconnect.
+func (fs *failsafeT) reset() {
+	fs.fsMu.Lock()
+	fs.stage, fs.overridden, fs.msg = fsStageNone, fsStageNone, ""
+	fs.lastLand = time.Time{}
+	fs.fsMu.Unlock()
+}
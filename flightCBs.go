@@ -7,11 +7,13 @@
 
 package main
 
+import "log"
+
 func takeoffCB() {
-	drone.TakeOff()
+	preflightTakeoff(false, "menu")
 }
 func throwTakeoffCB() {
-	drone.ThrowTakeOff()
+	preflightTakeoff(true, "menu")
 }
 func landCB() {
 	drone.Land()
@@ -20,6 +22,23 @@ func palmLandCB() {
 	drone.PalmLand()
 }
 
+// setHomeCB sets the drone's home to its current position, the geofence is centred on it
+func setHomeCB() {
+	if setHome() == nil {
+		menuBar.goHomeItem.SetSensitive(true)
+	}
+}
+
+func setHome() error {
+	if err := drone.SetHome(); err != nil {
+		log.Printf("Could not set home: %v\n", err)
+		return err
+	}
+	fd := drone.GetFlightData()
+	fenceGuard.setHome(fd.MVO.PositionX, fd.MVO.PositionY)
+	return nil
+}
+
 func toggleSportsModeCB() {
 	drone.SetSportsMode(menuBar.sportsModeItem.GetActive())
 }
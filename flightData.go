@@ -11,31 +11,32 @@ import (
 	"fmt"
 	"log"
 	"math"
+
+	"github.com/Anty0/tello"
+	"github.com/SMerrony/tellodesk/telemetry"
 )
 
-// fdListener should be run as a Goroutine to consume FD updates on the chan as they arrive.
-// It is started by connectCB() in droneCBs.go when the Tello is connected.
-func fdListener() {
-	for {
-		select {
-		case tmpFd := <-fdChan:
-			flightDataMu.Lock()
-			flightData = tmpFd
-			flightDataMu.Unlock()
-			if tmpFd.DownVisualState {
-				log.Println("Down visual state")
-			}
-			if tmpFd.OnGround {
-				log.Println("On Ground")
-			}
-			// if tmpFd.LightStrength == 0 {
-			// 	liveTrack.addPositionIfChanged(tmpFd)
-			// }
-			liveTrack.addPositionIfChanged(tmpFd)
-		case <-fdStopChan:
-			return
+// newFdListener returns the flight data listener with the handler which tracks, records
+// and guards the flight.  It is started by startDroneSession() in droneCBs.go when the Tello is connected.
+func newFdListener() (l *telemetry.ListenerT) {
+	l = telemetry.NewListener()
+	l.AddHandler(func(fd tello.FlightData) {
+		linkWatchdog.fdReceived()
+		if fd.DownVisualState {
+			log.Println("Down visual state")
 		}
-	}
+		if fd.OnGround {
+			log.Println("On Ground")
+		}
+		// if fd.LightStrength == 0 {
+		// 	liveTrack.AddPositionIfChanged(fd)
+		// }
+		liveTrack.AddPositionIfChanged(fd)
+		flightRecorder.record(fd)
+		failsafe.check(fd)
+		fenceGuard.update(fd)
+	})
+	return l
 }
 
 // updateFlightDataTCB should be run periodically to check for condition we should alert the user about
@@ -44,7 +45,7 @@ func updateFlightDataTCB() bool {
 	var (
 		msg string
 	)
-	flightDataMu.RLock()
+	flightData := currentFlightData()
 
 	// first, the message overlaid on the video display
 	// in order of priority, descending...
@@ -82,7 +83,14 @@ func updateFlightDataTCB() bool {
 	statFields[fFlying].value.SetText(boolToYN(flightData.Flying))
 	statFields[fWindy].value.SetText(boolToYN(flightData.WindState))
 
-	flightDataMu.RUnlock()
+	// what the watchdog, failsafe or geofence is doing takes priority
+	if _, lost, _, _ := linkWatchdog.status(); lost {
+		msg = "Link Lost - Reconnecting"
+	} else if fsMsg := failsafe.status(); fsMsg != "" {
+		msg = fsMsg
+	} else if gfMsg := fenceGuard.status(); gfMsg != "" {
+		msg = gfMsg
+	}
 	if msg == "" {
 		videoWgt.clearMessage()
 	} else {
@@ -0,0 +1,164 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Anty0/tello"
+	"github.com/SMerrony/tellodesk/track"
+)
+
+// flightRecorderFlushPeriod is how often the recording is written out, so that little is lost
+// if we crash (or the drone does).
+const flightRecorderFlushPeriod = time.Second
+
+// flightRecorderT logs every FlightData sample received during a flight to a CSV file.
+// Recording starts automatically when the drone reports that it is flying and the file
+// is closed when it lands (or we disconnect).
+type flightRecorderT struct {
+	recMu     sync.Mutex
+	file      *os.File
+	w         *csv.Writer
+	filename  string
+	flushed   time.Time         // when the CSV writer was last flushed
+	failed    bool              // could not create the file for this flight, don't keep trying
+	checklist *preflightResultT // saved with the next flight
+}
+
+var flightRecorder flightRecorderT
+
+// fdFieldNames returns the CSV column names for every field of tello.FlightData,
+// nested fields are named eg. "IMU.Yaw".
+func fdFieldNames(t reflect.Type, prefix string) (names []string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" { // unexported
+			continue
+		}
+		if f.Type.Kind() == reflect.Struct {
+			names = append(names, fdFieldNames(f.Type, prefix+f.Name+".")...)
+		} else {
+			names = append(names, prefix+f.Name)
+		}
+	}
+	return names
+}
+
+// fdFieldValues returns the values of v in the same order as fdFieldNames.
+func fdFieldValues(v reflect.Value, vals []string) []string {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath != "" {
+			continue
+		}
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct {
+			vals = fdFieldValues(fv, vals)
+		} else {
+			vals = append(vals, fmt.Sprint(fv.Interface()))
+		}
+	}
+	return vals
+}
+
+// record is called with every FlightData sample received from the drone.
+func (fr *flightRecorderT) record(fd tello.FlightData) {
+	fr.recMu.Lock()
+	defer fr.recMu.Unlock()
+	if fd.Flying && fr.file == nil && !fr.failed {
+		fr.start()
+	}
+	if fr.file != nil {
+		now := time.Now()
+		row := fdFieldValues(reflect.ValueOf(fd), []string{now.Format(track.TimeStampFmt)})
+		if err := fr.w.Write(row); err != nil {
+			log.Printf("Error writing to flight recording: %v\n", err)
+		}
+		if now.Sub(fr.flushed) >= flightRecorderFlushPeriod {
+			fr.w.Flush()
+			if err := fr.w.Error(); err != nil {
+				log.Printf("Error writing to flight recording: %v\n", err)
+			}
+			fr.flushed = now
+		}
+	}
+	if !fd.Flying {
+		fr.close()
+		fr.failed = false
+	}
+}
+
+// start opens a new timestamped recording file, recMu must be held.
+func (fr *flightRecorderT) start() {
+	fr.filename = dataFileName("tello_flight", ".csv")
+	var err error
+	fr.file, err = os.Create(fr.filename)
+	if err != nil {
+		log.Printf("Could not create flight recording: %v\n", err)
+		fr.file, fr.failed = nil, true
+		return
+	}
+	fr.w = csv.NewWriter(fr.file)
+	fr.flushed = time.Now()
+	fr.w.Write(append([]string{"TimeStamp"}, fdFieldNames(reflect.TypeOf(tello.FlightData{}), "")...))
+	log.Printf("Flight recording started: %s\n", fr.filename)
+	if fr.checklist != nil {
+		clFilename := strings.TrimSuffix(fr.filename, ".csv") + "_checklist.yaml"
+		if err = saveChecklist(*fr.checklist, clFilename); err != nil {
+			log.Printf("Could not save pre-flight checklist: %v\n", err)
+		}
+		fr.checklist = nil
+	}
+}
+
+// setChecklist keeps the pre-flight checklist result to be saved with the next flight.
+func (fr *flightRecorderT) setChecklist(res preflightResultT) {
+	fr.recMu.Lock()
+	fr.checklist = &res
+	fr.recMu.Unlock()
+}
+
+// close finishes any recording in progress, recMu must be held.
+func (fr *flightRecorderT) close() {
+	if fr.file == nil {
+		return
+	}
+	fr.w.Flush()
+	if err := fr.w.Error(); err != nil {
+		log.Printf("Error writing to flight recording: %v\n", err)
+	}
+	fr.file.Close()
+	fr.file = nil
+	log.Printf("Flight recording saved: %s\n", fr.filename)
+}
+
+// stop finishes any recording in progress, eg. when we disconnect in mid-flight.
+func (fr *flightRecorderT) stop() {
+	fr.recMu.Lock()
+	fr.close()
+	fr.failed = false
+	fr.recMu.Unlock()
+}
+
+// recording returns the name of the file being recorded, or "" if not recording.
+func (fr *flightRecorderT) recording() string {
+	fr.recMu.Lock()
+	defer fr.recMu.Unlock()
+	if fr.file == nil {
+		return ""
+	}
+	return fr.filename
+}
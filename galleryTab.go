@@ -0,0 +1,322 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"path/filepath"
+	"unsafe"
+
+	"github.com/mattn/go-gtk/gdk"
+	"github.com/mattn/go-gtk/gdkpixbuf"
+	"github.com/mattn/go-gtk/glib"
+	"github.com/mattn/go-gtk/gtk"
+)
+
+const (
+	galleryCtrlHeight = 70 // pixels reserved for the details and controls
+	galleryCellPad    = 8
+	galleryUpdateMs   = 500
+	gdk2ButtonPress   = 5 // GDK_2BUTTON_PRESS, ie. a double-click
+	galleryCellCol    = "gray80"
+	gallerySelCol     = "SteelBlue"
+)
+
+type galleryTabT struct {
+	*gtk.VBox
+	holder    *gtk.VBox  // holds grid, which is replaced whenever the photos change
+	grid      *gtk.Table // of thumbnails
+	cols      uint
+	infoLab   *gtk.Label
+	saveBtn   *gtk.Button
+	copyBtn   *gtk.Button
+	deleteBtn *gtk.Button
+	openBtn   *gtk.Button
+	statusLab *gtk.Label
+
+	photos     []photoT // as shown
+	shownGen   int
+	selected   int // photo ID, 0 for none
+	cells      map[int]*gtk.EventBox
+	pixbufs    map[int]*gdkpixbuf.Pixbuf // thumbnails, by photo ID
+	bufferedPb *gdkpixbuf.Pixbuf
+	noPreview  *gdkpixbuf.Pixbuf
+	thumbsDone chan bool // nil unless thumbnails are being made
+}
+
+func buildGalleryTab(w, h int) (gt *galleryTabT) {
+	gt = new(galleryTabT)
+	gt.VBox = gtk.NewVBox(false, 2)
+	gt.cols = uint(w / (thumbWidth + galleryCellPad))
+	gt.cells = make(map[int]*gtk.EventBox)
+	gt.pixbufs = make(map[int]*gdkpixbuf.Pixbuf)
+	gt.bufferedPb = placeholderPixbuf("Buffered in drone")
+	gt.noPreview = placeholderPixbuf("No preview")
+	gt.shownGen = -1
+
+	sw := gtk.NewScrolledWindow(nil, nil)
+	sw.SetPolicy(gtk.POLICY_NEVER, gtk.POLICY_AUTOMATIC)
+	sw.SetSizeRequest(w, h-galleryCtrlHeight)
+	gt.holder = gtk.NewVBox(false, 0)
+	sw.AddWithViewPort(gt.holder)
+	gt.PackStart(sw, true, true, 0)
+
+	gt.infoLab = gtk.NewLabel("")
+	gt.PackStart(gt.infoLab, false, false, 2)
+
+	hbox := gtk.NewHBox(false, 5)
+	gt.saveBtn = gtk.NewButtonWithLabel("Save Buffered")
+	gt.saveBtn.Connect("clicked", saveAllPhotosCB)
+	hbox.PackStart(gt.saveBtn, false, false, 2)
+	gt.copyBtn = gtk.NewButtonWithLabel("Copy To...")
+	gt.copyBtn.Connect("clicked", gt.copyPhotoCB)
+	hbox.PackStart(gt.copyBtn, false, false, 2)
+	gt.deleteBtn = gtk.NewButtonWithLabel("Delete")
+	gt.deleteBtn.Connect("clicked", gt.deletePhotoCB)
+	hbox.PackStart(gt.deleteBtn, false, false, 2)
+	gt.openBtn = gtk.NewButtonWithLabel("Open")
+	gt.openBtn.Connect("clicked", gt.openPhotoCB)
+	hbox.PackStart(gt.openBtn, false, false, 2)
+	gt.statusLab = gtk.NewLabel("")
+	hbox.PackStart(gt.statusLab, false, false, 10)
+	gt.PackStart(hbox, false, false, 0)
+
+	photoLog.loadSaved(settings.DataDir)
+	gt.galleryTCB()
+	return gt
+}
+
+// placeholderPixbuf is shown instead of a thumbnail.
+func placeholderPixbuf(msg string) *gdkpixbuf.Pixbuf {
+	img := image.NewRGBA(image.Rect(0, 0, thumbWidth, thumbHeight))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{80, 80, 80, 255}), image.ZP, draw.Src)
+	drawPhysLabel(img, (thumbWidth-7*len(msg))/2, thumbHeight/2+4, msg, color.White)
+	return rgbaPixbuf(img)
+}
+
+// rgbaPixbuf wraps img, which must not be changed or discarded while the pixbuf is in use.
+func rgbaPixbuf(img *image.RGBA) *gdkpixbuf.Pixbuf {
+	var pbd gdkpixbuf.PixbufData
+	pbd.Colorspace = gdkpixbuf.GDK_COLORSPACE_RGB
+	pbd.HasAlpha = true
+	pbd.BitsPerSample = 8
+	pbd.Width = img.Rect.Dx()
+	pbd.Height = img.Rect.Dy()
+	pbd.RowStride = img.Stride
+	pbd.Data = img.Pix
+	return gdkpixbuf.NewPixbufFromData(pbd)
+}
+
+// galleryTCB redraws the gallery if the photos have changed, and starts making any missing thumbnails.
+func (gt *galleryTabT) galleryTCB() bool {
+	if gt.thumbsDone != nil {
+		select {
+		case <-gt.thumbsDone:
+			gt.thumbsDone = nil
+		default:
+		}
+	}
+	photos, gen := photoLog.list()
+	if gen != gt.shownGen {
+		gt.photos, gt.shownGen = photos, gen
+		gt.redraw()
+		if gt.thumbsDone == nil && photoLog.nextThumb() != nil {
+			gt.thumbsDone = make(chan bool)
+			go photoLog.makeThumbs(gt.thumbsDone)
+		}
+	}
+	gt.saveBtn.SetSensitive(drone.NumPics() > 0)
+	return true // continue the timer
+}
+
+// redraw rebuilds the grid of thumbnails, newest first.
+func (gt *galleryTabT) redraw() {
+	if gt.grid != nil {
+		gt.grid.Destroy()
+	}
+	rows := (uint(len(gt.photos)) + gt.cols - 1) / gt.cols
+	if rows == 0 {
+		rows = 1
+	}
+	gt.grid = gtk.NewTable(rows, gt.cols, true)
+	gt.grid.SetRowSpacings(galleryCellPad)
+	gt.grid.SetColSpacings(galleryCellPad)
+
+	cells := make(map[int]*gtk.EventBox)
+	pixbufs := make(map[int]*gdkpixbuf.Pixbuf)
+	var buffered int
+	for i := range gt.photos {
+		p := gt.photos[len(gt.photos)-1-i]
+		var pb *gdkpixbuf.Pixbuf
+		switch {
+		case p.thumb != nil:
+			if pb = gt.pixbufs[p.id]; pb == nil {
+				pb = rgbaPixbuf(p.thumb)
+			}
+			pixbufs[p.id] = pb
+		case p.filename == "":
+			pb = gt.bufferedPb
+		default:
+			pb = gt.noPreview
+		}
+		caption := p.taken.Format("15:04:05")
+		switch {
+		case p.discarded:
+			caption += " (deleted)"
+		case p.filename == "":
+			caption += " (buffered)"
+			buffered++
+		}
+		cell := gtk.NewVBox(false, 2)
+		cell.PackStart(gtk.NewImageFromPixbuf(pb), false, false, 0)
+		cell.PackStart(gtk.NewLabel(caption), false, false, 0)
+		eb := gtk.NewEventBox()
+		eb.ModifyBG(gtk.STATE_NORMAL, gdk.NewColor(galleryCellCol))
+		eb.Add(cell)
+		id := p.id
+		eb.Connect("button-press-event", func(ctx *glib.CallbackContext) {
+			arg := ctx.Args(0)
+			ev := *(**gdk.EventButton)(unsafe.Pointer(&arg))
+			gt.selectPhoto(id)
+			if ev.Type == gdk2ButtonPress {
+				gt.openPhotoCB()
+			}
+		})
+		cells[id] = eb
+		col, row := uint(i)%gt.cols, uint(i)/gt.cols
+		gt.grid.Attach(eb, col, col+1, row, row+1, gtk.FILL, gtk.FILL, 0, 0)
+	}
+	gt.cells, gt.pixbufs = cells, pixbufs
+	gt.holder.PackStart(gt.grid, false, false, 0)
+	gt.grid.ShowAll()
+
+	if _, ok := gt.cells[gt.selected]; !ok {
+		gt.selected = 0
+	}
+	gt.selectPhoto(gt.selected)
+	gt.statusLab.SetText(fmt.Sprintf("%d photos, %d buffered", len(gt.photos), buffered))
+}
+
+// selectPhoto highlights the photo and shows its details, id 0 clears the selection.
+func (gt *galleryTabT) selectPhoto(id int) {
+	if eb, ok := gt.cells[gt.selected]; ok {
+		eb.ModifyBG(gtk.STATE_NORMAL, gdk.NewColor(galleryCellCol))
+	}
+	gt.selected = id
+	p := gt.selectedPhoto()
+	if p == nil {
+		gt.infoLab.SetText("Click a photo to see its details, double-click to open it")
+		gt.copyBtn.SetSensitive(false)
+		gt.deleteBtn.SetSensitive(false)
+		gt.openBtn.SetSensitive(false)
+		return
+	}
+	gt.cells[id].ModifyBG(gtk.STATE_NORMAL, gdk.NewColor(gallerySelCol))
+	gt.infoLab.SetText(describePhoto(p))
+	saved := p.filename != ""
+	gt.copyBtn.SetSensitive(saved)
+	gt.deleteBtn.SetSensitive(!p.discarded)
+	gt.openBtn.SetSensitive(saved)
+}
+
+func (gt *galleryTabT) selectedPhoto() *photoT {
+	for i := range gt.photos {
+		if gt.photos[i].id == gt.selected {
+			return &gt.photos[i]
+		}
+	}
+	return nil
+}
+
+// describePhoto gives the flight data at the moment the photo was taken, and where it is.
+func describePhoto(p *photoT) (desc string) {
+	desc = "Taken: " + p.taken.Format("2006-01-02 15:04:05")
+	if m := p.meta; p.hasMeta {
+		desc += fmt.Sprintf("   X: %.1fm  Y: %.1fm  Height: %.1fm  Yaw: %.0f°", m.X, m.Y, m.Height, m.Yaw)
+		if m.GPS != nil {
+			desc += fmt.Sprintf("   Lat: %.6f°  Lon: %.6f°", m.GPS.Lat, m.GPS.Lon)
+		}
+	} else {
+		desc += "   (no flight data)"
+	}
+	switch {
+	case p.discarded:
+		desc += "\nDeleted, it will be discarded when the buffered photos are saved"
+	case p.filename == "":
+		desc += "\nBuffered in the drone, not yet saved"
+	default:
+		desc += "\n" + p.filename
+		if p.thumbErr != nil {
+			desc += " - " + p.thumbErr.Error()
+		}
+	}
+	return desc
+}
+
+// copyPhotoCB saves a copy of the selected photo.  The user is prompted for a filename.
+func (gt *galleryTabT) copyPhotoCB() {
+	p := gt.selectedPhoto()
+	if p == nil || p.filename == "" {
+		return
+	}
+	fs := gtk.NewFileChooserDialog(
+		"Copy Photo To",
+		win,
+		gtk.FILE_CHOOSER_ACTION_SAVE, "_Cancel", gtk.RESPONSE_CANCEL, "_Save", gtk.RESPONSE_ACCEPT)
+	fs.SetCurrentFolder(settings.DataDir)
+	fs.SetCurrentName(filepath.Base(p.filename))
+	fs.SetLocalOnly(true)
+	res := fs.Run()
+	if res == gtk.RESPONSE_ACCEPT {
+		if expPath := fs.GetFilename(); expPath != "" {
+			pic, err := ioutil.ReadFile(p.filename)
+			if err == nil {
+				err = ioutil.WriteFile(expPath, pic, 0644)
+			}
+			if err != nil {
+				messageDialog(win, gtk.MESSAGE_ERROR, "Could not copy the photo.\n\n"+err.Error())
+			}
+		}
+	}
+	fs.Destroy()
+}
+
+// deletePhotoCB deletes the selected photo after asking the user.
+func (gt *galleryTabT) deletePhotoCB() {
+	p := gt.selectedPhoto()
+	if p == nil {
+		return
+	}
+	msg := "Delete this photo?\n\n" + describePhoto(p)
+	md := gtk.NewMessageDialog(win, gtk.DIALOG_MODAL, gtk.MESSAGE_QUESTION, gtk.BUTTONS_YES_NO, "%s", msg)
+	md.SetTitle(appName)
+	ok := md.Run() == gtk.RESPONSE_YES
+	md.Destroy()
+	if !ok {
+		return
+	}
+	if err := photoLog.remove(p.id); err != nil {
+		messageDialog(win, gtk.MESSAGE_ERROR, "Could not delete the photo.\n\n"+err.Error())
+	}
+	gt.galleryTCB()
+}
+
+// openPhotoCB opens the selected photo in the desktop's image viewer.
+func (gt *galleryTabT) openPhotoCB() {
+	p := gt.selectedPhoto()
+	if p == nil || p.filename == "" {
+		return
+	}
+	if err := openWithDesktop(p.filename); err != nil {
+		messageDialog(win, gtk.MESSAGE_ERROR, "Could not open the photo.\n\n"+err.Error())
+	}
+}
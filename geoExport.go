@@ -0,0 +1,267 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/SMerrony/tellodesk/track"
+	"github.com/mattn/go-gtk/gtk"
+)
+
+const earthRadius = 6371008.8 // metres, mean
+
+// geoOriginT anchors the drone's local MVO coordinates to the Earth.
+type geoOriginT struct {
+	Lat, Lon float64 // degrees
+	Alt      float64 // metres above sea level of the take-off point
+	Heading  float64 // degrees clockwise from true North of the drone's +X axis
+}
+
+// isSet is false until the origin has been given, eg. in the export dialog.
+func (o geoOriginT) isSet() bool {
+	return o.Lat != 0 || o.Lon != 0
+}
+
+// geoPosT is a track position converted to geographic coordinates.
+type geoPosT struct {
+	lat, lon, alt float64
+	timeStamp     time.Time
+}
+
+// toGeo converts a local position in metres to geographic coordinates.  The +Y axis
+// is 90 degrees anticlockwise from +X, as drawn on the track chart.  A flat Earth is
+// assumed, which is fine over the distances a Tello can fly.
+func (o geoOriginT) toGeo(tp track.PosT) (gp geoPosT) {
+	h := o.Heading * math.Pi / 180
+	x, y := float64(tp.MvoX), float64(tp.MvoY)
+	east := x*math.Sin(h) - y*math.Cos(h)
+	north := x*math.Cos(h) + y*math.Sin(h)
+	gp.lat = o.Lat + north/earthRadius*180/math.Pi
+	gp.lon = o.Lon + east/(earthRadius*math.Cos(o.Lat*math.Pi/180))*180/math.Pi
+	gp.alt = o.Alt + float64(tp.HeightDm)/10
+	gp.timeStamp = tp.TimeStamp
+	return gp
+}
+
+type geoFormatT struct {
+	name, ext string
+	write     func(w io.Writer, name string, geoTrack []geoPosT) error
+}
+
+var geoFormats = []geoFormatT{
+	{"GPX", ".gpx", writeGPX},
+	{"KML", ".kml", writeKML},
+	{"GeoJSON", ".geojson", writeGeoJSON},
+}
+
+type gpxPtT struct {
+	Lat  float64 `xml:"lat,attr"`
+	Lon  float64 `xml:"lon,attr"`
+	Ele  float64 `xml:"ele"`
+	Time string  `xml:"time,omitempty"`
+}
+
+type gpxT struct {
+	XMLName xml.Name `xml:"gpx"`
+	XMLNS   string   `xml:"xmlns,attr"`
+	Version string   `xml:"version,attr"`
+	Creator string   `xml:"creator,attr"`
+	Name    string   `xml:"trk>name"`
+	Points  []gpxPtT `xml:"trk>trkseg>trkpt"`
+}
+
+func writeGPX(w io.Writer, name string, geoTrack []geoPosT) error {
+	g := gpxT{XMLNS: "http://www.topografix.com/GPX/1/1", Version: "1.1", Creator: appName, Name: name}
+	for _, p := range geoTrack {
+		pt := gpxPtT{Lat: p.lat, Lon: p.lon, Ele: p.alt}
+		if !p.timeStamp.IsZero() {
+			pt.Time = p.timeStamp.UTC().Format(time.RFC3339Nano)
+		}
+		g.Points = append(g.Points, pt)
+	}
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", " ")
+	if err := enc.Encode(g); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+type kmlT struct {
+	XMLName      xml.Name `xml:"kml"`
+	XMLNS        string   `xml:"xmlns,attr"`
+	Name         string   `xml:"Document>name"`
+	PlaceName    string   `xml:"Document>Placemark>name"`
+	AltitudeMode string   `xml:"Document>Placemark>LineString>altitudeMode"`
+	Coordinates  string   `xml:"Document>Placemark>LineString>coordinates"`
+}
+
+func writeKML(w io.Writer, name string, geoTrack []geoPosT) error {
+	coords := make([]string, len(geoTrack))
+	for i, p := range geoTrack {
+		coords[i] = fmt.Sprintf("%.8f,%.8f,%.2f", p.lon, p.lat, p.alt)
+	}
+	k := kmlT{XMLNS: "http://www.opengis.net/kml/2.2", Name: name, PlaceName: name,
+		AltitudeMode: "absolute", Coordinates: strings.Join(coords, " ")}
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", " ")
+	if err := enc.Encode(k); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+type geoJSONGeometryT struct {
+	Type        string       `json:"type"`
+	Coordinates [][3]float64 `json:"coordinates"`
+}
+
+type geoJSONFeatureT struct {
+	Type       string                 `json:"type"`
+	Geometry   geoJSONGeometryT       `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONT struct {
+	Type     string            `json:"type"`
+	Features []geoJSONFeatureT `json:"features"`
+}
+
+func writeGeoJSON(w io.Writer, name string, geoTrack []geoPosT) error {
+	f := geoJSONFeatureT{Type: "Feature", Geometry: geoJSONGeometryT{Type: "LineString"}}
+	times := make([]string, len(geoTrack))
+	for i, p := range geoTrack {
+		f.Geometry.Coordinates = append(f.Geometry.Coordinates, [3]float64{p.lon, p.lat, p.alt})
+		if !p.timeStamp.IsZero() {
+			times[i] = p.timeStamp.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	f.Properties = map[string]interface{}{"name": name, "times": times}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	return enc.Encode(geoJSONT{Type: "FeatureCollection", Features: []geoJSONFeatureT{f}})
+}
+
+// geoExportCB exports the current track in a geographic format after asking the user for
+// the origin and format.  The origin is remembered in the settings.
+func geoExportCB() {
+	liveTrack.RLock()
+	nPos := len(liveTrack.Positions)
+	liveTrack.RUnlock()
+	if nPos < 2 {
+		messageDialog(win, gtk.MESSAGE_INFO, "There is no track to export.")
+		return
+	}
+
+	gd := gtk.NewDialog()
+	gd.SetTitle(appName + " Geographic Track Export")
+	gd.SetIcon(iconPixbuf)
+	gd.SetPosition(gtk.WIN_POS_CENTER_ON_PARENT)
+
+	table := gtk.NewTable(6, 2, false)
+	table.SetColSpacings(5)
+	table.SetRowSpacings(5)
+	addRow := func(row uint, label string, w gtk.IWidget) {
+		lab := gtk.NewLabel(label)
+		lab.SetAlignment(1, 0.5)
+		table.AttachDefaults(lab, 0, 1, row, row+1)
+		table.AttachDefaults(w, 1, 2, row, row+1)
+	}
+	newSpin := func(min, max, step, val float64, digits uint) *gtk.SpinButton {
+		sb := gtk.NewSpinButtonWithRange(min, max, step)
+		sb.SetDigits(digits)
+		sb.SetValue(val)
+		return sb
+	}
+	origin := settings.GeoOrigin
+	latSpin := newSpin(-90, 90, 0.000001, origin.Lat, 7)
+	addRow(0, "Origin Latitude (°) :", latSpin)
+	lonSpin := newSpin(-180, 180, 0.000001, origin.Lon, 7)
+	addRow(1, "Origin Longitude (°) :", lonSpin)
+	altSpin := newSpin(-500, 9000, 0.1, origin.Alt, 1)
+	addRow(2, "Origin Altitude (m) :", altSpin)
+	headSpin := newSpin(0, 360, 1, origin.Heading, 1)
+	addRow(3, "Heading of X axis (°) :", headSpin)
+	fmtCombo := gtk.NewComboBoxText()
+	for _, f := range geoFormats {
+		fmtCombo.AppendText(f.name)
+	}
+	fmtCombo.SetActive(0)
+	addRow(4, "Format :", fmtCombo)
+
+	gd.GetVBox().PackStart(table, true, true, 5)
+	gd.AddButton("Cancel", gtk.RESPONSE_CANCEL)
+	gd.AddButton("Export...", gtk.RESPONSE_OK)
+	gd.SetDefaultResponse(gtk.RESPONSE_OK)
+	gd.ShowAll()
+	response := gd.Run()
+	origin = geoOriginT{Lat: latSpin.GetValue(), Lon: lonSpin.GetValue(), Alt: altSpin.GetValue(), Heading: headSpin.GetValue()}
+	format := geoFormats[fmtCombo.GetActive()]
+	gd.Destroy()
+	if response != gtk.RESPONSE_OK {
+		return
+	}
+
+	settings.GeoOrigin = origin
+	setPhotoOrigin(origin)
+	if err := saveSettings(settings, appSettingsFile); err != nil {
+		log.Printf("Could not save settings: %v", err)
+	}
+
+	fs := gtk.NewFileChooserDialog(
+		"File for "+format.name+" Export",
+		win,
+		gtk.FILE_CHOOSER_ACTION_SAVE, "_Cancel", gtk.RESPONSE_CANCEL, "_Export", gtk.RESPONSE_ACCEPT)
+	fs.SetCurrentFolder(settings.DataDir)
+	fs.SetLocalOnly(true)
+	ff := gtk.NewFileFilter()
+	ff.AddPattern("*" + format.ext)
+	fs.SetFilter(ff)
+	res := fs.Run()
+	expPath := fs.GetFilename()
+	fs.Destroy()
+	if res != gtk.RESPONSE_ACCEPT || expPath == "" {
+		return
+	}
+	if filepath.Ext(expPath) == "" {
+		expPath += format.ext
+	}
+
+	liveTrack.RLock()
+	geoTrack := make([]geoPosT, len(liveTrack.Positions))
+	for i, tp := range liveTrack.Positions {
+		geoTrack[i] = origin.toGeo(tp)
+	}
+	liveTrack.RUnlock()
+
+	exp, err := os.Create(expPath)
+	if err != nil {
+		messageDialog(win, gtk.MESSAGE_INFO, "Could not create "+format.name+" file.")
+		return
+	}
+	defer exp.Close()
+	name := strings.TrimSuffix(filepath.Base(expPath), filepath.Ext(expPath))
+	if err = format.write(exp, name, geoTrack); err != nil {
+		log.Printf("Error exporting %s: %v\n", format.name, err)
+		messageDialog(win, gtk.MESSAGE_ERROR, "Could not write "+format.name+" file.")
+	}
+}
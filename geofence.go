@@ -0,0 +1,445 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"log"
+	"math"
+	"sync"
+	"unsafe"
+
+	"github.com/Anty0/tello"
+	"github.com/mattn/go-gtk/gdk"
+	"github.com/mattn/go-gtk/glib"
+	"github.com/mattn/go-gtk/gtk"
+)
+
+const (
+	fenceMargin       = 0.3 // metres inside the fence where outward stick movement is stopped
+	fenceBreachDist   = 0.5 // metres outside the fence before we return home
+	fenceCircleSteps  = 72
+	fencePickDist     = 0.5
+	fenceMaxRadius    = 100.0
+	fenceMaxHeightLim = 30.0
+)
+
+var fenceCol = color.RGBA{255, 140, 0, 255} // orange
+
+// fencePointT is a vertex of the geofence polygon in MVO coordinates (as shown on the tracker).
+type fencePointT struct {
+	X, Y float32
+}
+
+// geofenceT is the geofence configuration kept in the settings, zero values disable each limit.
+type geofenceT struct {
+	Enabled   bool
+	Radius    float64       // metres from home
+	MinHeight float64       // metres
+	MaxHeight float64       // metres
+	Polygon   []fencePointT `yaml:",flow"`
+}
+
+// fenceEdgeT is one edge of the polygon with its outward unit normal.
+type fenceEdgeT struct {
+	ax, ay, bx, by float64
+	nx, ny         float64
+}
+
+// fenceLimitT is a boundary which the drone is close to or beyond.
+type fenceLimitT struct {
+	nx, ny float64 // outward unit normal
+	dist   float64 // signed distance from the boundary, positive outside
+}
+
+// edges returns the polygon's edges, or nil if there is no usable polygon.
+func (gf *geofenceT) edges() (edges []fenceEdgeT) {
+	n := len(gf.Polygon)
+	if n < 3 {
+		return nil
+	}
+	var area float64 // twice the signed area, positive if anticlockwise
+	for i, p := range gf.Polygon {
+		q := gf.Polygon[(i+1)%n]
+		area += float64(p.X)*float64(q.Y) - float64(q.X)*float64(p.Y)
+	}
+	for i, p := range gf.Polygon {
+		q := gf.Polygon[(i+1)%n]
+		e := fenceEdgeT{ax: float64(p.X), ay: float64(p.Y), bx: float64(q.X), by: float64(q.Y)}
+		dx, dy := e.bx-e.ax, e.by-e.ay
+		l := math.Hypot(dx, dy)
+		if l == 0 {
+			continue
+		}
+		e.nx, e.ny = dy/l, -dx/l
+		if area < 0 {
+			e.nx, e.ny = -e.nx, -e.ny
+		}
+		edges = append(edges, e)
+	}
+	return edges
+}
+
+// insidePolygon is the usual ray-casting test.
+func insidePolygon(edges []fenceEdgeT, x, y float64) (in bool) {
+	for _, e := range edges {
+		if (e.ay > y) != (e.by > y) && x < (e.bx-e.ax)*(y-e.ay)/(e.by-e.ay)+e.ax {
+			in = !in
+		}
+	}
+	return in
+}
+
+// limits returns the horizontal boundaries within margin of (x, y) or which it is beyond.
+func (gf *geofenceT) limits(homeX, homeY, x, y, margin float64) (lims []fenceLimitT) {
+	if gf.Radius > 0 {
+		dx, dy := x-homeX, y-homeY
+		r := math.Hypot(dx, dy)
+		if r > 0 && r > gf.Radius-margin {
+			lims = append(lims, fenceLimitT{dx / r, dy / r, r - gf.Radius})
+		}
+	}
+	edges := gf.edges()
+	if edges == nil {
+		return lims
+	}
+	in := insidePolygon(edges, x, y)
+	nearest, nearestDist := -1, math.MaxFloat64
+	for i, e := range edges {
+		// distance to the closest point on the edge
+		dx, dy := e.bx-e.ax, e.by-e.ay
+		t := math.Max(0, math.Min(1, ((x-e.ax)*dx+(y-e.ay)*dy)/(dx*dx+dy*dy)))
+		d := math.Hypot(x-(e.ax+t*dx), y-(e.ay+t*dy))
+		if in && d < margin {
+			lims = append(lims, fenceLimitT{e.nx, e.ny, -d})
+		}
+		if d < nearestDist {
+			nearest, nearestDist = i, d
+		}
+	}
+	if !in {
+		lims = append(lims, fenceLimitT{edges[nearest].nx, edges[nearest].ny, nearestDist})
+	}
+	return lims
+}
+
+// extent returns the furthest distance of the fence from the chart origin along either axis.
+func (gf *geofenceT) extent(homeX, homeY float64) (ext float64) {
+	if gf.Radius > 0 {
+		ext = math.Max(math.Abs(homeX), math.Abs(homeY)) + gf.Radius
+	}
+	for _, p := range gf.Polygon {
+		ext = math.Max(ext, math.Max(math.Abs(float64(p.X)), math.Abs(float64(p.Y))))
+	}
+	return ext
+}
+
+// fenceGuardT enforces the geofence while we are flying.  It keeps its own copy of the
+// fence as settings.Geofence is changed on the GTK thread.
+type fenceGuardT struct {
+	guardMu        sync.Mutex
+	fence          geofenceT
+	homeX, homeY   float64
+	x, y, height   float64
+	yaw            float64 // degrees clockwise from +Y
+	flying         bool
+	breached       bool
+	msg            string
+	editingPolygon bool
+}
+
+var fenceGuard fenceGuardT
+
+// setFence must be called whenever settings.Geofence is changed.
+func (fg *fenceGuardT) setFence(gf geofenceT) {
+	gf.Polygon = append([]fencePointT(nil), gf.Polygon...)
+	fg.guardMu.Lock()
+	fg.fence = gf
+	fg.guardMu.Unlock()
+}
+
+// editing is true while the polygon is being drawn on the tracker chart.
+func (fg *fenceGuardT) editing() bool {
+	fg.guardMu.Lock()
+	defer fg.guardMu.Unlock()
+	return fg.editingPolygon
+}
+
+func (fg *fenceGuardT) setEditing(e bool) {
+	fg.guardMu.Lock()
+	fg.editingPolygon = e
+	fg.guardMu.Unlock()
+}
+
+// setHome records where the drone's home was set, the fence radius is centred on it.
+func (fg *fenceGuardT) setHome(x, y float32) {
+	fg.guardMu.Lock()
+	fg.homeX, fg.homeY = float64(x), float64(y)
+	fg.guardMu.Unlock()
+}
+
+func (fg *fenceGuardT) home() (x, y float64) {
+	fg.guardMu.Lock()
+	defer fg.guardMu.Unlock()
+	return fg.homeX, fg.homeY
+}
+
+// update is called with every FlightData sample, if the drone has flown through the
+// fence it is sent home (or stopped if no home is set).
+func (fg *fenceGuardT) update(fd tello.FlightData) {
+	fg.guardMu.Lock()
+	defer fg.guardMu.Unlock()
+	fg.x, fg.y = float64(fd.MVO.PositionX), float64(fd.MVO.PositionY)
+	fg.height = float64(fd.Height) / 10
+	fg.yaw = float64(fd.IMU.Yaw)
+	fg.flying = fd.Flying
+	gf := fg.fence
+	if !gf.Enabled || !fd.Flying {
+		fg.breached, fg.msg = false, ""
+		return
+	}
+	outside, over := false, gf.MaxHeight > 0 && fg.height > gf.MaxHeight+fenceBreachDist
+	for _, l := range gf.limits(fg.homeX, fg.homeY, fg.x, fg.y, 0) {
+		if l.dist > fenceBreachDist {
+			outside = true
+		}
+	}
+	switch {
+	case (outside || over) && !fg.breached:
+		fg.breached = true
+		home := outside && drone.IsHomeSet()
+		if home {
+			fg.msg = "Geofence Breach - Returning Home"
+		} else if outside {
+			fg.msg = "Geofence Breach - Fly Back Inside!"
+		} else {
+			fg.msg = "Geofence Breach - Descending"
+		}
+		log.Printf("Geofence: breached at (%.2f, %.2f) height %.1fm\n", fg.x, fg.y, fg.height)
+		maxDm := int16(gf.MaxHeight * 10)
+		go func() {
+			stopAutomation()
+			drone.CancelAutoFlyToXY()
+			if over {
+				drone.AutoFlyToHeight(maxDm)
+			}
+			if home {
+				if _, err := drone.AutoFlyToXY(0, 0); err != nil {
+					log.Printf("Geofence: could not return home: %v\n", err)
+				}
+			}
+		}()
+	case !outside && !over && fg.breached:
+		fg.breached, fg.msg = false, ""
+		log.Println("Geofence: back inside")
+	}
+}
+
+// limit removes any component of the stick movement which would take the drone further
+// through the fence.  Lx/Ly move the drone right/forward and Ry moves it up.
+func (fg *fenceGuardT) limit(sm tello.StickMessage) tello.StickMessage {
+	fg.guardMu.Lock()
+	defer fg.guardMu.Unlock()
+	gf := fg.fence
+	if !gf.Enabled || !fg.flying {
+		return sm
+	}
+	if gf.MaxHeight > 0 && fg.height >= gf.MaxHeight-fenceMargin && sm.Ry > 0 {
+		sm.Ry = 0
+	}
+	if gf.MinHeight > 0 && fg.height <= gf.MinHeight+fenceMargin && sm.Ry < 0 {
+		sm.Ry = 0
+	}
+	lims := gf.limits(fg.homeX, fg.homeY, fg.x, fg.y, fenceMargin)
+	if len(lims) == 0 {
+		return sm
+	}
+	sin, cos := math.Sincos(fg.yaw * math.Pi / 180)
+	fwd, right := float64(sm.Ly), float64(sm.Lx)
+	vx, vy := fwd*sin+right*cos, fwd*cos-right*sin
+	for _, l := range lims {
+		if d := vx*l.nx + vy*l.ny; d > 0 {
+			vx, vy = vx-d*l.nx, vy-d*l.ny
+		}
+	}
+	sm.Ly = int16(vx*sin + vy*cos)
+	sm.Lx = int16(vx*cos - vy*sin)
+	return sm
+}
+
+// status returns the message to display about a geofence breach, or "".
+func (fg *fenceGuardT) status() string {
+	fg.guardMu.Lock()
+	defer fg.guardMu.Unlock()
+	return fg.msg
+}
+
+// reset clears the breach state and home, eg. when we disconnect.
+func (fg *fenceGuardT) reset() {
+	fg.guardMu.Lock()
+	fg.homeX, fg.homeY = 0, 0
+	fg.breached, fg.flying, fg.msg = false, false, ""
+	fg.guardMu.Unlock()
+}
+
+// drawFence draws the geofence boundary on the chart.
+func (tc *trackChartT) drawFence() {
+	gf := settings.Geofence
+	if !gf.Enabled && !fenceGuard.editing() {
+		return
+	}
+	if gf.Radius > 0 {
+		hx, hy := fenceGuard.home()
+		var lastX, lastY float32
+		for i := 0; i <= fenceCircleSteps; i++ {
+			sin, cos := math.Sincos(2 * math.Pi * float64(i) / fenceCircleSteps)
+			x, y := float32(hx+gf.Radius*cos), float32(hy+gf.Radius*sin)
+			if i > 0 {
+				tc.line(lastX, lastY, x, y, fenceCol)
+			}
+			lastX, lastY = x, y
+		}
+	}
+	n := len(gf.Polygon)
+	for i, p := range gf.Polygon {
+		drawPhysLine(tc.backingImage, tc.xToOrd(p.X)-2, tc.yToOrd(p.Y)-2, tc.xToOrd(p.X)+2, tc.yToOrd(p.Y)+2, fenceCol)
+		drawPhysLine(tc.backingImage, tc.xToOrd(p.X)-2, tc.yToOrd(p.Y)+2, tc.xToOrd(p.X)+2, tc.yToOrd(p.Y)-2, fenceCol)
+		if i+1 < n {
+			tc.line(p.X, p.Y, gf.Polygon[i+1].X, gf.Polygon[i+1].Y, fenceCol)
+		} else if n >= 3 {
+			tc.line(p.X, p.Y, gf.Polygon[0].X, gf.Polygon[0].Y, fenceCol)
+		}
+	}
+}
+
+// redrawTrackChart shows the tracker with or without a track.
+func redrawTrackChart() {
+	if len(trackChart.track.Positions) > 2 {
+		trackChart.drawTrack()
+	} else {
+		trackChart.drawEmptyChart()
+	}
+}
+
+// fenceClickCB adds a polygon vertex where the tracker chart is left-clicked and removes
+// the nearest vertex on a right-click, but only while the polygon is being edited.
+func fenceClickCB(ctx *glib.CallbackContext) {
+	if !fenceGuard.editing() {
+		return
+	}
+	arg := ctx.Args(0)
+	ev := *(**gdk.EventButton)(unsafe.Pointer(&arg))
+	x, y := trackChart.ordToX(int(ev.X)), trackChart.ordToY(int(ev.Y))
+	poly := settings.Geofence.Polygon
+	switch ev.Button {
+	case 1:
+		poly = append(poly, fencePointT{x, y})
+	case 3:
+		for i, p := range poly {
+			if math.Hypot(float64(p.X-x), float64(p.Y-y)) < fencePickDist {
+				poly = append(poly[:i], poly[i+1:]...)
+				break
+			}
+		}
+	}
+	settings.Geofence.Polygon = poly
+	fenceGuard.setFence(settings.Geofence)
+	redrawTrackChart()
+}
+
+// editFencePolygonCB starts or finishes drawing the geofence polygon on the tracker chart.
+func editFencePolygonCB() {
+	editing := menuBar.fenceEditItem.GetActive()
+	fenceGuard.setEditing(editing)
+	if editing {
+		notebook.SetCurrentPage(trackPage)
+		messageDialog(win, gtk.MESSAGE_INFO, `Left-click on the tracker to add a geofence corner,
+right-click on a corner to remove it.
+
+Untick Track | Edit Geofence Polygon when finished.`)
+	} else {
+		if n := len(settings.Geofence.Polygon); n > 0 && n < 3 {
+			messageDialog(win, gtk.MESSAGE_INFO, "The geofence polygon needs at least 3 corners, it will be ignored.")
+		}
+		if err := saveSettings(settings, appSettingsFile); err != nil {
+			log.Printf("Could not save settings: %v", err)
+		}
+	}
+	redrawTrackChart()
+}
+
+// geofenceCB lets the user configure the geofence.
+func geofenceCB() {
+	gd := gtk.NewDialog()
+	gd.SetTitle(appName + " Geofence")
+	gd.SetIcon(iconPixbuf)
+	gd.SetPosition(gtk.WIN_POS_CENTER_ON_PARENT)
+
+	table := gtk.NewTable(5, 2, false)
+	table.SetColSpacings(5)
+	table.SetRowSpacings(5)
+	addRow := func(row uint, label string, w gtk.IWidget) {
+		lab := gtk.NewLabel(label)
+		lab.SetAlignment(1, 0.5)
+		table.AttachDefaults(lab, 0, 1, row, row+1)
+		table.AttachDefaults(w, 1, 2, row, row+1)
+	}
+	newSpin := func(max, val float64) *gtk.SpinButton {
+		sb := gtk.NewSpinButtonWithRange(0, max, 0.5)
+		sb.SetDigits(1)
+		sb.SetValue(val)
+		return sb
+	}
+	gf := settings.Geofence
+	enabled := gtk.NewCheckButtonWithLabel("Enabled")
+	enabled.SetActive(gf.Enabled)
+	addRow(0, "Geofence :", enabled)
+	radiusSpin := newSpin(fenceMaxRadius, gf.Radius)
+	addRow(1, "Max. Radius from Home (m, 0=none) :", radiusSpin)
+	minSpin := newSpin(fenceMaxHeightLim, gf.MinHeight)
+	addRow(2, "Min. Height (m, 0=none) :", minSpin)
+	maxSpin := newSpin(fenceMaxHeightLim, gf.MaxHeight)
+	addRow(3, "Max. Height (m, 0=none) :", maxSpin)
+	polyBox := gtk.NewHBox(false, 5)
+	polyLab := gtk.NewLabel(fmt.Sprintf("%d corners", len(gf.Polygon)))
+	polyBox.PackStart(polyLab, false, false, 2)
+	clearBtn := gtk.NewButtonWithLabel("Clear")
+	clearBtn.Connect("clicked", func() {
+		gf.Polygon = nil
+		polyLab.SetText("0 corners")
+	})
+	polyBox.PackStart(clearBtn, false, false, 2)
+	addRow(4, "Polygon :", polyBox)
+
+	gd.GetVBox().PackStart(table, true, true, 5)
+	gd.GetVBox().PackStart(gtk.NewLabel("Draw the polygon with Track | Edit Geofence Polygon."), false, false, 5)
+	gd.AddButton("Cancel", gtk.RESPONSE_CANCEL)
+	gd.AddButton("OK", gtk.RESPONSE_OK)
+	gd.SetDefaultResponse(gtk.RESPONSE_OK)
+	gd.ShowAll()
+	response := gd.Run()
+	if response == gtk.RESPONSE_OK {
+		gf.Enabled = enabled.GetActive()
+		gf.Radius = radiusSpin.GetValue()
+		gf.MinHeight = minSpin.GetValue()
+		gf.MaxHeight = maxSpin.GetValue()
+		if gf.MaxHeight > 0 && gf.MinHeight >= gf.MaxHeight {
+			messageDialog(win, gtk.MESSAGE_INFO, "The minimum height must be below the maximum, it has been ignored.")
+			gf.MinHeight = 0
+		}
+		settings.Geofence = gf
+		fenceGuard.setFence(gf)
+		if err := saveSettings(settings, appSettingsFile); err != nil {
+			messageDialog(win, gtk.MESSAGE_ERROR, "Could not save settings.")
+			log.Printf("Could not save settings: %v", err)
+		}
+		redrawTrackChart()
+	}
+	gd.Destroy()
+}
@@ -0,0 +1,13 @@
+module github.com/SMerrony/tellodesk
+
+go 1.18
+
+require (
+	github.com/3d0c/gmf ec1401b491850f6cce7615f222072d0d473f1c80
+	github.com/Anty0/tello v0.9.0
+	github.com/mattn/go-gtk v0.0.0-20190405072524-4deadb416788
+	github.com/simulatedsimian/joystick v1.0.0
+	github.com/yuin/gopher-lua v0.0.0-20190514113301-1cd887cd7036
+	golang.org/x/image v0.18.0
+	gopkg.in/yaml.v2 v2.4.0
+)
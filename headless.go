@@ -0,0 +1,377 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/SMerrony/tellodesk/track"
+)
+
+// In headless mode there is no window, the command line says what to do, eg.
+//
+//   tellodesk -headless -record -duration 5m
+//   tellodesk -headless -record -mission survey.csv -photo-every 10s
+//   tellodesk -headless -sim -script orbit.lua
+//
+// It connects, optionally records video, flies a mission and/or takes photos, then saves
+// everything to the data directory and exits.  No GTK funcs may be called from here,
+// nor from anything it runs.
+
+const (
+	headlessFlyingWait  = 15 * time.Second // for the drone to take off
+	headlessSettleWait  = 3 * time.Second  // after taking off, before setting home
+	headlessLandingWait = 30 * time.Second
+	headlessPhotoWait   = 2 * time.Second // for the last photo to arrive
+	headlessPollPeriod  = 100 * time.Millisecond
+)
+
+type headlessOptsT struct {
+	sim        bool
+	addr       string
+	dataDir    string
+	record     bool
+	duration   time.Duration
+	mission    string
+	script     string
+	photoEvery time.Duration
+	force      bool
+}
+
+// parseCommandLine sets headless and returns the other options.
+func parseCommandLine() (opts headlessOptsT) {
+	flag.BoolVar(&headless, "headless", false, "run without a window, the other flags say what to do")
+	flag.BoolVar(&opts.sim, "sim", false, "use the built-in simulated drone")
+	flag.StringVar(&opts.addr, "addr", "", "`address` of the drone, default from the settings")
+	flag.StringVar(&opts.dataDir, "datadir", "", "`directory` for videos, photos and logs, default from the settings")
+	flag.BoolVar(&opts.record, "record", false, "record video")
+	flag.DurationVar(&opts.duration, "duration", 0, "stop after this long, default is after the mission or when interrupted")
+	flag.StringVar(&opts.mission, "mission", "", "take off, fly the waypoints in this CSV `file` and land")
+	flag.StringVar(&opts.script, "script", "", "run this Lua script `file`")
+	flag.DurationVar(&opts.photoEvery, "photo-every", 0, "take a photo at this `interval`")
+	flag.BoolVar(&opts.force, "force", false, "take off even if the pre-flight checklist fails")
+	flag.Parse()
+	if !headless && flag.NFlag() > 0 {
+		fmt.Fprintln(os.Stderr, "Warning: the command line options are only used with -headless")
+	}
+	return opts
+}
+
+// runHeadless runs a complete session and returns the exit status.
+func runHeadless(opts headlessOptsT) int {
+	var err error
+	if settings, err = loadSettings(appSettingsFile); err != nil {
+		log.Printf("Using default settings, could not load %s: %v\n", appSettingsFile, err)
+	} else {
+		settingsLoaded = true
+	}
+	if opts.dataDir != "" {
+		settings.DataDir = opts.dataDir
+	}
+	fenceGuard.setFence(settings.Geofence)
+	setPhotoOrigin(settings.GeoOrigin)
+	if opts.mission != "" && opts.script != "" {
+		log.Println("Only one of -mission and -script may be given")
+		return 1
+	}
+	liveTrack = track.New()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	cancel := make(chan bool)
+	go func() {
+		<-interrupt
+		log.Println("Interrupted")
+		close(cancel)
+	}()
+
+	if err = headlessConnect(opts, cancel); err != nil {
+		log.Printf("Could not connect: %v\n", err)
+		return 1
+	}
+	startHeadlessSession()
+	defer endHeadlessSession()
+
+	if opts.record {
+		if _, _, err = startVideoRecording(); err != nil {
+			log.Printf("Could not record video: %v\n", err)
+			return 1
+		}
+	}
+	if opts.photoEvery > 0 {
+		finished := make(chan bool)
+		defer close(finished) // before endHeadlessSession
+		go takePhotos(opts.photoEvery, cancel, finished)
+	}
+
+	status := 0
+	var timeout <-chan time.Time
+	if opts.duration > 0 {
+		timeout = time.After(opts.duration)
+	}
+	if opts.mission != "" {
+		if err = headlessMission(opts.mission, opts.force, cancel, timeout); err != nil {
+			log.Printf("Mission failed: %v\n", err)
+			status = 1
+		}
+	} else if opts.script != "" {
+		if err = headlessScript(opts.script, cancel, timeout); err != nil {
+			log.Printf("Script failed: %v\n", err)
+			status = 1
+		}
+	} else {
+		if timeout == nil {
+			log.Println("Running until interrupted")
+		}
+		select {
+		case <-cancel:
+		case <-timeout:
+		}
+	}
+	return status
+}
+
+// headlessConnect connects to the simulator or to the drone, retrying like the GUI does.
+func headlessConnect(opts headlessOptsT, cancel chan bool) error {
+	if opts.sim {
+		if simDrone == nil {
+			simDrone = newSimDrone()
+		}
+		drone = simDrone
+		log.Println("Connecting to the simulator")
+		return drone.ControlConnectDefault()
+	}
+	conn := settings.Connection.withDefaults()
+	if opts.addr != "" {
+		conn.Address = opts.addr
+	}
+	drone = &realDrone
+	err := retryConnect(conn, cancel, func(attempt int) {
+		log.Printf("Connecting to %s (%d/%d)...\n", conn, attempt, connectAttempts)
+	})
+	if err == nil {
+		droneConn = conn
+		log.Printf("Connected to %s\n", conn)
+	}
+	return err
+}
+
+// startHeadlessSession is the equivalent of startDroneSession, without the GUI.
+func startHeadlessSession() {
+	if err := connectVideo(); err == nil {
+		go headlessVideoPump()
+	}
+	if err := startStickRelay(); err != nil { // needed by the autopilot
+		log.Printf("Could not start stick listener: %v\n", err)
+	}
+	fdStream, _ := drone.StreamFlightData(false, fdPeriodMs)
+	fdListener.Start(fdStream)
+	linkWatchdog.start()
+
+	drone.GetLowBatteryThreshold()
+	drone.GetMaxHeight()
+	drone.GetSSID()
+	drone.GetVersion()
+}
+
+// headlessVideoPump stands in for videoListener, the video is only recorded, not decoded.
+func headlessVideoPump() {
+	for pkt := range videoChan {
+		linkWatchdog.videoReceived()
+		queueVideoPacket(pkt)
+	}
+}
+
+// endHeadlessSession saves everything and disconnects.
+func endHeadlessSession() {
+	scripter.abort()
+	stopVideoRecording()
+	audioMerges.Wait()
+	if drone.NumPics() > 0 {
+		time.Sleep(headlessPhotoWait)
+		saveAllPhotos()
+	}
+	saveHeadlessTrack()
+
+	drone.VideoDisconnect()
+	drone.ControlDisconnect()
+	stopStickRelay()
+	linkWatchdog.stop()
+	fdListener.Stop()
+	flightRecorder.stop()
+	select {
+	case vrStopChan <- true:
+	default:
+	}
+	log.Println("Headless session finished")
+}
+
+func takePhotos(every time.Duration, cancel, finished chan bool) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cancel:
+			return
+		case <-finished:
+			return
+		case <-ticker.C:
+			log.Println("Taking photo")
+			if err := takePhoto(); err != nil {
+				log.Printf("Error taking photo: %v\n", err)
+			}
+		}
+	}
+}
+
+// saveHeadlessTrack exports the live track to the data directory, as exportTrackCB would.
+func saveHeadlessTrack() {
+	liveTrack.RLock()
+	defer liveTrack.RUnlock()
+	if len(liveTrack.Positions) == 0 {
+		return
+	}
+	filename := dataFileName("tello_track", ".csv")
+	f, err := os.Create(filename)
+	if err == nil {
+		err = writeTrack(f, liveTrack)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		log.Printf("Could not save track: %v\n", err)
+		return
+	}
+	log.Printf("Saved track to %s\n", filename)
+}
+
+// waitFor polls cond until it is true, giving up after wait or if cancelled.
+func waitFor(cond func() bool, wait time.Duration, cancel chan bool) bool {
+	giveUp := time.After(wait)
+	for !cond() {
+		select {
+		case <-cancel:
+			return false
+		case <-giveUp:
+			return false
+		case <-time.After(headlessPollPeriod):
+		}
+	}
+	return true
+}
+
+// headlessMission takes off, sets home, flies the mission in filename and lands.  It is aborted
+// if cancelled or the timeout passes.
+func headlessMission(filename string, force bool, cancel chan bool, timeout <-chan time.Time) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	m := newMission()
+	err = m.read(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("could not parse %s: %v", filename, err)
+	}
+
+	waitFor(func() bool { return droneResponding(currentFlightData()) }, ssidWait, cancel)
+	if !settings.Preflight.Disabled {
+		ps := settings.Preflight
+		ps.Skip = append(ps.Skip[:len(ps.Skip):len(ps.Skip)], "home") // it is set after takeoff
+		res := evalChecklist(currentFlightData(), ps)
+		res.Via = "headless"
+		if !res.Passed && force {
+			res.Overridden = true
+		}
+		logChecklist(res)
+		if !res.Passed && !force {
+			return errors.New("pre-flight checklist failed: " + strings.Join(res.failures(), ", "))
+		}
+	}
+
+	log.Println("Taking off")
+	drone.TakeOff()
+	defer headlessLand()
+	if !waitFor(func() bool { return currentFlightData().Flying }, headlessFlyingWait, cancel) {
+		return errors.New("did not take off")
+	}
+	time.Sleep(headlessSettleWait)
+	if err = setHome(); err != nil {
+		return err
+	}
+
+	wps, ok := m.start()
+	if !ok {
+		return errors.New("there are no waypoints in the mission")
+	}
+	done := make(chan bool)
+	go func() {
+		m.fly(wps)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-cancel:
+		m.abort()
+		<-done
+	case <-timeout:
+		log.Println("Time is up, aborting the mission")
+		m.abort()
+		<-done
+	}
+	_, _, err = m.progress()
+	return err
+}
+
+// headlessScript runs the Lua script in filename until it ends, it is aborted if cancelled
+// or the timeout passes.
+func headlessScript(filename string, cancel chan bool, timeout <-chan time.Time) error {
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	waitFor(func() bool { return droneResponding(currentFlightData()) }, ssidWait, cancel)
+	if err = scripter.start(filepath.Base(filename), string(src)); err != nil {
+		return err
+	}
+	done := make(chan bool)
+	go func() {
+		scripter.wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-cancel:
+		scripter.abort()
+	case <-timeout:
+		log.Println("Time is up, aborting the script")
+		scripter.abort()
+	}
+	<-done
+	_, _, err = scripter.progress()
+	return err
+}
+
+func headlessLand() {
+	log.Println("Landing")
+	drone.Land()
+	if !waitFor(func() bool { return !currentFlightData().Flying }, headlessLandingWait, nil) {
+		log.Println("WARNING: the drone has not reported landing")
+	}
+}
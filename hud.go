@@ -0,0 +1,330 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"math"
+
+	"github.com/Anty0/tello"
+	"github.com/mattn/go-gtk/gtk"
+)
+
+// The HUD is drawn over each decoded video frame just before it is displayed.
+
+const (
+	hudPxPerDegPitch = 8   // of the artificial horizon
+	hudPxPerDegYaw   = 4   // of the heading tape
+	hudTapeWidth     = 360 // pixels
+	hudMapSize       = 180 // pixels square
+	hudMinMapRange   = 5.0 // metres from the centre of the mini-map to its edge
+	hudMaxMapPoints  = 500
+)
+
+var (
+	hudCol     = color.RGBA{0, 255, 0, 255}
+	hudWarnCol = color.RGBA{255, 0, 0, 255}
+	hudBgCol   = color.RGBA{0, 0, 0, 128}
+)
+
+// hudSettingsT is kept in the settings, zero values show every element.
+type hudSettingsT struct {
+	Off    bool
+	Hidden []string `yaml:",flow"` // names of elements not shown
+}
+
+func (hs hudSettingsT) shown(name string) bool {
+	for _, h := range hs.Hidden {
+		if h == name {
+			return false
+		}
+	}
+	return true
+}
+
+// setShown shows or hides the named element.
+func (hs *hudSettingsT) setShown(name string, show bool) {
+	hidden := hs.Hidden[:0]
+	for _, h := range hs.Hidden {
+		if h != name {
+			hidden = append(hidden, h)
+		}
+	}
+	if !show {
+		hidden = append(hidden, name)
+	}
+	hs.Hidden = hidden
+}
+
+type hudElementT struct {
+	name  string
+	label string
+	draw  func(img *image.RGBA, fd tello.FlightData)
+}
+
+var hudElements = []hudElementT{
+	{"horizon", "Artificial Horizon", drawHUDHorizon},
+	{"heading", "Heading Tape", drawHUDHeading},
+	{"altitude", "Altitude and Vertical Speed", drawHUDAltitude},
+	{"power", "Battery and Wifi", drawHUDPower},
+	{"time", "Flight Time", drawHUDTime},
+	{"map", "Mini-map", drawHUDMap},
+}
+
+// drawHUD draws the enabled elements of the HUD over the video frame img.
+func drawHUD(img *image.RGBA) {
+	if settings.HUD.Off {
+		return
+	}
+	fd := currentFlightData()
+	if !droneResponding(fd) {
+		return
+	}
+	for _, el := range hudElements {
+		if settings.HUD.shown(el.name) {
+			el.draw(img, fd)
+		}
+	}
+}
+
+// quatToEuler returns the roll, pitch and yaw in degrees given by an IMU quaternion,
+// roll is positive to the right and pitch is positive nose up.
+func quatToEuler(w, x, y, z float64) (roll, pitch, yaw float64) {
+	roll = math.Atan2(2*(w*x+y*z), 1-2*(x*x+y*y))
+	sinp := 2 * (w*y - z*x)
+	sinp = math.Max(-1, math.Min(1, sinp))
+	pitch = math.Asin(sinp)
+	yaw = math.Atan2(2*(w*z+x*y), 1-2*(y*y+z*z))
+	return roll * 180 / math.Pi, pitch * 180 / math.Pi, yaw * 180 / math.Pi
+}
+
+// eulerToQuat is the inverse of quatToEuler.
+func eulerToQuat(roll, pitch, yaw float64) (w, x, y, z float64) {
+	cr, sr := math.Cos(roll*math.Pi/360), math.Sin(roll*math.Pi/360)
+	cp, sp := math.Cos(pitch*math.Pi/360), math.Sin(pitch*math.Pi/360)
+	cy, sy := math.Cos(yaw*math.Pi/360), math.Sin(yaw*math.Pi/360)
+	w = cr*cp*cy + sr*sp*sy
+	x = sr*cp*cy - cr*sp*sy
+	y = cr*sp*cy + sr*cp*sy
+	z = cr*cp*sy - sr*sp*cy
+	return w, x, y, z
+}
+
+// drawThickLine draws a line two pixels wide.
+func drawThickLine(img *image.RGBA, x0, y0, x1, y1 int, col color.Color) {
+	drawPhysLine(img, x0, y0, x1, y1, col)
+	if abs(x1-x0) > abs(y1-y0) {
+		drawPhysLine(img, x0, y0+1, x1, y1+1, col)
+	} else {
+		drawPhysLine(img, x0+1, y0, x1+1, y1, col)
+	}
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
+
+// drawHUDBox darkens the area behind some HUD text.
+func drawHUDBox(img *image.RGBA, r image.Rectangle) {
+	draw.Draw(img, r, image.NewUniform(hudBgCol), image.ZP, draw.Over)
+}
+
+func drawHUDHorizon(img *image.RGBA, fd tello.FlightData) {
+	b := img.Bounds()
+	cx, cy := b.Dx()/2, b.Dy()/2
+	if fd.IMU.QuaternionW == 0 && fd.IMU.QuaternionX == 0 && fd.IMU.QuaternionY == 0 && fd.IMU.QuaternionZ == 0 {
+		return // no attitude data
+	}
+	roll, pitch, _ := quatToEuler(float64(fd.IMU.QuaternionW), float64(fd.IMU.QuaternionX),
+		float64(fd.IMU.QuaternionY), float64(fd.IMU.QuaternionZ))
+	r := roll * math.Pi / 180
+	// the horizon and pitch ladder rotate against the roll and move down as the nose goes up
+	along := [2]float64{math.Cos(r), -math.Sin(r)}
+	down := [2]float64{math.Sin(r), math.Cos(r)}
+	ladderLine := func(deg float64, halfLen float64, label bool) {
+		off := (pitch - deg) * hudPxPerDegPitch
+		mx, my := float64(cx)+down[0]*off, float64(cy)+down[1]*off
+		if my < 0 || my > float64(b.Dy()) {
+			return
+		}
+		gap := 0.0
+		if deg != 0 {
+			gap = halfLen / 2 // the ladder rungs have a gap for the aircraft symbol
+		}
+		for _, side := range []float64{-1, 1} {
+			x0, y0 := mx+side*along[0]*gap, my+side*along[1]*gap
+			x1, y1 := mx+side*along[0]*halfLen, my+side*along[1]*halfLen
+			drawThickLine(img, int(x0), int(y0), int(x1), int(y1), hudCol)
+		}
+		if label {
+			drawPhysLabel(img, int(mx+along[0]*(halfLen+6)), int(my+along[1]*(halfLen+6))+4, fmt.Sprintf("%.0f", deg), hudCol)
+		}
+	}
+	ladderLine(0, float64(b.Dx())/6, false)
+	for deg := -30.0; deg <= 30; deg += 10 {
+		if deg != 0 {
+			ladderLine(deg, float64(b.Dx())/16, true)
+		}
+	}
+	// the fixed aircraft symbol
+	drawThickLine(img, cx-40, cy, cx-12, cy, hudWarnCol)
+	drawThickLine(img, cx+12, cy, cx+40, cy, hudWarnCol)
+	drawThickLine(img, cx-12, cy, cx, cy+8, hudWarnCol)
+	drawThickLine(img, cx, cy+8, cx+12, cy, hudWarnCol)
+}
+
+func drawHUDHeading(img *image.RGBA, fd tello.FlightData) {
+	b := img.Bounds()
+	cx, y := b.Dx()/2, 40
+	heading := math.Mod(float64(fd.IMU.Yaw)+360, 360)
+	drawHUDBox(img, image.Rect(cx-hudTapeWidth/2-10, y-30, cx+hudTapeWidth/2+10, y+22))
+	half := float64(hudTapeWidth/2) / hudPxPerDegYaw
+	for deg := math.Ceil((heading-half)/10) * 10; deg <= heading+half; deg += 10 {
+		x := cx + int((deg-heading)*hudPxPerDegYaw)
+		d := int(math.Mod(deg+360, 360))
+		tick := 6
+		if d%30 == 0 {
+			tick = 12
+			lab := fmt.Sprintf("%d", d)
+			switch d {
+			case 0:
+				lab = "N"
+			case 90:
+				lab = "E"
+			case 180:
+				lab = "S"
+			case 270:
+				lab = "W"
+			}
+			drawPhysLabel(img, x-len(lab)*7/2, y+18, lab, hudCol)
+		}
+		drawPhysLine(img, x, y, x, y-tick, hudCol)
+	}
+	drawThickLine(img, cx, y+2, cx, y-16, hudWarnCol)
+	drawPhysLabel(img, cx-10, y-18, fmt.Sprintf("%03.0f", heading), hudCol)
+}
+
+func drawHUDAltitude(img *image.RGBA, fd tello.FlightData) {
+	b := img.Bounds()
+	x, y := b.Dx()-130, b.Dy()/2
+	drawHUDBox(img, image.Rect(x-8, y-40, x+110, y+30))
+	drawPhysLabel(img, x, y-20, fmt.Sprintf("ALT %5.1fm", float32(fd.Height)/10), hudCol)
+	drawPhysLabel(img, x, y+2, fmt.Sprintf("VS  %+dm/s", fd.VerticalSpeed), hudCol)
+	// an arrow showing the vertical speed
+	ax := x + 100
+	drawThickLine(img, ax, y, ax, y-int(fd.VerticalSpeed)*8, hudCol)
+	drawThickLine(img, ax-4, y, ax+4, y, hudCol)
+}
+
+func drawHUDPower(img *image.RGBA, fd tello.FlightData) {
+	b := img.Bounds()
+	x, y := 20, b.Dy()-30
+	drawHUDBox(img, image.Rect(x-8, y-18, x+200, y+10))
+	batCol, wifiCol := hudCol, hudCol
+	if fd.BatteryLow || fd.BatteryCritical {
+		batCol = hudWarnCol
+	}
+	if fd.WifiStrength < 50 {
+		wifiCol = hudWarnCol
+	}
+	drawPhysLabel(img, x, y, fmt.Sprintf("BAT %3d%%", fd.BatteryPercentage), batCol)
+	drawPhysLabel(img, x+90, y, fmt.Sprintf("WIFI %3d%%", fd.WifiStrength), wifiCol)
+}
+
+func drawHUDTime(img *image.RGBA, fd tello.FlightData) {
+	x, y := 20, 30
+	secs := int(fd.FlyTime) / 10 // FlyTime is in decisecs
+	col := hudCol
+	if fd.DroneFlyTimeLeft > 0 && fd.DroneFlyTimeLeft < 60 {
+		col = hudWarnCol
+	}
+	drawHUDBox(img, image.Rect(x-8, y-18, x+110, y+10))
+	drawPhysLabel(img, x, y, fmt.Sprintf("FLY %02d:%02d", secs/60, secs%60), col)
+}
+
+// drawHUDMap draws the live track in the bottom right corner, with north up and home in the middle.
+func drawHUDMap(img *image.RGBA, fd tello.FlightData) {
+	b := img.Bounds()
+	r := image.Rect(b.Dx()-hudMapSize-20, b.Dy()-hudMapSize-20, b.Dx()-20, b.Dy()-20)
+	drawHUDBox(img, r)
+	cx, cy := (r.Min.X+r.Max.X)/2, (r.Min.Y+r.Max.Y)/2
+
+	trk := liveTrack
+	trk.RLock()
+	n := len(trk.Positions)
+	step := 1 + n/hudMaxMapPoints
+	pts := make([][2]float32, 0, n/step+1)
+	for i := 0; i < n; i += step {
+		pts = append(pts, [2]float32{trk.Positions[i].MvoX, trk.Positions[i].MvoY})
+	}
+	trk.RUnlock()
+	pts = append(pts, [2]float32{fd.MVO.PositionX, fd.MVO.PositionY})
+
+	hx, hy := fenceGuard.home()
+	rng := hudMinMapRange
+	for _, p := range pts {
+		rng = math.Max(rng, math.Max(math.Abs(float64(p[0])-hx), math.Abs(float64(p[1])-hy))*1.1)
+	}
+	scale := float64(hudMapSize/2) / rng
+	toPx := func(x, y float32) (int, int) {
+		return cx + int((float64(x)-hx)*scale), cy - int((float64(y)-hy)*scale)
+	}
+
+	drawPhysLine(img, cx-5, cy, cx+5, cy, hudWarnCol) // home
+	drawPhysLine(img, cx, cy-5, cx, cy+5, hudWarnCol)
+	for i := 1; i < len(pts); i++ {
+		x0, y0 := toPx(pts[i-1][0], pts[i-1][1])
+		x1, y1 := toPx(pts[i][0], pts[i][1])
+		drawPhysLine(img, x0, y0, x1, y1, hudCol)
+	}
+	dx, dy := toPx(fd.MVO.PositionX, fd.MVO.PositionY)
+	yaw := float64(fd.IMU.Yaw) * math.Pi / 180
+	drawThickLine(img, dx, dy, dx+int(12*math.Sin(yaw)), dy-int(12*math.Cos(yaw)), hudWarnCol)
+	drawHUDBox(img, image.Rect(dx-3, dy-3, dx+4, dy+4))
+	drawPhysLabel(img, r.Min.X+4, r.Min.Y+14, fmt.Sprintf("%.0fm", rng), hudCol)
+}
+
+// hudMenuItems builds the items of the HUD menu.
+func hudMenuItems(menu *gtk.Menu) {
+	show := gtk.NewCheckMenuItemWithLabel("Show HUD")
+	show.SetActive(!settings.HUD.Off)
+	menu.Append(show)
+	menu.Append(gtk.NewSeparatorMenuItem())
+	items := make([]*gtk.CheckMenuItem, len(hudElements))
+	for i, el := range hudElements {
+		items[i] = gtk.NewCheckMenuItemWithLabel(el.label)
+		items[i].SetActive(settings.HUD.shown(el.name))
+		items[i].SetSensitive(!settings.HUD.Off)
+		name, item := el.name, items[i]
+		item.Connect("activate", func() {
+			settings.HUD.setShown(name, item.GetActive())
+			saveHUDSettings()
+		})
+		menu.Append(item)
+	}
+	show.Connect("activate", func() {
+		settings.HUD.Off = !show.GetActive()
+		for _, item := range items {
+			item.SetSensitive(!settings.HUD.Off)
+		}
+		saveHUDSettings()
+	})
+}
+
+func saveHUDSettings() {
+	if err := saveSettings(settings, appSettingsFile); err != nil {
+		log.Printf("Could not save settings: %v", err)
+	}
+}
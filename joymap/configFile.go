@@ -0,0 +1,313 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package joymap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// User-defined joystick configurations are read from files matching this pattern in the data directory.
+const ConfigFilePattern = "*.joystick.yaml"
+
+// The names used for the Ax*, Btn*, Ft* and Type* constants in joystick YAML files.
+var (
+	AxisNames = []string{
+		AxLeftX: "LeftX", AxLeftY: "LeftY", AxRightX: "RightX", AxRightY: "RightY",
+		AxSlowMode: "SlowMode",
+		AxFlipX:    "FlipX", AxFlipY: "FlipY",
+	}
+	ButtonNames = []string{
+		BtnTakeoff: "Takeoff", BtnLand: "Land", BtnTakePhoto: "TakePhoto",
+		BtnSetHome: "SetHome", BtnReturnHome: "ReturnHome", BtnCancelAuto: "CancelAuto",
+		BtnThrowPalm:      "ThrowPalm",
+		BtnSlowMode:       "SlowMode",
+		BtnFlightModeSlow: "FlightModeSlow", BtnFlightModeFast: "FlightModeFast",
+		BtnFlipForward: "FlipForward", BtnFlipBackward: "FlipBackward", BtnFlipLeft: "FlipLeft", BtnFlipRight: "FlipRight",
+		BtnStatsPage: "StatsPage", BtnTrackChartPage: "TrackChartPage", BtnProfileChartPage: "ProfileChartPage",
+	}
+	FeatureNames = []string{
+		FtHasThrowPalmButton:    "ThrowPalmButton",
+		FtHasSlowModeButton:     "SlowModeButton",
+		FtHasSlowModeAxes:       "SlowModeAxes",
+		FtHasFlightSpeedButtons: "FlightSpeedButtons",
+		FtHasFlipButtons:        "FlipButtons",
+		FtHasFlipAxes:           "FlipAxes",
+		FtHasPageSwitchButtons:  "PageSwitchButtons",
+	}
+	TypeNames = []string{
+		TypeGameController:   "GameController",
+		TypeFlightController: "FlightController",
+	}
+)
+
+// The inputs which every joystick configuration must provide.
+var (
+	RequiredAxes    = []int{AxLeftX, AxLeftY, AxRightX, AxRightY}
+	RequiredButtons = []int{BtnTakeoff, BtnLand, BtnTakePhoto, BtnSetHome, BtnReturnHome, BtnCancelAuto}
+)
+
+// FeatureInputs lists the axes and buttons each optional feature relies upon.
+var FeatureInputs = []struct {
+	Axes, Buttons []int
+}{
+	FtHasThrowPalmButton:    {Buttons: []int{BtnThrowPalm}},
+	FtHasSlowModeButton:     {Buttons: []int{BtnSlowMode}},
+	FtHasSlowModeAxes:       {Axes: []int{AxSlowMode}},
+	FtHasFlightSpeedButtons: {Buttons: []int{BtnFlightModeSlow, BtnFlightModeFast}},
+	FtHasFlipButtons:        {Buttons: []int{BtnFlipForward, BtnFlipBackward, BtnFlipLeft, BtnFlipRight}},
+	FtHasFlipAxes:           {Axes: []int{AxFlipX, AxFlipY}},
+	FtHasPageSwitchButtons:  {Buttons: []int{BtnStatsPage, BtnTrackChartPage, BtnProfileChartPage}},
+}
+
+// ConfigFileT is the YAML representation of a ConfigT, eg.
+//
+//	name: My Gamepad
+//	os: linux            # optional, the config is used on every OS if omitted
+//	type: GameController
+//	axes: {LeftX: 0, LeftY: 1, RightX: 3, RightY: 4}
+//	buttons: {Takeoff: 3, Land: 0, TakePhoto: 1, SetHome: 4, ReturnHome: 5, CancelAuto: 10}
+//	features: {FlipButtons: false}   # optional, by default features are enabled when their inputs are mapped
+//	inverted: {LeftY: true}          # optional, axes which read the opposite way to usual
+type ConfigFileT struct {
+	Name     string
+	OS       string `yaml:"os,omitempty"`
+	Type     string
+	Axes     map[string]int
+	Buttons  map[string]uint
+	Features map[string]bool `yaml:",omitempty"`
+	Inverted map[string]bool `yaml:",omitempty"`
+}
+
+func indexOfName(names []string, name string) int {
+	for i, n := range names {
+		if strings.EqualFold(n, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// ToConfig validates a YAML joystick definition and converts it to a ConfigT.
+func (jf *ConfigFileT) ToConfig() (conf ConfigT, err error) {
+	if jf.Name == "" {
+		return conf, fmt.Errorf("joystick configuration has no name")
+	}
+	conf.Name = jf.Name
+	conf.JsType = TypeGameController
+	if jf.Type != "" {
+		if conf.JsType = indexOfName(TypeNames, jf.Type); conf.JsType < 0 {
+			return conf, fmt.Errorf("unknown joystick type: %s", jf.Type)
+		}
+	}
+
+	conf.Axes = make([]int, AxCount)
+	axMapped := make([]bool, AxCount)
+	for name, ax := range jf.Axes {
+		ix := indexOfName(AxisNames, name)
+		if ix < 0 {
+			return conf, fmt.Errorf("unknown axis function: %s", name)
+		}
+		if ax < 0 {
+			return conf, fmt.Errorf("axis %s is mapped to a negative axis: %d", name, ax)
+		}
+		conf.Axes[ix], axMapped[ix] = ax, true
+	}
+	conf.Buttons = make([]uint, BtnCount)
+	btnMapped := make([]bool, BtnCount)
+	for name, btn := range jf.Buttons {
+		ix := indexOfName(ButtonNames, name)
+		if ix < 0 {
+			return conf, fmt.Errorf("unknown button function: %s", name)
+		}
+		conf.Buttons[ix], btnMapped[ix] = btn, true
+	}
+
+	for _, ax := range RequiredAxes {
+		if !axMapped[ax] {
+			return conf, fmt.Errorf("required axis %s is not mapped", AxisNames[ax])
+		}
+	}
+	for _, btn := range RequiredButtons {
+		if !btnMapped[btn] {
+			return conf, fmt.Errorf("required button %s is not mapped", ButtonNames[btn])
+		}
+	}
+
+	// features default to being available if all their inputs are mapped...
+	conf.Features = DeriveFeatures(axMapped, btnMapped)
+	// ...but may be explicitly switched off (or on)
+	for name, on := range jf.Features {
+		ft := indexOfName(FeatureNames, name)
+		if ft < 0 {
+			return conf, fmt.Errorf("unknown feature: %s", name)
+		}
+		if on && !conf.Features[ft] {
+			return conf, fmt.Errorf("feature %s is enabled but its inputs are not all mapped", name)
+		}
+		conf.Features[ft] = on
+	}
+
+	conf.Inverted = make([]bool, AxCount)
+	for name, inv := range jf.Inverted {
+		ix := indexOfName(AxisNames, name)
+		if ix < 0 {
+			return conf, fmt.Errorf("unknown inverted axis function: %s", name)
+		}
+		conf.Inverted[ix] = inv
+	}
+	return conf, nil
+}
+
+// ToConfigFile does the inverse of ToConfig.  Only the inputs used by the enabled
+// features are included, so the features themselves need not be written.
+func ToConfigFile(conf ConfigT) (jf ConfigFileT) {
+	jf.Name = conf.Name
+	jf.Type = TypeNames[conf.JsType]
+	axUsed := make([]bool, AxCount)
+	btnUsed := make([]bool, BtnCount)
+	for _, ax := range RequiredAxes {
+		axUsed[ax] = true
+	}
+	for _, btn := range RequiredButtons {
+		btnUsed[btn] = true
+	}
+	for ft, inputs := range FeatureInputs {
+		if ft < len(conf.Features) && conf.Features[ft] {
+			for _, ax := range inputs.Axes {
+				axUsed[ax] = true
+			}
+			for _, btn := range inputs.Buttons {
+				btnUsed[btn] = true
+			}
+		}
+	}
+	jf.Axes = make(map[string]int)
+	for ax, used := range axUsed {
+		if used && ax < len(conf.Axes) {
+			jf.Axes[AxisNames[ax]] = conf.Axes[ax]
+			if ax < len(conf.Inverted) && conf.Inverted[ax] {
+				if jf.Inverted == nil {
+					jf.Inverted = make(map[string]bool)
+				}
+				jf.Inverted[AxisNames[ax]] = true
+			}
+		}
+	}
+	jf.Buttons = make(map[string]uint)
+	for btn, used := range btnUsed {
+		if used && btn < len(conf.Buttons) {
+			jf.Buttons[ButtonNames[btn]] = conf.Buttons[btn]
+		}
+	}
+	return jf
+}
+
+// SaveConfig writes a joystick configuration to a YAML file for this OS.
+func SaveConfig(conf ConfigT, filename string) error {
+	jf := ToConfigFile(conf)
+	jf.OS = runtime.GOOS
+	bytes, err := yaml.Marshal(jf)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, bytes, 0644)
+}
+
+// ConfigFilename returns a suitable path in dir for a user-defined joystick configuration.
+func ConfigFilename(dir, name string) string {
+	safe := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' {
+			return r
+		}
+		return '_'
+	}, name)
+	return filepath.Join(dir, strings.Replace(ConfigFilePattern, "*", safe, 1))
+}
+
+// DeriveFeatures returns the Ft??? features whose axes and buttons are all mapped.
+func DeriveFeatures(axMapped, btnMapped []bool) (features []bool) {
+	features = make([]bool, FtCount)
+	for ft, inputs := range FeatureInputs {
+		features[ft] = true
+		for _, ax := range inputs.Axes {
+			features[ft] = features[ft] && axMapped[ax]
+		}
+		for _, btn := range inputs.Buttons {
+			features[ft] = features[ft] && btnMapped[btn]
+		}
+	}
+	return features
+}
+
+// LoadConfig reads a single user-defined joystick configuration from a YAML file.
+// ok is false if the configuration is for a different OS.
+func LoadConfig(filename string) (conf ConfigT, ok bool, err error) {
+	bytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return conf, false, err
+	}
+	var jf ConfigFileT
+	if err = yaml.Unmarshal(bytes, &jf); err != nil {
+		return conf, false, err
+	}
+	if jf.OS != "" && !strings.EqualFold(jf.OS, runtime.GOOS) {
+		return conf, false, nil
+	}
+	conf, err = jf.ToConfig()
+	return conf, err == nil, err
+}
+
+// LoadUserConfigs returns all the valid joystick configurations found in dir.
+// Invalid files are logged and skipped.
+func LoadUserConfigs(dir string) (confs []ConfigT) {
+	if dir == "" {
+		dir = "."
+	}
+	files, err := filepath.Glob(filepath.Join(dir, ConfigFilePattern))
+	if err != nil {
+		log.Printf("Error searching for joystick configurations: %v\n", err)
+		return nil
+	}
+	for _, f := range files {
+		conf, ok, err := LoadConfig(f)
+		if err != nil {
+			log.Printf("Ignoring joystick configuration %s: %v\n", f, err)
+			continue
+		}
+		if ok {
+			confs = append(confs, conf)
+		}
+	}
+	return confs
+}
+
+// MergeConfigs returns the built-in configurations followed by the user-defined ones,
+// a user-defined configuration replaces any built-in one with the same name.
+func MergeConfigs(builtIn, user []ConfigT) (merged []ConfigT) {
+	merged = append(merged, builtIn...)
+	for _, u := range user {
+		replaced := false
+		for i := range merged {
+			if merged[i].Name == u.Name {
+				merged[i], replaced = u, true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, u)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,111 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package joymap
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// minimalConfigFile maps just the required inputs.
+func minimalConfigFile() ConfigFileT {
+	return ConfigFileT{
+		Name: "Test Pad",
+		Axes: map[string]int{"LeftX": 0, "LeftY": 1, "RightX": 3, "RightY": 4},
+		Buttons: map[string]uint{"Takeoff": 3, "Land": 0, "TakePhoto": 1, "SetHome": 4,
+			"ReturnHome": 5, "CancelAuto": 10},
+	}
+}
+
+func TestToConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		edit    func(jf *ConfigFileT)
+		check   func(conf ConfigT) bool
+		wantErr string
+	}{
+		{"minimal", func(jf *ConfigFileT) {}, func(conf ConfigT) bool {
+			return conf.Name == "Test Pad" && conf.JsType == TypeGameController &&
+				reflect.DeepEqual(conf.Axes[:AxSlowMode], []int{0, 1, 3, 4}) &&
+				conf.Buttons[BtnCancelAuto] == 10 && !conf.Features[FtHasFlipButtons]
+		}, ""},
+		{"names ignore case", func(jf *ConfigFileT) {
+			jf.Type = "flightcontroller"
+			jf.Axes["rightx"] = jf.Axes["RightX"]
+			delete(jf.Axes, "RightX")
+		}, func(conf ConfigT) bool {
+			return conf.JsType == TypeFlightController && conf.Axes[AxRightX] == 3
+		}, ""},
+		{"feature derived", func(jf *ConfigFileT) {
+			jf.Buttons["FlipForward"], jf.Buttons["FlipBackward"] = 11, 12
+			jf.Buttons["FlipLeft"], jf.Buttons["FlipRight"] = 13, 14
+		}, func(conf ConfigT) bool { return conf.Features[FtHasFlipButtons] }, ""},
+		{"feature switched off", func(jf *ConfigFileT) {
+			jf.Buttons["ThrowPalm"] = 2
+			jf.Features = map[string]bool{"ThrowPalmButton": false}
+		}, func(conf ConfigT) bool { return !conf.Features[FtHasThrowPalmButton] }, ""},
+		{"inverted", func(jf *ConfigFileT) { jf.Inverted = map[string]bool{"LeftY": true} },
+			func(conf ConfigT) bool { return conf.Inverted[AxLeftY] && !conf.Inverted[AxLeftX] }, ""},
+
+		{"no name", func(jf *ConfigFileT) { jf.Name = "" }, nil, "has no name"},
+		{"unknown type", func(jf *ConfigFileT) { jf.Type = "Steering Wheel" }, nil, "unknown joystick type"},
+		{"unknown axis", func(jf *ConfigFileT) { jf.Axes["Throttle"] = 2 }, nil, "unknown axis function: Throttle"},
+		{"negative axis", func(jf *ConfigFileT) { jf.Axes["LeftX"] = -1 }, nil, "negative axis"},
+		{"unknown button", func(jf *ConfigFileT) { jf.Buttons["Eject"] = 9 }, nil, "unknown button function: Eject"},
+		{"required axis", func(jf *ConfigFileT) { delete(jf.Axes, "RightY") }, nil, "required axis RightY"},
+		{"required button", func(jf *ConfigFileT) { delete(jf.Buttons, "Land") }, nil, "required button Land"},
+		{"unknown feature", func(jf *ConfigFileT) { jf.Features = map[string]bool{"Autopilot": true} }, nil, "unknown feature"},
+		{"feature not mapped", func(jf *ConfigFileT) { jf.Features = map[string]bool{"FlipAxes": true} }, nil,
+			"feature FlipAxes is enabled but its inputs are not all mapped"},
+		{"unknown inverted axis", func(jf *ConfigFileT) { jf.Inverted = map[string]bool{"Throttle": true} }, nil,
+			"unknown inverted axis function"},
+	}
+	for _, tc := range tests {
+		jf := minimalConfigFile()
+		tc.edit(&jf)
+		conf, err := jf.ToConfig()
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%s: error = %v, want %q", tc.name, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: error = %v", tc.name, err)
+			continue
+		}
+		if !tc.check(conf) {
+			t.Errorf("%s: got %+v", tc.name, conf)
+		}
+	}
+}
+
+// TestToConfigFileRoundTrip checks that the built-in configurations survive being saved and loaded.
+func TestToConfigFileRoundTrip(t *testing.T) {
+	for _, confs := range [][]ConfigT{KnownLinuxConfigs, KnownWindowsConfigs} {
+		for _, conf := range confs {
+			jf := ToConfigFile(conf)
+			got, err := jf.ToConfig()
+			if err != nil {
+				t.Errorf("%s: error = %v", conf.Name, err)
+				continue
+			}
+			for _, ax := range RequiredAxes {
+				if got.Axes[ax] != conf.Axes[ax] {
+					t.Errorf("%s: axis %s = %d, want %d", conf.Name, AxisNames[ax], got.Axes[ax], conf.Axes[ax])
+				}
+			}
+			for ft := range conf.Features {
+				if got.Features[ft] != conf.Features[ft] {
+					t.Errorf("%s: feature %s = %v, want %v", conf.Name, FeatureNames[ft], got.Features[ft], conf.Features[ft])
+				}
+			}
+		}
+	}
+}
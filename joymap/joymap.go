@@ -0,0 +1,349 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+// Package joymap maps the axes and buttons of joysticks and game controllers onto the
+// drone's controls, and shapes the response of the sticks.  It has no GUI dependencies.
+package joymap
+
+import (
+	"runtime"
+
+	"github.com/simulatedsimian/joystick"
+)
+
+// The types of controller.
+const (
+	//typeJoystick = iota
+	TypeGameController = iota
+	TypeFlightController
+)
+
+// The axis functions, indices into ConfigT.Axes.
+const (
+	AxLeftX = iota
+	AxLeftY
+	AxRightX
+	AxRightY
+
+	AxSlowMode
+
+	AxFlipX
+	AxFlipY
+
+	AxCount
+)
+
+// The button functions, indices into ConfigT.Buttons.
+const (
+	BtnTakeoff = iota
+	BtnLand
+	BtnTakePhoto
+	BtnSetHome
+	BtnReturnHome
+	BtnCancelAuto
+
+	BtnThrowPalm
+
+	BtnSlowMode
+
+	BtnFlightModeSlow
+	BtnFlightModeFast
+
+	BtnFlipForward
+	BtnFlipBackward
+	BtnFlipLeft
+	BtnFlipRight
+
+	BtnStatsPage
+	BtnTrackChartPage
+	BtnProfileChartPage
+
+	BtnCount
+)
+
+// The optional features, indices into ConfigT.Features.
+const (
+	FtHasThrowPalmButton = iota
+	FtHasSlowModeButton
+	FtHasSlowModeAxes
+	FtHasFlightSpeedButtons
+	FtHasFlipButtons
+	FtHasFlipAxes
+	FtHasPageSwitchButtons
+
+	FtCount
+)
+
+// MaxVal is the full-scale reading of a joystick axis.
+const MaxVal = 32767
+
+// ConfigT holds a joystick configuration
+type ConfigT struct {
+	Name     string
+	JsType   int
+	Axes     []int  // must have left and right X & Y entries
+	Buttons  []uint // must have an entry for each Btn??? const
+	Features []bool
+	Inverted []bool // optional, true for each Ax??? function whose axis reads the 'wrong' way
+}
+
+// The built-in configurations for joysticks known to work.
+var (
+	KnownWindowsConfigs = []ConfigT{
+		ConfigT{
+			Name:   "DualShock 3", // TODO - Untested
+			JsType: TypeGameController,
+			Axes:   []int{AxLeftX: 0, AxLeftY: 1, AxRightX: 2, AxRightY: 3},
+			//Buttons: []uint{btnCross: 1, btnCircle: 2, btnTriangle: 3, btnSquare: 0, btnL1: 4, btnL2: 6, btnR1: 5, btnR2: 7},
+			Buttons:  []uint{BtnLand: 1, BtnTakeoff: 3, BtnTakePhoto: 0, BtnSetHome: 4, BtnReturnHome: 5, BtnCancelAuto: 11},
+			Features: []bool{FtHasThrowPalmButton: false, FtHasSlowModeButton: false, FtHasSlowModeAxes: false, FtHasFlightSpeedButtons: false, FtHasFlipButtons: false, FtHasFlipAxes: false, FtHasPageSwitchButtons: false},
+		},
+		ConfigT{
+			Name:   "DualShock 4",
+			JsType: TypeGameController,
+			Axes:   []int{AxLeftX: 0, AxLeftY: 1, AxRightX: 2, AxRightY: 3},
+			//Buttons: []uint{btnCross: 1, btnCircle: 2, btnTriangle: 3, btnSquare: 0, btnL1: 4, btnL2: 6, btnR1: 5, btnR2: 7},
+			Buttons:  []uint{BtnLand: 1, BtnTakeoff: 3, BtnTakePhoto: 0, BtnSetHome: 4, BtnReturnHome: 5, BtnCancelAuto: 11},
+			Features: []bool{FtHasThrowPalmButton: false, FtHasSlowModeButton: false, FtHasSlowModeAxes: false, FtHasFlightSpeedButtons: false, FtHasFlipButtons: false, FtHasFlipAxes: false, FtHasPageSwitchButtons: false},
+		},
+		ConfigT{
+			Name:   "T-Flight Hotas X",
+			JsType: TypeFlightController,
+			Axes:   []int{AxLeftX: 4, AxLeftY: 2, AxRightX: 0, AxRightY: 1},
+			//Buttons: []uint{btnR1: 0, btnL1: 1, btnR3: 2, btnL3: 3, btnSquare: 4, btnCross: 5, btnCircle: 6, btnTriangle: 7, btnR2: 8, btnL2: 9},
+			Buttons:  []uint{BtnTakePhoto: 4, BtnLand: 5, BtnTakeoff: 7, BtnSetHome: 1, BtnReturnHome: 0, BtnCancelAuto: 12},
+			Features: []bool{FtHasThrowPalmButton: false, FtHasSlowModeButton: false, FtHasSlowModeAxes: false, FtHasFlightSpeedButtons: false, FtHasFlipButtons: false, FtHasFlipAxes: false, FtHasPageSwitchButtons: false},
+		},
+		ConfigT{
+			Name:     "XBox 360", // TODO - Untested
+			JsType:   TypeGameController,
+			Axes:     []int{AxLeftX: 0, AxLeftY: 1, AxRightX: 4, AxRightY: 5},
+			Buttons:  []uint{BtnLand: 2, BtnTakeoff: 3, BtnTakePhoto: 0, BtnSetHome: 4, BtnReturnHome: 5, BtnCancelAuto: 9},
+			Features: []bool{FtHasThrowPalmButton: false, FtHasSlowModeButton: false, FtHasSlowModeAxes: false, FtHasFlightSpeedButtons: false, FtHasFlipButtons: false, FtHasFlipAxes: false, FtHasPageSwitchButtons: false},
+		},
+	}
+	KnownLinuxConfigs = []ConfigT{
+		ConfigT{
+			Name:     "DualShock 4",
+			JsType:   TypeGameController,
+			Axes:     []int{AxLeftX: 0, AxLeftY: 1, AxRightX: 3, AxRightY: 4},
+			Buttons:  []uint{BtnLand: 0, BtnTakeoff: 2, BtnTakePhoto: 3, BtnSetHome: 4, BtnReturnHome: 5, BtnCancelAuto: 11},
+			Features: []bool{FtHasThrowPalmButton: false, FtHasSlowModeButton: false, FtHasSlowModeAxes: false, FtHasFlightSpeedButtons: false, FtHasFlipButtons: false, FtHasFlipAxes: false, FtHasPageSwitchButtons: false},
+		},
+		ConfigT{
+			Name:     "T-Flight Hotas X", // Seeems to be the same on Linux and Windows
+			JsType:   TypeFlightController,
+			Axes:     []int{AxLeftX: 4, AxLeftY: 2, AxRightX: 0, AxRightY: 1},
+			Buttons:  []uint{BtnTakePhoto: 4, BtnLand: 5, BtnTakeoff: 7, BtnSetHome: 1, BtnReturnHome: 0, BtnCancelAuto: 12},
+			Features: []bool{FtHasThrowPalmButton: false, FtHasSlowModeButton: false, FtHasSlowModeAxes: false, FtHasFlightSpeedButtons: false, FtHasFlipButtons: false, FtHasFlipAxes: false, FtHasPageSwitchButtons: false},
+		},
+		ConfigT{
+			Name:     "XBox 360", // TODO - Untested
+			JsType:   TypeGameController,
+			Axes:     []int{AxLeftX: 0, AxLeftY: 1, AxRightX: 4, AxRightY: 5},
+			Buttons:  []uint{BtnLand: 2, BtnTakeoff: 3, BtnTakePhoto: 0, BtnSetHome: 4, BtnReturnHome: 5, BtnCancelAuto: 10},
+			Features: []bool{FtHasThrowPalmButton: false, FtHasSlowModeButton: false, FtHasSlowModeAxes: false, FtHasFlightSpeedButtons: false, FtHasFlipButtons: false, FtHasFlipAxes: false, FtHasPageSwitchButtons: false},
+		},
+		ConfigT{
+			Name:   "Steam Controller (Linux kernel driver)", // Steam Controller mapping tested with Linux kernel driver added in Linux 4.18.
+			JsType: TypeGameController,
+			Axes:   []int{AxLeftX: 2, AxLeftY: 3, AxRightX: 0, AxRightY: 1}, // This controller has only single stick, so this mapping maps right stick on left (real) stick.
+			Buttons: []uint{
+				BtnLand:       2,  // A
+				BtnTakeoff:    5,  // Y
+				BtnTakePhoto:  3,  // B
+				BtnSetHome:    10, // Select
+				BtnReturnHome: 12, // Home
+				BtnCancelAuto: 11, // Start
+
+				BtnThrowPalm: 4, // X
+
+				BtnSlowMode: 9, // R2
+
+				BtnFlightModeSlow: 6, // L1
+				BtnFlightModeFast: 7, // R1
+
+				BtnFlipForward:  17, // D-Up
+				BtnFlipBackward: 18, // D-Down
+				BtnFlipLeft:     19, // D-Left
+				BtnFlipRight:    20, // D-Right
+
+				BtnStatsPage:        8,  // L2
+				BtnTrackChartPage:   16, // BackR
+				BtnProfileChartPage: 15, // BackL
+
+				// R3       = 14
+				// L3       = 13
+				// D-Touch  =  0
+				// R3-Touch =  1
+			},
+			Features: []bool{
+				FtHasThrowPalmButton:    true,
+				FtHasSlowModeButton:     true,
+				FtHasSlowModeAxes:       false,
+				FtHasFlightSpeedButtons: true,
+				FtHasFlipButtons:        true,
+				FtHasFlipAxes:           false,
+				FtHasPageSwitchButtons:  true,
+			},
+		},
+		ConfigT{
+			Name:   "EVOLVEO Fighter F1 (Cable connection)",
+			JsType: TypeGameController,
+			Axes: []int{
+				AxLeftX:  0,
+				AxLeftY:  1,
+				AxRightX: 3,
+				AxRightY: 4,
+
+				AxSlowMode: 5,
+
+				AxFlipX: 6,
+				AxFlipY: 7,
+
+				// axL2 = 2
+			},
+			Buttons: []uint{
+				BtnLand:       0,  // A
+				BtnTakeoff:    3,  // Y
+				BtnTakePhoto:  1,  // B
+				BtnSetHome:    6,  // Select
+				BtnReturnHome: 7,  // Start
+				BtnCancelAuto: 10, // R3
+
+				BtnThrowPalm: 2, // X
+
+				BtnFlightModeSlow: 4, // L1
+				BtnFlightModeFast: 5, // R1
+
+				// L3      =  9
+			},
+			Features: []bool{
+				FtHasThrowPalmButton:    true,
+				FtHasSlowModeButton:     false,
+				FtHasSlowModeAxes:       true,
+				FtHasFlightSpeedButtons: true,
+				FtHasFlipButtons:        false,
+				FtHasFlipAxes:           true,
+				FtHasPageSwitchButtons:  false,
+			},
+		},
+		ConfigT{
+			Name:   "EVOLVEO Fighter F1 (Wireless connection in Windows, Android or PS3 mode)",
+			JsType: TypeGameController,
+			Axes: []int{
+				AxLeftX:  0,
+				AxLeftY:  1,
+				AxRightX: 3,
+				AxRightY: 4,
+
+				AxSlowMode: 5,
+
+				// axL2 = 2
+			},
+			Buttons: []uint{
+				BtnLand:       0,  // A
+				BtnTakeoff:    2,  // Y
+				BtnTakePhoto:  1,  // B
+				BtnSetHome:    8,  // Select
+				BtnReturnHome: 10, // Home
+				BtnCancelAuto: 9,  // Start
+
+				BtnThrowPalm: 3, // X
+
+				BtnFlightModeSlow: 4, // L1
+				BtnFlightModeFast: 5, // R1
+
+				BtnFlipForward:  13, // D-Up
+				BtnFlipBackward: 14, // D-Down
+				BtnFlipLeft:     15, // D-Left
+				BtnFlipRight:    16, // D-Right
+
+				// R3      = 12
+				// L3      = 11
+				// R2      =  7
+				// L2      =  6
+			},
+			Features: []bool{
+				FtHasThrowPalmButton:    true,
+				FtHasSlowModeButton:     false,
+				FtHasSlowModeAxes:       true,
+				FtHasFlightSpeedButtons: true,
+				FtHasFlipButtons:        true,
+				FtHasFlipAxes:           false,
+				FtHasPageSwitchButtons:  false,
+			},
+		},
+		ConfigT{
+			Name:   "EVOLVEO Fighter F1 (Bluetooth wireless connection in Android mode)",
+			JsType: TypeGameController,
+			Axes: []int{
+				AxLeftX:  0,
+				AxLeftY:  1,
+				AxRightX: 2,
+				AxRightY: 3,
+
+				AxSlowMode: 4,
+
+				AxFlipX: 6,
+				AxFlipY: 7,
+
+				// axL2 = 5
+			},
+			Buttons: []uint{
+				BtnLand:       0,  // A
+				BtnTakeoff:    4,  // Y
+				BtnTakePhoto:  1,  // B
+				BtnSetHome:    10, // Select
+				BtnReturnHome: 11, // Start
+				BtnCancelAuto: 14, // R3
+
+				BtnThrowPalm: 3, // X
+
+				BtnFlightModeSlow: 6, // L1
+				BtnFlightModeFast: 7, // R1
+
+				// L3      = 13
+				// R2      =  9
+				// L2      =  8
+			},
+			Features: []bool{
+				FtHasThrowPalmButton:    true,
+				FtHasSlowModeButton:     false,
+				FtHasSlowModeAxes:       true,
+				FtHasFlightSpeedButtons: true,
+				FtHasFlipButtons:        false,
+				FtHasFlipAxes:           true,
+				FtHasPageSwitchButtons:  false,
+			},
+		},
+	}
+)
+
+// BuiltInConfigs returns the built-in configurations for this OS.
+func BuiltInConfigs() []ConfigT {
+	switch runtime.GOOS {
+	case "windows":
+		return KnownWindowsConfigs
+	case "linux":
+		return KnownLinuxConfigs
+	}
+	return nil
+}
+
+// AxisValue returns the raw reading of the axis mapped to the Ax??? function, allowing for inversion.
+// It is 0 if the function is not mapped to an axis the joystick has.
+func (conf *ConfigT) AxisValue(jsState joystick.State, ax int) int {
+	if ax < 0 || ax >= len(conf.Axes) || conf.Axes[ax] < 0 || conf.Axes[ax] >= len(jsState.AxisData) {
+		return 0
+	}
+	v := jsState.AxisData[conf.Axes[ax]]
+	if ax < len(conf.Inverted) && conf.Inverted[ax] {
+		v = -v
+	}
+	return v
+}
@@ -0,0 +1,95 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package joymap
+
+import (
+	"math"
+
+	"github.com/simulatedsimian/joystick"
+)
+
+// The sticks whose response may be configured, in StickMessage order
+const (
+	StLx = iota
+	StLy
+	StRx
+	StRy
+	StCount
+)
+
+// StickNames are the user-visible names of the St??? sticks.
+var StickNames = []string{StLx: "Left X (Left/Right)", StLy: "Left Y (Fwd/Back)", StRx: "Right X (Turn)", StRy: "Right Y (Up/Down)"}
+
+// AxisResponseT defines how a normalised stick reading is converted into a stick value.
+type AxisResponseT struct {
+	DeadZone float64 // fraction of travel either side of centre that is ignored
+	Expo     float64 // 0 = linear, 1 = fully cubic - softens the response near centre
+	MaxRate  float64 // fraction of the drone's maximum rate given at full deflection
+	Invert   bool
+}
+
+// ProfileT holds the response of each stick for a joystick type.
+type ProfileT struct {
+	Axes [StCount]AxisResponseT
+}
+
+// DefaultAxisResponse is a linear response with a small dead zone.
+var DefaultAxisResponse = AxisResponseT{DeadZone: 0.06, Expo: 0, MaxRate: 1.0}
+
+// DefaultProfile returns a profile with the default response on every stick.
+func DefaultProfile() (sp ProfileT) {
+	for i := range sp.Axes {
+		sp.Axes[i] = DefaultAxisResponse
+	}
+	return sp
+}
+
+// Apply converts a normalised (-1.0 ~ 1.0) reading according to the response settings.
+func (ar *AxisResponseT) Apply(v float64) float64 {
+	if ar.Invert {
+		v = -v
+	}
+	a := math.Abs(v)
+	if a <= ar.DeadZone {
+		return 0
+	}
+	a = (a - ar.DeadZone) / (1 - ar.DeadZone) // use the full range outside the dead zone
+	if a > 1 {
+		a = 1
+	}
+	a = (1-ar.Expo)*a + ar.Expo*a*a*a
+	a *= ar.MaxRate
+	return math.Copysign(a, v)
+}
+
+// StickAxes maps each configurable stick to its Ax??? function
+var StickAxes = [StCount]int{StLx: AxLeftX, StLy: AxLeftY, StRx: AxRightX, StRy: AxRightY}
+
+// RawStick returns the normalised (-1.0 ~ 1.0) reading of stick st on a joystick with
+// configuration conf, positive being right, forwards or up.
+func RawStick(conf *ConfigT, jsState joystick.State, st int) float64 {
+	ax := StickAxes[st]
+	if ax >= len(conf.Axes) || conf.Axes[ax] < 0 || conf.Axes[ax] >= len(jsState.AxisData) {
+		return 0
+	}
+	raw := jsState.AxisData[conf.Axes[ax]]
+	if ax < len(conf.Inverted) && conf.Inverted[ax] {
+		raw = -raw
+	}
+	if st == StLy || st == StRy { // joysticks read negative when pushed forwards or up
+		raw = -raw
+	}
+	v := float64(raw) / MaxVal // some joysticks report 32768
+	if v > 1 {
+		v = 1
+	}
+	if v < -1 {
+		v = -1
+	}
+	return v
+}
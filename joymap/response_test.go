@@ -0,0 +1,87 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package joymap
+
+import (
+	"math"
+	"testing"
+
+	"github.com/simulatedsimian/joystick"
+)
+
+func TestAxisResponseApply(t *testing.T) {
+	linear := AxisResponseT{MaxRate: 1}
+	tests := []struct {
+		name string
+		ar   AxisResponseT
+		in   float64
+		want float64
+	}{
+		{"linear centre", linear, 0, 0},
+		{"linear half", linear, 0.5, 0.5},
+		{"linear negative", linear, -0.25, -0.25},
+		{"linear full", linear, 1, 1},
+		{"linear over", linear, 1.2, 1},
+		{"inside dead zone", AxisResponseT{DeadZone: 0.1, MaxRate: 1}, 0.1, 0},
+		{"inside dead zone negative", AxisResponseT{DeadZone: 0.1, MaxRate: 1}, -0.05, 0},
+		{"dead zone rescaled", AxisResponseT{DeadZone: 0.2, MaxRate: 1}, 0.6, 0.5},
+		{"dead zone full", AxisResponseT{DeadZone: 0.2, MaxRate: 1}, -1, -1},
+		{"full expo", AxisResponseT{Expo: 1, MaxRate: 1}, 0.5, 0.125},
+		{"half expo", AxisResponseT{Expo: 0.5, MaxRate: 1}, -0.5, -0.3125},
+		{"expo full", AxisResponseT{Expo: 0.7, MaxRate: 1}, 1, 1},
+		{"max rate", AxisResponseT{MaxRate: 0.5}, 1, 0.5},
+		{"inverted", AxisResponseT{MaxRate: 1, Invert: true}, 0.75, -0.75},
+		{"everything", AxisResponseT{DeadZone: 0.2, Expo: 1, MaxRate: 0.8, Invert: true}, -0.6, 0.1},
+		{"default small", DefaultAxisResponse, 0.05, 0},
+	}
+	for _, tc := range tests {
+		if got := tc.ar.Apply(tc.in); math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("%s: Apply(%v) = %v, want %v", tc.name, tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestRawStickAndAxisValue(t *testing.T) {
+	conf := ConfigT{
+		Axes:     []int{AxLeftX: 0, AxLeftY: 1, AxRightX: 2, AxRightY: 5},
+		Inverted: []bool{AxLeftX: true},
+	}
+	state := joystick.State{AxisData: []int{16384, -MaxVal, 32768, 0}}
+	tests := []struct {
+		st       int
+		wantRaw  float64
+		wantAxis int
+	}{
+		{StLx, -16384.0 / MaxVal, -16384}, // inverted
+		{StLy, 1, -MaxVal},                // forwards reads negative
+		{StRx, 1, 32768},                  // clamped
+		{StRy, 0, 0},                      // axis 5 is beyond the joystick's axes
+	}
+	for _, tc := range tests {
+		if got := RawStick(&conf, state, tc.st); math.Abs(got-tc.wantRaw) > 1e-9 {
+			t.Errorf("RawStick(%s) = %v, want %v", StickNames[tc.st], got, tc.wantRaw)
+		}
+		if got := conf.AxisValue(state, StickAxes[tc.st]); got != tc.wantAxis {
+			t.Errorf("AxisValue(%s) = %v, want %v", AxisNames[StickAxes[tc.st]], got, tc.wantAxis)
+		}
+	}
+
+	// axes which are unmapped or out of range read as centred rather than panicking
+	bad := ConfigT{Axes: []int{AxLeftX: -1, AxLeftY: 1}}
+	if got := RawStick(&bad, state, StLx); got != 0 {
+		t.Errorf("RawStick of a negative axis = %v, want 0", got)
+	}
+	if got := RawStick(&bad, state, StRy); got != 0 {
+		t.Errorf("RawStick of an unmapped function = %v, want 0", got)
+	}
+	for _, ax := range []int{AxLeftX, AxRightY, -1, AxCount} {
+		if got := bad.AxisValue(state, ax); got != 0 {
+			t.Errorf("AxisValue(%d) = %v, want 0", ax, got)
+		}
+	}
+}
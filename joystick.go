@@ -11,318 +11,25 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"runtime"
 	"time"
 
+	"github.com/SMerrony/tellodesk/joymap"
+	"github.com/mattn/go-gtk/glib"
 	"github.com/mattn/go-gtk/gtk"
 
 	"github.com/Anty0/tello"
 	"github.com/simulatedsimian/joystick"
 )
 
-const (
-	//typeJoystick = iota
-	typeGameController = iota
-	typeFlightController
-)
-
-const (
-	axLeftX = iota
-	axLeftY
-	axRightX
-	axRightY
-
-	axSlowMode
-
-	axFlipX
-	axFlipY
-)
-
-const (
-	btnTakeoff = iota
-	btnLand
-	btnTakePhoto
-	btnSetHome
-	btnReturnHome
-	btnCancelAuto
-
-	btnThrowPalm
-
-	btnSlowMode
-
-	btnFlightModeSlow
-	btnFlightModeFast
-
-	btnFlipForward
-	btnFlipBackward
-	btnFlipLeft
-	btnFlipRight
-
-	btnStatsPage
-	btnTrackChartPage
-	btnProfileChartPage
-)
-
-const (
-	ftHasThrowPalmButton = iota
-	ftHasSlowModeButton
-	ftHasSlowModeAxes
-	ftHasFlightSpeedButtons
-	ftHasFlipButtons
-	ftHasFlipAxes
-	ftHasPageSwitchButtons
-)
-
-const (
-	deadZone = 2000
-	maxZone  = 16000
-	maxVal   = 32767
-)
+const maxVal = 32767
 
 const jsUpdatePeriod = 20 * time.Millisecond // 40ms = 25Hz
 
-// JoystickConfig holds a known joystick configuration
-type JoystickConfig struct {
-	Name     string
-	JsType   int
-	Axes     []int  // must have left and right X & Y entries
-	Buttons  []uint // must have an entry for each define btn??? const
-	Features []bool
-}
-
 var (
-	js                    joystick.Joystick
-	jsID                  int
-	jsConfig              JoystickConfig
-	jsKnownWindowsConfigs = []JoystickConfig{
-		JoystickConfig{
-			Name:   "DualShock 3", // TODO - Untested
-			JsType: typeGameController,
-			Axes:   []int{axLeftX: 0, axLeftY: 1, axRightX: 2, axRightY: 3},
-			//Buttons: []uint{btnCross: 1, btnCircle: 2, btnTriangle: 3, btnSquare: 0, btnL1: 4, btnL2: 6, btnR1: 5, btnR2: 7},
-			Buttons:  []uint{btnLand: 1, btnTakeoff: 3, btnTakePhoto: 0, btnSetHome: 4, btnReturnHome: 5, btnCancelAuto: 11},
-			Features: []bool{ftHasThrowPalmButton: false, ftHasSlowModeButton: false, ftHasSlowModeAxes: false, ftHasFlightSpeedButtons: false, ftHasFlipButtons: false, ftHasFlipAxes: false, ftHasPageSwitchButtons: false},
-		},
-		JoystickConfig{
-			Name:   "DualShock 4",
-			JsType: typeGameController,
-			Axes:   []int{axLeftX: 0, axLeftY: 1, axRightX: 2, axRightY: 3},
-			//Buttons: []uint{btnCross: 1, btnCircle: 2, btnTriangle: 3, btnSquare: 0, btnL1: 4, btnL2: 6, btnR1: 5, btnR2: 7},
-			Buttons:  []uint{btnLand: 1, btnTakeoff: 3, btnTakePhoto: 0, btnSetHome: 4, btnReturnHome: 5, btnCancelAuto: 11},
-			Features: []bool{ftHasThrowPalmButton: false, ftHasSlowModeButton: false, ftHasSlowModeAxes: false, ftHasFlightSpeedButtons: false, ftHasFlipButtons: false, ftHasFlipAxes: false, ftHasPageSwitchButtons: false},
-		},
-		JoystickConfig{
-			Name:   "T-Flight Hotas X",
-			JsType: typeFlightController,
-			Axes:   []int{axLeftX: 4, axLeftY: 2, axRightX: 0, axRightY: 1},
-			//Buttons: []uint{btnR1: 0, btnL1: 1, btnR3: 2, btnL3: 3, btnSquare: 4, btnCross: 5, btnCircle: 6, btnTriangle: 7, btnR2: 8, btnL2: 9},
-			Buttons:  []uint{btnTakePhoto: 4, btnLand: 5, btnTakeoff: 7, btnSetHome: 1, btnReturnHome: 0, btnCancelAuto: 12},
-			Features: []bool{ftHasThrowPalmButton: false, ftHasSlowModeButton: false, ftHasSlowModeAxes: false, ftHasFlightSpeedButtons: false, ftHasFlipButtons: false, ftHasFlipAxes: false, ftHasPageSwitchButtons: false},
-		},
-		JoystickConfig{
-			Name:     "XBox 360", // TODO - Untested
-			JsType:   typeGameController,
-			Axes:     []int{axLeftX: 0, axLeftY: 1, axRightX: 4, axRightY: 5},
-			Buttons:  []uint{btnLand: 2, btnTakeoff: 3, btnTakePhoto: 0, btnSetHome: 4, btnReturnHome: 5, btnCancelAuto: 9},
-			Features: []bool{ftHasThrowPalmButton: false, ftHasSlowModeButton: false, ftHasSlowModeAxes: false, ftHasFlightSpeedButtons: false, ftHasFlipButtons: false, ftHasFlipAxes: false, ftHasPageSwitchButtons: false},
-		},
-	}
-	jsKnownLinuxConfigs = []JoystickConfig{
-		JoystickConfig{
-			Name:     "DualShock 4",
-			JsType:   typeGameController,
-			Axes:     []int{axLeftX: 0, axLeftY: 1, axRightX: 3, axRightY: 4},
-			Buttons:  []uint{btnLand: 0, btnTakeoff: 2, btnTakePhoto: 3, btnSetHome: 4, btnReturnHome: 5, btnCancelAuto: 11},
-			Features: []bool{ftHasThrowPalmButton: false, ftHasSlowModeButton: false, ftHasSlowModeAxes: false, ftHasFlightSpeedButtons: false, ftHasFlipButtons: false, ftHasFlipAxes: false, ftHasPageSwitchButtons: false},
-		},
-		JoystickConfig{
-			Name:     "T-Flight Hotas X", // Seeems to be the same on Linux and Windows
-			JsType:   typeFlightController,
-			Axes:     []int{axLeftX: 4, axLeftY: 2, axRightX: 0, axRightY: 1},
-			Buttons:  []uint{btnTakePhoto: 4, btnLand: 5, btnTakeoff: 7, btnSetHome: 1, btnReturnHome: 0, btnCancelAuto: 12},
-			Features: []bool{ftHasThrowPalmButton: false, ftHasSlowModeButton: false, ftHasSlowModeAxes: false, ftHasFlightSpeedButtons: false, ftHasFlipButtons: false, ftHasFlipAxes: false, ftHasPageSwitchButtons: false},
-		},
-		JoystickConfig{
-			Name:     "XBox 360", // TODO - Untested
-			JsType:   typeGameController,
-			Axes:     []int{axLeftX: 0, axLeftY: 1, axRightX: 4, axRightY: 5},
-			Buttons:  []uint{btnLand: 2, btnTakeoff: 3, btnTakePhoto: 0, btnSetHome: 4, btnReturnHome: 5, btnCancelAuto: 10},
-			Features: []bool{ftHasThrowPalmButton: false, ftHasSlowModeButton: false, ftHasSlowModeAxes: false, ftHasFlightSpeedButtons: false, ftHasFlipButtons: false, ftHasFlipAxes: false, ftHasPageSwitchButtons: false},
-		},
-		JoystickConfig{
-			Name:   "Steam Controller (Linux kernel driver)", // Steam Controller mapping tested with Linux kernel driver added in Linux 4.18.
-			JsType: typeGameController,
-			Axes:   []int{axLeftX: 2, axLeftY: 3, axRightX: 0, axRightY: 1}, // This controller has only single stick, so this mapping maps right stick on left (real) stick.
-			Buttons: []uint{
-				btnLand:       2,  // A
-				btnTakeoff:    5,  // Y
-				btnTakePhoto:  3,  // B
-				btnSetHome:    10, // Select
-				btnReturnHome: 12, // Home
-				btnCancelAuto: 11, // Start
-
-				btnThrowPalm: 4, // X
-
-				btnSlowMode: 9, // R2
-
-				btnFlightModeSlow: 6, // L1
-				btnFlightModeFast: 7, // R1
-
-				btnFlipForward:  17, // D-Up
-				btnFlipBackward: 18, // D-Down
-				btnFlipLeft:     19, // D-Left
-				btnFlipRight:    20, // D-Right
-
-				btnStatsPage:        8,  // L2
-				btnTrackChartPage:   16, // BackR
-				btnProfileChartPage: 15, // BackL
-
-				// R3       = 14
-				// L3       = 13
-				// D-Touch  =  0
-				// R3-Touch =  1
-			},
-			Features: []bool{
-				ftHasThrowPalmButton:    true,
-				ftHasSlowModeButton:     true,
-				ftHasSlowModeAxes:       false,
-				ftHasFlightSpeedButtons: true,
-				ftHasFlipButtons:        true,
-				ftHasFlipAxes:           false,
-				ftHasPageSwitchButtons:  true,
-			},
-		},
-		JoystickConfig{
-			Name:   "EVOLVEO Fighter F1 (Cable connection)",
-			JsType: typeGameController,
-			Axes: []int{
-				axLeftX:  0,
-				axLeftY:  1,
-				axRightX: 3,
-				axRightY: 4,
-
-				axSlowMode: 5,
-
-				axFlipX: 6,
-				axFlipY: 7,
-
-				// axL2 = 2
-			},
-			Buttons: []uint{
-				btnLand:       0,  // A
-				btnTakeoff:    3,  // Y
-				btnTakePhoto:  1,  // B
-				btnSetHome:    6,  // Select
-				btnReturnHome: 7,  // Start
-				btnCancelAuto: 10, // R3
-
-				btnThrowPalm: 2, // X
-
-				btnFlightModeSlow: 4, // L1
-				btnFlightModeFast: 5, // R1
-
-				// L3      =  9
-			},
-			Features: []bool{
-				ftHasThrowPalmButton:    true,
-				ftHasSlowModeButton:     false,
-				ftHasSlowModeAxes:       true,
-				ftHasFlightSpeedButtons: true,
-				ftHasFlipButtons:        false,
-				ftHasFlipAxes:           true,
-				ftHasPageSwitchButtons:  false,
-			},
-		},
-		JoystickConfig{
-			Name:   "EVOLVEO Fighter F1 (Wireless connection in Windows, Android or PS3 mode)",
-			JsType: typeGameController,
-			Axes: []int{
-				axLeftX:  0,
-				axLeftY:  1,
-				axRightX: 3,
-				axRightY: 4,
-
-				axSlowMode: 5,
-
-				// axL2 = 2
-			},
-			Buttons: []uint{
-				btnLand:       0,  // A
-				btnTakeoff:    2,  // Y
-				btnTakePhoto:  1,  // B
-				btnSetHome:    8,  // Select
-				btnReturnHome: 10, // Home
-				btnCancelAuto: 9,  // Start
-
-				btnThrowPalm: 3, // X
-
-				btnFlightModeSlow: 4, // L1
-				btnFlightModeFast: 5, // R1
-
-				btnFlipForward:  13, // D-Up
-				btnFlipBackward: 14, // D-Down
-				btnFlipLeft:     15, // D-Left
-				btnFlipRight:    16, // D-Right
-
-				// R3      = 12
-				// L3      = 11
-				// R2      =  7
-				// L2      =  6
-			},
-			Features: []bool{
-				ftHasThrowPalmButton:    true,
-				ftHasSlowModeButton:     false,
-				ftHasSlowModeAxes:       true,
-				ftHasFlightSpeedButtons: true,
-				ftHasFlipButtons:        true,
-				ftHasFlipAxes:           false,
-				ftHasPageSwitchButtons:  false,
-			},
-		},
-		JoystickConfig{
-			Name:   "EVOLVEO Fighter F1 (Bluetooth wireless connection in Android mode)",
-			JsType: typeGameController,
-			Axes: []int{
-				axLeftX:  0,
-				axLeftY:  1,
-				axRightX: 2,
-				axRightY: 3,
-
-				axSlowMode: 4,
-
-				axFlipX: 6,
-				axFlipY: 7,
-
-				// axL2 = 5
-			},
-			Buttons: []uint{
-				btnLand:       0,  // A
-				btnTakeoff:    4,  // Y
-				btnTakePhoto:  1,  // B
-				btnSetHome:    10, // Select
-				btnReturnHome: 11, // Start
-				btnCancelAuto: 14, // R3
-
-				btnThrowPalm: 3, // X
-
-				btnFlightModeSlow: 6, // L1
-				btnFlightModeFast: 7, // R1
-
-				// L3      = 13
-				// R2      =  9
-				// L2      =  8
-			},
-			Features: []bool{
-				ftHasThrowPalmButton:    true,
-				ftHasSlowModeButton:     false,
-				ftHasSlowModeAxes:       true,
-				ftHasFlightSpeedButtons: true,
-				ftHasFlipButtons:        false,
-				ftHasFlipAxes:           true,
-				ftHasPageSwitchButtons:  false,
-			},
-		},
-	}
+	js        joystick.Joystick
+	jsID      int
+	jsConfig  joymap.ConfigT
+	jsProfile joymap.ProfileT
 )
 
 // FoundJs holds one of the discovered joysticks
@@ -353,19 +60,14 @@ func listJoysticks() (found []*FoundJs) {
 type KnownJs struct {
 	ID   int
 	Name string
-	Conf JoystickConfig
+	Conf joymap.ConfigT
 }
 
+// listKnownJoystickTypes returns the built-in configurations for this OS merged with
+// any user-defined ones found in the data directory.
 func listKnownJoystickTypes() (known []*KnownJs) {
-	switch runtime.GOOS {
-	case "windows":
-		for jsid, config := range jsKnownWindowsConfigs {
-			known = append(known, &KnownJs{jsid, config.Name, config})
-		}
-	case "linux":
-		for jsid, config := range jsKnownLinuxConfigs {
-			known = append(known, &KnownJs{jsid, config.Name, config})
-		}
+	for jsid, config := range joymap.MergeConfigs(joymap.BuiltInConfigs(), joymap.LoadUserConfigs(settings.DataDir)) {
+		known = append(known, &KnownJs{jsid, config.Name, config})
 	}
 	return known
 }
@@ -373,13 +75,19 @@ func listKnownJoystickTypes() (known []*KnownJs) {
 func openJoystick(id int, chosenType string) (err error) {
 
 	kt := listKnownJoystickTypes()
+	found := false
 	for _, t := range kt {
 		if t.Name == chosenType {
 			jsConfig = t.Conf
+			jsProfile = settings.stickProfile(t.Name)
+			found = true
 			fmt.Printf("Debug: Joystick type set to: %s\n", jsConfig.Name)
 			break
 		}
 	}
+	if !found { // eg. a user-defined configuration has been removed
+		return errors.New("Unknown Joystick type: " + chosenType)
+	}
 
 	js, err = joystick.Open(id)
 	if err != nil {
@@ -390,17 +98,11 @@ func openJoystick(id int, chosenType string) (err error) {
 	return nil
 }
 
-func intAbs(x int16) int16 {
-	if x < 0 {
-		return -x
-	}
-	return x
-}
-
 // readJoystick is run as a Goroutine
 func readJoystick(test bool) {
 	var (
 		sm                 tello.StickMessage
+		stickVals          [joymap.StCount]float64
 		jsState, prevState joystick.State
 		err                error
 
@@ -420,155 +122,95 @@ func readJoystick(test bool) {
 			return
 		}
 
-		if jsState.AxisData[jsConfig.Axes[axLeftX]] == 32768 {
-			sm.Lx = maxVal
-		} else {
-			sm.Lx = int16(jsState.AxisData[jsConfig.Axes[axLeftX]])
+		// shape each stick according to the user's response settings for this joystick type
+		for st := range stickVals {
+			stickVals[st] = jsProfile.Axes[st].Apply(joymap.RawStick(&jsConfig, jsState, st))
 		}
 
-		if jsState.AxisData[jsConfig.Axes[axLeftY]] == 32768 {
-			sm.Ly = -maxVal
-		} else {
-			sm.Ly = -int16(jsState.AxisData[jsConfig.Axes[axLeftY]])
-		}
-
-		if jsState.AxisData[jsConfig.Axes[axRightX]] == 32768 {
-			sm.Rx = maxVal
-		} else {
-			sm.Rx = int16(jsState.AxisData[jsConfig.Axes[axRightX]])
-		}
-
-		if jsState.AxisData[jsConfig.Axes[axRightY]] == 32768 {
-			sm.Ry = -maxVal
-		} else {
-			sm.Ry = -int16(jsState.AxisData[jsConfig.Axes[axRightY]])
-		}
-
-		// zero out values in dead zone
-		if intAbs(sm.Lx) < deadZone {
-			sm.Lx = 0
-		}
-		if intAbs(sm.Ly) < deadZone {
-			sm.Ly = 0
-		}
-		if intAbs(sm.Rx) < deadZone {
-			sm.Rx = 0
-		}
-		if intAbs(sm.Ry) < deadZone {
-			sm.Ry = 0
-		}
-
-		if jsConfig.Features[ftHasSlowModeAxes] {
-			divider := (float32(jsState.AxisData[jsConfig.Axes[axSlowMode]]) / float32(maxVal)) + 2.0
-			sm.Lx = int16(float32(sm.Lx) / divider)
-			sm.Ly = int16(float32(sm.Ly) / divider)
-			sm.Rx = int16(float32(sm.Rx) / divider)
-			sm.Ry = int16(float32(sm.Ry) / divider)
-		} else if jsConfig.Features[ftHasSlowModeButton] && jsState.Buttons&(1<<jsConfig.Buttons[btnSlowMode]) != 0 {
-			sm.Lx /= 3
-			sm.Ly /= 3
-			sm.Rx /= 3
-			sm.Ry /= 3
-		}
-
-		if sm.Lx > maxZone {
-			sm.Lx = maxVal
-		}
-		if sm.Lx < -maxZone {
-			sm.Lx = -maxVal
-		}
-
-		if sm.Ly > maxZone {
-			sm.Ly = maxVal
-		}
-		if sm.Ly < -maxZone {
-			sm.Ly = -maxVal
-		}
-
-		if sm.Rx > maxZone {
-			sm.Rx = maxVal
-		}
-		if sm.Rx < -maxZone {
-			sm.Rx = -maxVal
-		}
-
-		if sm.Ry > maxZone {
-			sm.Ry = maxVal
-		}
-		if sm.Ry < -maxZone {
-			sm.Ry = -maxVal
+		scale := float64(maxVal)
+		if jsConfig.Features[joymap.FtHasSlowModeAxes] {
+			scale /= (float64(jsConfig.AxisValue(jsState, joymap.AxSlowMode)) / maxVal) + 2.0
+		} else if jsConfig.Features[joymap.FtHasSlowModeButton] && jsState.Buttons&(1<<jsConfig.Buttons[joymap.BtnSlowMode]) != 0 {
+			scale /= 3
 		}
+		sm.Lx = int16(stickVals[joymap.StLx] * scale)
+		sm.Ly = int16(stickVals[joymap.StLy] * scale)
+		sm.Rx = int16(stickVals[joymap.StRx] * scale)
+		sm.Ry = int16(stickVals[joymap.StRy] * scale)
 
 		if test {
-			log.Printf("JS: Lx: %d, Ly: %d, Rx: %d=>%d, Ry: %d\n", sm.Lx, sm.Ly, jsState.AxisData[jsConfig.Axes[axRightX]], sm.Rx, sm.Ry)
-		} else {
-			stickChan <- sm
+			log.Printf("JS: Lx: %d, Ly: %d, Rx: %d=>%d, Ry: %d\n", sm.Lx, sm.Ly, jsConfig.AxisValue(jsState, joymap.AxRightX), sm.Rx, sm.Ry)
+		} else if !sticksClaimed() {
+			stickChan <- fenceGuard.limit(sm)
 
 			newUpdateTime := time.Now().UnixNano()
 			if newUpdateTime-updateTime > (int64)(jsUpdatePeriod*3) {
 				log.Println("WARNING: Long control delay detected!")
 			}
 			updateTime = newUpdateTime
+		} else {
+			pilotOverride(sm)
 		}
 
-		if jsState.Buttons&(1<<jsConfig.Buttons[btnTakePhoto]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[btnTakePhoto]) == 0 {
+		if jsState.Buttons&(1<<jsConfig.Buttons[joymap.BtnTakePhoto]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[joymap.BtnTakePhoto]) == 0 {
 			if test {
 				log.Println("Take photo button pressed")
 			} else {
-				drone.TakePicture()
+				takePhotoCB()
 			}
 		}
-		if jsState.Buttons&(1<<jsConfig.Buttons[btnTakeoff]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[btnTakeoff]) == 0 {
+		if jsState.Buttons&(1<<jsConfig.Buttons[joymap.BtnTakeoff]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[joymap.BtnTakeoff]) == 0 {
 			if test {
 				log.Println("Takeoff button pressed")
 			} else {
-				drone.TakeOff()
+				glib.IdleAdd(func() bool { preflightTakeoff(false, "joystick"); return false })
 			}
 		}
-		if jsState.Buttons&(1<<jsConfig.Buttons[btnLand]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[btnLand]) == 0 {
+		if jsState.Buttons&(1<<jsConfig.Buttons[joymap.BtnLand]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[joymap.BtnLand]) == 0 {
 			if test {
 				log.Println("Land button button pressed")
 			} else {
 				drone.Land()
 			}
 		}
-		if jsState.Buttons&(1<<jsConfig.Buttons[btnSetHome]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[btnSetHome]) == 0 {
+		if jsState.Buttons&(1<<jsConfig.Buttons[joymap.BtnSetHome]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[joymap.BtnSetHome]) == 0 {
 			if test {
 				log.Println("Set home button pressed")
 			} else {
-				drone.SetHome()
-				menuBar.goHomeItem.SetSensitive(true)
+				setHomeCB()
 			}
 		}
-		if jsState.Buttons&(1<<jsConfig.Buttons[btnReturnHome]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[btnReturnHome]) == 0 {
+		if jsState.Buttons&(1<<jsConfig.Buttons[joymap.BtnReturnHome]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[joymap.BtnReturnHome]) == 0 {
 			if test {
 				log.Println("Return home button pressed")
 			} else {
 				drone.AutoFlyToXY(0, 0)
 			}
 		}
-		if jsState.Buttons&(1<<jsConfig.Buttons[btnCancelAuto]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[btnCancelAuto]) == 0 {
+		if jsState.Buttons&(1<<jsConfig.Buttons[joymap.BtnCancelAuto]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[joymap.BtnCancelAuto]) == 0 {
 			if test {
 				log.Println("Cancel return home button pressed")
 			} else {
+				failsafe.override()
+				scripter.abort()
 				drone.CancelAutoFlyToXY()
 			}
 		}
 
-		if jsConfig.Features[ftHasThrowPalmButton] && jsState.Buttons&(1<<jsConfig.Buttons[btnThrowPalm]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[btnThrowPalm]) == 0 {
+		if jsConfig.Features[joymap.FtHasThrowPalmButton] && jsState.Buttons&(1<<jsConfig.Buttons[joymap.BtnThrowPalm]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[joymap.BtnThrowPalm]) == 0 {
 			if test {
 				log.Println("Throw takeoff/Palm landing button pressed")
 			} else {
 				if drone.GetFlightData().Flying {
 					drone.PalmLand()
 				} else {
-					drone.ThrowTakeOff()
+					glib.IdleAdd(func() bool { preflightTakeoff(true, "joystick"); return false })
 				}
 			}
 		}
 
-		if jsConfig.Features[ftHasFlightSpeedButtons] {
-			if jsState.Buttons&(1<<jsConfig.Buttons[btnFlightModeSlow]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[btnFlightModeSlow]) == 0 {
+		if jsConfig.Features[joymap.FtHasFlightSpeedButtons] {
+			if jsState.Buttons&(1<<jsConfig.Buttons[joymap.BtnFlightModeSlow]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[joymap.BtnFlightModeSlow]) == 0 {
 				if test {
 					log.Println("Set slow flight mode button pressed")
 				} else {
@@ -576,7 +218,7 @@ func readJoystick(test bool) {
 					menuBar.sportsModeItem.SetActive(false)
 				}
 			}
-			if jsState.Buttons&(1<<jsConfig.Buttons[btnFlightModeFast]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[btnFlightModeFast]) == 0 {
+			if jsState.Buttons&(1<<jsConfig.Buttons[joymap.BtnFlightModeFast]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[joymap.BtnFlightModeFast]) == 0 {
 				if test {
 					log.Println("Set fast flight mode button pressed")
 				} else {
@@ -586,38 +228,38 @@ func readJoystick(test bool) {
 			}
 		}
 
-		if jsConfig.Features[ftHasFlipButtons] {
-			if jsState.Buttons&(1<<jsConfig.Buttons[btnFlipForward]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[btnFlipForward]) == 0 {
+		if jsConfig.Features[joymap.FtHasFlipButtons] {
+			if jsState.Buttons&(1<<jsConfig.Buttons[joymap.BtnFlipForward]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[joymap.BtnFlipForward]) == 0 {
 				if test {
 					log.Println("Flip forward button pressed")
 				} else {
 					drone.ForwardFlip()
 				}
 			}
-			if jsState.Buttons&(1<<jsConfig.Buttons[btnFlipBackward]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[btnFlipBackward]) == 0 {
+			if jsState.Buttons&(1<<jsConfig.Buttons[joymap.BtnFlipBackward]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[joymap.BtnFlipBackward]) == 0 {
 				if test {
 					log.Println("Flip backward button pressed")
 				} else {
 					drone.BackFlip()
 				}
 			}
-			if jsState.Buttons&(1<<jsConfig.Buttons[btnFlipLeft]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[btnFlipLeft]) == 0 {
+			if jsState.Buttons&(1<<jsConfig.Buttons[joymap.BtnFlipLeft]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[joymap.BtnFlipLeft]) == 0 {
 				if test {
 					log.Println("Flip left button pressed")
 				} else {
 					drone.LeftFlip()
 				}
 			}
-			if jsState.Buttons&(1<<jsConfig.Buttons[btnFlipRight]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[btnFlipRight]) == 0 {
+			if jsState.Buttons&(1<<jsConfig.Buttons[joymap.BtnFlipRight]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[joymap.BtnFlipRight]) == 0 {
 				if test {
 					log.Println("Flip right button pressed")
 				} else {
 					drone.RightFlip()
 				}
 			}
-		} else if jsConfig.Features[ftHasFlipAxes] && len(prevState.AxisData) != 0 { // Make sure, that this is not the first loop.
-			flipX := jsState.AxisData[jsConfig.Axes[axFlipX]]
-			flipY := jsState.AxisData[jsConfig.Axes[axFlipY]]
+		} else if jsConfig.Features[joymap.FtHasFlipAxes] && len(prevState.AxisData) != 0 { // Make sure, that this is not the first loop.
+			flipX := jsConfig.AxisValue(jsState, joymap.AxFlipX)
+			flipY := jsConfig.AxisValue(jsState, joymap.AxFlipY)
 			trashold := maxVal / 2
 
 			if flipY < -trashold && prevFlipY >= -trashold {
@@ -653,40 +295,40 @@ func readJoystick(test bool) {
 			prevFlipY = flipY
 		}
 
-		if jsConfig.Features[ftHasPageSwitchButtons] {
-			if jsState.Buttons&(1<<jsConfig.Buttons[btnStatsPage]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[btnStatsPage]) == 0 {
+		if jsConfig.Features[joymap.FtHasPageSwitchButtons] {
+			if jsState.Buttons&(1<<jsConfig.Buttons[joymap.BtnStatsPage]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[joymap.BtnStatsPage]) == 0 {
 				if test {
 					log.Println("Stats page button pressed")
 				} else {
 					notebook.SetCurrentPage(statusPage)
 				}
-			} else if jsState.Buttons&(1<<jsConfig.Buttons[btnStatsPage]) == 0 && prevState.Buttons&(1<<jsConfig.Buttons[btnStatsPage]) != 0 {
+			} else if jsState.Buttons&(1<<jsConfig.Buttons[joymap.BtnStatsPage]) == 0 && prevState.Buttons&(1<<jsConfig.Buttons[joymap.BtnStatsPage]) != 0 {
 				if test {
 					log.Println("Stats page button released")
 				} else {
 					notebook.SetCurrentPage(videoPage)
 				}
 			}
-			if jsState.Buttons&(1<<jsConfig.Buttons[btnTrackChartPage]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[btnTrackChartPage]) == 0 {
+			if jsState.Buttons&(1<<jsConfig.Buttons[joymap.BtnTrackChartPage]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[joymap.BtnTrackChartPage]) == 0 {
 				if test {
 					log.Println("Track chart page button pressed")
 				} else {
 					notebook.SetCurrentPage(trackPage)
 				}
-			} else if jsState.Buttons&(1<<jsConfig.Buttons[btnTrackChartPage]) == 0 && prevState.Buttons&(1<<jsConfig.Buttons[btnTrackChartPage]) != 0 {
+			} else if jsState.Buttons&(1<<jsConfig.Buttons[joymap.BtnTrackChartPage]) == 0 && prevState.Buttons&(1<<jsConfig.Buttons[joymap.BtnTrackChartPage]) != 0 {
 				if test {
 					log.Println("Track chart page button released")
 				} else {
 					notebook.SetCurrentPage(videoPage)
 				}
 			}
-			if jsState.Buttons&(1<<jsConfig.Buttons[btnProfileChartPage]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[btnProfileChartPage]) == 0 {
+			if jsState.Buttons&(1<<jsConfig.Buttons[joymap.BtnProfileChartPage]) != 0 && prevState.Buttons&(1<<jsConfig.Buttons[joymap.BtnProfileChartPage]) == 0 {
 				if test {
 					log.Println("Profile chart page button pressed")
 				} else {
 					notebook.SetCurrentPage(profilePage)
 				}
-			} else if jsState.Buttons&(1<<jsConfig.Buttons[btnProfileChartPage]) == 0 && prevState.Buttons&(1<<jsConfig.Buttons[btnProfileChartPage]) != 0 {
+			} else if jsState.Buttons&(1<<jsConfig.Buttons[joymap.BtnProfileChartPage]) == 0 && prevState.Buttons&(1<<jsConfig.Buttons[joymap.BtnProfileChartPage]) != 0 {
 				if test {
 					log.Println("Profile chart page button released")
 				} else {
@@ -0,0 +1,261 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/SMerrony/tellodesk/joymap"
+	"github.com/mattn/go-gtk/glib"
+	"github.com/mattn/go-gtk/gtk"
+	"github.com/simulatedsimian/joystick"
+)
+
+const (
+	wizPollMs       = 50
+	wizAxisTrigger  = 20000 // movement from rest needed to select an axis
+	wizAxisReleased = 8000  // axes must return this close to rest before the next step
+)
+
+// jsWizardStepT is one prompt of the joystick mapping wizard.
+type jsWizardStepT struct {
+	isAxis   bool
+	fn       int // the joymap.Ax??? or joymap.Btn??? function being mapped
+	prompt   string
+	optional bool
+	wantNeg  bool // axes only: the raw reading normally goes negative in the prompted direction
+}
+
+var jsWizardSteps = []jsWizardStepT{
+	{isAxis: true, fn: joymap.AxLeftX, prompt: "Move the stick for LEFT/RIGHT fully to the RIGHT"},
+	{isAxis: true, fn: joymap.AxLeftY, prompt: "Move the stick for FORWARDS/BACKWARDS fully FORWARDS", wantNeg: true},
+	{isAxis: true, fn: joymap.AxRightX, prompt: "Move the stick for TURNING fully to the RIGHT"},
+	{isAxis: true, fn: joymap.AxRightY, prompt: "Move the stick for UP/DOWN fully UP", wantNeg: true},
+	{isAxis: true, fn: joymap.AxSlowMode, prompt: "Move the SLOW MODE control (eg. a trigger) fully to SLOW", optional: true},
+	{isAxis: true, fn: joymap.AxFlipX, prompt: "Move the FLIP control (eg. a D-pad) to flip RIGHT", optional: true},
+	{isAxis: true, fn: joymap.AxFlipY, prompt: "Move the FLIP control to flip FORWARDS", optional: true, wantNeg: true},
+	{fn: joymap.BtnTakeoff, prompt: "Press the button for Take-off"},
+	{fn: joymap.BtnLand, prompt: "Press the button for Land"},
+	{fn: joymap.BtnTakePhoto, prompt: "Press the button for Take Photo"},
+	{fn: joymap.BtnSetHome, prompt: "Press the button for Set Home"},
+	{fn: joymap.BtnReturnHome, prompt: "Press the button for Return to Home"},
+	{fn: joymap.BtnCancelAuto, prompt: "Press the button for Cancel Auto-Flight"},
+	{fn: joymap.BtnThrowPalm, prompt: "Press the button for Throw Take-off/Palm Land", optional: true},
+	{fn: joymap.BtnSlowMode, prompt: "Press the button for Slow Mode (held)", optional: true},
+	{fn: joymap.BtnFlightModeSlow, prompt: "Press the button for Slow Flight Mode", optional: true},
+	{fn: joymap.BtnFlightModeFast, prompt: "Press the button for Fast (Sports) Flight Mode", optional: true},
+	{fn: joymap.BtnFlipForward, prompt: "Press the button for Flip Forwards", optional: true},
+	{fn: joymap.BtnFlipBackward, prompt: "Press the button for Flip Backwards", optional: true},
+	{fn: joymap.BtnFlipLeft, prompt: "Press the button for Flip Left", optional: true},
+	{fn: joymap.BtnFlipRight, prompt: "Press the button for Flip Right", optional: true},
+	{fn: joymap.BtnStatsPage, prompt: "Press the button to show the Status page", optional: true},
+	{fn: joymap.BtnTrackChartPage, prompt: "Press the button to show the Tracker page", optional: true},
+	{fn: joymap.BtnProfileChartPage, prompt: "Press the button to show the Profile page", optional: true},
+}
+
+func axisAbs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// jsWizardCB walks the user through mapping every joystick function for joystick jsid.
+// The resulting configuration is saved in the data directory and its name returned,
+// ok is false if the wizard was cancelled or the configuration could not be saved.
+func jsWizardCB(jsid int) (name string, ok bool) {
+	wjs, err := joystick.Open(jsid)
+	if err != nil {
+		messageDialog(win, gtk.MESSAGE_ERROR, "Could not open the selected joystick.")
+		return "", false
+	}
+	defer wjs.Close()
+
+	conf := joymap.ConfigT{
+		JsType:   joymap.TypeGameController,
+		Axes:     make([]int, joymap.AxCount),
+		Buttons:  make([]uint, joymap.BtnCount),
+		Inverted: make([]bool, joymap.AxCount),
+	}
+	axMapped := make([]bool, joymap.AxCount)
+	btnMapped := make([]bool, joymap.BtnCount)
+
+	wd := gtk.NewDialog()
+	wd.SetTitle(appName + " Joystick Mapping Wizard")
+	wd.SetIcon(iconPixbuf)
+	wd.SetPosition(gtk.WIN_POS_CENTER_ON_PARENT)
+	vbox := wd.GetVBox()
+
+	stepLab := gtk.NewLabel("")
+	vbox.PackStart(stepLab, false, false, 2)
+	promptLab := gtk.NewLabel("")
+	promptLab.ModifyFontEasy("Sans 14")
+	vbox.PackStart(promptLab, false, false, 10)
+
+	// live axis bars and buttons
+	axisBars := make([]*gtk.ProgressBar, wjs.AxisCount())
+	for i := range axisBars {
+		axisBars[i] = gtk.NewProgressBar()
+		vbox.PackStart(axisBars[i], false, false, 1)
+	}
+	btnLab := gtk.NewLabel("")
+	vbox.PackStart(btnLab, false, false, 5)
+
+	nameBox := gtk.NewHBox(false, 5)
+	nameBox.PackStart(gtk.NewLabel("Name :"), false, false, 2)
+	nameEntry := gtk.NewEntry()
+	nameEntry.SetText(wjs.Name())
+	nameEntry.SetWidthChars(40)
+	nameBox.PackStart(nameEntry, true, true, 2)
+	vbox.PackStart(nameBox, false, false, 5)
+	flightCtrl := gtk.NewCheckButtonWithLabel("Flight Controller (rather than Game Controller)")
+	vbox.PackStart(flightCtrl, false, false, 2)
+
+	skipBtn := wd.AddButton("Skip", gtk.RESPONSE_APPLY)
+	wd.AddButton("Cancel", gtk.RESPONSE_CANCEL)
+	saveBtn := wd.AddButton("Save", gtk.RESPONSE_OK)
+	saveBtn.SetSensitive(false)
+
+	var (
+		cur            int
+		rest           joystick.State
+		waitForRelease = true // take the first reading as the rest position
+		finished       bool
+		closed         bool
+	)
+
+	showStep := func() {
+		if cur >= len(jsWizardSteps) {
+			finished = true
+			stepLab.SetText("Mapping complete")
+			promptLab.SetText("Give the configuration a name and Save it")
+			skipBtn.SetSensitive(false)
+			saveBtn.SetSensitive(true)
+			return
+		}
+		step := jsWizardSteps[cur]
+		if step.optional {
+			stepLab.SetText(fmt.Sprintf("Step %d of %d (optional - Skip if not wanted)", cur+1, len(jsWizardSteps)))
+		} else {
+			stepLab.SetText(fmt.Sprintf("Step %d of %d", cur+1, len(jsWizardSteps)))
+		}
+		promptLab.SetText(step.prompt)
+		skipBtn.SetSensitive(step.optional)
+	}
+	showStep()
+
+	glib.TimeoutAdd(wizPollMs, func() bool {
+		if closed {
+			return false
+		}
+		state, err := wjs.Read()
+		if err != nil {
+			log.Printf("Error reading joystick: %v\n", err)
+			return true
+		}
+		for i, bar := range axisBars {
+			if i < len(state.AxisData) {
+				bar.SetFraction((float64(state.AxisData[i]) + 32768) / 65535)
+				bar.SetText(fmt.Sprintf("Axis %d: %d", i, state.AxisData[i]))
+			}
+		}
+		pressed := ""
+		for b := uint(0); b < 32; b++ {
+			if state.Buttons&(1<<b) != 0 {
+				pressed += fmt.Sprintf(" %d", b)
+			}
+		}
+		btnLab.SetText("Buttons pressed:" + pressed)
+
+		if waitForRelease {
+			if rest.AxisData != nil {
+				for i, v := range state.AxisData {
+					if i < len(rest.AxisData) && axisAbs(v-rest.AxisData[i]) > wizAxisReleased {
+						return true
+					}
+				}
+				if state.Buttons&^rest.Buttons != 0 {
+					return true
+				}
+			} else {
+				rest = state
+			}
+			waitForRelease = false
+			return true
+		}
+		if finished {
+			return true
+		}
+
+		step := jsWizardSteps[cur]
+		if step.isAxis {
+			bestAxis, bestDev := -1, 0
+			for i, v := range state.AxisData {
+				if i < len(rest.AxisData) && axisAbs(v-rest.AxisData[i]) > axisAbs(bestDev) {
+					bestAxis, bestDev = i, v-rest.AxisData[i]
+				}
+			}
+			if axisAbs(bestDev) < wizAxisTrigger {
+				return true
+			}
+			conf.Axes[step.fn] = bestAxis
+			conf.Inverted[step.fn] = (bestDev < 0) != step.wantNeg
+			axMapped[step.fn] = true
+		} else {
+			newBits := state.Buttons &^ rest.Buttons
+			if newBits == 0 {
+				return true
+			}
+			var b uint
+			for newBits&(1<<b) == 0 {
+				b++
+			}
+			conf.Buttons[step.fn] = b
+			btnMapped[step.fn] = true
+		}
+		cur++
+		waitForRelease = true
+		showStep()
+		return true
+	})
+
+	wd.ShowAll()
+	for {
+		response := wd.Run()
+		if response == gtk.RESPONSE_APPLY && !finished {
+			cur++
+			showStep()
+			continue
+		}
+		if response == gtk.RESPONSE_OK {
+			name = nameEntry.GetText()
+			if name == "" {
+				messageDialog(win, gtk.MESSAGE_ERROR, "Please give the configuration a name.")
+				continue
+			}
+			conf.Name = name
+			if flightCtrl.GetActive() {
+				conf.JsType = joymap.TypeFlightController
+			}
+			conf.Features = joymap.DeriveFeatures(axMapped, btnMapped)
+			filename := joymap.ConfigFilename(settings.DataDir, name)
+			if err := joymap.SaveConfig(conf, filename); err != nil {
+				log.Printf("Could not save joystick configuration: %v\n", err)
+				messageDialog(win, gtk.MESSAGE_ERROR, "Could not save joystick configuration.")
+				continue
+			}
+			log.Printf("Saved joystick configuration to %s\n", filename)
+			ok = true
+		}
+		break
+	}
+	closed = true
+	wd.Destroy()
+	return name, ok
+}
@@ -0,0 +1,350 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sync"
+	"text/tabwriter"
+	"time"
+	"unsafe"
+
+	"github.com/Anty0/tello"
+	"github.com/mattn/go-gtk/gdk"
+	"github.com/mattn/go-gtk/glib"
+	"github.com/mattn/go-gtk/gtk"
+)
+
+// kbRampTime is how long a key must be held for its stick to reach full deflection,
+// sticks return to centre twice as fast when the key is released.
+const kbRampTime = 500 * time.Millisecond
+
+// keyBindingsT holds the (GDK) names of the keys bound to each keyboard function
+type keyBindingsT struct {
+	Forward, Backward, Left, Right                 string // left stick
+	Up, Down, TurnLeft, TurnRight                  string // right stick
+	SlowMode                                       string // held
+	Takeoff, Land, TakePhoto                       string
+	SetHome, ReturnHome, CancelAuto                string
+	FlipForward, FlipBackward, FlipLeft, FlipRight string
+}
+
+var defaultKeyBindings = keyBindingsT{
+	Forward: "w", Backward: "s", Left: "a", Right: "d",
+	Up: "Up", Down: "Down", TurnLeft: "Left", TurnRight: "Right",
+	SlowMode: "Shift_L",
+	Takeoff:  "t", Land: "g", TakePhoto: "p",
+	SetHome: "Home", ReturnHome: "h", CancelAuto: "Escape",
+	FlipForward: "i", FlipBackward: "k", FlipLeft: "j", FlipRight: "l",
+}
+
+type keyActionT struct {
+	label string
+	key   *string
+}
+
+// actions lists every bindable function along with a pointer to its binding.
+func (kb *keyBindingsT) actions() []keyActionT {
+	return []keyActionT{
+		{"Forward", &kb.Forward},
+		{"Backward", &kb.Backward},
+		{"Left", &kb.Left},
+		{"Right", &kb.Right},
+		{"Up", &kb.Up},
+		{"Down", &kb.Down},
+		{"Turn Left", &kb.TurnLeft},
+		{"Turn Right", &kb.TurnRight},
+		{"Slow Mode (Hold)", &kb.SlowMode},
+		{"Take-off", &kb.Takeoff},
+		{"Land", &kb.Land},
+		{"Take Photo", &kb.TakePhoto},
+		{"Set Home", &kb.SetHome},
+		{"Return to Home", &kb.ReturnHome},
+		{"Cancel Auto-Flight", &kb.CancelAuto},
+		{"Flip Forward", &kb.FlipForward},
+		{"Flip Backward", &kb.FlipBackward},
+		{"Flip Left", &kb.FlipLeft},
+		{"Flip Right", &kb.FlipRight},
+	}
+}
+
+// setDefaults fills in any missing bindings, eg. after loading settings from an older version.
+func (kb *keyBindingsT) setDefaults() {
+	defs := defaultKeyBindings.actions()
+	for i, a := range kb.actions() {
+		if *a.key == "" {
+			*a.key = *defs[i].key
+		}
+	}
+}
+
+func (kb *keyBindingsT) isBound(name string) bool {
+	for _, a := range kb.actions() {
+		if *a.key == name {
+			return true
+		}
+	}
+	return false
+}
+
+// keyvalNames maps the GDK keyvals we accept for bindings to their GDK names.
+// Letters are always reported in lower case so that Shift may be used as a modifier.
+var keyvalNames = map[uint32]string{
+	0x0020: "space", 0xff08: "BackSpace", 0xff09: "Tab", 0xff0d: "Return", 0xff1b: "Escape",
+	0xff50: "Home", 0xff51: "Left", 0xff52: "Up", 0xff53: "Right", 0xff54: "Down",
+	0xff55: "Page_Up", 0xff56: "Page_Down", 0xff57: "End", 0xff63: "Insert", 0xffff: "Delete",
+	0xffe1: "Shift_L", 0xffe2: "Shift_R", 0xffe3: "Control_L", 0xffe4: "Control_R",
+	0xffe9: "Alt_L", 0xffea: "Alt_R",
+}
+
+func init() {
+	for c := 'a'; c <= 'z'; c++ {
+		keyvalNames[uint32(c)] = string(c)
+	}
+	for c := '0'; c <= '9'; c++ {
+		keyvalNames[uint32(c)] = string(c)
+		keyvalNames[0xffb0+uint32(c-'0')] = fmt.Sprintf("KP_%c", c)
+	}
+	for f := uint32(1); f <= 12; f++ {
+		keyvalNames[0xffbd+f] = fmt.Sprintf("F%d", f)
+	}
+}
+
+func keyName(keyval uint32) string {
+	if keyval >= 'A' && keyval <= 'Z' {
+		keyval += 'a' - 'A'
+	}
+	return keyvalNames[keyval]
+}
+
+var (
+	kbMu      sync.Mutex
+	kbPressed = map[string]bool{} // keyed by key name
+	kbActive  bool                // true while the keyboard is the flight controller
+)
+
+// keyEventCB is connected to the main window's key press and release events.  Bound keys
+// are consumed while keyboard control is active, anything else is passed on to GTK.
+func keyEventCB(ctx *glib.CallbackContext, pressed bool) bool {
+	if !kbActive {
+		return false
+	}
+	arg := ctx.Args(0)
+	kev := *(**gdk.EventKey)(unsafe.Pointer(&arg))
+	name := keyName(kev.Keyval)
+	if name == "" || !settings.KeyBindings.isBound(name) {
+		return false
+	}
+	kbMu.Lock()
+	wasPressed := kbPressed[name]
+	kbPressed[name] = pressed
+	kbMu.Unlock()
+	if pressed && !wasPressed { // ignore auto-repeat
+		keyActionCB(name)
+	}
+	return true
+}
+
+// keyReleaseAll forgets all held keys, eg. when the window loses focus and we
+// would never see the release events.
+func keyReleaseAll() {
+	kbMu.Lock()
+	kbPressed = map[string]bool{}
+	kbMu.Unlock()
+}
+
+// keyActionCB performs the one-shot functions bound to keys.
+func keyActionCB(name string) {
+	kb := &settings.KeyBindings
+	switch name {
+	case kb.Takeoff:
+		preflightTakeoff(false, "keyboard")
+	case kb.Land:
+		landCB()
+	case kb.TakePhoto:
+		takePhotoCB()
+	case kb.SetHome:
+		setHomeCB()
+	case kb.ReturnHome:
+		drone.AutoFlyToXY(0, 0)
+	case kb.CancelAuto:
+		failsafe.override()
+		scripter.abort()
+		drone.CancelAutoFlyToXY()
+	case kb.FlipForward:
+		drone.ForwardFlip()
+	case kb.FlipBackward:
+		drone.BackFlip()
+	case kb.FlipLeft:
+		drone.LeftFlip()
+	case kb.FlipRight:
+		drone.RightFlip()
+	}
+}
+
+// kbAxis returns the target value (-1, 0 or 1) of an axis driven by a pair of keys,
+// kbMu must be held by the caller.
+func kbAxis(neg, pos string) (v float32) {
+	if kbPressed[neg] {
+		v--
+	}
+	if kbPressed[pos] {
+		v++
+	}
+	return v
+}
+
+// rampTowards moves val towards target by at most step, or twice that when re-centring.
+func rampTowards(val, target, step float32) float32 {
+	if target == 0 || val*target < 0 {
+		step *= 2
+	}
+	switch {
+	case val < target:
+		val += step
+		if val > target {
+			val = target
+		}
+	case val > target:
+		val -= step
+		if val < target {
+			val = target
+		}
+	}
+	return val
+}
+
+// readKeyboard is run as a Goroutine, it is the keyboard equivalent of readJoystick.
+// It is stopped via kbStopChan.
+func readKeyboard() {
+	var (
+		sm             tello.StickMessage
+		lx, ly, rx, ry float32 // ramped values, -1.0 ~ 1.0
+	)
+	kb := settings.KeyBindings
+	step := float32(jsUpdatePeriod) / float32(kbRampTime)
+
+	log.Println("Debug: Keyboard listener starting")
+	for {
+		select {
+		case <-kbStopChan:
+			log.Println("Debug: Keyboard listener stopping")
+			return
+		default:
+		}
+
+		kbMu.Lock()
+		lx = rampTowards(lx, kbAxis(kb.Left, kb.Right), step)
+		ly = rampTowards(ly, kbAxis(kb.Backward, kb.Forward), step)
+		rx = rampTowards(rx, kbAxis(kb.TurnLeft, kb.TurnRight), step)
+		ry = rampTowards(ry, kbAxis(kb.Down, kb.Up), step)
+		slow := kbPressed[kb.SlowMode]
+		kbMu.Unlock()
+
+		scale := float32(maxVal)
+		if slow {
+			scale /= 3
+		}
+		sm.Lx = int16(lx * scale)
+		sm.Ly = int16(ly * scale)
+		sm.Rx = int16(rx * scale)
+		sm.Ry = int16(ry * scale)
+		if !sticksClaimed() {
+			stickChan <- fenceGuard.limit(sm)
+		} else {
+			pilotOverride(sm)
+		}
+
+		time.Sleep(jsUpdatePeriod)
+	}
+}
+
+// keyBindingsCB lets the user change the key bindings in kb by clicking on a function
+// and then pressing the desired key.
+func keyBindingsCB(kb *keyBindingsT) {
+	kd := gtk.NewDialog()
+	kd.SetTitle(appName + " Key Bindings")
+	kd.SetIcon(iconPixbuf)
+	kd.SetPosition(gtk.WIN_POS_CENTER_ON_PARENT)
+
+	tmp := *kb
+	actions := tmp.actions()
+	capturing := -1
+	btns := make([]*gtk.Button, len(actions))
+
+	table := gtk.NewTable(uint(len(actions)), 2, false)
+	table.SetColSpacings(5)
+	table.SetRowSpacings(2)
+	for i, a := range actions {
+		lab := gtk.NewLabel(a.label + " :")
+		lab.SetAlignment(1, 0.5)
+		table.AttachDefaults(lab, 0, 1, uint(i), uint(i+1))
+		btns[i] = gtk.NewButtonWithLabel(*a.key)
+		ix := i
+		btns[i].Connect("clicked", func() {
+			if capturing >= 0 {
+				btns[capturing].SetLabel(*actions[capturing].key)
+			}
+			capturing = ix
+			btns[ix].SetLabel("Press a key...")
+		})
+		table.AttachDefaults(btns[i], 1, 2, uint(i), uint(i+1))
+	}
+	kd.Connect("key-press-event", func(ctx *glib.CallbackContext) bool {
+		if capturing < 0 {
+			return false
+		}
+		arg := ctx.Args(0)
+		kev := *(**gdk.EventKey)(unsafe.Pointer(&arg))
+		if name := keyName(kev.Keyval); name != "" {
+			*actions[capturing].key = name
+			btns[capturing].SetLabel(name)
+			capturing = -1
+		}
+		return true
+	})
+
+	kd.GetVBox().PackStart(table, true, true, 5)
+	kd.AddButton("Defaults", gtk.RESPONSE_APPLY)
+	kd.AddButton("Cancel", gtk.RESPONSE_CANCEL)
+	kd.AddButton("OK", gtk.RESPONSE_OK)
+	kd.ShowAll()
+
+	for {
+		response := kd.Run()
+		if response == gtk.RESPONSE_APPLY {
+			tmp = defaultKeyBindings
+			for i, a := range actions {
+				btns[i].SetLabel(*a.key)
+			}
+			capturing = -1
+			continue
+		}
+		if response == gtk.RESPONSE_OK {
+			*kb = tmp
+		}
+		break
+	}
+	kd.Destroy()
+}
+
+func keyboardHelpCB() {
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+	for _, a := range settings.KeyBindings.actions() {
+		fmt.Fprintf(tw, "%s\t%s\n", a.label, *a.key)
+	}
+	tw.Flush()
+	msg := "Keyboard Controls\n\n" + buf.String()
+	if !settings.KeyboardControl {
+		msg += "\nKeyboard control is currently disabled in Settings."
+	}
+	messageDialog(win, gtk.MESSAGE_INFO, msg)
+}
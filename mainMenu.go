@@ -13,12 +13,15 @@ import (
 
 type menuBarT struct {
 	*gtk.MenuBar
-	connectItem, disconnectItem             *gtk.MenuItem
+	connectItem, connectToItem              *gtk.MenuItem
+	connectSimItem                          *gtk.MenuItem
+	disconnectItem                          *gtk.MenuItem
 	navItem, goHomeItem, flightItem         *gtk.MenuItem
 	sportsModeItem                          *gtk.CheckMenuItem
-	importTrackItem                         *gtk.MenuItem
+	importTrackItem, playbackItem           *gtk.MenuItem
 	imagingItem, recVidItem, stopRecVidItem *gtk.MenuItem
 	trackShowDrone, trackShowPath           *gtk.CheckMenuItem
+	fenceEditItem                           *gtk.CheckMenuItem
 }
 
 func buildMenu() (mb *menuBarT) {
@@ -51,6 +54,12 @@ func buildMenu() (mb *menuBarT) {
 	mb.connectItem = gtk.NewMenuItemWithLabel("Connect")
 	mb.connectItem.Connect("activate", connectCB)
 	droneMenu.Append(mb.connectItem)
+	mb.connectToItem = gtk.NewMenuItemWithLabel("Connect To...")
+	mb.connectToItem.Connect("activate", connectToCB)
+	droneMenu.Append(mb.connectToItem)
+	mb.connectSimItem = gtk.NewMenuItemWithLabel("Connect to Simulator")
+	mb.connectSimItem.Connect("activate", connectSimCB)
+	droneMenu.Append(mb.connectSimItem)
 	mb.disconnectItem = gtk.NewMenuItemWithLabel("Disconnect")
 	mb.disconnectItem.Connect("activate", disconnectCB)
 	droneMenu.Append(mb.disconnectItem)
@@ -87,10 +96,7 @@ func buildMenu() (mb *menuBarT) {
 	mb.navItem.SetSubmenu(navMenu)
 
 	sh := gtk.NewMenuItemWithLabel("Set Home Position")
-	sh.Connect("activate", func() {
-		drone.SetHome()
-		mb.goHomeItem.SetSensitive(true)
-	})
+	sh.Connect("activate", setHomeCB)
 	navMenu.Append(sh)
 	mb.goHomeItem = gtk.NewMenuItemWithLabel("Return to Home")
 	mb.goHomeItem.SetSensitive(false)
@@ -98,9 +104,22 @@ func buildMenu() (mb *menuBarT) {
 	navMenu.Append(mb.goHomeItem)
 
 	ca := gtk.NewMenuItemWithLabel("Cancel Auto-Flight (RTH)")
-	ca.Connect("activate", func() { drone.CancelAutoFlyToXY() })
+	ca.Connect("activate", func() {
+		failsafe.override()
+		scripter.abort()
+		drone.CancelAutoFlyToXY()
+	})
 	navMenu.Append(ca)
 
+	navMenu.Append(gtk.NewSeparatorMenuItem())
+
+	fm := gtk.NewMenuItemWithLabel("Fly Planned Mission")
+	fm.Connect("activate", flyMissionCB)
+	navMenu.Append(fm)
+	am := gtk.NewMenuItemWithLabel("Abort Mission")
+	am.Connect("activate", abortMissionCB)
+	navMenu.Append(am)
+
 	// Track
 
 	trackItem := gtk.NewMenuItemWithLabel("Track")
@@ -114,9 +133,15 @@ func buildMenu() (mb *menuBarT) {
 	et := gtk.NewMenuItemWithLabel("Export Current Track as CSV")
 	et.Connect("activate", exportTrackCB)
 	trackMenu.Append(et)
+	geo := gtk.NewMenuItemWithLabel("Export Track as GPX/KML/GeoJSON")
+	geo.Connect("activate", geoExportCB)
+	trackMenu.Append(geo)
 	mb.importTrackItem = gtk.NewMenuItemWithLabel("Import CSV Track")
 	mb.importTrackItem.Connect("activate", importTrackCB)
 	trackMenu.Append(mb.importTrackItem)
+	mb.playbackItem = gtk.NewMenuItemWithLabel("Play Back Flight Recording")
+	mb.playbackItem.Connect("activate", playbackCB)
+	trackMenu.Append(mb.playbackItem)
 	simpt := gtk.NewMenuItemWithLabel("Simplify (Reduce Points)")
 	simpt.Connect("activate", simplifyCB)
 	trackMenu.Append(simpt)
@@ -126,6 +151,15 @@ func buildMenu() (mb *menuBarT) {
 
 	trackMenu.Append(gtk.NewSeparatorMenuItem())
 
+	gf := gtk.NewMenuItemWithLabel("Geofence...")
+	gf.Connect("activate", geofenceCB)
+	trackMenu.Append(gf)
+	mb.fenceEditItem = gtk.NewCheckMenuItemWithLabel("Edit Geofence Polygon")
+	mb.fenceEditItem.Connect("activate", editFencePolygonCB)
+	trackMenu.Append(mb.fenceEditItem)
+
+	trackMenu.Append(gtk.NewSeparatorMenuItem())
+
 	mb.trackShowDrone = gtk.NewCheckMenuItemWithLabel("Show Drone Positions")
 	mb.trackShowDrone.SetActive(true)
 	trackMenu.Append(mb.trackShowDrone)
@@ -165,6 +199,14 @@ func buildMenu() (mb *menuBarT) {
 	sp.Connect("activate", saveAllPhotosCB)
 	imagingMenu.Append(sp)
 
+	// HUD
+
+	hudItem := gtk.NewMenuItemWithLabel("HUD")
+	mb.Append(hudItem)
+	hudMenu := gtk.NewMenu()
+	hudItem.SetSubmenu(hudMenu)
+	hudMenuItems(hudMenu)
+
 	// Help
 
 	helpItem := gtk.NewMenuItemWithLabel("Help")
@@ -175,6 +217,9 @@ func buildMenu() (mb *menuBarT) {
 	jh := gtk.NewMenuItemWithLabel("Joystick Functions")
 	jh.Connect("activate", func() { joystickHelpCB() })
 	helpMenu.Append(jh)
+	kh := gtk.NewMenuItemWithLabel("Keyboard Functions")
+	kh.Connect("activate", keyboardHelpCB)
+	helpMenu.Append(kh)
 
 	oh := gtk.NewMenuItemWithLabel("Online Help")
 	oh.Connect("activate", func() { openBrowser(appHelpURL) })
@@ -194,19 +239,44 @@ func buildMenu() (mb *menuBarT) {
 func (mb *menuBarT) enableFlightMenus() {
 	mb.disconnectItem.SetSensitive(true)
 	mb.connectItem.SetSensitive(false)
+	mb.connectToItem.SetSensitive(false)
+	mb.connectSimItem.SetSensitive(false)
 	mb.flightItem.SetSensitive(true)
 	mb.navItem.SetSensitive(true)
 	mb.imagingItem.SetSensitive(true)
 	mb.importTrackItem.SetSensitive(false)
+	mb.playbackItem.SetSensitive(false)
 }
 
 func (mb *menuBarT) disableFlightMenus() {
 	mb.disconnectItem.SetSensitive(false)
 	mb.connectItem.SetSensitive(true)
+	mb.connectToItem.SetSensitive(true)
+	mb.connectSimItem.SetSensitive(true)
 	mb.flightItem.SetSensitive(false)
 	mb.navItem.SetSensitive(false)
 	mb.imagingItem.SetSensitive(false)
 	mb.importTrackItem.SetSensitive(true)
+	mb.playbackItem.SetSensitive(true)
+}
+
+// connectingMenus allows only Disconnect, to give up, while we are trying to connect
+func (mb *menuBarT) connectingMenus() {
+	mb.disconnectItem.SetSensitive(true)
+	mb.connectItem.SetSensitive(false)
+	mb.connectToItem.SetSensitive(false)
+	mb.connectSimItem.SetSensitive(false)
+	mb.importTrackItem.SetSensitive(false)
+	mb.playbackItem.SetSensitive(false)
+}
+
+// playbackMenus disables the functions which would interfere with flight playback while it is running
+func (mb *menuBarT) playbackMenus(playing bool) {
+	mb.connectItem.SetSensitive(!playing)
+	mb.connectToItem.SetSensitive(!playing)
+	mb.connectSimItem.SetSensitive(!playing)
+	mb.importTrackItem.SetSensitive(!playing)
+	mb.playbackItem.SetSensitive(!playing)
 }
 
 // func nyi() {
@@ -0,0 +1,396 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-gtk/glib"
+	"github.com/mattn/go-gtk/gtk"
+)
+
+// waypointT defines a single point of a planned mission.
+type waypointT struct {
+	x, y     float32 // metres from home, same axes as the MVO position
+	heightDm int16
+	yaw      int16
+}
+
+// missionT holds a planned mission and, once started, its progress.
+type missionT struct {
+	missionMu sync.RWMutex
+	waypoints []waypointT
+	running   bool
+	current   int // index of the waypoint being flown to, -1 if none
+	lastErr   error
+	stopChan  chan bool // made by start(), closed by abort()
+}
+
+var errMissionAborted = errors.New("aborted by pilot")
+
+// flyingMission is the mission being flown, if any, so that it can be aborted from anywhere.
+// flyingMu may be locked while missionMu is held, but not the other way round.
+var (
+	flyingMu      sync.Mutex
+	flyingMission *missionT
+)
+
+func newMission() (m *missionT) {
+	m = new(missionT)
+	m.waypoints = make([]waypointT, 0, 20)
+	m.current = -1
+	return m
+}
+
+// toStrings converts a single waypoint into an array of human-readable strings
+// suitable for CSV export etc.
+func (wp *waypointT) toStrings() (strings []string) {
+	strings = append(strings, fmt.Sprintf("%.2f", wp.x))
+	strings = append(strings, fmt.Sprintf("%.2f", wp.y))
+	strings = append(strings, fmt.Sprintf("%.1f", float64(wp.heightDm)/10))
+	strings = append(strings, fmt.Sprintf("%d", wp.yaw))
+	return strings
+}
+
+// toWaypoint does the inverse of toStrings, converting an array of strings into
+// a single waypoint struct.
+func toWaypoint(strings []string) (wp waypointT, err error) {
+	if len(strings) < 4 {
+		return wp, errors.New("too few fields for a waypoint")
+	}
+	var f64 float64
+	if f64, err = strconv.ParseFloat(strings[0], 32); err != nil {
+		return wp, err
+	}
+	wp.x = float32(f64)
+	if f64, err = strconv.ParseFloat(strings[1], 32); err != nil {
+		return wp, err
+	}
+	wp.y = float32(f64)
+	if f64, err = strconv.ParseFloat(strings[2], 32); err != nil {
+		return wp, err
+	}
+	wp.heightDm = int16(f64 * 10)
+	i64, err := strconv.ParseInt(strings[3], 10, 16)
+	wp.yaw = int16(i64)
+	return wp, err
+}
+
+func (m *missionT) addWaypoint(wp waypointT) {
+	m.missionMu.Lock()
+	m.waypoints = append(m.waypoints, wp)
+	m.missionMu.Unlock()
+}
+
+// removeNearest deletes the waypoint closest to x, y if it is within maxDist metres.
+func (m *missionT) removeNearest(x, y, maxDist float32) {
+	m.missionMu.Lock()
+	defer m.missionMu.Unlock()
+	nearest := -1
+	nearestDist := maxDist * maxDist
+	for i, wp := range m.waypoints {
+		d := (wp.x-x)*(wp.x-x) + (wp.y-y)*(wp.y-y)
+		if d <= nearestDist {
+			nearest, nearestDist = i, d
+		}
+	}
+	if nearest >= 0 {
+		m.waypoints = append(m.waypoints[:nearest], m.waypoints[nearest+1:]...)
+	}
+}
+
+func (m *missionT) clear() {
+	m.missionMu.Lock()
+	m.waypoints = m.waypoints[:0]
+	m.current = -1
+	m.lastErr = nil
+	m.missionMu.Unlock()
+}
+
+// deriveScale returns the largest X or Y waypoint value rounded up to a whole number,
+// but never less than minScale.
+func (m *missionT) deriveScale(minScale float32) (scale float32) {
+	scale = minScale
+	m.missionMu.RLock()
+	for _, wp := range m.waypoints {
+		for _, v := range []float32{wp.x, -wp.x, wp.y, -wp.y} {
+			if v > scale {
+				scale = v
+			}
+		}
+	}
+	m.missionMu.RUnlock()
+	scale = float32(math.Ceil(float64(scale)))
+	return scale
+}
+
+// write saves the waypoints as CSV.
+func (m *missionT) write(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	m.missionMu.RLock()
+	for _, wp := range m.waypoints {
+		cw.Write(wp.toStrings())
+	}
+	m.missionMu.RUnlock()
+	cw.Flush()
+	return cw.Error()
+}
+
+// read replaces the waypoints with those in the CSV from r.
+func (m *missionT) read(r io.Reader) error {
+	cr := csv.NewReader(r)
+	wps := make([]waypointT, 0, 20)
+	for {
+		line, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		wp, err := toWaypoint(line)
+		if err != nil {
+			return err
+		}
+		wps = append(wps, wp)
+	}
+	m.missionMu.Lock()
+	m.waypoints = wps
+	m.current = -1
+	m.lastErr = nil
+	m.missionMu.Unlock()
+	return nil
+}
+
+// progress returns a snapshot of the mission state.
+func (m *missionT) progress() (running bool, current int, lastErr error) {
+	m.missionMu.RLock()
+	defer m.missionMu.RUnlock()
+	return m.running, m.current, m.lastErr
+}
+
+func (m *missionT) setCurrent(ix int) {
+	m.missionMu.Lock()
+	m.current = ix
+	m.missionMu.Unlock()
+}
+
+// start marks the mission as running and returns a copy of the waypoints to be flown,
+// ok is false if there is nothing to fly or the mission is already running.
+func (m *missionT) start() (wps []waypointT, ok bool) {
+	m.missionMu.Lock()
+	defer m.missionMu.Unlock()
+	if m.running || len(m.waypoints) == 0 {
+		return nil, false
+	}
+	wps = make([]waypointT, len(m.waypoints))
+	copy(wps, m.waypoints)
+	m.running = true
+	m.current = 0
+	m.lastErr = nil
+	m.stopChan = make(chan bool)
+	flyingMu.Lock()
+	flyingMission = m
+	flyingMu.Unlock()
+	return wps, true
+}
+
+// abort stops the mission if it is running.  It is sticky, the mission stops before its next
+// manoeuvre even if it is between manoeuvres when aborted.
+func (m *missionT) abort() {
+	m.missionMu.Lock()
+	if m.running && m.stopChan != nil {
+		close(m.stopChan)
+		m.stopChan = nil
+	}
+	m.missionMu.Unlock()
+}
+
+// fly should be run as a Goroutine after start(), it flies to each waypoint in turn by chaining
+// the drone's height, XY and yaw autopilot functions.  It is stopped via abort().
+func (m *missionT) fly(wps []waypointT) {
+	m.missionMu.RLock()
+	stop := m.stopChan
+	m.missionMu.RUnlock()
+	var err error
+	for ix, wp := range wps {
+		m.setCurrent(ix)
+		log.Printf("Mission: flying to waypoint %d (%.2f, %.2f)\n", ix+1, wp.x, wp.y)
+		if err = waitForAuto(stop, func() (chan bool, error) { return drone.AutoFlyToHeight(wp.heightDm) }); err != nil {
+			break
+		}
+		if err = waitForAuto(stop, func() (chan bool, error) { return drone.AutoFlyToXY(wp.x, wp.y) }); err != nil {
+			break
+		}
+		if err = waitForAuto(stop, func() (chan bool, error) { return drone.AutoTurnToYaw(wp.yaw) }); err != nil {
+			break
+		}
+	}
+
+	m.missionMu.Lock()
+	m.running = false
+	m.stopChan = nil
+	flyingMu.Lock()
+	if flyingMission == m {
+		flyingMission = nil
+	}
+	flyingMu.Unlock()
+	if err != nil {
+		m.lastErr = err
+		log.Printf("Mission stopped: %v\n", err)
+	} else {
+		m.current = len(wps)
+		log.Println("Mission complete")
+	}
+	m.missionMu.Unlock()
+}
+
+// waitForAuto starts an autopilot manoeuvre, unless the mission has been aborted via stop, and
+// blocks until it completes or the mission is aborted.
+func waitForAuto(stop chan bool, manoeuvre func() (chan bool, error)) error {
+	select {
+	case <-stop:
+		return errMissionAborted
+	default:
+	}
+	done, err := manoeuvre()
+	if err != nil {
+		return err
+	}
+	select {
+	case ok := <-done:
+		if !ok {
+			return errors.New("manoeuvre cancelled")
+		}
+	case <-stop:
+		drone.CancelAutoFlyToHeight()
+		drone.CancelAutoFlyToXY()
+		drone.CancelAutoTurn()
+		return errMissionAborted
+	}
+	return nil
+}
+
+// flyMissionCB starts the planned mission, progress is shown on the planner chart.
+func flyMissionCB() {
+	wps, ok := plannerTab.mission.start()
+	if !ok {
+		messageDialog(win, gtk.MESSAGE_INFO, "There are no waypoints in the mission,\nor it is already running.")
+		return
+	}
+	go plannerTab.mission.fly(wps)
+	notebook.SetCurrentPage(plannerPage)
+	glib.TimeoutAdd(500, plannerTab.missionTCB) // stops itself when the mission ends
+}
+
+// abortFlyingMission aborts the mission being flown, if any.
+func abortFlyingMission() {
+	flyingMu.Lock()
+	m := flyingMission
+	flyingMu.Unlock()
+	if m != nil {
+		m.abort()
+	}
+}
+
+// abortMissionCB stops a running mission, the drone is left hovering where it is.
+func abortMissionCB() {
+	abortFlyingMission()
+	drone.CancelAutoFlyToHeight()
+	drone.CancelAutoFlyToXY()
+	drone.CancelAutoTurn()
+}
+
+// stop aborts any mission being flown and waits briefly for it to end, so that the
+// caller can take over the autopilot without the mission cancelling its manoeuvre.
+func (m *missionT) stop() {
+	for i := 0; i < 20; i++ {
+		if running, _, _ := m.progress(); !running {
+			return
+		}
+		abortMissionCB()
+		time.Sleep(50 * time.Millisecond)
+	}
+	log.Println("Mission did not stop")
+}
+
+// stopAutomation stops any mission or script being run, so that the caller can take over
+// the autopilot.
+func stopAutomation() {
+	scripter.abort()
+	if plannerTab != nil {
+		plannerTab.mission.stop()
+	} else { // headless, its mission is the flying one
+		abortMissionCB()
+	}
+}
+
+// saveMissionCB saves the planned mission as a CSV file.  The user is prompted for a filename.
+func saveMissionCB() {
+	fs := gtk.NewFileChooserDialog(
+		"File for Mission",
+		win,
+		gtk.FILE_CHOOSER_ACTION_SAVE, "_Cancel", gtk.RESPONSE_CANCEL, "_Save", gtk.RESPONSE_ACCEPT)
+	fs.SetCurrentFolder(settings.DataDir)
+	fs.SetLocalOnly(true)
+	ff := gtk.NewFileFilter()
+	ff.AddPattern("*.csv")
+	fs.SetFilter(ff)
+	res := fs.Run()
+	if res == gtk.RESPONSE_ACCEPT {
+		if expPath := fs.GetFilename(); expPath != "" {
+			exp, err := os.Create(expPath)
+			if err != nil {
+				messageDialog(win, gtk.MESSAGE_INFO, "Could not create mission file.")
+			} else {
+				defer exp.Close()
+				if err = plannerTab.mission.write(exp); err != nil {
+					messageDialog(win, gtk.MESSAGE_ERROR, "Could not write mission file.")
+				}
+			}
+		}
+	}
+	fs.Destroy()
+}
+
+// loadMissionCB replaces the planned mission with one loaded from a CSV file.
+func loadMissionCB() {
+	fs := gtk.NewFileChooserDialog("Mission to Load",
+		win,
+		gtk.FILE_CHOOSER_ACTION_OPEN,
+		"_Cancel", gtk.RESPONSE_CANCEL, "_Load", gtk.RESPONSE_ACCEPT)
+	fs.SetCurrentFolder(settings.DataDir)
+	fs.SetLocalOnly(true)
+	ff := gtk.NewFileFilter()
+	ff.AddPattern("*.csv")
+	fs.SetFilter(ff)
+	res := fs.Run()
+	if res == gtk.RESPONSE_ACCEPT {
+		if impPath := fs.GetFilename(); impPath != "" {
+			imp, err := os.Open(impPath)
+			if err != nil {
+				messageDialog(win, gtk.MESSAGE_INFO, "Could not open mission file.")
+			} else {
+				defer imp.Close()
+				if err = plannerTab.mission.read(imp); err != nil {
+					messageDialog(win, gtk.MESSAGE_ERROR, "Could not parse mission file.")
+				}
+				plannerTab.drawPlan()
+			}
+		}
+	}
+	fs.Destroy()
+}
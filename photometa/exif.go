@@ -0,0 +1,218 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package photometa
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// TIFF field types
+const (
+	typeByte      = 1
+	typeASCII     = 2
+	typeLong      = 4
+	typeRational  = 5
+	typeUndefined = 7
+)
+
+// EXIF tags
+const (
+	tagImageDescription   = 0x010e
+	tagMake               = 0x010f
+	tagModel              = 0x0110
+	tagSoftware           = 0x0131
+	tagDateTime           = 0x0132
+	tagExifIFD            = 0x8769
+	tagGPSIFD             = 0x8825
+	tagExifVersion        = 0x9000
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTimeOriginal = 0x9011
+	tagSubSecTimeOriginal = 0x9291
+
+	tagGPSVersionID       = 0x0000
+	tagGPSLatitudeRef     = 0x0001
+	tagGPSLatitude        = 0x0002
+	tagGPSLongitudeRef    = 0x0003
+	tagGPSLongitude       = 0x0004
+	tagGPSAltitudeRef     = 0x0005
+	tagGPSAltitude        = 0x0006
+	tagGPSTimeStamp       = 0x0007
+	tagGPSImgDirectionRef = 0x0010
+	tagGPSImgDirection    = 0x0011
+	tagGPSDateStamp       = 0x001d
+)
+
+const exifTimeFmt = "2006:01:02 15:04:05"
+
+var le = binary.LittleEndian
+
+type ifdEntryT struct {
+	tag, typ uint16
+	count    uint32
+	data     []byte
+}
+
+type ifdT []ifdEntryT
+
+func (ifd *ifdT) add(tag, typ uint16, count uint32, data []byte) {
+	*ifd = append(*ifd, ifdEntryT{tag, typ, count, data})
+}
+
+// ascii adds a string, any characters which are not 7-bit ASCII are dropped as EXIF requires.
+func (ifd *ifdT) ascii(tag uint16, s string) {
+	s = strings.Map(func(r rune) rune {
+		if r > 0x7e {
+			return -1
+		}
+		return r
+	}, s)
+	if s != "" {
+		ifd.add(tag, typeASCII, uint32(len(s)+1), append([]byte(s), 0))
+	}
+}
+
+func (ifd *ifdT) long(tag uint16, v uint32) {
+	b := make([]byte, 4)
+	le.PutUint32(b, v)
+	ifd.add(tag, typeLong, 1, b)
+}
+
+// rationals adds numerator, denominator pairs.
+func (ifd *ifdT) rationals(tag uint16, nd ...uint32) {
+	b := make([]byte, 4*len(nd))
+	for i, v := range nd {
+		le.PutUint32(b[4*i:], v)
+	}
+	ifd.add(tag, typeRational, uint32(len(nd)/2), b)
+}
+
+// size is the number of bytes the IFD and its values take.
+func (ifd ifdT) size() (n uint32) {
+	n = 2 + 12*uint32(len(ifd)) + 4
+	for _, e := range ifd {
+		if len(e.data) > 4 {
+			n += uint32(len(e.data)+1) &^ 1 // values start on word boundaries
+		}
+	}
+	return n
+}
+
+// write writes the IFD, which begins at offset bytes into the TIFF data, and its values.
+func (ifd ifdT) write(buf *bytes.Buffer, offset uint32) {
+	sort.Slice(ifd, func(i, j int) bool { return ifd[i].tag < ifd[j].tag })
+	var values bytes.Buffer
+	valOffset := offset + 2 + 12*uint32(len(ifd)) + 4
+	b := make([]byte, 12)
+	le.PutUint16(b, uint16(len(ifd)))
+	buf.Write(b[:2])
+	for _, e := range ifd {
+		le.PutUint16(b[0:], e.tag)
+		le.PutUint16(b[2:], e.typ)
+		le.PutUint32(b[4:], e.count)
+		if len(e.data) <= 4 {
+			copy(b[8:], []byte{0, 0, 0, 0})
+			copy(b[8:], e.data)
+		} else {
+			le.PutUint32(b[8:], valOffset+uint32(values.Len()))
+			values.Write(e.data)
+			if values.Len()%2 == 1 {
+				values.WriteByte(0)
+			}
+		}
+		buf.Write(b)
+	}
+	buf.Write([]byte{0, 0, 0, 0}) // no next IFD
+	buf.Write(values.Bytes())
+}
+
+// buildExif returns the little-endian TIFF structure of the EXIF APP1 segment.
+func buildExif(m MetaT) []byte {
+	var ifd0, exifIFD, gpsIFD ifdT
+	ifd0.ascii(tagImageDescription, fmt.Sprintf("X %.2fm, Y %.2fm, Height %.2fm, Yaw %.0f deg", m.X, m.Y, m.Height, m.Yaw))
+	ifd0.ascii(tagMake, m.Make)
+	ifd0.ascii(tagModel, m.Model)
+	ifd0.ascii(tagSoftware, m.Software)
+	ifd0.ascii(tagDateTime, m.Taken.Format(exifTimeFmt))
+
+	exifIFD.add(tagExifVersion, typeUndefined, 4, []byte("0231"))
+	exifIFD.ascii(tagDateTimeOriginal, m.Taken.Format(exifTimeFmt))
+	exifIFD.ascii(tagOffsetTimeOriginal, m.Taken.Format("-07:00"))
+	exifIFD.ascii(tagSubSecTimeOriginal, fmt.Sprintf("%03d", m.Taken.Nanosecond()/1e6))
+
+	if g := m.GPS; g != nil {
+		gpsIFD.add(tagGPSVersionID, typeByte, 4, []byte{2, 3, 0, 0})
+		gpsIFD.ascii(tagGPSLatitudeRef, hemisphere(g.Lat, "N", "S"))
+		gpsIFD.rationals(tagGPSLatitude, degMinSec(g.Lat)...)
+		gpsIFD.ascii(tagGPSLongitudeRef, hemisphere(g.Lon, "E", "W"))
+		gpsIFD.rationals(tagGPSLongitude, degMinSec(g.Lon)...)
+		altRef := byte(0)
+		if g.Alt < 0 {
+			altRef = 1 // below sea level
+		}
+		gpsIFD.add(tagGPSAltitudeRef, typeByte, 1, []byte{altRef})
+		gpsIFD.rationals(tagGPSAltitude, uint32(math.Round(math.Abs(g.Alt)*100)), 100)
+		utc := m.Taken.UTC()
+		gpsIFD.rationals(tagGPSTimeStamp, uint32(utc.Hour()), 1, uint32(utc.Minute()), 1,
+			uint32(utc.Second()*1000+utc.Nanosecond()/1e6), 1000)
+		gpsIFD.ascii(tagGPSDateStamp, utc.Format("2006:01:02"))
+		gpsIFD.ascii(tagGPSImgDirectionRef, "T")
+		gpsIFD.rationals(tagGPSImgDirection, uint32(math.Round(normHeading(g.Heading)*100)), 100)
+	}
+
+	// the pointers must be in IFD0 before its size is known
+	ifd0.long(tagExifIFD, 0)
+	if len(gpsIFD) > 0 {
+		ifd0.long(tagGPSIFD, 0)
+	}
+	exifOffset := 8 + ifd0.size()
+	gpsOffset := exifOffset + exifIFD.size()
+	for i := range ifd0 {
+		switch ifd0[i].tag {
+		case tagExifIFD:
+			le.PutUint32(ifd0[i].data, exifOffset)
+		case tagGPSIFD:
+			le.PutUint32(ifd0[i].data, gpsOffset)
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{'I', 'I', 42, 0, 8, 0, 0, 0}) // little-endian, IFD0 follows
+	ifd0.write(&buf, 8)
+	exifIFD.write(&buf, exifOffset)
+	if len(gpsIFD) > 0 {
+		gpsIFD.write(&buf, gpsOffset)
+	}
+	return buf.Bytes()
+}
+
+func hemisphere(deg float64, pos, neg string) string {
+	if deg < 0 {
+		return neg
+	}
+	return pos
+}
+
+// degMinSec gives the rationals for an EXIF GPS latitude or longitude, to 1/1000 second.
+func degMinSec(deg float64) []uint32 {
+	ms := uint32(math.Round(math.Abs(deg) * 3600 * 1000))
+	return []uint32{ms / 3600000, 1, ms / 60000 % 60, 1, ms % 60000, 1000}
+}
+
+// normHeading returns the heading in the range 0 ~ 360.
+func normHeading(h float64) float64 {
+	h = math.Mod(h, 360)
+	if h < 0 {
+		h += 360
+	}
+	return h
+}
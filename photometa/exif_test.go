@@ -0,0 +1,171 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package photometa
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDegMinSec(t *testing.T) {
+	tests := []struct {
+		deg  float64
+		want []uint32
+	}{
+		{0, []uint32{0, 1, 0, 1, 0, 1000}},
+		{51.5, []uint32{51, 1, 30, 1, 0, 1000}},
+		{-0.1278, []uint32{0, 1, 7, 1, 40080, 1000}},
+		{179.9999999, []uint32{180, 1, 0, 1, 0, 1000}}, // rounds up to the next degree
+		{-33.865143, []uint32{33, 1, 51, 1, 54515, 1000}},
+	}
+	for _, tc := range tests {
+		if got := degMinSec(tc.deg); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("degMinSec(%v) = %v, want %v", tc.deg, got, tc.want)
+		}
+	}
+}
+
+func TestNormHeading(t *testing.T) {
+	tests := []struct{ in, want float64 }{
+		{0, 0}, {359.5, 359.5}, {360, 0}, {-90, 270}, {450, 90}, {-720, 0},
+	}
+	for _, tc := range tests {
+		if got := normHeading(tc.in); got != tc.want {
+			t.Errorf("normHeading(%v) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+// tiffEntryT is an IFD entry read back from the TIFF data.
+type tiffEntryT struct {
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// readIFD returns the entries of the IFD at offset in tiff, by tag.
+func readIFD(t *testing.T, tiff []byte, offset uint32) map[uint16]tiffEntryT {
+	t.Helper()
+	sizes := map[uint16]uint32{typeByte: 1, typeASCII: 1, typeLong: 4, typeRational: 8, typeUndefined: 1}
+	n := uint32(le.Uint16(tiff[offset:]))
+	entries := make(map[uint16]tiffEntryT)
+	var lastTag uint16
+	for i := uint32(0); i < n; i++ {
+		e := tiff[offset+2+12*i:]
+		tag, typ, count := le.Uint16(e), le.Uint16(e[2:]), le.Uint32(e[4:])
+		if i > 0 && tag <= lastTag {
+			t.Errorf("IFD at %d: tag %#x is out of order", offset, tag)
+		}
+		lastTag = tag
+		size := sizes[typ] * count
+		value := e[8 : 8+size]
+		if size > 4 {
+			at := le.Uint32(e[8:])
+			if at%2 != 0 {
+				t.Errorf("IFD at %d: tag %#x value is not word aligned", offset, tag)
+			}
+			value = tiff[at : at+size]
+		}
+		entries[tag] = tiffEntryT{typ, count, value}
+	}
+	return entries
+}
+
+func (e tiffEntryT) ascii() string {
+	return strings.TrimSuffix(string(e.value), "\x00")
+}
+
+func (e tiffEntryT) rationals() (r []uint32) {
+	for i := 0; i+4 <= len(e.value); i += 4 {
+		r = append(r, le.Uint32(e.value[i:]))
+	}
+	return r
+}
+
+func TestBuildExif(t *testing.T) {
+	taken := time.Date(2019, 5, 4, 13, 2, 3, 456e6, time.FixedZone("BST", 3600))
+	tests := []struct {
+		name string
+		m    MetaT
+	}{
+		{"local only", MetaT{Taken: taken, X: 1.5, Y: -2, Height: 3.25, Yaw: 45, Make: "Ryze", Model: "Tello",
+			Software: "TelloDesk® 0.2"}},
+		{"with GPS", MetaT{Taken: taken, Height: 1, Make: "Ryze", Model: "Tello",
+			GPS: &GPST{Lat: -33.865143, Lon: 151.2099, Alt: -2.5, Heading: -90}}},
+	}
+	for _, tc := range tests {
+		tiff := buildExif(tc.m)
+		if string(tiff[:4]) != "II*\x00" || le.Uint32(tiff[4:]) != 8 {
+			t.Fatalf("%s: bad TIFF header % x", tc.name, tiff[:8])
+		}
+		ifd0 := readIFD(t, tiff, 8)
+		wantASCII := map[uint16]string{
+			tagMake:             tc.m.Make,
+			tagModel:            tc.m.Model,
+			tagDateTime:         "2019:05:04 13:02:03",
+			tagImageDescription: "X 1.50m, Y -2.00m, Height 3.25m, Yaw 45 deg",
+		}
+		if tc.m.Software != "" {
+			wantASCII[tagSoftware] = "TelloDesk 0.2" // not ASCII, so the ® is dropped
+		}
+		if tc.m.GPS != nil {
+			wantASCII[tagImageDescription] = "X 0.00m, Y 0.00m, Height 1.00m, Yaw 0 deg"
+		}
+		for tag, want := range wantASCII {
+			if got := ifd0[tag].ascii(); got != want {
+				t.Errorf("%s: IFD0 tag %#x = %q, want %q", tc.name, tag, got, want)
+			}
+		}
+
+		exifIFD := readIFD(t, tiff, le.Uint32(ifd0[tagExifIFD].value))
+		for tag, want := range map[uint16]string{
+			tagDateTimeOriginal:   "2019:05:04 13:02:03",
+			tagOffsetTimeOriginal: "+01:00",
+			tagSubSecTimeOriginal: "456",
+		} {
+			if got := exifIFD[tag].ascii(); got != want {
+				t.Errorf("%s: EXIF tag %#x = %q, want %q", tc.name, tag, got, want)
+			}
+		}
+
+		gpsPtr, hasGPS := ifd0[tagGPSIFD]
+		if hasGPS != (tc.m.GPS != nil) {
+			t.Errorf("%s: GPS IFD present = %v", tc.name, hasGPS)
+		}
+		if !hasGPS {
+			continue
+		}
+		gps := readIFD(t, tiff, le.Uint32(gpsPtr.value))
+		for tag, want := range map[uint16]string{
+			tagGPSLatitudeRef:     "S",
+			tagGPSLongitudeRef:    "E",
+			tagGPSDateStamp:       "2019:05:04",
+			tagGPSImgDirectionRef: "T",
+		} {
+			if got := gps[tag].ascii(); got != want {
+				t.Errorf("%s: GPS tag %#x = %q, want %q", tc.name, tag, got, want)
+			}
+		}
+		for tag, want := range map[uint16][]uint32{
+			tagGPSLatitude:     degMinSec(-33.865143),
+			tagGPSLongitude:    degMinSec(151.2099),
+			tagGPSAltitude:     {250, 100},
+			tagGPSTimeStamp:    {12, 1, 2, 1, 3456, 1000}, // UTC
+			tagGPSImgDirection: {27000, 100},
+		} {
+			if got := gps[tag].rationals(); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: GPS tag %#x = %v, want %v", tc.name, tag, got, want)
+			}
+		}
+		if got := gps[tagGPSAltitudeRef].value; len(got) != 1 || got[0] != 1 {
+			t.Errorf("%s: GPS altitude ref = %v, want below sea level", tc.name, got)
+		}
+	}
+}
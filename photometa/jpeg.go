@@ -0,0 +1,79 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package photometa
+
+import (
+	"bytes"
+	"errors"
+)
+
+const (
+	markerSOI  = 0xd8
+	markerAPP0 = 0xe0
+	markerAPP1 = 0xe1
+	markerCOM  = 0xfe
+	maxSegment = 65533 // most data which fits in one segment
+)
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+)
+
+// Embed returns a copy of the JPEG jpg with m added as EXIF and XMP.  Any EXIF or XMP
+// already in the JPEG is replaced, the rest of the file is unchanged.
+func Embed(jpg []byte, m MetaT) ([]byte, error) {
+	if len(jpg) < 4 || jpg[0] != 0xff || jpg[1] != markerSOI {
+		return nil, errors.New("not a JPEG file")
+	}
+	exif := append(append([]byte(nil), exifHeader...), buildExif(m)...)
+	xmp := append(append([]byte(nil), xmpHeader...), buildXMP(m)...)
+	if len(exif) > maxSegment || len(xmp) > maxSegment {
+		return nil, errors.New("metadata is too large")
+	}
+
+	var out bytes.Buffer
+	out.Write(jpg[:2])
+	pos := 2
+	inserted := false
+	insert := func() {
+		writeSegment(&out, markerAPP1, exif)
+		writeSegment(&out, markerAPP1, xmp)
+		inserted = true
+	}
+	// the metadata goes after any JFIF APP0 segment, and the old EXIF and XMP are dropped
+	for pos+4 <= len(jpg) && jpg[pos] == 0xff {
+		marker := jpg[pos+1]
+		if (marker < markerAPP0 || marker > 0xef) && marker != markerCOM {
+			break
+		}
+		end := pos + 2 + int(jpg[pos+2])<<8 + int(jpg[pos+3])
+		if end > len(jpg) {
+			return nil, errors.New("corrupt JPEG file")
+		}
+		if marker != markerAPP0 && !inserted {
+			insert()
+		}
+		data := jpg[pos+4 : end]
+		if marker != markerAPP1 || !(bytes.HasPrefix(data, exifHeader) || bytes.HasPrefix(data, xmpHeader)) {
+			out.Write(jpg[pos:end])
+		}
+		pos = end
+	}
+	if !inserted {
+		insert()
+	}
+	out.Write(jpg[pos:])
+	return out.Bytes(), nil
+}
+
+func writeSegment(buf *bytes.Buffer, marker byte, data []byte) {
+	l := len(data) + 2
+	buf.Write([]byte{0xff, marker, byte(l >> 8), byte(l)})
+	buf.Write(data)
+}
@@ -0,0 +1,144 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package photometa
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+	"time"
+)
+
+// testJPEG returns a small JPEG, which has no APP segments when made by image/jpeg.
+func testJPEG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for x := 0; x < 16; x++ {
+		img.Set(x, x/2, color.RGBA{255, 140, 0, 255})
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// segment returns a JPEG marker segment.
+func segment(marker byte, data string) []byte {
+	var buf bytes.Buffer
+	writeSegment(&buf, marker, []byte(data))
+	return buf.Bytes()
+}
+
+// withSegments inserts segments after the SOI marker of jpg.
+func withSegments(jpg []byte, segs ...[]byte) []byte {
+	return bytes.Join(append(append([][]byte{jpg[:2]}, segs...), jpg[2:]), nil)
+}
+
+// segmentsOf lists the marker and start of the data of each segment before the image data.
+func segmentsOf(jpg []byte) (segs []string) {
+	for pos := 2; pos+4 <= len(jpg) && jpg[pos] == 0xff; {
+		marker := jpg[pos+1]
+		end := pos + 2 + int(jpg[pos+2])<<8 + int(jpg[pos+3])
+		data := jpg[pos+4 : end]
+		switch {
+		case marker == markerAPP0:
+			segs = append(segs, "APP0")
+		case marker == markerAPP1 && bytes.HasPrefix(data, exifHeader):
+			segs = append(segs, "EXIF")
+		case marker == markerAPP1 && bytes.HasPrefix(data, xmpHeader):
+			segs = append(segs, "XMP")
+		case marker == markerCOM:
+			segs = append(segs, "COM:"+string(data))
+		case marker == 0xdb:
+			segs = append(segs, "DQT")
+			return segs // the image data follows, which is not listed
+		default:
+			segs = append(segs, "?")
+		}
+		pos = end
+	}
+	return segs
+}
+
+func TestEmbed(t *testing.T) {
+	jpg := testJPEG(t)
+	m := MetaT{Taken: time.Date(2019, 5, 4, 13, 2, 3, 0, time.UTC), Height: 1.5, Make: "Ryze", Model: "Tello"}
+	embedded, err := Embed(jpg, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		jpg  []byte
+		want []string
+	}{
+		{"bare", jpg, []string{"EXIF", "XMP", "DQT"}},
+		{"JFIF", withSegments(jpg, segment(markerAPP0, "JFIF\x00\x01\x01")), []string{"APP0", "EXIF", "XMP", "DQT"}},
+		{"comment kept", withSegments(jpg, segment(markerAPP0, "JFIF\x00"), segment(markerCOM, "hello")),
+			[]string{"APP0", "EXIF", "XMP", "COM:hello", "DQT"}},
+		{"old metadata replaced", withSegments(jpg, segment(markerAPP1, "Exif\x00\x00old"), segment(markerAPP1, string(xmpHeader)+"old")),
+			[]string{"EXIF", "XMP", "DQT"}},
+		{"embedded twice", embedded, []string{"EXIF", "XMP", "DQT"}},
+	}
+	for _, tc := range tests {
+		got, err := Embed(tc.jpg, m)
+		if err != nil {
+			t.Errorf("%s: error = %v", tc.name, err)
+			continue
+		}
+		if segs := segmentsOf(got); !equalStrings(segs, tc.want) {
+			t.Errorf("%s: segments = %v, want %v", tc.name, segs, tc.want)
+		}
+		if !bytes.Contains(got, buildExif(m)) || !bytes.Contains(got, buildXMP(m)) {
+			t.Errorf("%s: the new metadata is missing", tc.name)
+		}
+		if bytes.Contains(got, []byte("old")) {
+			t.Errorf("%s: the old metadata is still there", tc.name)
+		}
+		if !bytes.HasSuffix(got, jpg[bytes.Index(jpg, []byte{0xff, 0xdb}):]) {
+			t.Errorf("%s: the image data has changed", tc.name)
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(got)); err != nil {
+			t.Errorf("%s: the result does not decode: %v", tc.name, err)
+		}
+	}
+}
+
+func TestEmbedErrors(t *testing.T) {
+	jpg := testJPEG(t)
+	tests := []struct {
+		name string
+		jpg  []byte
+		m    MetaT
+	}{
+		{"empty", nil, MetaT{}},
+		{"not a JPEG", []byte("\x89PNG\r\n\x1a\n"), MetaT{}},
+		{"corrupt segment", append(jpg[:2:2], 0xff, markerAPP0, 0x7f, 0xff, 'J'), MetaT{}},
+		{"metadata too large", jpg, MetaT{Software: string(bytes.Repeat([]byte("x"), maxSegment))}},
+	}
+	for _, tc := range tests {
+		if _, err := Embed(tc.jpg, tc.m); err == nil {
+			t.Errorf("%s: no error", tc.name)
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
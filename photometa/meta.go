@@ -0,0 +1,84 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+// Package photometa records where and when a photo was taken, embedded in the JPEG as EXIF
+// and XMP and in a JSON sidecar file next to it.  It has no GUI dependencies.
+package photometa
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// GPST is the geographic position of the drone, derived from its local position.
+type GPST struct {
+	Lat     float64 `json:"lat"`     // degrees, North is positive
+	Lon     float64 `json:"lon"`     // degrees, East is positive
+	Alt     float64 `json:"alt"`     // metres above sea level
+	Heading float64 `json:"heading"` // degrees clockwise from true North
+}
+
+// MetaT is the flight data captured when the shutter was pressed.
+type MetaT struct {
+	Taken    time.Time `json:"taken"`
+	X        float64   `json:"x"`      // metres from home
+	Y        float64   `json:"y"`      // metres from home
+	Height   float64   `json:"height"` // metres above the take-off point
+	Yaw      float64   `json:"yaw"`    // degrees from the take-off heading, clockwise
+	Pitch    float64   `json:"pitch"`  // degrees, nose up is positive
+	Roll     float64   `json:"roll"`   // degrees, right is positive
+	GPS      *GPST     `json:"gps,omitempty"`
+	Make     string    `json:"make,omitempty"`
+	Model    string    `json:"model,omitempty"`
+	Software string    `json:"software,omitempty"`
+}
+
+// SidecarName returns the name of the JSON file for a photo.
+func SidecarName(photo string) string {
+	return strings.TrimSuffix(photo, filepath.Ext(photo)) + ".json"
+}
+
+// WriteSidecar saves m as the photo's JSON sidecar file.
+func WriteSidecar(photo string, m MetaT) error {
+	j, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(SidecarName(photo), append(j, '\n'), 0644)
+}
+
+// ReadSidecar loads the photo's JSON sidecar file.
+func ReadSidecar(photo string) (m MetaT, err error) {
+	j, err := ioutil.ReadFile(SidecarName(photo))
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(j, &m)
+	return m, err
+}
+
+// WriteFile embeds m in a JPEG file, which is replaced.
+func WriteFile(photo string, m MetaT) error {
+	jpg, err := ioutil.ReadFile(photo)
+	if err != nil {
+		return err
+	}
+	jpg, err = Embed(jpg, m)
+	if err != nil {
+		return err
+	}
+	tmp := photo + ".tmp"
+	if err = ioutil.WriteFile(tmp, jpg, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, photo)
+}
@@ -0,0 +1,88 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package photometa
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSidecarName(t *testing.T) {
+	tests := []struct{ photo, want string }{
+		{"tello_pic_2019-05-04_13-02-03_0.jpg", "tello_pic_2019-05-04_13-02-03_0.json"},
+		{filepath.Join("data", "pic.v2.JPG"), filepath.Join("data", "pic.v2.json")},
+		{"noext", "noext.json"},
+	}
+	for _, tc := range tests {
+		if got := SidecarName(tc.photo); got != tc.want {
+			t.Errorf("SidecarName(%q) = %q, want %q", tc.photo, got, tc.want)
+		}
+	}
+}
+
+func TestFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tellodesk-photometa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	photo := filepath.Join(dir, "pic.jpg")
+	jpg := testJPEG(t)
+	if err := ioutil.WriteFile(photo, jpg, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := MetaT{Taken: time.Date(2019, 5, 4, 13, 2, 3, 250e6, time.UTC), X: 1.5, Y: 2, Height: 3, Yaw: 90,
+		GPS: &GPST{Lat: 51.5, Lon: -0.12, Alt: 20, Heading: 45}, Make: "Ryze", Model: "Tello"}
+	if err := WriteSidecar(photo, m); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadSidecar(photo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Taken.Equal(m.Taken) {
+		t.Errorf("sidecar Taken = %v, want %v", got.Taken, m.Taken)
+	}
+	got.Taken = m.Taken
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("sidecar = %+v, want %+v", got, m)
+	}
+	if _, err := ReadSidecar(filepath.Join(dir, "missing.jpg")); err == nil {
+		t.Error("ReadSidecar of a missing file did not fail")
+	}
+
+	if err := WriteFile(photo, m); err != nil {
+		t.Fatal(err)
+	}
+	embedded, err := ioutil.ReadFile(photo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := Embed(jpg, m)
+	if !bytes.Equal(embedded, want) {
+		t.Error("WriteFile did not write the embedded JPEG")
+	}
+	if _, err := os.Stat(photo + ".tmp"); !os.IsNotExist(err) {
+		t.Error("WriteFile left its temporary file")
+	}
+
+	notJPEG := filepath.Join(dir, "pic.txt")
+	ioutil.WriteFile(notJPEG, []byte("hello"), 0644)
+	if err := WriteFile(notJPEG, m); err == nil {
+		t.Error("WriteFile of a file which is not a JPEG did not fail")
+	}
+	if b, _ := ioutil.ReadFile(notJPEG); string(b) != "hello" {
+		t.Error("WriteFile changed a file which is not a JPEG")
+	}
+}
@@ -0,0 +1,79 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package photometa
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"time"
+)
+
+// xmpNamespace is used for the drone's position relative to home, which has no standard property.
+const xmpNamespace = "https://github.com/SMerrony/tellodesk/ns/1.0/"
+
+// buildXMP returns an XMP packet for the XMP APP1 segment.  Along with the standard properties
+// it has the relative altitude and attitude in DJI's namespace, which photogrammetry tools read.
+func buildXMP(m MetaT) []byte {
+	var props []string
+	prop := func(name, format string, a ...interface{}) {
+		var esc bytes.Buffer
+		xml.EscapeText(&esc, []byte(fmt.Sprintf(format, a...)))
+		props = append(props, fmt.Sprintf("\n   %s=\"%s\"", name, esc.String()))
+	}
+	prop("xmp:CreateDate", "%s", m.Taken.Format(time.RFC3339Nano))
+	if m.Software != "" {
+		prop("xmp:CreatorTool", "%s", m.Software)
+	}
+	prop("tellodesk:X", "%.2f", m.X)
+	prop("tellodesk:Y", "%.2f", m.Y)
+	prop("tellodesk:Height", "%.2f", m.Height)
+	prop("tellodesk:Yaw", "%.1f", m.Yaw)
+	prop("drone-dji:RelativeAltitude", "%+.2f", m.Height)
+	prop("drone-dji:FlightPitchDegree", "%+.1f", m.Pitch)
+	prop("drone-dji:FlightRollDegree", "%+.1f", m.Roll)
+	if g := m.GPS; g != nil {
+		heading := normHeading(g.Heading)
+		if heading > 180 {
+			heading -= 360 // DJI uses -180 ~ 180
+		}
+		prop("drone-dji:FlightYawDegree", "%+.1f", heading)
+		prop("drone-dji:GimbalYawDegree", "%+.1f", heading) // the camera is fixed
+		prop("exif:GPSLatitude", "%s", xmpCoord(g.Lat, "N", "S"))
+		prop("exif:GPSLongitude", "%s", xmpCoord(g.Lon, "E", "W"))
+		altRef := 0
+		if g.Alt < 0 {
+			altRef = 1
+		}
+		prop("exif:GPSAltitudeRef", "%d", altRef)
+		prop("exif:GPSAltitude", "%d/100", int(math.Round(math.Abs(g.Alt)*100)))
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	buf.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n")
+	buf.WriteString(" <rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n")
+	buf.WriteString("  <rdf:Description rdf:about=\"\"")
+	buf.WriteString("\n   xmlns:xmp=\"http://ns.adobe.com/xap/1.0/\"")
+	buf.WriteString("\n   xmlns:exif=\"http://ns.adobe.com/exif/1.0/\"")
+	buf.WriteString("\n   xmlns:drone-dji=\"http://www.dji.com/drone-dji/1.0/\"")
+	buf.WriteString("\n   xmlns:tellodesk=\"" + xmpNamespace + "\"")
+	for _, p := range props {
+		buf.WriteString(p)
+	}
+	buf.WriteString("/>\n </rdf:RDF>\n</x:xmpmeta>\n<?xpacket end=\"w\"?>")
+	return buf.Bytes()
+}
+
+// xmpCoord formats a latitude or longitude as XMP's "DDD,MM.mmmmmmK".
+func xmpCoord(deg float64, pos, neg string) string {
+	abs := math.Abs(deg)
+	d := math.Floor(abs)
+	return fmt.Sprintf("%d,%.6f%s", int(d), (abs-d)*60, hemisphere(deg, pos, neg))
+}
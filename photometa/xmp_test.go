@@ -0,0 +1,114 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package photometa
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestXMPCoord(t *testing.T) {
+	tests := []struct {
+		deg  float64
+		want string
+	}{
+		{0, "0,0.000000N"},
+		{51.5, "51,30.000000N"},
+		{-0.1278, "0,7.668000W"},
+		{151.2099, "151,12.594000E"},
+	}
+	for _, tc := range tests {
+		pos, neg := "N", "S"
+		if tc.want[len(tc.want)-1] == 'E' || tc.want[len(tc.want)-1] == 'W' {
+			pos, neg = "E", "W"
+		}
+		if got := xmpCoord(tc.deg, pos, neg); got != tc.want {
+			t.Errorf("xmpCoord(%v) = %q, want %q", tc.deg, got, tc.want)
+		}
+	}
+}
+
+// xmpProps parses an XMP packet and returns the attributes of its rdf:Description, by namespace:name.
+func xmpProps(t *testing.T, packet []byte) map[string]string {
+	t.Helper()
+	props := make(map[string]string)
+	dec := xml.NewDecoder(bytes.NewReader(packet))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("XMP is not well-formed: %v\n%s", err, packet)
+		}
+		if se, ok := tok.(xml.StartElement); ok && se.Name.Local == "Description" {
+			for _, a := range se.Attr {
+				props[a.Name.Space+":"+a.Name.Local] = a.Value
+			}
+		}
+	}
+	return props
+}
+
+func TestBuildXMP(t *testing.T) {
+	const (
+		xmpNS  = "http://ns.adobe.com/xap/1.0/"
+		exifNS = "http://ns.adobe.com/exif/1.0/"
+		djiNS  = "http://www.dji.com/drone-dji/1.0/"
+	)
+	taken := time.Date(2019, 5, 4, 13, 2, 3, 500e6, time.UTC)
+	tests := []struct {
+		name string
+		m    MetaT
+		want map[string]string
+		not  []string
+	}{
+		{"local only", MetaT{Taken: taken, X: 1, Y: -2, Height: 3.5, Yaw: -45, Pitch: 2, Roll: -1.25, Software: "Tello <&> Desk"},
+			map[string]string{
+				xmpNS + ":CreateDate":        "2019-05-04T13:02:03.5Z",
+				xmpNS + ":CreatorTool":       "Tello <&> Desk",
+				xmpNamespace + ":X":          "1.00",
+				xmpNamespace + ":Y":          "-2.00",
+				xmpNamespace + ":Yaw":        "-45.0",
+				djiNS + ":RelativeAltitude":  "+3.50",
+				djiNS + ":FlightPitchDegree": "+2.0",
+				djiNS + ":FlightRollDegree":  "-1.2",
+			},
+			[]string{exifNS + ":GPSLatitude", djiNS + ":FlightYawDegree"}},
+		{"with GPS", MetaT{Taken: taken, GPS: &GPST{Lat: 51.5, Lon: -0.1278, Alt: 12.345, Heading: 270}},
+			map[string]string{
+				exifNS + ":GPSLatitude":    "51,30.000000N",
+				exifNS + ":GPSLongitude":   "0,7.668000W",
+				exifNS + ":GPSAltitudeRef": "0",
+				exifNS + ":GPSAltitude":    "1235/100",
+				djiNS + ":FlightYawDegree": "-90.0",
+				djiNS + ":GimbalYawDegree": "-90.0",
+			},
+			[]string{xmpNS + ":CreatorTool"}},
+	}
+	for _, tc := range tests {
+		packet := buildXMP(tc.m)
+		if !bytes.HasPrefix(packet, []byte("<?xpacket begin=\"\ufeff\"")) {
+			t.Errorf("%s: packet does not start with the xpacket header", tc.name)
+		}
+		props := xmpProps(t, packet)
+		for k, want := range tc.want {
+			if got, ok := props[k]; !ok || got != want {
+				t.Errorf("%s: %s = %q, want %q", tc.name, k, got, want)
+			}
+		}
+		for _, k := range tc.not {
+			if _, ok := props[k]; ok {
+				t.Errorf("%s: %s should not be present", tc.name, k)
+			}
+		}
+	}
+}
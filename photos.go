@@ -9,23 +9,309 @@ package main
 
 import (
 	"fmt"
+	"image"
+	"image/jpeg"
 	"log"
+	"os"
 	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 
+	"github.com/Anty0/tello"
+	"github.com/SMerrony/tellodesk/photometa"
+	"github.com/SMerrony/tellodesk/track"
 	"github.com/mattn/go-gtk/gtk"
+	"golang.org/x/image/draw"
 )
 
+const (
+	photoFilePrefix = "tello_pic"
+	thumbWidth      = 160
+	thumbHeight     = 120
+)
+
+// photoT is one photo taken by TelloDesk.  The flight data is captured when the shutter is
+// pressed, the photo itself stays buffered in the drone until it is saved.
+type photoT struct {
+	id        int
+	taken     time.Time
+	meta      photometa.MetaT
+	hasMeta   bool        // false for photos found in the data directory without a sidecar file
+	filename  string      // empty while buffered
+	discarded bool        // deleted while buffered, the file is removed as soon as it is saved
+	thumb     *image.RGBA // nil until it has been made
+	thumbErr  error
+}
+
+// photoLogT lists the photos taken this session, and those found in the data directory, oldest first.
+type photoLogT struct {
+	photosMu sync.RWMutex
+	photos   []*photoT
+	lastID   int
+	gen      int // incremented on every change, so the gallery knows when to redraw
+}
+
+var photoLog photoLogT
+
 func takePhotoCB() {
-	drone.TakePicture()
+	if err := takePhoto(); err != nil {
+		log.Printf("Error taking photo: %v\n", err)
+	}
+}
+
+// takePhoto captures the flight data and asks the drone to take a photo.
+// All photos should be taken via here so that they appear in the gallery.
+func takePhoto() error {
+	now := time.Now()
+	p := &photoT{taken: now, meta: photoMeta(currentFlightData(), now), hasMeta: true}
+	if err := drone.TakePicture(); err != nil {
+		return err
+	}
+	photoLog.add(p)
+	return nil
 }
 
 func saveAllPhotosCB() {
-	n, err := drone.SaveAllPics(fmt.Sprintf("%s%ctello_pic_%s",
-		settings.DataDir, filepath.Separator, time.Now().Format(time.RFC3339))) // time.Now().Format("2006Jan2150405")
+	if _, err := saveAllPhotos(); err != nil {
+		messageDialog(win, gtk.MESSAGE_ERROR, err.Error())
+	}
+}
+
+// saveAllPhotos saves any photos taken to the data directory, each with the flight data from
+// when it was taken embedded and in a sidecar file.
+func saveAllPhotos() (n int, err error) {
+	prefix := dataFileName(photoFilePrefix, "")
+	for i := 2; fileExists(picFilename(prefix, 0)); i++ { // saved twice in one second
+		prefix = dataFileName(photoFilePrefix, fmt.Sprintf("_%d", i))
+	}
+	n, err = drone.SaveAllPics(prefix)
 	if err != nil {
 		log.Printf("Error saving photos: %s", err.Error())
-		messageDialog(win, gtk.MESSAGE_ERROR, err.Error())
 	}
 	log.Printf("Saved %d photos", n)
+	for _, p := range photoLog.saved(prefix, n) {
+		if !p.hasMeta {
+			continue
+		}
+		if err := photometa.WriteFile(p.filename, p.meta); err != nil {
+			log.Printf("Error embedding photo metadata: %v\n", err)
+		}
+		if err := photometa.WriteSidecar(p.filename, p.meta); err != nil {
+			log.Printf("Error writing photo sidecar: %v\n", err)
+		}
+	}
+	return n, err
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+// Photos are taken from the joystick reader, scripts and the headless photo ticker, which must
+// not read the settings, so photoMeta() uses its own copy of settings.GeoOrigin.
+var (
+	photoOriginMu sync.Mutex
+	photoOrigin   geoOriginT
+)
+
+// setPhotoOrigin must be called whenever settings.GeoOrigin is changed.
+func setPhotoOrigin(origin geoOriginT) {
+	photoOriginMu.Lock()
+	photoOrigin = origin
+	photoOriginMu.Unlock()
+}
+
+// photoMeta returns the metadata saved with a photo taken at t.  It has a geographic position
+// if the origin has been set for the geographic track exports.
+func photoMeta(fd tello.FlightData, t time.Time) (m photometa.MetaT) {
+	m.Taken = t
+	m.X, m.Y = float64(fd.MVO.PositionX), float64(fd.MVO.PositionY)
+	m.Height = float64(fd.Height) / 10
+	m.Yaw = float64(fd.IMU.Yaw)
+	m.Roll, m.Pitch, _ = quatToEuler(float64(fd.IMU.QuaternionW), float64(fd.IMU.QuaternionX),
+		float64(fd.IMU.QuaternionY), float64(fd.IMU.QuaternionZ))
+	photoOriginMu.Lock()
+	origin := photoOrigin
+	photoOriginMu.Unlock()
+	if origin.isSet() {
+		gp := origin.toGeo(track.PosT{HeightDm: fd.Height, MvoX: fd.MVO.PositionX, MvoY: fd.MVO.PositionY})
+		m.GPS = &photometa.GPST{Lat: gp.lat, Lon: gp.lon, Alt: gp.alt, Heading: origin.Heading + m.Yaw}
+	}
+	m.Make, m.Model = "Ryze", "Tello"
+	if simDrone != nil && drone == simDrone {
+		m.Model = "Tello Simulator"
+	}
+	m.Software = appName + " " + appVersion
+	return m
+}
+
+func (pl *photoLogT) add(p *photoT) {
+	pl.photosMu.Lock()
+	pl.lastID++
+	p.id = pl.lastID
+	pl.photos = append(pl.photos, p)
+	pl.gen++
+	pl.photosMu.Unlock()
+}
+
+// saved gives the files written by SaveAllPics(prefix) to the oldest n buffered photos; the
+// drone hands them over in the order they were taken.  Any others are still on their way.
+// Copies of the newly saved photos are returned.
+func (pl *photoLogT) saved(prefix string, n int) (newly []photoT) {
+	pl.photosMu.Lock()
+	defer pl.photosMu.Unlock()
+	ix := 0
+	kept := pl.photos[:0]
+	for _, p := range pl.photos {
+		if p.filename == "" && ix < n {
+			p.filename = picFilename(prefix, ix)
+			ix++
+			if p.discarded {
+				if err := os.Remove(p.filename); err != nil {
+					log.Printf("Error removing discarded photo: %v\n", err)
+				}
+				continue
+			}
+			newly = append(newly, *p)
+		}
+		kept = append(kept, p)
+	}
+	pl.photos = kept
+	for ; ix < n; ix++ { // not taken via takePhoto()
+		pl.lastID++
+		p := &photoT{id: pl.lastID, taken: time.Now(), filename: picFilename(prefix, ix)}
+		pl.photos = append(pl.photos, p)
+		newly = append(newly, *p)
+	}
+	pl.gen++
+	return newly
+}
+
+// picFilename matches the names given by SaveAllPics.
+func picFilename(prefix string, ix int) string {
+	return fmt.Sprintf("%s_%d.jpg", prefix, ix)
+}
+
+// loadSaved adds the photos already in dir, eg. from earlier sessions.
+func (pl *photoLogT) loadSaved(dir string) {
+	files, err := filepath.Glob(filepath.Join(dir, photoFilePrefix+"_*.jpg"))
+	if err != nil {
+		return
+	}
+	var found []*photoT
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		p := &photoT{taken: fi.ModTime(), filename: f}
+		if m, err := photometa.ReadSidecar(f); err == nil {
+			p.taken, p.meta, p.hasMeta = m.Taken, m, true
+		}
+		found = append(found, p)
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].taken.Before(found[j].taken) })
+	pl.photosMu.Lock()
+	for _, p := range found {
+		pl.lastID++
+		p.id = pl.lastID
+	}
+	pl.photos = append(found, pl.photos...)
+	pl.gen++
+	pl.photosMu.Unlock()
+}
+
+// remove deletes a saved photo's file, a buffered photo is discarded when it is saved.
+func (pl *photoLogT) remove(id int) error {
+	pl.photosMu.Lock()
+	defer pl.photosMu.Unlock()
+	for i, p := range pl.photos {
+		if p.id != id {
+			continue
+		}
+		if p.filename == "" {
+			p.discarded = true
+		} else {
+			if err := os.Remove(p.filename); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			os.Remove(photometa.SidecarName(p.filename))
+			pl.photos = append(pl.photos[:i], pl.photos[i+1:]...)
+		}
+		pl.gen++
+		break
+	}
+	return nil
+}
+
+// list returns copies of the photos and the generation they are from.
+func (pl *photoLogT) list() (photos []photoT, gen int) {
+	pl.photosMu.RLock()
+	defer pl.photosMu.RUnlock()
+	for _, p := range pl.photos {
+		photos = append(photos, *p)
+	}
+	return photos, pl.gen
+}
+
+// buffered returns the number of photos waiting to be saved, not counting discarded ones.
+func (pl *photoLogT) buffered() (n int) {
+	pl.photosMu.RLock()
+	defer pl.photosMu.RUnlock()
+	for _, p := range pl.photos {
+		if p.filename == "" && !p.discarded {
+			n++
+		}
+	}
+	return n
+}
+
+// nextThumb returns the oldest saved photo which needs a thumbnail, or nil.
+func (pl *photoLogT) nextThumb() *photoT {
+	pl.photosMu.RLock()
+	defer pl.photosMu.RUnlock()
+	for _, p := range pl.photos {
+		if p.filename != "" && p.thumb == nil && p.thumbErr == nil {
+			return p
+		}
+	}
+	return nil
+}
+
+// makeThumbs makes the missing thumbnails, it is run as a Goroutine by the gallery.
+func (pl *photoLogT) makeThumbs(done chan bool) {
+	for p := pl.nextThumb(); p != nil; p = pl.nextThumb() {
+		pl.photosMu.RLock()
+		filename := p.filename
+		pl.photosMu.RUnlock()
+		thumb, err := makeThumb(filename)
+		pl.photosMu.Lock()
+		p.thumb, p.thumbErr = thumb, err
+		pl.gen++
+		pl.photosMu.Unlock()
+	}
+	close(done)
+}
+
+// makeThumb scales a JPEG to fit thumbWidth x thumbHeight.
+func makeThumb(filename string) (*image.RGBA, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	b := img.Bounds()
+	w, h := thumbWidth, b.Dy()*thumbWidth/b.Dx()
+	if h > thumbHeight {
+		w, h = b.Dx()*thumbHeight/b.Dy(), thumbHeight
+	}
+	thumb := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.ApproxBiLinear.Scale(thumb, thumb.Bounds(), img, b, draw.Src, nil)
+	return thumb, nil
 }
@@ -0,0 +1,163 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"unsafe"
+
+	"github.com/SMerrony/tellodesk/track"
+	"github.com/mattn/go-gtk/gdk"
+	"github.com/mattn/go-gtk/glib"
+	"github.com/mattn/go-gtk/gtk"
+)
+
+const (
+	defaultPlanScale  float32 = 5.0
+	plannerCtrlHeight         = 40 // pixels reserved below the chart for the controls
+	wpPickDist        float32 = 0.5
+)
+
+type plannerTabT struct {
+	*gtk.VBox
+	mission          *missionT
+	chart            *trackChartT // the planner shares the tracker's grid and scaling
+	eventBox         *gtk.EventBox
+	heightSpin       *gtk.SpinButton
+	yawSpin          *gtk.SpinButton
+	statusLab        *gtk.Label
+	planCol, doneCol color.Color
+}
+
+func buildPlannerTab(w, h int) (pt *plannerTabT) {
+	pt = new(plannerTabT)
+	pt.VBox = gtk.NewVBox(false, 2)
+	pt.mission = newMission()
+	pt.planCol = color.RGBA{0, 0, 255, 255} // blue
+	pt.doneCol = color.RGBA{0, 160, 0, 255} // green
+
+	pt.chart = buildTrackChart(track.New(), w, h-plannerCtrlHeight, defaultPlanScale, true, false)
+	pt.eventBox = gtk.NewEventBox()
+	pt.eventBox.Add(pt.chart)
+	pt.eventBox.Connect("button-press-event", pt.chartClickCB)
+	pt.PackStart(pt.eventBox, false, false, 0)
+
+	hbox := gtk.NewHBox(false, 5)
+	hbox.PackStart(gtk.NewLabel("New Waypoint Height (m):"), false, false, 2)
+	pt.heightSpin = gtk.NewSpinButtonWithRange(0.5, 30, 0.1)
+	pt.heightSpin.SetValue(1.5)
+	hbox.PackStart(pt.heightSpin, false, false, 2)
+	hbox.PackStart(gtk.NewLabel("Yaw (°):"), false, false, 2)
+	pt.yawSpin = gtk.NewSpinButtonWithRange(-180, 180, 5)
+	hbox.PackStart(pt.yawSpin, false, false, 2)
+
+	loadBtn := gtk.NewButtonWithLabel("Load...")
+	loadBtn.Connect("clicked", loadMissionCB)
+	hbox.PackStart(loadBtn, false, false, 2)
+	saveBtn := gtk.NewButtonWithLabel("Save...")
+	saveBtn.Connect("clicked", saveMissionCB)
+	hbox.PackStart(saveBtn, false, false, 2)
+	clearBtn := gtk.NewButtonWithLabel("Clear")
+	clearBtn.Connect("clicked", func() {
+		if running, _, _ := pt.mission.progress(); !running {
+			pt.mission.clear()
+			pt.drawPlan()
+		}
+	})
+	hbox.PackStart(clearBtn, false, false, 2)
+
+	pt.statusLab = gtk.NewLabel("")
+	hbox.PackStart(pt.statusLab, false, false, 10)
+	pt.PackStart(hbox, false, false, 0)
+
+	pt.drawPlan()
+	return pt
+}
+
+// chartClickCB adds a waypoint where the chart is left-clicked and removes the nearest
+// waypoint on a right-click.  The plan cannot be edited while it is being flown.
+func (pt *plannerTabT) chartClickCB(ctx *glib.CallbackContext) {
+	if running, _, _ := pt.mission.progress(); running {
+		return
+	}
+	arg := ctx.Args(0)
+	ev := *(**gdk.EventButton)(unsafe.Pointer(&arg))
+	x, y := pt.chart.ordToX(int(ev.X)), pt.chart.ordToY(int(ev.Y))
+	switch ev.Button {
+	case 1:
+		pt.mission.addWaypoint(waypointT{
+			x:        x,
+			y:        y,
+			heightDm: int16(pt.heightSpin.GetValue() * 10),
+			yaw:      int16(pt.yawSpin.GetValueAsInt()),
+		})
+	case 3:
+		pt.mission.removeNearest(x, y, wpPickDist)
+	}
+	pt.drawPlan()
+}
+
+// drawPlan redraws the mission on the planner chart, showing progress and the drone
+// position if the mission is being flown.
+func (pt *plannerTabT) drawPlan() {
+	tc := pt.chart
+	tc.setMaxOffset(pt.mission.deriveScale(defaultPlanScale))
+	tc.drawEmptyChart()
+
+	running, current, lastErr := pt.mission.progress()
+	pt.mission.missionMu.RLock()
+	nWps := len(pt.mission.waypoints)
+	var lastX, lastY float32 // every mission starts from home
+	for i, wp := range pt.mission.waypoints {
+		col := pt.planCol
+		if i < current {
+			col = pt.doneCol
+		}
+		tc.line(lastX, lastY, wp.x, wp.y, col)
+		pt.drawWaypoint(i, wp, col)
+		lastX, lastY = wp.x, wp.y
+	}
+	pt.mission.missionMu.RUnlock()
+
+	if running {
+		fd := currentFlightData()
+		tc.drawPos(fd.MVO.PositionX, fd.MVO.PositionY, fd.IMU.Yaw)
+	}
+
+	switch {
+	case running:
+		pt.statusLab.SetText(fmt.Sprintf("Flying to waypoint %d of %d", current+1, nWps))
+	case lastErr != nil:
+		pt.statusLab.SetText(fmt.Sprintf("Mission stopped at waypoint %d: %v", current+1, lastErr))
+	case current >= nWps && nWps > 0:
+		pt.statusLab.SetText("Mission complete")
+	default:
+		pt.statusLab.SetText(fmt.Sprintf("Waypoints: %d", nWps))
+	}
+
+	tc.pbd.Data = tc.backingImage.Pix
+	tc.SetFromPixbuf(tc.pixBuf)
+}
+
+func (pt *plannerTabT) drawWaypoint(ix int, wp waypointT, col color.Color) {
+	tc := pt.chart
+	x, y := tc.xToOrd(wp.x), tc.yToOrd(wp.y)
+	drawPhysLine(tc.backingImage, x-3, y-3, x+3, y-3, col)
+	drawPhysLine(tc.backingImage, x+3, y-3, x+3, y+3, col)
+	drawPhysLine(tc.backingImage, x+3, y+3, x-3, y+3, col)
+	drawPhysLine(tc.backingImage, x-3, y+3, x-3, y-3, col)
+	drawPhysLabel(tc.backingImage, x+5, y-5, fmt.Sprintf("%d: %.1fm %d°", ix+1, float32(wp.heightDm)/10, wp.yaw), col)
+}
+
+// missionTCB is to be run at intervals (not as a goroutine) while a mission is flown
+func (pt *plannerTabT) missionTCB() bool {
+	running, _, _ := pt.mission.progress()
+	pt.drawPlan() // always draw the final state after the mission ends
+	return running
+}
@@ -0,0 +1,312 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Anty0/tello"
+	"github.com/SMerrony/tellodesk/track"
+	"github.com/mattn/go-gtk/glib"
+	"github.com/mattn/go-gtk/gtk"
+)
+
+const playbackPeriodMs = fdPeriodMs
+
+var playbackSpeeds = []struct {
+	label string
+	speed float64
+}{
+	{"¼×", 0.25}, {"½×", 0.5}, {"1×", 1}, {"2×", 2}, {"4×", 4}, {"8×", 8},
+}
+
+const playbackDefaultSpeed = 2 // index into playbackSpeeds
+
+// fdSampleT is a single FlightData sample from a flight recording.
+type fdSampleT struct {
+	timeStamp time.Time
+	fd        tello.FlightData
+}
+
+// playbackT holds the state of a flight recording being replayed.
+type playbackT struct {
+	samples  []fdSampleT
+	pos      int           // index of the latest sample applied
+	offset   time.Duration // from the first sample
+	duration time.Duration
+	playing  bool
+	speed    float64
+	updating bool // the timeline is being moved by us rather than the user
+	closed   bool
+
+	win      *gtk.Window
+	playBtn  *gtk.Button
+	timeline *gtk.HScale
+	timeLab  *gtk.Label
+}
+
+// fdField returns the (possibly nested, eg. "IMU.Yaw") field name of the FlightData v.
+func fdField(v reflect.Value, name string) (reflect.Value, bool) {
+	for _, part := range strings.Split(name, ".") {
+		if v.Kind() != reflect.Struct {
+			return v, false
+		}
+		if v = v.FieldByName(part); !v.IsValid() {
+			return v, false
+		}
+	}
+	return v, v.Kind() != reflect.Struct
+}
+
+// setFdField sets the field name of the FlightData v to value.
+func setFdField(v reflect.Value, name, value string) error {
+	v, ok := fdField(v, name)
+	if !ok {
+		return fmt.Errorf("unknown field: %s", name)
+	}
+	var err error
+	switch v.Kind() {
+	case reflect.Bool:
+		var b bool
+		b, err = strconv.ParseBool(value)
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		i, err = strconv.ParseInt(value, 10, v.Type().Bits())
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var u uint64
+		u, err = strconv.ParseUint(value, 10, v.Type().Bits())
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		f, err = strconv.ParseFloat(value, v.Type().Bits())
+		v.SetFloat(f)
+	case reflect.String:
+		v.SetString(value)
+	default:
+		return fmt.Errorf("unsupported field: %s", name)
+	}
+	return err
+}
+
+// readFlightRecording reads a CSV file written by the flight recorder.  Columns which
+// are not FlightData fields (eg. from a different version of the tello package) are ignored.
+func readFlightRecording(r io.Reader) (samples []fdSampleT, err error) {
+	cr := csv.NewReader(bufio.NewReader(r))
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	if len(header) < 2 || header[0] != "TimeStamp" {
+		return nil, errors.New("not a flight recording")
+	}
+	known := make([]bool, len(header))
+	for i, name := range header[1:] {
+		if _, known[i+1] = fdField(reflect.ValueOf(tello.FlightData{}), name); !known[i+1] {
+			log.Printf("Ignoring unknown flight recording column: %s\n", name)
+		}
+	}
+	for line := 2; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var s fdSampleT
+		if s.timeStamp, err = time.ParseInLocation(track.TimeStampFmt, row[0], time.Local); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		v := reflect.ValueOf(&s.fd).Elem()
+		for i, val := range row[1:] {
+			if known[i+1] {
+				if err = setFdField(v, header[i+1], val); err != nil {
+					return nil, fmt.Errorf("line %d: %v", line, err)
+				}
+			}
+		}
+		samples = append(samples, s)
+	}
+	if len(samples) == 0 {
+		return nil, errors.New("the recording is empty")
+	}
+	return samples, nil
+}
+
+// playbackCB asks for a flight recording and replays it through the live displays.
+func playbackCB() {
+	fs := gtk.NewFileChooserDialog("Flight Recording to Play Back",
+		win,
+		gtk.FILE_CHOOSER_ACTION_OPEN,
+		"_Cancel", gtk.RESPONSE_CANCEL, "_Play", gtk.RESPONSE_ACCEPT)
+	fs.SetCurrentFolder(settings.DataDir)
+	fs.SetLocalOnly(true)
+	ff := gtk.NewFileFilter()
+	ff.AddPattern("*.csv")
+	fs.SetFilter(ff)
+	res := fs.Run()
+	recPath := fs.GetFilename()
+	fs.Destroy()
+	if res != gtk.RESPONSE_ACCEPT || recPath == "" {
+		return
+	}
+	rec, err := os.Open(recPath)
+	if err != nil {
+		messageDialog(win, gtk.MESSAGE_ERROR, "Could not open flight recording.")
+		return
+	}
+	samples, err := readFlightRecording(rec)
+	rec.Close()
+	if err != nil {
+		log.Printf("Error reading flight recording %s: %v\n", recPath, err)
+		messageDialog(win, gtk.MESSAGE_ERROR, "Could not read flight recording.\n\n"+err.Error())
+		return
+	}
+	startPlayback(samples, filepath.Base(recPath))
+}
+
+func startPlayback(samples []fdSampleT, title string) {
+	pb := &playbackT{
+		samples:  samples,
+		duration: samples[len(samples)-1].timeStamp.Sub(samples[0].timeStamp),
+		speed:    playbackSpeeds[playbackDefaultSpeed].speed,
+	}
+	menuBar.playbackMenus(true)
+
+	pb.win = gtk.NewWindow(gtk.WINDOW_TOPLEVEL)
+	pb.win.SetTitle(appName + " Playback - " + title)
+	pb.win.SetIcon(iconPixbuf)
+	pb.win.SetTransientFor(win)
+	pb.win.SetDefaultSize(600, -1)
+	pb.win.Connect("destroy", pb.end)
+
+	vbox := gtk.NewVBox(false, 5)
+	pb.timeline = gtk.NewHScaleWithRange(0, pb.duration.Seconds()+0.1, 0.1)
+	pb.timeline.SetDrawValue(false)
+	pb.timeline.Connect("value-changed", func() {
+		if !pb.updating {
+			pb.seek(time.Duration(pb.timeline.GetValue() * float64(time.Second)))
+		}
+	})
+	vbox.PackStart(pb.timeline, false, false, 2)
+
+	hbox := gtk.NewHBox(false, 5)
+	pb.playBtn = gtk.NewButtonWithLabel("Play")
+	pb.playBtn.Connect("clicked", pb.playPause)
+	hbox.PackStart(pb.playBtn, false, false, 2)
+	hbox.PackStart(gtk.NewLabel("Speed:"), false, false, 2)
+	speedCombo := gtk.NewComboBoxText()
+	for _, s := range playbackSpeeds {
+		speedCombo.AppendText(s.label)
+	}
+	speedCombo.SetActive(playbackDefaultSpeed)
+	speedCombo.Connect("changed", func() {
+		if ix := speedCombo.GetActive(); ix >= 0 {
+			pb.speed = playbackSpeeds[ix].speed
+		}
+	})
+	hbox.PackStart(speedCombo, false, false, 2)
+	pb.timeLab = gtk.NewLabel("")
+	hbox.PackStart(pb.timeLab, false, false, 10)
+	closeBtn := gtk.NewButtonWithLabel("Close")
+	closeBtn.Connect("clicked", func() { pb.win.Destroy() })
+	hbox.PackEnd(closeBtn, false, false, 2)
+	vbox.PackStart(hbox, false, false, 2)
+
+	pb.win.Add(vbox)
+	pb.win.ShowAll()
+
+	pb.seek(0)
+	notebook.SetCurrentPage(trackPage)
+	glib.TimeoutAdd(playbackPeriodMs, pb.playbackTCB)
+}
+
+func (pb *playbackT) playPause() {
+	if !pb.playing && pb.offset >= pb.duration { // play again from the start
+		pb.seek(0)
+	}
+	pb.playing = !pb.playing
+	if pb.playing {
+		pb.playBtn.SetLabel("Pause")
+	} else {
+		pb.playBtn.SetLabel("Play")
+	}
+}
+
+// seek moves the playback to offset from the start of the recording and updates the displays.
+func (pb *playbackT) seek(offset time.Duration) {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > pb.duration {
+		offset = pb.duration
+	}
+	target := pb.samples[0].timeStamp.Add(offset)
+	if offset < pb.offset || pb.offset == 0 { // rebuild the track from the beginning
+		liveTrack = track.New()
+		trackChart.track = liveTrack
+		profileChart.track = liveTrack
+		pb.pos = 0
+		liveTrack.AddPositionIfChangedAt(pb.samples[0].fd, pb.samples[0].timeStamp)
+	}
+	for pb.pos+1 < len(pb.samples) && !pb.samples[pb.pos+1].timeStamp.After(target) {
+		pb.pos++
+		liveTrack.AddPositionIfChangedAt(pb.samples[pb.pos].fd, pb.samples[pb.pos].timeStamp)
+	}
+	pb.offset = offset
+
+	fdListener.Set(pb.samples[pb.pos].fd)
+
+	if len(liveTrack.Positions) > 2 {
+		trackChart.drawTrack()
+		profileChart.drawProfile()
+	} else {
+		trackChart.drawEmptyChart()
+		profileChart.drawEmptyChart()
+	}
+
+	pb.updating = true
+	pb.timeline.SetValue(offset.Seconds())
+	pb.updating = false
+	pb.timeLab.SetText(fmt.Sprintf("%s  (%.1fs / %.1fs)",
+		pb.samples[pb.pos].timeStamp.Format("15:04:05.0"), offset.Seconds(), pb.duration.Seconds()))
+}
+
+// playbackTCB advances the playback, it is to be run at intervals (not as a goroutine)
+func (pb *playbackT) playbackTCB() bool {
+	if pb.closed {
+		return false
+	}
+	if pb.playing {
+		pb.seek(pb.offset + time.Duration(float64(playbackPeriodMs*time.Millisecond)*pb.speed))
+		if pb.offset >= pb.duration {
+			pb.playPause()
+		}
+	}
+	return true
+}
+
+// end finishes playback, the replayed track remains on the charts as if it had been imported.
+func (pb *playbackT) end() {
+	pb.closed = true
+	fdListener.Set(tello.FlightData{})
+	menuBar.playbackMenus(false)
+}
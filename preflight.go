@@ -0,0 +1,360 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Anty0/tello"
+	"github.com/mattn/go-gtk/gdk"
+	"github.com/mattn/go-gtk/glib"
+	"github.com/mattn/go-gtk/gtk"
+	"gopkg.in/yaml.v2"
+)
+
+// Before every takeoff the pre-flight checklist is evaluated against the live FlightData.
+// Takeoff is blocked until every required check passes, or the pilot overrides it.  The
+// result is saved alongside the flight recording of the flight that follows.
+
+const (
+	defaultMinBattery       = 50 // %
+	defaultMinWifi          = 60 // %
+	preflightUpdatePeriodMs = 500
+)
+
+// preflightSettingsT is kept in the settings, zero values give a checklist with every check required.
+type preflightSettingsT struct {
+	Disabled   bool     // no checklist before takeoff
+	MinBattery int      // %, 0 means the default
+	MinWifi    int      // %, 0 means the default
+	Skip       []string `yaml:",flow"` // names of checks which are not required
+}
+
+// clone returns a copy of ps which shares nothing with the settings, for use off the GTK thread.
+func (ps preflightSettingsT) clone() preflightSettingsT {
+	ps.Skip = append([]string(nil), ps.Skip...)
+	return ps
+}
+
+func (ps preflightSettingsT) minBattery() int {
+	if ps.MinBattery == 0 {
+		return defaultMinBattery
+	}
+	return ps.MinBattery
+}
+
+func (ps preflightSettingsT) minWifi() int {
+	if ps.MinWifi == 0 {
+		return defaultMinWifi
+	}
+	return ps.MinWifi
+}
+
+func (ps preflightSettingsT) required(name string) bool {
+	for _, s := range ps.Skip {
+		if s == name {
+			return false
+		}
+	}
+	return true
+}
+
+type preflightCheckT struct {
+	name  string
+	label string
+	check func(fd tello.FlightData, ps preflightSettingsT) (ok bool, value string)
+}
+
+var preflightChecks = []preflightCheckT{
+	{"battery", "Battery", func(fd tello.FlightData, ps preflightSettingsT) (bool, string) {
+		return int(fd.BatteryPercentage) >= ps.minBattery() && !fd.BatteryLow,
+			fmt.Sprintf("%d%% (minimum %d%%)", fd.BatteryPercentage, ps.minBattery())
+	}},
+	{"wifi", "Wifi Strength", func(fd tello.FlightData, ps preflightSettingsT) (bool, string) {
+		return int(fd.WifiStrength) >= ps.minWifi(),
+			fmt.Sprintf("%d%% (minimum %d%%)", fd.WifiStrength, ps.minWifi())
+	}},
+	{"temperature", "Temperature", func(fd tello.FlightData, ps preflightSettingsT) (bool, string) {
+		if fd.OverTemp {
+			return false, fmt.Sprintf("%dC - Too Hot", fd.IMU.Temperature)
+		}
+		return true, fmt.Sprintf("%dC", fd.IMU.Temperature)
+	}},
+	{"imu", "IMU", func(fd tello.FlightData, ps preflightSettingsT) (bool, string) {
+		if fd.ImuState {
+			return true, "OK"
+		}
+		return false, "Not Ready"
+	}},
+	{"vision", "Vision Positioning (MVO)", func(fd tello.FlightData, ps preflightSettingsT) (bool, string) {
+		if fd.LightStrength != 0 {
+			return true, "OK"
+		}
+		return false, "Not Enough Light"
+	}},
+	{"home", "Home Set", func(fd tello.FlightData, ps preflightSettingsT) (bool, string) {
+		if drone.IsHomeSet() {
+			return true, "Yes"
+		}
+		return false, "No"
+	}},
+	{"recording", "Video Recording", func(fd tello.FlightData, ps preflightSettingsT) (bool, string) {
+		if isRecordingVideo() {
+			return true, "Started"
+		}
+		return false, "Not Started"
+	}},
+}
+
+// preflightItemT is the outcome of one check, it is saved with the flight.
+type preflightItemT struct {
+	Check    string
+	Value    string
+	Passed   bool
+	Required bool
+}
+
+// preflightResultT is the outcome of the whole checklist.
+type preflightResultT struct {
+	Time       string
+	Drone      string
+	Firmware   string
+	Items      []preflightItemT
+	Passed     bool
+	Overridden bool   `yaml:",omitempty"`
+	Via        string // where takeoff was requested
+}
+
+// evalChecklist runs every check against fd.
+func evalChecklist(fd tello.FlightData, ps preflightSettingsT) (res preflightResultT) {
+	res = preflightResultT{
+		Time:     time.Now().Format(time.RFC3339),
+		Drone:    fd.SSID,
+		Firmware: fd.Version,
+		Passed:   true,
+	}
+	for _, c := range preflightChecks {
+		ok, val := c.check(fd, ps)
+		req := ps.required(c.name)
+		res.Items = append(res.Items, preflightItemT{c.label, val, ok, req})
+		if req && !ok {
+			res.Passed = false
+		}
+	}
+	return res
+}
+
+// failures returns the labels of the required checks which failed.
+func (res preflightResultT) failures() (failed []string) {
+	for _, it := range res.Items {
+		if it.Required && !it.Passed {
+			failed = append(failed, it.Check)
+		}
+	}
+	return failed
+}
+
+// logChecklist records the outcome in the log and keeps it for the flight recorder.
+func logChecklist(res preflightResultT) {
+	switch {
+	case res.Passed:
+		log.Printf("Pre-flight checklist passed (%s)\n", res.Via)
+	case res.Overridden:
+		log.Printf("Pre-flight checklist OVERRIDDEN (%s), failed: %s\n", res.Via, strings.Join(res.failures(), ", "))
+	default:
+		log.Printf("Pre-flight checklist failed (%s): %s\n", res.Via, strings.Join(res.failures(), ", "))
+	}
+	flightRecorder.setChecklist(res)
+}
+
+// saveChecklist writes the result to filename.
+func saveChecklist(res preflightResultT, filename string) error {
+	bytes, err := yaml.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, bytes, 0644)
+}
+
+// preflightTakeoff takes off once the checklist has passed or been overridden.
+// It must be called on the GTK thread, other Goroutines should use glib.IdleAdd().
+func preflightTakeoff(throw bool, via string) {
+	takeoff := drone.TakeOff
+	if throw {
+		takeoff = drone.ThrowTakeOff
+	}
+	if settings.Preflight.Disabled || currentFlightData().Flying {
+		takeoff()
+		return
+	}
+	if checklistCB(via) {
+		takeoff()
+	}
+}
+
+var checklistOpen bool // only on the GTK thread
+
+// checklistCB shows the checklist, updating it live, and returns true if takeoff may go ahead.
+func checklistCB(via string) (clear bool) {
+	if checklistOpen {
+		return false
+	}
+	checklistOpen = true
+	defer func() { checklistOpen = false }()
+
+	cd := gtk.NewDialog()
+	cd.SetTitle(appName + " Pre-flight Checklist")
+	cd.SetIcon(iconPixbuf)
+	cd.SetPosition(gtk.WIN_POS_CENTER_ON_PARENT)
+
+	table := gtk.NewTable(uint(len(preflightChecks)), 3, false)
+	table.SetColSpacings(10)
+	table.SetRowSpacings(5)
+	valueLabs := make([]*gtk.Label, len(preflightChecks))
+	stateLabs := make([]*gtk.Label, len(preflightChecks))
+	for i, c := range preflightChecks {
+		lab := gtk.NewLabel(c.label + " :")
+		lab.SetAlignment(1, 0.5)
+		table.AttachDefaults(lab, 0, 1, uint(i), uint(i+1))
+		valueLabs[i] = gtk.NewLabel("")
+		valueLabs[i].SetAlignment(0, 0.5)
+		table.AttachDefaults(valueLabs[i], 1, 2, uint(i), uint(i+1))
+		stateLabs[i] = gtk.NewLabel("")
+		table.AttachDefaults(stateLabs[i], 2, 3, uint(i), uint(i+1))
+	}
+
+	var res preflightResultT
+	update := func() {
+		res = evalChecklist(currentFlightData(), settings.Preflight)
+		for i, it := range res.Items {
+			valueLabs[i].SetText(it.Value)
+			switch {
+			case it.Passed:
+				stateLabs[i].SetText("PASS")
+				stateLabs[i].ModifyFG(gtk.STATE_NORMAL, gdk.NewColor("dark green"))
+			case it.Required:
+				stateLabs[i].SetText("FAIL")
+				stateLabs[i].ModifyFG(gtk.STATE_NORMAL, gdk.NewColor("red"))
+			default:
+				stateLabs[i].SetText("(not required)")
+				stateLabs[i].ModifyFG(gtk.STATE_NORMAL, gdk.NewColor("grey"))
+			}
+		}
+		cd.SetResponseSensitive(gtk.RESPONSE_OK, res.Passed)
+		cd.SetResponseSensitive(gtk.RESPONSE_REJECT, !res.Passed)
+	}
+
+	cd.GetVBox().PackStart(table, true, true, 5)
+	cd.AddButton("Cancel", gtk.RESPONSE_CANCEL)
+	cd.AddButton("Override", gtk.RESPONSE_REJECT)
+	cd.AddButton("Take Off", gtk.RESPONSE_OK)
+	cd.SetDefaultResponse(gtk.RESPONSE_CANCEL)
+	update()
+	cd.ShowAll()
+
+	open := true
+	glib.TimeoutAdd(preflightUpdatePeriodMs, func() bool {
+		if open {
+			update()
+		}
+		return open
+	})
+	response := cd.Run()
+	open = false
+	res.Via = via
+
+	switch response {
+	case gtk.RESPONSE_OK:
+		clear = res.Passed
+	case gtk.RESPONSE_REJECT:
+		clear = confirmOverride(res)
+		res.Overridden = clear
+	}
+	cd.Destroy()
+	if clear {
+		logChecklist(res)
+	} else {
+		log.Printf("Takeoff cancelled at the pre-flight checklist (%s)\n", via)
+	}
+	return clear
+}
+
+// confirmOverride asks the pilot to confirm taking off despite failed checks.
+func confirmOverride(res preflightResultT) bool {
+	md := gtk.NewMessageDialog(win, gtk.DIALOG_MODAL, gtk.MESSAGE_WARNING, gtk.BUTTONS_YES_NO, "%s",
+		"These checks have failed:\n\n"+strings.Join(res.failures(), "\n")+
+			"\n\nTake off anyway?  The override will be recorded with the flight.")
+	md.SetTitle(appName)
+	defer md.Destroy()
+	return md.Run() == gtk.RESPONSE_YES
+}
+
+// checklistSettingsCB lets the user choose which checks are required and the limits.
+func checklistSettingsCB(ps *preflightSettingsT) {
+	sd := gtk.NewDialog()
+	sd.SetTitle(appName + " Pre-flight Checklist Settings")
+	sd.SetIcon(iconPixbuf)
+	sd.SetPosition(gtk.WIN_POS_CENTER_ON_PARENT)
+
+	table := gtk.NewTable(uint(len(preflightChecks)+2), 2, false)
+	table.SetColSpacings(5)
+	table.SetRowSpacings(5)
+	addRow := func(row uint, label string, w gtk.IWidget) {
+		lab := gtk.NewLabel(label)
+		lab.SetAlignment(1, 0.5)
+		table.AttachDefaults(lab, 0, 1, row, row+1)
+		table.AttachDefaults(w, 1, 2, row, row+1)
+	}
+	batSpin := gtk.NewSpinButtonWithRange(5, 100, 5)
+	addRow(0, "Minimum Battery (%) :", batSpin)
+	wifiSpin := gtk.NewSpinButtonWithRange(5, 100, 5)
+	addRow(1, "Minimum Wifi Strength (%) :", wifiSpin)
+	reqChecks := make([]*gtk.CheckButton, len(preflightChecks))
+	for i, c := range preflightChecks {
+		reqChecks[i] = gtk.NewCheckButtonWithLabel("Required")
+		addRow(uint(i+2), c.label+" :", reqChecks[i])
+	}
+	setFields := func(ps preflightSettingsT) {
+		batSpin.SetValue(float64(ps.minBattery()))
+		wifiSpin.SetValue(float64(ps.minWifi()))
+		for i, c := range preflightChecks {
+			reqChecks[i].SetActive(ps.required(c.name))
+		}
+	}
+	setFields(*ps)
+
+	sd.GetVBox().PackStart(table, true, true, 5)
+	sd.AddButton("Defaults", gtk.RESPONSE_APPLY)
+	sd.AddButton("Cancel", gtk.RESPONSE_CANCEL)
+	sd.AddButton("OK", gtk.RESPONSE_OK)
+	sd.SetDefaultResponse(gtk.RESPONSE_OK)
+	sd.ShowAll()
+	for {
+		response := sd.Run()
+		if response == gtk.RESPONSE_APPLY {
+			setFields(preflightSettingsT{})
+			continue
+		}
+		if response == gtk.RESPONSE_OK {
+			ps.MinBattery = batSpin.GetValueAsInt()
+			ps.MinWifi = wifiSpin.GetValueAsInt()
+			ps.Skip = nil
+			for i, c := range preflightChecks {
+				if !reqChecks[i].GetActive() {
+					ps.Skip = append(ps.Skip, c.name)
+				}
+			}
+		}
+		break
+	}
+	sd.Destroy()
+}
@@ -15,13 +15,14 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/SMerrony/tellodesk/track"
 	"github.com/mattn/go-gtk/gdkpixbuf"
 	"github.com/mattn/go-gtk/gtk"
 )
 
 type profileChartT struct {
 	*gtk.Image
-	track                                       *telloTrackT
+	track                                       *track.TrackT
 	backingImage                                *image.RGBA
 	pbd                                         gdkpixbuf.PixbufData
 	pixBuf                                      *gdkpixbuf.Pixbuf
@@ -58,7 +59,7 @@ func buildProfileChart(w, h int) (pc *profileChartT) {
 	pc.pbd.RowStride = pc.backingImage.Stride
 	pc.pbd.Data = pc.backingImage.Pix
 	pc.pixBuf = gdkpixbuf.NewPixbufFromData(pc.pbd)
-	pc.track = newTrack()
+	pc.track = track.New()
 	pc.drawEmptyChart()
 	pc.SetFromPixbuf(pc.pixBuf)
 
@@ -74,11 +75,11 @@ func (pc *profileChartT) clearChart() {
 
 func (pc *profileChartT) calcScales() {
 	// vertical (height)
-	pc.maxOffset = pc.track.deriveHeightScale()
+	pc.maxOffset = pc.track.DeriveHeightScale()
 	pc.yScalePPM = float32(pc.yOrigin) / pc.maxOffset
 	// horizontal (time)
-	if len(pc.track.positions) > 3 {
-		pc.trackDuration = pc.track.positions[len(pc.track.positions)-1].timeStamp.Sub(pc.track.positions[1].timeStamp)
+	if len(pc.track.Positions) > 3 {
+		pc.trackDuration = pc.track.Positions[len(pc.track.Positions)-1].TimeStamp.Sub(pc.track.Positions[1].TimeStamp)
 	} else {
 		pc.trackDuration = time.Minute
 	}
@@ -135,28 +136,28 @@ func (pc *profileChartT) drawEmptyChart() {
 
 func (pc *profileChartT) drawTitles() {
 	const dateFmt = "Jan 2 2006 15:04:05"
-	if len(pc.track.positions) > 1 {
+	if len(pc.track.Positions) > 1 {
 		drawPhysLabel(pc.backingImage, 40, pc.height-40, fmt.Sprintf("Flight Profile from %s to %s",
-			pc.track.positions[1].timeStamp.Format(dateFmt),
-			pc.track.positions[len(pc.track.positions)-1].timeStamp.Format("15:04:05")),
+			pc.track.Positions[1].TimeStamp.Format(dateFmt),
+			pc.track.Positions[len(pc.track.Positions)-1].TimeStamp.Format("15:04:05")),
 			pc.labelCol)
 	}
 }
 
 func (pc *profileChartT) drawProfile() {
-	if pc.track == nil || len(pc.track.positions) < 3 {
+	if pc.track == nil || len(pc.track.Positions) < 3 {
 		return
 	}
 	pc.calcScales()
 	pc.drawEmptyChart()
 
-	t0 := pc.track.positions[1].timeStamp
+	t0 := pc.track.Positions[1].TimeStamp
 	var lastT time.Duration
-	lastH := float32(pc.track.positions[1].heightDm) / 10
-	for n, pos := range pc.track.positions {
+	lastH := float32(pc.track.Positions[1].HeightDm) / 10
+	for n, pos := range pc.track.Positions {
 		if n > 1 {
-			t := pos.timeStamp.Sub(t0) // how long in (fractional) seconds
-			h := float32(pos.heightDm) / 10
+			t := pos.TimeStamp.Sub(t0) // how long in (fractional) seconds
+			h := float32(pos.HeightDm) / 10
 			// log.Printf("Debug: drawing from %d, %d to %d, %d\n", pc.xToOrd(float32(lastT.Seconds())), pc.yToOrd(lastH),
 			// 	pc.xToOrd(float32(t.Seconds())), pc.yToOrd(h))
 			drawPhysLine(pc.backingImage,
@@ -0,0 +1,324 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The restreamer lets others on the LAN watch the live feed, either in a browser or in a
+// player such as VLC, ffplay or OBS.
+//
+//   /             a page showing the MJPEG stream
+//   /video.mjpeg  the decoded frames as multipart MJPEG
+//   /video.h264   the drone's raw H.264 (Annex B) elementary stream, e.g. ffplay -f h264 <url>
+//
+// Unlike the API this listens on all interfaces, it is view-only.
+
+const (
+	defaultRestreamPort    = 8891
+	defaultRestreamQuality = 75
+	restreamFPS            = 15
+	h264ClientQueue        = 512 // packets, a client this far behind is dropped
+	mjpegBoundary          = "tellodeskframe"
+)
+
+// restreamSettingsT is kept in the settings.
+type restreamSettingsT struct {
+	Enabled bool
+	Port    int
+	Quality int // JPEG quality 1-100 for the MJPEG stream
+}
+
+type restreamerT struct {
+	rsMu        sync.Mutex
+	srv         *http.Server
+	port        int
+	h264Clients map[chan []byte]bool // false until the client has been sent an SPS
+	frame       *image.RGBA
+	frameSeq    uint64
+	quality     int        // JPEG quality, copied from the settings by start
+	encMu       sync.Mutex // held while encoding, so that each frame is only encoded once
+	jpeg        []byte
+	jpegSeq     uint64
+	viewers     int
+}
+
+var restreamer restreamerT
+
+// start runs the HTTP server on port, any previous server is stopped first.
+// The MJPEG stream is encoded at the given quality.
+func (rs *restreamerT) start(port, quality int) error {
+	rs.stop()
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", restreamIndex)
+	mux.HandleFunc("/video.mjpeg", restreamMJPEG)
+	mux.HandleFunc("/video.h264", restreamH264)
+
+	rs.rsMu.Lock()
+	rs.srv = &http.Server{Handler: mux}
+	rs.port = port
+	if quality < 1 || quality > 100 {
+		quality = defaultRestreamQuality
+	}
+	rs.quality = quality
+	if rs.h264Clients == nil {
+		rs.h264Clients = make(map[chan []byte]bool)
+	}
+	srv := rs.srv
+	rs.rsMu.Unlock()
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("Restreamer error: %v\n", err)
+		}
+	}()
+	log.Printf("Restreaming video on port %d\n", port)
+	return nil
+}
+
+// stop shuts down the HTTP server, if it is running, and disconnects all viewers.
+func (rs *restreamerT) stop() {
+	rs.rsMu.Lock()
+	srv := rs.srv
+	rs.srv = nil
+	for c := range rs.h264Clients {
+		close(c)
+		delete(rs.h264Clients, c)
+	}
+	rs.rsMu.Unlock()
+	if srv != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		srv.Shutdown(ctx)
+		cancel()
+		srv.Close() // the streams never finish by themselves
+		log.Println("Restreamer stopped")
+	}
+}
+
+// applyRestreamSettings starts, restarts or stops the restreamer to match the settings.
+func applyRestreamSettings() error {
+	s := settings.Restream
+	if !s.Enabled {
+		restreamer.stop()
+		return nil
+	}
+	restreamer.rsMu.Lock()
+	same := restreamer.srv != nil && restreamer.port == s.Port
+	restreamer.rsMu.Unlock()
+	if same {
+		return nil
+	}
+	return restreamer.start(s.Port, s.Quality)
+}
+
+// isSPS returns true if the packet begins with an H.264 sequence parameter set.
+func isSPS(pkt []byte) bool {
+	return len(pkt) > 4 && bytes.HasPrefix(pkt, []byte{0, 0, 0, 1}) && pkt[4]&0x1f == 7
+}
+
+// h264Packet passes a packet from the drone to the H.264 viewers, it is called by customReader.
+func (rs *restreamerT) h264Packet(pkt []byte) {
+	rs.rsMu.Lock()
+	defer rs.rsMu.Unlock()
+	for c, started := range rs.h264Clients {
+		if !started {
+			if !isSPS(pkt) {
+				continue
+			}
+			rs.h264Clients[c] = true
+		}
+		select {
+		case c <- pkt:
+		default:
+			log.Println("Restreamer: dropping a slow H.264 viewer")
+			close(c)
+			delete(rs.h264Clients, c)
+		}
+	}
+}
+
+// newFrame makes the latest decoded frame available to the MJPEG viewers, it is called by videoListener.
+func (rs *restreamerT) newFrame(frame *image.RGBA) {
+	rs.rsMu.Lock()
+	if rs.viewers > 0 {
+		rs.frame = frame
+		rs.frameSeq++
+	}
+	rs.rsMu.Unlock()
+}
+
+// latestJPEG returns the latest frame as a JPEG, which is only encoded once however many are watching.
+// The encoding is done without holding rsMu, so that it does not hold up the H.264 viewers.
+func (rs *restreamerT) latestJPEG() (jpg []byte, seq uint64, err error) {
+	rs.encMu.Lock()
+	defer rs.encMu.Unlock()
+	rs.rsMu.Lock()
+	frame, seq, q := rs.frame, rs.frameSeq, rs.quality
+	jpg, cached := rs.jpeg, rs.jpeg != nil && rs.jpegSeq == seq
+	rs.rsMu.Unlock()
+	if frame == nil {
+		return nil, 0, nil
+	}
+	if cached {
+		return jpg, seq, nil
+	}
+
+	var buf bytes.Buffer
+	if err = jpeg.Encode(&buf, frame, &jpeg.Options{Quality: q}); err != nil {
+		return nil, 0, err
+	}
+	rs.rsMu.Lock()
+	if rs.frame != nil { // the last viewer may have gone while encoding
+		rs.jpeg, rs.jpegSeq = buf.Bytes(), seq
+	}
+	rs.rsMu.Unlock()
+	return buf.Bytes(), seq, nil
+}
+
+// running returns true if the server is up.
+func (rs *restreamerT) running() bool {
+	rs.rsMu.Lock()
+	defer rs.rsMu.Unlock()
+	return rs.srv != nil
+}
+
+// viewerCount returns the number of people watching either stream.
+func (rs *restreamerT) viewerCount() int {
+	rs.rsMu.Lock()
+	defer rs.rsMu.Unlock()
+	return rs.viewers + len(rs.h264Clients)
+}
+
+func restreamIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html><head><title>%s Live Feed</title></head>
+<body style="margin:0;background:black">
+<img src="/video.mjpeg" style="width:100%%;height:100vh;object-fit:contain" alt="Live Feed">
+</body></html>
+`, appName)
+}
+
+// restreamMJPEG sends the decoded frames to a viewer until it goes away.
+func restreamMJPEG(w http.ResponseWriter, r *http.Request) {
+	restreamer.rsMu.Lock()
+	restreamer.viewers++
+	restreamer.rsMu.Unlock()
+	defer func() {
+		restreamer.rsMu.Lock()
+		if restreamer.viewers--; restreamer.viewers == 0 {
+			restreamer.frame, restreamer.jpeg = nil, nil
+		}
+		restreamer.rsMu.Unlock()
+	}()
+	log.Printf("Restreamer: MJPEG viewer %s connected\n", r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mjpegBoundary)
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush() // send the headers now, the first frame may be a while
+	}
+	ticker := time.NewTicker(time.Second / restreamFPS)
+	defer ticker.Stop()
+	var sent uint64
+	for {
+		select {
+		case <-r.Context().Done():
+			log.Printf("Restreamer: MJPEG viewer %s disconnected\n", r.RemoteAddr)
+			return
+		case <-ticker.C:
+		}
+		jpg, seq, err := restreamer.latestJPEG()
+		if err != nil {
+			log.Printf("Restreamer: %v\n", err)
+			return
+		}
+		if jpg == nil || seq == sent {
+			continue
+		}
+		sent = seq
+		if _, err = fmt.Fprintf(w, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n",
+			mjpegBoundary, len(jpg)); err != nil {
+			return
+		}
+		if _, err = w.Write(jpg); err != nil {
+			return
+		}
+		if _, err = w.Write([]byte("\r\n")); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// restreamH264 relays the drone's video to a viewer, starting at the next SPS so that it can be decoded.
+func restreamH264(w http.ResponseWriter, r *http.Request) {
+	c := make(chan []byte, h264ClientQueue)
+	restreamer.rsMu.Lock()
+	if restreamer.srv == nil {
+		restreamer.rsMu.Unlock()
+		http.Error(w, "Restreamer stopped", http.StatusServiceUnavailable)
+		return
+	}
+	restreamer.h264Clients[c] = false
+	restreamer.rsMu.Unlock()
+	log.Printf("Restreamer: H.264 viewer %s connected\n", r.RemoteAddr)
+	defer func() {
+		restreamer.rsMu.Lock()
+		if _, ok := restreamer.h264Clients[c]; ok {
+			delete(restreamer.h264Clients, c)
+			close(c)
+		}
+		restreamer.rsMu.Unlock()
+		log.Printf("Restreamer: H.264 viewer %s disconnected\n", r.RemoteAddr)
+	}()
+
+	w.Header().Set("Content-Type", "video/h264")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush() // send the headers now, the first frame may be a while
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case pkt, ok := <-c:
+			if !ok {
+				return
+			}
+			if _, err := w.Write(pkt); err != nil {
+				return
+			}
+			if flusher != nil && len(c) == 0 {
+				flusher.Flush()
+			}
+		}
+	}
+}
@@ -0,0 +1,535 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Anty0/tello"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Scripts are written in Lua and run in their own Goroutine, eg.
+//
+//   takeoff()
+//   set_home()
+//   climb_to(2)
+//   turn_by(90)
+//   move(3)
+//   photo()
+//   fly_to(0, 0)
+//   land()
+//
+// Only the base, table, string and math libraries are available, plus the drone functions
+// registered by newScriptState().  The manoeuvres block until they are complete.  Aborting
+// a script stops it immediately, centres the sticks and cancels the autopilot, so the drone
+// hovers.  No GTK funcs may be called from here, the output is passed to scriptOutput.
+
+const (
+	scriptPollPeriod  = 100 * time.Millisecond
+	scriptTakeoffWait = 15 * time.Second // for the drone to report flying
+	scriptLandingWait = 30 * time.Second
+	scriptClaimant    = "a script"
+)
+
+// scriptRunnerT runs one script at a time.
+type scriptRunnerT struct {
+	scriptMu sync.Mutex
+	running  bool
+	name     string
+	cancel   context.CancelFunc
+	done     chan bool
+	lastErr  error
+
+	holdMu sync.Mutex
+	held   *tello.StickMessage // re-sent by stickHolder while not nil
+}
+
+var (
+	scripter     scriptRunnerT
+	scriptOutput = func(line string) { log.Println("Script: " + line) }
+
+	errScriptAborted = errors.New("aborted by pilot")
+)
+
+// start runs the Lua source src in a new Goroutine, name is used in error messages.
+func (sr *scriptRunnerT) start(name, src string) error {
+	sr.scriptMu.Lock()
+	defer sr.scriptMu.Unlock()
+	if sr.running {
+		return errors.New("a script is already running")
+	}
+	if active, _, _, _ := linkWatchdog.status(); !active {
+		return errors.New("the drone is not connected")
+	}
+	if plannerTab != nil {
+		if running, _, _ := plannerTab.mission.progress(); running {
+			return errors.New("a mission is being flown")
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sr.running, sr.name, sr.cancel, sr.lastErr = true, name, cancel, nil
+	sr.done = make(chan bool)
+	sc := &scriptCtxT{ctx: ctx, sr: sr, preflight: settings.Preflight.clone()}
+	go sr.stickHolder(ctx)
+	go sr.run(sc, name, src, sr.done)
+	return nil
+}
+
+// run is the script Goroutine.
+func (sr *scriptRunnerT) run(sc *scriptCtxT, name, src string, done chan bool) {
+	log.Printf("Script: running %s\n", name)
+	L := newScriptState(sc)
+	err := runScriptChunk(L, name, src)
+	L.Close()
+	aborted := sc.ctx.Err() != nil
+	sr.holdSticks(nil) // in case the script left the sticks deflected
+	releaseSticks(scriptClaimant)
+
+	sr.scriptMu.Lock()
+	sr.running = false
+	sr.cancel()
+	switch {
+	case aborted:
+		sr.lastErr = errScriptAborted
+		scriptOutput("Aborted")
+	case err != nil:
+		sr.lastErr = err
+		scriptOutput("Error: " + err.Error())
+	default:
+		scriptOutput("Finished")
+	}
+	sr.scriptMu.Unlock()
+	close(done)
+}
+
+func runScriptChunk(L *lua.LState, name, src string) error {
+	fn, err := L.Load(strings.NewReader(src), name)
+	if err != nil {
+		return err
+	}
+	L.Push(fn)
+	return L.PCall(0, lua.MultRet, nil)
+}
+
+// abort stops any running script at once and leaves the drone hovering.
+func (sr *scriptRunnerT) abort() {
+	sr.scriptMu.Lock()
+	running := sr.running
+	if running {
+		sr.cancel()
+	}
+	sr.scriptMu.Unlock()
+	if running {
+		log.Println("Script: aborting")
+		sr.holdSticks(nil)
+		releaseSticks(scriptClaimant)
+		drone.CancelAutoFlyToHeight()
+		drone.CancelAutoFlyToXY()
+		drone.CancelAutoTurn()
+	}
+}
+
+// wait blocks until the script Goroutine has ended.
+func (sr *scriptRunnerT) wait() {
+	sr.scriptMu.Lock()
+	done := sr.done
+	sr.scriptMu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// progress returns a snapshot of the runner's state.
+func (sr *scriptRunnerT) progress() (running bool, name string, lastErr error) {
+	sr.scriptMu.Lock()
+	defer sr.scriptMu.Unlock()
+	return sr.running, sr.name, sr.lastErr
+}
+
+// holdSticks moves the sticks to sm and keeps them there, limited by the geofence, until it is
+// called again.  A nil sm centres the sticks and lets them go, so that the autopilot may fly.
+func (sr *scriptRunnerT) holdSticks(sm *tello.StickMessage) {
+	sr.holdMu.Lock()
+	defer sr.holdMu.Unlock()
+	sr.held = sm
+	if sm == nil {
+		sendSticks(tello.StickMessage{})
+	} else {
+		sendSticks(fenceGuard.limit(*sm))
+	}
+}
+
+// stickHolder is run as a Goroutine while a script runs.  Like the joystick and keyboard readers
+// it re-sends the held sticks every jsUpdatePeriod, limited afresh as the drone nears the geofence.
+func (sr *scriptRunnerT) stickHolder(ctx context.Context) {
+	ticker := time.NewTicker(jsUpdatePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		sr.holdMu.Lock()
+		if sr.held != nil {
+			sendSticks(fenceGuard.limit(*sr.held))
+		}
+		sr.holdMu.Unlock()
+	}
+}
+
+// sendSticks passes sm to the drone if the stick relay is running.
+func sendSticks(sm tello.StickMessage) {
+	stickRelayMu.Lock()
+	on := stickRelayOn
+	stickRelayMu.Unlock()
+	if on {
+		stickChan <- sm
+	}
+}
+
+// newScriptState returns a Lua state with the drone functions of sc registered, it stops
+// running Lua when sc.ctx is cancelled.
+func newScriptState(sc *scriptCtxT) (L *lua.LState) {
+	L = lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	L.SetContext(sc.ctx)
+	for name, fn := range map[string]lua.LGFunction{
+		"print":       sc.print,
+		"takeoff":     sc.takeoff,
+		"land":        sc.land,
+		"set_home":    sc.setHome,
+		"fly_to":      sc.flyTo,
+		"move":        sc.move,
+		"climb_to":    sc.climbTo,
+		"turn_to":     sc.turnTo,
+		"turn_by":     sc.turnBy,
+		"flip":        sc.flip,
+		"photo":       sc.photo,
+		"sticks":      sc.sticks,
+		"hover":       sc.hover,
+		"wait":        sc.wait,
+		"wait_until":  sc.waitUntil,
+		"flight_data": sc.flightData,
+	} {
+		L.SetGlobal(name, L.NewFunction(fn))
+	}
+	return L
+}
+
+// scriptCtxT holds the funcs callable from Lua, they raise a Lua error if they fail.
+type scriptCtxT struct {
+	ctx       context.Context
+	sr        *scriptRunnerT
+	preflight preflightSettingsT // copied by start(), the settings are not safe to read here
+}
+
+// check raises a Lua error if err is not nil, or if the script has been aborted.
+func (sc *scriptCtxT) check(L *lua.LState, err error) {
+	if sc.ctx.Err() != nil {
+		err = errScriptAborted
+	}
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+}
+
+// sleep waits for d, returning early with an error if the script is aborted.
+func (sc *scriptCtxT) sleep(d time.Duration) error {
+	select {
+	case <-sc.ctx.Done():
+		return errScriptAborted
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// waitFor polls cond until it is true, ok is false if it is still false after wait.
+func (sc *scriptCtxT) waitFor(cond func() bool, wait time.Duration) (ok bool, err error) {
+	giveUp := time.Now().Add(wait)
+	for !cond() {
+		if time.Now().After(giveUp) {
+			return false, nil
+		}
+		if err = sc.sleep(scriptPollPeriod); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// waitForAuto blocks until an autopilot manoeuvre completes, it is cancelled if the script is aborted.
+func (sc *scriptCtxT) waitForAuto(done chan bool, err error) error {
+	if err != nil {
+		return err
+	}
+	select {
+	case ok := <-done:
+		if !ok {
+			return errors.New("manoeuvre cancelled")
+		}
+	case <-sc.ctx.Done():
+		return errScriptAborted
+	}
+	return nil
+}
+
+// print(...) writes its arguments to the script console
+func (sc *scriptCtxT) print(L *lua.LState) int {
+	parts := make([]string, L.GetTop())
+	for i := range parts {
+		parts[i] = L.ToStringMeta(L.Get(i + 1)).String()
+	}
+	scriptOutput(strings.Join(parts, "\t"))
+	return 0
+}
+
+// takeoff([override]) takes off if the pre-flight checklist passes, or override is true,
+// and waits until the drone is flying.
+func (sc *scriptCtxT) takeoff(L *lua.LState) int {
+	override := L.OptBool(1, false)
+	fd := currentFlightData()
+	if fd.Flying {
+		return 0
+	}
+	if !sc.preflight.Disabled {
+		res := evalChecklist(fd, sc.preflight)
+		res.Via = "script"
+		if !res.Passed {
+			if !override {
+				L.RaiseError("pre-flight checklist failed: %s", strings.Join(res.failures(), ", "))
+			}
+			res.Overridden = true
+		}
+		logChecklist(res)
+	}
+	drone.TakeOff()
+	ok, err := sc.waitFor(func() bool { return currentFlightData().Flying }, scriptTakeoffWait)
+	if err == nil && !ok {
+		err = errors.New("did not take off")
+	}
+	sc.check(L, err)
+	return 0
+}
+
+// land() lands and waits until the drone has landed.
+func (sc *scriptCtxT) land(L *lua.LState) int {
+	drone.Land()
+	ok, err := sc.waitFor(func() bool { return !currentFlightData().Flying }, scriptLandingWait)
+	if err == nil && !ok {
+		err = errors.New("did not land")
+	}
+	sc.check(L, err)
+	return 0
+}
+
+// set_home() makes the current position home, ie. (0, 0) for fly_to.
+func (sc *scriptCtxT) setHome(L *lua.LState) int {
+	sc.check(L, setHome())
+	return 0
+}
+
+// fly_to(x, y) flies to x, y metres from home.
+func (sc *scriptCtxT) flyTo(L *lua.LState) int {
+	x, y := float32(L.CheckNumber(1)), float32(L.CheckNumber(2))
+	sc.check(L, sc.waitForAuto(drone.AutoFlyToXY(x, y)))
+	return 0
+}
+
+// move(forward [, right]) flies forward and right by the given metres, relative to the drone's heading.
+func (sc *scriptCtxT) move(L *lua.LState) int {
+	fwd, right := float64(L.CheckNumber(1)), float64(L.OptNumber(2, 0))
+	fd := currentFlightData()
+	yawRad := float64(fd.IMU.Yaw) * math.Pi / 180
+	x := float64(fd.MVO.PositionX) + fwd*math.Sin(yawRad) + right*math.Cos(yawRad)
+	y := float64(fd.MVO.PositionY) + fwd*math.Cos(yawRad) - right*math.Sin(yawRad)
+	sc.check(L, sc.waitForAuto(drone.AutoFlyToXY(float32(x), float32(y))))
+	return 0
+}
+
+// climb_to(height) climbs or descends to height metres.
+func (sc *scriptCtxT) climbTo(L *lua.LState) int {
+	dm := int16(math.Round(float64(L.CheckNumber(1)) * 10))
+	sc.check(L, sc.waitForAuto(drone.AutoFlyToHeight(dm)))
+	return 0
+}
+
+// turn_to(yaw) turns to yaw degrees (-180 ~ 180), 0 being the heading at take-off.
+func (sc *scriptCtxT) turnTo(L *lua.LState) int {
+	yaw := int16(math.Round(float64(L.CheckNumber(1))))
+	sc.check(L, sc.waitForAuto(drone.AutoTurnToYaw(yaw)))
+	return 0
+}
+
+// turn_by(degrees) turns clockwise by degrees, anticlockwise if negative.
+func (sc *scriptCtxT) turnBy(L *lua.LState) int {
+	yaw := math.Remainder(float64(currentFlightData().IMU.Yaw)+float64(L.CheckNumber(1)), 360)
+	sc.check(L, sc.waitForAuto(drone.AutoTurnToYaw(int16(math.Round(yaw)))))
+	return 0
+}
+
+// flip(direction) flips "forward", "back", "left" or "right".
+func (sc *scriptCtxT) flip(L *lua.LState) int {
+	sc.check(L, nil)
+	switch dir := L.CheckString(1); dir {
+	case "forward":
+		drone.ForwardFlip()
+	case "back":
+		drone.BackFlip()
+	case "left":
+		drone.LeftFlip()
+	case "right":
+		drone.RightFlip()
+	default:
+		L.ArgError(1, "direction must be forward, back, left or right")
+	}
+	return 0
+}
+
+// photo() takes a photo, it is saved with the others.
+func (sc *scriptCtxT) photo(L *lua.LState) int {
+	sc.check(L, takePhoto())
+	return 0
+}
+
+// sticks(lx, ly, rx, ry [, seconds]) moves the sticks, each in the range -1 ~ 1.  Lx/Ly move
+// the drone right/forward, Rx turns and Ry climbs.  If seconds is given the sticks are held
+// for that long and then centred, otherwise they stay put until moved again or hover() is called.
+// The script keeps the sticks from then until it ends, the joystick and keyboard are ignored
+// unless the pilot pushes a stick far enough to take over (see pilotOverride).
+func (sc *scriptCtxT) sticks(L *lua.LState) int {
+	var sm tello.StickMessage
+	for i, v := range []*int16{&sm.Lx, &sm.Ly, &sm.Rx, &sm.Ry} {
+		f := math.Max(-1, math.Min(1, float64(L.CheckNumber(i+1))))
+		*v = int16(f * maxVal)
+	}
+	secs := float64(L.OptNumber(5, 0))
+	stickRelayMu.Lock()
+	on := stickRelayOn
+	stickRelayMu.Unlock()
+	if !on {
+		L.RaiseError("the stick listener is not running")
+	}
+	sc.check(L, nil)
+	if err := claimSticks(scriptClaimant, 0); err != nil {
+		L.RaiseError("%v", err)
+	}
+	sc.sr.holdSticks(&sm)
+	if secs > 0 {
+		err := sc.sleep(time.Duration(secs * float64(time.Second)))
+		sc.sr.holdSticks(nil)
+		sc.check(L, err)
+	}
+	return 0
+}
+
+// hover([seconds]) centres the sticks and optionally waits.
+func (sc *scriptCtxT) hover(L *lua.LState) int {
+	sc.sr.holdSticks(nil)
+	sc.check(L, sc.sleep(time.Duration(float64(L.OptNumber(1, 0))*float64(time.Second))))
+	return 0
+}
+
+// wait(seconds)
+func (sc *scriptCtxT) wait(L *lua.LState) int {
+	sc.check(L, sc.sleep(time.Duration(float64(L.CheckNumber(1))*float64(time.Second))))
+	return 0
+}
+
+// wait_until(func [, timeout]) calls func until it returns true, eg.
+//
+//	wait_until(function() return flight_data().height > 1.5 end, 10)
+//
+// It returns false if the timeout (default 60s) passes first.
+func (sc *scriptCtxT) waitUntil(L *lua.LState) int {
+	fn := L.CheckFunction(1)
+	timeout := time.Duration(float64(L.OptNumber(2, 60)) * float64(time.Second))
+	ok, err := sc.waitFor(func() bool {
+		if err := L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}); err != nil {
+			L.RaiseError("%v", err)
+		}
+		ret := L.Get(-1)
+		L.Pop(1)
+		return lua.LVAsBool(ret)
+	}, timeout)
+	sc.check(L, err)
+	L.Push(lua.LBool(ok))
+	return 1
+}
+
+// flight_data() returns a table of the latest flight data, distances in metres.
+func (sc *scriptCtxT) flightData(L *lua.LState) int {
+	fd := currentFlightData()
+	t := L.NewTable()
+	for k, v := range map[string]lua.LValue{
+		"height":         lua.LNumber(float64(fd.Height) / 10),
+		"x":              lua.LNumber(fd.MVO.PositionX),
+		"y":              lua.LNumber(fd.MVO.PositionY),
+		"yaw":            lua.LNumber(fd.IMU.Yaw),
+		"battery":        lua.LNumber(fd.BatteryPercentage),
+		"battery_low":    lua.LBool(fd.BatteryLow),
+		"wifi":           lua.LNumber(fd.WifiStrength),
+		"flying":         lua.LBool(fd.Flying),
+		"on_ground":      lua.LBool(fd.OnGround),
+		"vertical_speed": lua.LNumber(fd.VerticalSpeed),
+		"ground_speed":   lua.LNumber(fd.GroundSpeed),
+		"home_set":       lua.LBool(drone.IsHomeSet()),
+	} {
+		t.RawSetString(k, v)
+	}
+	L.Push(t)
+	return 1
+}
+
+// describeScriptFuncs is the help text for the script console.
+func describeScriptFuncs() string {
+	return fmt.Sprintf(`Lua Script Functions
+
+takeoff([override])         take off if the pre-flight checklist passes
+land()
+set_home()                  the current position becomes (0, 0)
+fly_to(x, y)                metres from home
+move(forward [, right])     metres, relative to the current heading
+climb_to(height)            metres
+turn_to(yaw)                degrees, -180 ~ 180
+turn_by(degrees)            +ve clockwise
+flip(direction)             "forward", "back", "left" or "right"
+photo()
+sticks(lx, ly, rx, ry [, seconds])   -1 ~ 1, centred after seconds if given,
+                            the joystick and keyboard are ignored from then until
+                            the script ends, unless a stick is pushed a quarter of
+                            the way, which aborts it; fails if the HTTP API has them
+hover([seconds])            centre the sticks
+wait(seconds)
+wait_until(func [, timeout])   returns false after timeout (default 60s)
+flight_data()               height, x, y, yaw, battery, flying etc.
+print(...)                  to the console
+
+Manoeuvres wait until they are complete (or %v for take-off).
+Abort centres the sticks and cancels the autopilot, leaving the drone hovering.`, scriptTakeoffWait)
+}
@@ -0,0 +1,216 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/mattn/go-gtk/gtk"
+)
+
+const (
+	scriptCtrlHeight  = 40 // pixels reserved for the controls
+	scriptConsoleFrac = 3  // the console gets 1/scriptConsoleFrac of the height
+	scriptUpdateMs    = 250
+	scriptMaxLines    = 500 // kept in the console
+)
+
+const exampleScript = `-- Take a photo 3m ahead and come back, see Functions... for what is available
+takeoff()
+set_home()
+climb_to(2)
+turn_by(90)
+move(3)
+hover(1)
+photo()
+fly_to(0, 0)
+land()
+`
+
+type scriptTabT struct {
+	*gtk.VBox
+	editor    *gtk.TextView
+	console   *gtk.TextView
+	runBtn    *gtk.Button
+	abortBtn  *gtk.Button
+	statusLab *gtk.Label
+	filename  string
+
+	outMu   sync.Mutex
+	pending []string // output waiting for scriptTCB
+	lines   []string // shown in the console
+}
+
+func buildScriptTab(w, h int) (st *scriptTabT) {
+	st = new(scriptTabT)
+	st.VBox = gtk.NewVBox(false, 2)
+
+	st.editor = gtk.NewTextView()
+	st.editor.ModifyFontEasy("Monospace 11")
+	st.editor.GetBuffer().SetText(exampleScript)
+	edSW := gtk.NewScrolledWindow(nil, nil)
+	edSW.SetPolicy(gtk.POLICY_AUTOMATIC, gtk.POLICY_AUTOMATIC)
+	edSW.Add(st.editor)
+
+	st.console = gtk.NewTextView()
+	st.console.ModifyFontEasy("Monospace 10")
+	st.console.SetEditable(false)
+	st.console.SetCursorVisible(false)
+	conSW := gtk.NewScrolledWindow(nil, nil)
+	conSW.SetPolicy(gtk.POLICY_AUTOMATIC, gtk.POLICY_AUTOMATIC)
+	conSW.Add(st.console)
+
+	paned := gtk.NewVPaned()
+	paned.Pack1(edSW, true, false)
+	paned.Pack2(conSW, true, false)
+	paned.SetSizeRequest(w, h-scriptCtrlHeight)
+	paned.SetPosition((h - scriptCtrlHeight) * (scriptConsoleFrac - 1) / scriptConsoleFrac)
+	st.PackStart(paned, true, true, 0)
+
+	hbox := gtk.NewHBox(false, 5)
+	loadBtn := gtk.NewButtonWithLabel("Load...")
+	loadBtn.Connect("clicked", loadScriptCB)
+	hbox.PackStart(loadBtn, false, false, 2)
+	saveBtn := gtk.NewButtonWithLabel("Save...")
+	saveBtn.Connect("clicked", saveScriptCB)
+	hbox.PackStart(saveBtn, false, false, 2)
+	st.runBtn = gtk.NewButtonWithLabel("Run")
+	st.runBtn.Connect("clicked", runScriptCB)
+	hbox.PackStart(st.runBtn, false, false, 2)
+	st.abortBtn = gtk.NewButtonWithLabel("Abort")
+	st.abortBtn.Connect("clicked", scripter.abort)
+	st.abortBtn.SetSensitive(false)
+	hbox.PackStart(st.abortBtn, false, false, 2)
+	helpBtn := gtk.NewButtonWithLabel("Functions...")
+	helpBtn.Connect("clicked", func() { messageDialog(win, gtk.MESSAGE_INFO, describeScriptFuncs()) })
+	hbox.PackStart(helpBtn, false, false, 2)
+	st.statusLab = gtk.NewLabel("")
+	hbox.PackStart(st.statusLab, false, false, 10)
+	st.PackStart(hbox, false, false, 0)
+
+	scriptOutput = st.output
+	return st
+}
+
+// output queues a line for the console, it may be called from any Goroutine.
+func (st *scriptTabT) output(line string) {
+	st.outMu.Lock()
+	st.pending = append(st.pending, line)
+	st.outMu.Unlock()
+}
+
+// scriptTCB shows any new output in the console and the runner's state.
+func (st *scriptTabT) scriptTCB() bool {
+	st.outMu.Lock()
+	pending := st.pending
+	st.pending = nil
+	st.outMu.Unlock()
+	if len(pending) > 0 {
+		st.lines = append(st.lines, pending...)
+		if len(st.lines) > scriptMaxLines {
+			st.lines = st.lines[len(st.lines)-scriptMaxLines:]
+		}
+		buf := st.console.GetBuffer()
+		buf.SetText(strings.Join(st.lines, "\n"))
+		var end gtk.TextIter
+		buf.GetEndIter(&end)
+		st.console.ScrollToIter(&end, 0, false, 0, 0)
+	}
+
+	running, name, lastErr := scripter.progress()
+	st.runBtn.SetSensitive(!running)
+	st.abortBtn.SetSensitive(running)
+	switch {
+	case running:
+		st.statusLab.SetText("Running " + name)
+	case lastErr != nil:
+		st.statusLab.SetText(name + " stopped: " + strings.SplitN(lastErr.Error(), "\n", 2)[0]) // no traceback
+	case name != "":
+		st.statusLab.SetText(name + " finished")
+	}
+	return true // continue the timer
+}
+
+// source returns the script in the editor.
+func (st *scriptTabT) source() string {
+	var start, end gtk.TextIter
+	buf := st.editor.GetBuffer()
+	buf.GetStartIter(&start)
+	buf.GetEndIter(&end)
+	return buf.GetText(&start, &end, false)
+}
+
+// runScriptCB runs the script in the editor, its output is shown in the console.
+func runScriptCB() {
+	name := "script"
+	if scriptTab.filename != "" {
+		name = filepath.Base(scriptTab.filename)
+	}
+	if err := scripter.start(name, scriptTab.source()); err != nil {
+		messageDialog(win, gtk.MESSAGE_ERROR, "Could not run the script.\n\n"+err.Error())
+		return
+	}
+	scriptTab.output("Running " + name)
+}
+
+// loadScriptCB replaces the script in the editor with one loaded from a file.
+func loadScriptCB() {
+	fs := gtk.NewFileChooserDialog("Script to Load",
+		win,
+		gtk.FILE_CHOOSER_ACTION_OPEN,
+		"_Cancel", gtk.RESPONSE_CANCEL, "_Load", gtk.RESPONSE_ACCEPT)
+	fs.SetCurrentFolder(settings.DataDir)
+	fs.SetLocalOnly(true)
+	ff := gtk.NewFileFilter()
+	ff.AddPattern("*.lua")
+	fs.SetFilter(ff)
+	res := fs.Run()
+	if res == gtk.RESPONSE_ACCEPT {
+		if impPath := fs.GetFilename(); impPath != "" {
+			src, err := ioutil.ReadFile(impPath)
+			if err != nil {
+				messageDialog(win, gtk.MESSAGE_INFO, "Could not open script file.")
+			} else {
+				scriptTab.editor.GetBuffer().SetText(string(src))
+				scriptTab.filename = impPath
+			}
+		}
+	}
+	fs.Destroy()
+}
+
+// saveScriptCB saves the script in the editor.  The user is prompted for a filename.
+func saveScriptCB() {
+	fs := gtk.NewFileChooserDialog(
+		"File for Script",
+		win,
+		gtk.FILE_CHOOSER_ACTION_SAVE, "_Cancel", gtk.RESPONSE_CANCEL, "_Save", gtk.RESPONSE_ACCEPT)
+	if scriptTab.filename != "" {
+		fs.SetCurrentFolder(filepath.Dir(scriptTab.filename))
+	} else {
+		fs.SetCurrentFolder(settings.DataDir)
+	}
+	fs.SetLocalOnly(true)
+	ff := gtk.NewFileFilter()
+	ff.AddPattern("*.lua")
+	fs.SetFilter(ff)
+	res := fs.Run()
+	if res == gtk.RESPONSE_ACCEPT {
+		if expPath := fs.GetFilename(); expPath != "" {
+			if err := ioutil.WriteFile(expPath, []byte(scriptTab.source()), 0644); err != nil {
+				messageDialog(win, gtk.MESSAGE_ERROR, "Could not write script file.")
+			} else {
+				scriptTab.filename = expPath
+			}
+		}
+	}
+	fs.Destroy()
+}
@@ -11,16 +11,32 @@ import (
 	"io/ioutil"
 	"log"
 
+	"github.com/SMerrony/tellodesk/joymap"
 	"github.com/mattn/go-gtk/gtk"
 	"gopkg.in/yaml.v2"
 )
 
 // settings holds the settings we want to persist across program invocations
 type settingsT struct {
-	JoystickID   int
-	JoystickType string
-	DataDir      string
-	WideVideo    bool
+	JoystickID       int
+	JoystickType     string
+	DataDir          string
+	WideVideo        bool
+	RecordAudio      bool // from this computer, while recording video
+	TelemetrySubs    bool // save flight data as .srt subtitles with recorded video
+	KeyboardControl  bool
+	KeyBindings      keyBindingsT
+	StickProfiles    map[string]joymap.ProfileT // keyed by joystick type
+	GeoOrigin        geoOriginT                 // used for geographic track exports
+	FailsafeLow      int                        // fsLow... action on BatteryLow
+	FailsafeCritical int                        // fsCritical... action on BatteryCritical
+	Geofence         geofenceT
+	Connection       connectionT    // the drone last connected to
+	RecentDrones     []recentDroneT // most recent first
+	API              apiSettingsT
+	Restream         restreamSettingsT
+	Preflight        preflightSettingsT
+	HUD              hudSettingsT
 }
 
 func saveSettings(s settingsT, filename string) error {
@@ -50,7 +66,7 @@ func settingsCB() {
 	sd.SetIcon(iconPixbuf)
 	sd.SetPosition(gtk.WIN_POS_CENTER_ON_PARENT)
 
-	table := gtk.NewTable(6, 3, false)
+	table := gtk.NewTable(13, 3, false)
 	table.SetColSpacings(5)
 	table.SetRowSpacings(5)
 
@@ -82,6 +98,52 @@ func settingsCB() {
 	}
 	table.AttachDefaults(chosenTypeCombo, 2, 3, 1, 2)
 
+	wizBtn := gtk.NewButtonWithLabel("New Joystick Type...")
+	wizBtn.Connect("clicked", func() {
+		if foundCombo.GetActive() < 0 || foundCombo.GetActive() >= len(found) {
+			messageDialog(win, gtk.MESSAGE_INFO, "Please select a detected joystick first.")
+			return
+		}
+		name, ok := jsWizardCB(found[foundCombo.GetActive()].ID)
+		if !ok {
+			return
+		}
+		for i, k := range known {
+			if k.Name == name { // an existing configuration was replaced
+				chosenTypeCombo.SetActive(i)
+				return
+			}
+		}
+		known = append(known, &KnownJs{len(known), name, joymap.ConfigT{Name: name}})
+		chosenTypeCombo.AppendText(name)
+		chosenTypeCombo.SetActive(len(known) - 1)
+	})
+	table.AttachDefaults(wizBtn, 2, 3, 5, 6)
+
+	profiles := make(map[string]joymap.ProfileT)
+	for k, sp := range settings.StickProfiles {
+		profiles[k] = sp
+	}
+	respBtn := gtk.NewButtonWithLabel("Stick Response...")
+	respBtn.Connect("clicked", func() {
+		jsType := chosenTypeCombo.GetActiveText()
+		if jsType == "" {
+			messageDialog(win, gtk.MESSAGE_INFO, "Please select a joystick type first.")
+			return
+		}
+		jsid := -1
+		if ix := foundCombo.GetActive(); ix >= 0 && ix < len(found) {
+			jsid = found[ix].ID
+		}
+		sp, ok := profiles[jsType]
+		if !ok {
+			sp = joymap.DefaultProfile()
+		}
+		stickResponseCB(&sp, jsType, jsid)
+		profiles[jsType] = sp
+	})
+	table.AttachDefaults(respBtn, 1, 2, 5, 6)
+
 	ddLab := gtk.NewLabel("Data Directory :")
 	ddLab.SetAlignment(1, 0.5)
 	table.AttachDefaults(ddLab, 0, 1, 2, 3)
@@ -114,6 +176,96 @@ func settingsCB() {
 		vm.SetActive(true)
 	}
 	table.AttachDefaults(vm, 1, 2, 3, 4)
+	ra := gtk.NewCheckButtonWithLabel("Record Sound (needs ffmpeg)")
+	ra.SetActive(settings.RecordAudio)
+	table.AttachDefaults(ra, 2, 3, 3, 4)
+
+	kbLab := gtk.NewLabel("Keyboard :")
+	kbLab.SetAlignment(1, 0.5)
+	table.AttachDefaults(kbLab, 0, 1, 4, 5)
+	kbc := gtk.NewCheckButtonWithLabel("Keyboard Control")
+	kbc.SetActive(settings.KeyboardControl)
+	table.AttachDefaults(kbc, 1, 2, 4, 5)
+	bindings := settings.KeyBindings
+	kbBtn := gtk.NewButtonWithLabel("Key Bindings...")
+	kbBtn.Connect("clicked", func() { keyBindingsCB(&bindings) })
+	table.AttachDefaults(kbBtn, 2, 3, 4, 5)
+
+	fsLowLab := gtk.NewLabel("Battery Low :")
+	fsLowLab.SetAlignment(1, 0.5)
+	table.AttachDefaults(fsLowLab, 0, 1, 6, 7)
+	fsLowCombo := gtk.NewComboBoxText()
+	for _, a := range fsLowActions {
+		fsLowCombo.AppendText(a)
+	}
+	fsLowCombo.SetActive(settings.FailsafeLow)
+	table.AttachDefaults(fsLowCombo, 1, 2, 6, 7)
+	fsCritLab := gtk.NewLabel("Battery Critical :")
+	fsCritLab.SetAlignment(1, 0.5)
+	table.AttachDefaults(fsCritLab, 0, 1, 7, 8)
+	fsCritCombo := gtk.NewComboBoxText()
+	for _, a := range fsCriticalActions {
+		fsCritCombo.AppendText(a)
+	}
+	fsCritCombo.SetActive(settings.FailsafeCritical)
+	table.AttachDefaults(fsCritCombo, 1, 2, 7, 8)
+
+	apiLab := gtk.NewLabel("HTTP API :")
+	apiLab.SetAlignment(1, 0.5)
+	table.AttachDefaults(apiLab, 0, 1, 8, 9)
+	apiCheck := gtk.NewCheckButtonWithLabel("Enabled, on port")
+	apiCheck.SetActive(settings.API.Enabled)
+	table.AttachDefaults(apiCheck, 1, 2, 8, 9)
+	apiPortSpin := gtk.NewSpinButtonWithRange(1024, 65535, 1)
+	if settings.API.Port == 0 {
+		settings.API.Port = defaultAPIPort
+	}
+	apiPortSpin.SetValue(float64(settings.API.Port))
+	table.AttachDefaults(apiPortSpin, 2, 3, 8, 9)
+	tokenLab := gtk.NewLabel("API Token :")
+	tokenLab.SetAlignment(1, 0.5)
+	table.AttachDefaults(tokenLab, 0, 1, 9, 10)
+	if settings.API.Token == "" {
+		settings.API.Token = newAPIToken()
+	}
+	tokenEntry := gtk.NewEntry()
+	tokenEntry.SetText(settings.API.Token)
+	tokenEntry.SetEditable(false)
+	table.AttachDefaults(tokenEntry, 1, 2, 9, 10)
+	tokenBtn := gtk.NewButtonWithLabel("New Token")
+	tokenBtn.Connect("clicked", func() { tokenEntry.SetText(newAPIToken()) })
+	table.AttachDefaults(tokenBtn, 2, 3, 9, 10)
+
+	rsLab := gtk.NewLabel("Video Restream :")
+	rsLab.SetAlignment(1, 0.5)
+	table.AttachDefaults(rsLab, 0, 1, 10, 11)
+	rsCheck := gtk.NewCheckButtonWithLabel("Enabled, on port")
+	rsCheck.SetActive(settings.Restream.Enabled)
+	table.AttachDefaults(rsCheck, 1, 2, 10, 11)
+	rsPortSpin := gtk.NewSpinButtonWithRange(1024, 65535, 1)
+	if settings.Restream.Port == 0 {
+		settings.Restream.Port = defaultRestreamPort
+	}
+	rsPortSpin.SetValue(float64(settings.Restream.Port))
+	table.AttachDefaults(rsPortSpin, 2, 3, 10, 11)
+
+	pfLab := gtk.NewLabel("Pre-flight :")
+	pfLab.SetAlignment(1, 0.5)
+	table.AttachDefaults(pfLab, 0, 1, 11, 12)
+	pfCheck := gtk.NewCheckButtonWithLabel("Checklist before Takeoff")
+	pfCheck.SetActive(!settings.Preflight.Disabled)
+	table.AttachDefaults(pfCheck, 1, 2, 11, 12)
+	preflight := settings.Preflight
+	pfBtn := gtk.NewButtonWithLabel("Checklist...")
+	pfBtn.Connect("clicked", func() { checklistSettingsCB(&preflight) })
+	table.AttachDefaults(pfBtn, 2, 3, 11, 12)
+
+	tsLab := gtk.NewLabel("Video Telemetry :")
+	tsLab.SetAlignment(1, 0.5)
+	table.AttachDefaults(tsLab, 0, 1, 12, 13)
+	tsCheck := gtk.NewCheckButtonWithLabel("Save Subtitles (.srt)")
+	tsCheck.SetActive(settings.TelemetrySubs)
+	table.AttachDefaults(tsCheck, 1, 2, 12, 13)
 
 	sd.GetVBox().PackStart(table, true, true, 5)
 	sd.AddButton("Cancel", gtk.RESPONSE_CANCEL)
@@ -126,13 +278,31 @@ func settingsCB() {
 		settings.JoystickID = foundCombo.GetActive()
 		settings.JoystickType = chosenTypeCombo.GetActiveText()
 		settings.WideVideo = vm.GetActive()
+		settings.RecordAudio = ra.GetActive()
+		settings.TelemetrySubs = tsCheck.GetActive()
+		settings.KeyboardControl = kbc.GetActive()
+		settings.KeyBindings = bindings
+		settings.StickProfiles = profiles
+		settings.FailsafeLow = fsLowCombo.GetActive()
+		settings.FailsafeCritical = fsCritCombo.GetActive()
+		settings.Preflight = preflight
+		settings.Preflight.Disabled = !pfCheck.GetActive()
+		settings.API = apiSettingsT{apiCheck.GetActive(), apiPortSpin.GetValueAsInt(), tokenEntry.GetText()}
+		if err := applyAPISettings(); err != nil {
+			messageDialog(win, gtk.MESSAGE_ERROR, "Could not start the HTTP API.\n\n"+err.Error())
+		}
+		settings.Restream.Enabled = rsCheck.GetActive()
+		settings.Restream.Port = rsPortSpin.GetValueAsInt()
+		if err := applyRestreamSettings(); err != nil {
+			messageDialog(win, gtk.MESSAGE_ERROR, "Could not start the video restreamer.\n\n"+err.Error())
+		}
 		if err := saveSettings(settings, appSettingsFile); err != nil {
 			messageDialog(win, gtk.MESSAGE_ERROR, "Could not save settings.")
 			log.Printf("Could not save settings: %v", err)
 		} else {
 			messageDialog(win, gtk.MESSAGE_INFO, `Settings Saved
 		
-N.B. If you changed Joystick settings either
+N.B. If you changed Joystick, Keyboard or HTTP API settings either
 reconnect to the drone or restart the program.
 
 If you changed video mode please restart the program.`)
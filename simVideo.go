@@ -0,0 +1,246 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	"github.com/Anty0/tello"
+)
+
+// The simulator's video feed is a genuine H.264 elementary stream made up entirely of
+// I_PCM (uncompressed) macroblocks.  It is bulky, but needs no encoder library and is
+// decoded by videoListener exactly like the drone's own feed.
+
+const (
+	simVideoChunk = 1400 // bytes per packet sent on the video channel, like the drone's UDP packets
+)
+
+// bitWriterT accumulates an H.264 RBSP bit by bit
+type bitWriterT struct {
+	buf   []byte
+	cur   byte
+	nBits uint
+}
+
+func (bw *bitWriterT) putBit(b uint) {
+	bw.cur = bw.cur<<1 | byte(b&1)
+	bw.nBits++
+	if bw.nBits == 8 {
+		bw.buf = append(bw.buf, bw.cur)
+		bw.cur, bw.nBits = 0, 0
+	}
+}
+
+// putBits writes the low n bits of v, most significant first
+func (bw *bitWriterT) putBits(v uint, n uint) {
+	for i := n; i > 0; i-- {
+		bw.putBit(v >> (i - 1))
+	}
+}
+
+// putUE writes v as an unsigned Exp-Golomb code
+func (bw *bitWriterT) putUE(v uint) {
+	v++
+	n := uint(0)
+	for t := v; t > 1; t >>= 1 {
+		n++
+	}
+	bw.putBits(0, n)
+	bw.putBits(v, n+1)
+}
+
+// putSE writes v as a signed Exp-Golomb code
+func (bw *bitWriterT) putSE(v int) {
+	if v > 0 {
+		bw.putUE(uint(2*v - 1))
+	} else {
+		bw.putUE(uint(-2 * v))
+	}
+}
+
+func (bw *bitWriterT) aligned() bool { return bw.nBits == 0 }
+
+func (bw *bitWriterT) alignZero() {
+	for !bw.aligned() {
+		bw.putBit(0)
+	}
+}
+
+// putByte writes a whole byte, the writer must be aligned
+func (bw *bitWriterT) putByte(b byte) {
+	bw.buf = append(bw.buf, b)
+}
+
+// trailingBits terminates the RBSP and returns it
+func (bw *bitWriterT) trailingBits() []byte {
+	bw.putBit(1)
+	bw.alignZero()
+	return bw.buf
+}
+
+// appendNAL appends an RBSP to stream as an Annex B NAL unit, inserting emulation prevention bytes
+func appendNAL(stream []byte, header byte, rbsp []byte) []byte {
+	stream = append(stream, 0, 0, 0, 1, header)
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros == 2 && b <= 3 {
+			stream = append(stream, 3)
+			zeros = 0
+		}
+		stream = append(stream, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return stream
+}
+
+// pcmEncoderT turns images into a baseline H.264 stream of IDR frames
+type pcmEncoderT struct {
+	mbWidth, mbHeight int
+	idrPicID          uint
+	spsPps            []byte
+}
+
+func newPCMEncoder(width, height int) (enc *pcmEncoderT) {
+	enc = new(pcmEncoderT)
+	enc.mbWidth, enc.mbHeight = width/16, height/16
+
+	var sps bitWriterT
+	sps.putBits(66, 8) // profile_idc: baseline
+	sps.putBits(0, 8)  // constraint flags
+	sps.putBits(31, 8) // level_idc: 3.1
+	sps.putUE(0)       // seq_parameter_set_id
+	sps.putUE(0)       // log2_max_frame_num_minus4
+	sps.putUE(2)       // pic_order_cnt_type: derived from frame_num
+	sps.putUE(0)       // max_num_ref_frames
+	sps.putBit(0)      // gaps_in_frame_num_value_allowed_flag
+	sps.putUE(uint(enc.mbWidth - 1))
+	sps.putUE(uint(enc.mbHeight - 1))
+	sps.putBit(1) // frame_mbs_only_flag
+	sps.putBit(1) // direct_8x8_inference_flag
+	sps.putBit(0) // frame_cropping_flag
+	sps.putBit(0) // vui_parameters_present_flag
+	enc.spsPps = appendNAL(nil, 0x67, sps.trailingBits())
+
+	var pps bitWriterT
+	pps.putUE(0)      // pic_parameter_set_id
+	pps.putUE(0)      // seq_parameter_set_id
+	pps.putBit(0)     // entropy_coding_mode_flag: CAVLC
+	pps.putBit(0)     // bottom_field_pic_order_in_frame_present_flag
+	pps.putUE(0)      // num_slice_groups_minus1
+	pps.putUE(0)      // num_ref_idx_l0_default_active_minus1
+	pps.putUE(0)      // num_ref_idx_l1_default_active_minus1
+	pps.putBit(0)     // weighted_pred_flag
+	pps.putBits(0, 2) // weighted_bipred_idc
+	pps.putSE(0)      // pic_init_qp_minus26
+	pps.putSE(0)      // pic_init_qs_minus26
+	pps.putSE(0)      // chroma_qp_index_offset
+	pps.putBit(0)     // deblocking_filter_control_present_flag
+	pps.putBit(0)     // constrained_intra_pred_flag
+	pps.putBit(0)     // redundant_pic_cnt_present_flag
+	enc.spsPps = appendNAL(enc.spsPps, 0x68, pps.trailingBits())
+	return enc
+}
+
+// pcmSample avoids zero samples which older decoders reject in I_PCM macroblocks
+func pcmSample(v uint8) byte {
+	if v == 0 {
+		return 1
+	}
+	return v
+}
+
+// encode returns the SPS, PPS and a single IDR slice holding img, which must be at
+// least as large as the encoder's frame.
+func (enc *pcmEncoderT) encode(img *image.RGBA) []byte {
+	var bw bitWriterT
+	bw.putUE(0)            // first_mb_in_slice
+	bw.putUE(7)            // slice_type: I (all slices)
+	bw.putUE(0)            // pic_parameter_set_id
+	bw.putBits(0, 4)       // frame_num
+	bw.putUE(enc.idrPicID) // idr_pic_id
+	bw.putBit(0)           // no_output_of_prior_pics_flag
+	bw.putBit(0)           // long_term_reference_flag
+	bw.putSE(0)            // slice_qp_delta
+	enc.idrPicID ^= 1      // consecutive IDR pictures must differ
+
+	var cb, cr [64]byte
+	for mby := 0; mby < enc.mbHeight; mby++ {
+		for mbx := 0; mbx < enc.mbWidth; mbx++ {
+			bw.putUE(25) // mb_type: I_PCM
+			bw.alignZero()
+			for y := 0; y < 16; y++ {
+				for x := 0; x < 16; x++ {
+					c := img.RGBAAt(mbx*16+x, mby*16+y)
+					yy, u, v := color.RGBToYCbCr(c.R, c.G, c.B)
+					bw.putByte(pcmSample(yy))
+					if x&1 == 0 && y&1 == 0 {
+						cb[y/2*8+x/2], cr[y/2*8+x/2] = pcmSample(u), pcmSample(v)
+					}
+				}
+			}
+			bw.buf = append(bw.buf, cb[:]...)
+			bw.buf = append(bw.buf, cr[:]...)
+		}
+	}
+	return appendNAL(append([]byte(nil), enc.spsPps...), 0x65, bw.trailingBits())
+}
+
+var (
+	simSkyCol     = color.RGBA{110, 170, 230, 255}
+	simGroundCol  = color.RGBA{70, 130, 60, 255}
+	simMarkingCol = color.RGBA{255, 255, 255, 255}
+	simTextCol    = color.RGBA{255, 255, 0, 255}
+)
+
+// renderSimView draws a simple synthetic camera view for the flight data fd.
+// The horizon drops as the drone climbs and the compass markings move as it turns.
+func renderSimView(img *image.RGBA, fd tello.FlightData) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	horizon := h/2 + int(fd.Height)*h/400 // 40m would put the horizon at the bottom
+	if horizon > h {
+		horizon = h
+	}
+	draw.Draw(img, image.Rect(0, 0, w, horizon), image.NewUniform(simSkyCol), image.ZP, draw.Src)
+	draw.Draw(img, image.Rect(0, horizon, w, h), image.NewUniform(simGroundCol), image.ZP, draw.Src)
+
+	// a marking every 30 degrees of yaw, with the compass points labelled
+	const degPerPixel = 0.1
+	for deg := -180; deg < 180; deg += 30 {
+		delta := math.Remainder(float64(deg)-float64(fd.IMU.Yaw), 360)
+		x := w/2 + int(delta/degPerPixel)
+		if x < 0 || x >= w {
+			continue
+		}
+		drawPhysLine(img, x, horizon-20, x, horizon, simMarkingCol)
+		switch deg {
+		case 0:
+			drawPhysLabel(img, x-3, horizon-25, "N", simMarkingCol)
+		case 90:
+			drawPhysLabel(img, x-3, horizon-25, "E", simMarkingCol)
+		case -180:
+			drawPhysLabel(img, x-3, horizon-25, "S", simMarkingCol)
+		case -90:
+			drawPhysLabel(img, x-3, horizon-25, "W", simMarkingCol)
+		}
+	}
+
+	drawPhysLabel(img, 10, 20, "SIMULATOR", simTextCol)
+	drawPhysLabel(img, 10, 40, fmt.Sprintf("X: %.1fm  Y: %.1fm  Height: %.1fm  Yaw: %d",
+		fd.MVO.PositionX, fd.MVO.PositionY, float32(fd.Height)/10, fd.IMU.Yaw), simTextCol)
+	drawPhysLabel(img, 10, 60, fmt.Sprintf("Battery: %d%%", fd.BatteryPercentage), simTextCol)
+}
@@ -0,0 +1,666 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Anty0/tello"
+)
+
+// The simulator is a very simple model of a Tello which runs entirely within TelloDesk.
+// It implements droneT so that the rest of the program works just as it does with a
+// real drone - flight data, sticks, auto-flight, photos and the video feed.
+
+const (
+	simTickPeriod     = 50 * time.Millisecond
+	simVideoPeriod    = 100 * time.Millisecond // 10 frames per second
+	simVideoWidth     = 640
+	simVideoHeight    = 480
+	simWideVideoWidth = 848
+
+	simTakeoffHeightDm = 12
+	simMaxHeightDm     = 100
+	simSpeedSlow       = 1.5  // m/s at full stick
+	simSpeedFast       = 3.5  // m/s at full stick in sports mode
+	simClimbRate       = 1.0  // m/s
+	simTurnRate        = 90.0 // degrees/s
+	simAutoSpeed       = 1.0  // m/s when auto-flying
+	simAutoTolerance   = 0.1  // metres (or decimetres for height, or degrees for yaw) counted as arrived
+	simMaxTilt         = 15.0 // degrees of pitch or roll at full stick
+
+	simFlyingDrain = 10 * time.Second // time flying to use 1% of the battery
+	simIdleDrain   = 60 * time.Second // time on the ground to use 1% of the battery
+)
+
+// simAutoT is an auto-flight manoeuvre in progress
+type simAutoT struct {
+	active bool
+	target float64
+	x, y   float64 // for AutoFlyToXY
+	done   chan bool
+}
+
+// simDroneT holds the state of the simulated drone
+type simDroneT struct {
+	simMu sync.RWMutex
+	fd    tello.FlightData
+
+	x, y, height, yaw float64 // metres and degrees, yaw 0 is North, +ve clockwise
+	targetHeight      float64 // used by take-off and landing
+	landing           bool
+	sticks            tello.StickMessage
+	sportsMode        bool
+	homeSet           bool
+	homeX, homeY      float64
+	autoXY            simAutoT
+	autoHeight        simAutoT
+	autoYaw           simAutoT
+	drained           time.Duration
+	flyTime           float64 // seconds
+
+	wideVideo bool
+	pics      [][]byte // JPEGs awaiting SaveAllPics
+
+	connected                    bool
+	stopChan                     chan bool // closed to stop every simulator goroutine
+	stickStopChan, videoStopChan chan bool
+}
+
+func newSimDrone() (sd *simDroneT) {
+	sd = new(simDroneT)
+	sd.fd.SSID = "TELLO-SIMULATOR"
+	sd.fd.Version = "SIM"
+	sd.fd.BatteryPercentage = 100
+	sd.fd.BatteryMilliVolts = 4200
+	sd.fd.LowBatteryThreshold = 30
+	sd.fd.MaxHeight = simMaxHeightDm / 10
+	sd.fd.WifiStrength = 90
+	sd.fd.LightStrength = 1
+	sd.fd.IMU.Temperature = 25
+	sd.fd.OnGround = true
+	sd.fd.ImuState = true
+	sd.fd.PressureState = true
+	sd.fd.PowerState = true
+	sd.fd.BatteryState = true
+	sd.fd.GravityState = true
+	return sd
+}
+
+// ControlConnect starts the simulation, the address is ignored
+func (sd *simDroneT) ControlConnect(udpAddr string, droneUDPPort int, localUDPPort int) error {
+	return sd.ControlConnectDefault()
+}
+
+// ControlConnectDefault starts the simulation
+func (sd *simDroneT) ControlConnectDefault() error {
+	sd.simMu.Lock()
+	defer sd.simMu.Unlock()
+	if sd.connected {
+		return errors.New("simulator already running")
+	}
+	sd.connected = true
+	sd.stopChan = make(chan bool)
+	go sd.simulate(sd.stopChan)
+	log.Println("Debug: Simulator started")
+	return nil
+}
+
+// ControlDisconnect stops the simulation and all its goroutines
+func (sd *simDroneT) ControlDisconnect() {
+	sd.simMu.Lock()
+	defer sd.simMu.Unlock()
+	if sd.connected {
+		sd.connected = false
+		close(sd.stopChan)
+		// like a real drone losing its link, we come down where we are
+		sd.autoXY.finish(false)
+		sd.autoHeight.finish(false)
+		sd.autoYaw.finish(false)
+		sd.height, sd.targetHeight, sd.landing = 0, 0, false
+		sd.fd.Flying, sd.fd.OnGround, sd.fd.Height = false, true, 0
+		log.Println("Debug: Simulator stopped")
+	}
+}
+
+// simulate is run as a Goroutine, it updates the drone's state every simTickPeriod
+func (sd *simDroneT) simulate(stop chan bool) {
+	ticker := time.NewTicker(simTickPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			sd.simMu.Lock()
+			sd.step(simTickPeriod.Seconds())
+			sd.simMu.Unlock()
+		}
+	}
+}
+
+// approach moves val towards target by at most maxStep
+func approach(val, target, maxStep float64) float64 {
+	switch {
+	case target > val+maxStep:
+		return val + maxStep
+	case target < val-maxStep:
+		return val - maxStep
+	}
+	return target
+}
+
+// finish ends a manoeuvre, reporting whether it completed
+func (a *simAutoT) finish(completed bool) {
+	if a.active {
+		a.active = false
+		a.done <- completed
+	}
+}
+
+// step advances the simulation by dt seconds, simMu must be held
+func (sd *simDroneT) step(dt float64) {
+	flying := sd.fd.Flying
+	lastX, lastY, lastH := sd.x, sd.y, sd.height
+
+	if flying {
+		// vertical
+		switch {
+		case sd.landing || sd.targetHeight > 0:
+			sd.height = approach(sd.height, sd.targetHeight, simClimbRate*dt)
+			if sd.height == sd.targetHeight {
+				sd.targetHeight = 0
+				if sd.landing {
+					sd.landing, flying = false, false
+				}
+			}
+		case sd.autoHeight.active:
+			sd.height = approach(sd.height, sd.autoHeight.target, simClimbRate*dt)
+			if math.Abs(sd.height-sd.autoHeight.target) < simAutoTolerance/10 {
+				sd.autoHeight.finish(true)
+			}
+		default:
+			sd.height += float64(sd.sticks.Ry) / maxVal * simClimbRate * dt
+		}
+		if sd.height < 0 {
+			sd.height = 0
+		}
+		if sd.height > simMaxHeightDm/10.0 {
+			sd.height = simMaxHeightDm / 10.0
+		}
+
+		// rotation
+		if sd.autoYaw.active {
+			delta := math.Remainder(sd.autoYaw.target-sd.yaw, 360)
+			sd.yaw += approach(0, delta, simTurnRate*dt)
+			if math.Abs(delta) < simAutoTolerance {
+				sd.autoYaw.finish(true)
+			}
+		} else {
+			sd.yaw += float64(sd.sticks.Rx) / maxVal * simTurnRate * dt
+		}
+		sd.yaw = math.Remainder(sd.yaw, 360)
+
+		// horizontal
+		if sd.autoXY.active {
+			dx, dy := sd.homeX+sd.autoXY.x-sd.x, sd.homeY+sd.autoXY.y-sd.y
+			dist := math.Hypot(dx, dy)
+			if dist < simAutoTolerance {
+				sd.autoXY.finish(true)
+			} else {
+				move := math.Min(dist, simAutoSpeed*dt)
+				sd.x += dx / dist * move
+				sd.y += dy / dist * move
+			}
+		} else if !sd.landing {
+			speed := simSpeedSlow
+			if sd.sportsMode {
+				speed = simSpeedFast
+			}
+			yawRad := sd.yaw * math.Pi / 180
+			fwd, right := float64(sd.sticks.Ly)/maxVal*speed*dt, float64(sd.sticks.Lx)/maxVal*speed*dt
+			sd.x += fwd*math.Sin(yawRad) + right*math.Cos(yawRad)
+			sd.y += fwd*math.Cos(yawRad) - right*math.Sin(yawRad)
+		}
+	}
+
+	// battery
+	drain := simIdleDrain
+	if flying {
+		drain = simFlyingDrain
+	}
+	sd.drained += time.Duration(dt * float64(time.Second))
+	if sd.drained >= drain && sd.fd.BatteryPercentage > 0 {
+		sd.drained = 0
+		sd.fd.BatteryPercentage--
+	}
+	if sd.fd.BatteryPercentage <= 5 && flying && !sd.landing {
+		log.Println("Simulator: battery exhausted, landing")
+		sd.startLanding()
+	}
+
+	sd.fd.Flying = flying
+	sd.fd.OnGround = !flying
+	sd.fd.DroneHover = flying && sd.sticks == (tello.StickMessage{}) && !sd.autoXY.active
+	sd.fd.Height = int16(math.Round(sd.height * 10))
+	sd.fd.MVO.PositionX = float32(sd.x)
+	sd.fd.MVO.PositionY = float32(sd.y)
+	sd.fd.MVO.PositionZ = float32(-sd.height)
+	sd.fd.IMU.Yaw = int16(math.Round(sd.yaw))
+	// lean into the direction of travel, for the HUD's artificial horizon
+	roll, pitch := 0.0, 0.0
+	if flying && !sd.autoXY.active && !sd.landing {
+		roll = float64(sd.sticks.Lx) / maxVal * simMaxTilt
+		pitch = -float64(sd.sticks.Ly) / maxVal * simMaxTilt
+	}
+	qw, qx, qy, qz := eulerToQuat(roll, pitch, sd.yaw)
+	sd.fd.IMU.QuaternionW, sd.fd.IMU.QuaternionX = float32(qw), float32(qx)
+	sd.fd.IMU.QuaternionY, sd.fd.IMU.QuaternionZ = float32(qy), float32(qz)
+	sd.fd.EastSpeed = int16(math.Round((sd.x - lastX) / dt))
+	sd.fd.NorthSpeed = int16(math.Round((sd.y - lastY) / dt))
+	sd.fd.VerticalSpeed = int16(math.Round((sd.height - lastH) / dt))
+	sd.fd.GroundSpeed = int16(math.Round(math.Hypot(sd.x-lastX, sd.y-lastY) / dt))
+	sd.fd.BatteryLow = sd.fd.BatteryPercentage <= int8(sd.fd.LowBatteryThreshold)
+	sd.fd.BatteryCritical = sd.fd.BatteryPercentage <= 10
+	sd.fd.BatteryMilliVolts = int16(3500 + 7*int(sd.fd.BatteryPercentage))
+	sd.fd.DroneFlyTimeLeft = int16(sd.fd.BatteryPercentage) * int16(simFlyingDrain/time.Second)
+	if flying {
+		sd.flyTime += dt
+	}
+	sd.fd.FlyTime = int16(sd.flyTime * 10) // decisecs
+}
+
+// StreamFlightData sends the simulated flight data every periodMs milliseconds
+func (sd *simDroneT) StreamFlightData(asAvailable bool, periodMs time.Duration) (<-chan tello.FlightData, error) {
+	sd.simMu.RLock()
+	stop := sd.stopChan
+	sd.simMu.RUnlock()
+	fdc := make(chan tello.FlightData, 1)
+	go func() {
+		ticker := time.NewTicker(periodMs * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				select {
+				case fdc <- sd.GetFlightData():
+				default: // don't queue stale data
+				}
+			}
+		}
+	}()
+	return fdc, nil
+}
+
+// GetFlightData returns a copy of the current simulated flight data
+func (sd *simDroneT) GetFlightData() tello.FlightData {
+	sd.simMu.RLock()
+	defer sd.simMu.RUnlock()
+	return sd.fd
+}
+
+// StartStickListener returns a channel on which stick positions are accepted
+func (sd *simDroneT) StartStickListener() (chan<- tello.StickMessage, error) {
+	sd.simMu.Lock()
+	defer sd.simMu.Unlock()
+	if sd.stickStopChan != nil {
+		return nil, errors.New("stick listener already running")
+	}
+	sc := make(chan tello.StickMessage, 10)
+	sd.stickStopChan = make(chan bool)
+	go func(stickStop, stop chan bool) {
+		for {
+			select {
+			case sm := <-sc:
+				sd.simMu.Lock()
+				sd.sticks = sm
+				sd.simMu.Unlock()
+			case <-stickStop:
+				return
+			case <-stop:
+				return
+			}
+		}
+	}(sd.stickStopChan, sd.stopChan)
+	return sc, nil
+}
+
+// StopStickListener stops accepting stick positions and centres the sticks
+func (sd *simDroneT) StopStickListener() {
+	sd.simMu.Lock()
+	defer sd.simMu.Unlock()
+	if sd.stickStopChan != nil {
+		close(sd.stickStopChan)
+		sd.stickStopChan = nil
+	}
+	sd.sticks = tello.StickMessage{}
+}
+
+func (sd *simDroneT) takeOff() {
+	sd.simMu.Lock()
+	defer sd.simMu.Unlock()
+	if !sd.fd.Flying && sd.fd.BatteryPercentage > 10 {
+		sd.fd.Flying = true
+		sd.landing = false
+		sd.targetHeight = simTakeoffHeightDm / 10.0
+	}
+}
+
+// startLanding begins a descent to the ground, simMu must be held
+func (sd *simDroneT) startLanding() {
+	if sd.fd.Flying {
+		sd.autoXY.finish(false)
+		sd.autoHeight.finish(false)
+		sd.autoYaw.finish(false)
+		sd.landing = true
+		sd.targetHeight = 0
+	}
+}
+
+func (sd *simDroneT) land() {
+	sd.simMu.Lock()
+	sd.startLanding()
+	sd.simMu.Unlock()
+}
+
+// TakeOff climbs to the default take-off height
+func (sd *simDroneT) TakeOff() { sd.takeOff() }
+
+// ThrowTakeOff is simulated as a normal take-off
+func (sd *simDroneT) ThrowTakeOff() { sd.takeOff() }
+
+// Land descends to the ground where the drone is
+func (sd *simDroneT) Land() { sd.land() }
+
+// PalmLand is simulated as a normal landing
+func (sd *simDroneT) PalmLand() { sd.land() }
+
+func (sd *simDroneT) flip(dir string) {
+	sd.simMu.RLock()
+	flying := sd.fd.Flying
+	sd.simMu.RUnlock()
+	if flying {
+		log.Printf("Simulator: flip %s\n", dir)
+	}
+}
+
+// ForwardFlip is only logged by the simulator
+func (sd *simDroneT) ForwardFlip() { sd.flip("forward") }
+
+// BackFlip is only logged by the simulator
+func (sd *simDroneT) BackFlip() { sd.flip("backward") }
+
+// LeftFlip is only logged by the simulator
+func (sd *simDroneT) LeftFlip() { sd.flip("left") }
+
+// RightFlip is only logged by the simulator
+func (sd *simDroneT) RightFlip() { sd.flip("right") }
+
+// SetSportsMode switches between the slow and fast maximum speeds
+func (sd *simDroneT) SetSportsMode(sports bool) {
+	sd.simMu.Lock()
+	sd.sportsMode = sports
+	sd.simMu.Unlock()
+}
+
+// SetFastMode selects sports mode
+func (sd *simDroneT) SetFastMode() { sd.SetSportsMode(true) }
+
+// SetSlowMode selects normal mode
+func (sd *simDroneT) SetSlowMode() { sd.SetSportsMode(false) }
+
+// SetHome records the current position as home, auto-flight positions are relative to it
+func (sd *simDroneT) SetHome() error {
+	sd.simMu.Lock()
+	defer sd.simMu.Unlock()
+	sd.homeX, sd.homeY, sd.homeSet = sd.x, sd.y, true
+	return nil
+}
+
+// IsHomeSet reports whether SetHome has been called successfully
+func (sd *simDroneT) IsHomeSet() bool {
+	sd.simMu.RLock()
+	defer sd.simMu.RUnlock()
+	return sd.homeSet
+}
+
+// startAuto begins a manoeuvre, cancelling any similar one already in progress.  simMu must be held.
+func (sd *simDroneT) startAuto(a *simAutoT) (chan bool, error) {
+	if !sd.fd.Flying {
+		return nil, errors.New("cannot auto-fly when not flying")
+	}
+	a.finish(false)
+	a.active = true
+	a.done = make(chan bool, 1)
+	return a.done, nil
+}
+
+// AutoFlyToXY flies in a straight line to x, y metres relative to the home position
+func (sd *simDroneT) AutoFlyToXY(x, y float32) (chan bool, error) {
+	sd.simMu.Lock()
+	defer sd.simMu.Unlock()
+	if !sd.homeSet {
+		return nil, errors.New("home position not set")
+	}
+	done, err := sd.startAuto(&sd.autoXY)
+	sd.autoXY.x, sd.autoXY.y = float64(x), float64(y)
+	return done, err
+}
+
+// CancelAutoFlyToXY stops any AutoFlyToXY manoeuvre
+func (sd *simDroneT) CancelAutoFlyToXY() {
+	sd.simMu.Lock()
+	sd.autoXY.finish(false)
+	sd.simMu.Unlock()
+}
+
+// AutoFlyToHeight climbs or descends to dm decimetres
+func (sd *simDroneT) AutoFlyToHeight(dm int16) (chan bool, error) {
+	sd.simMu.Lock()
+	defer sd.simMu.Unlock()
+	done, err := sd.startAuto(&sd.autoHeight)
+	sd.autoHeight.target = float64(dm) / 10
+	return done, err
+}
+
+// CancelAutoFlyToHeight stops any AutoFlyToHeight manoeuvre
+func (sd *simDroneT) CancelAutoFlyToHeight() {
+	sd.simMu.Lock()
+	sd.autoHeight.finish(false)
+	sd.simMu.Unlock()
+}
+
+// AutoTurnToYaw turns the shortest way to the given yaw in degrees
+func (sd *simDroneT) AutoTurnToYaw(yaw int16) (chan bool, error) {
+	sd.simMu.Lock()
+	defer sd.simMu.Unlock()
+	if yaw < -180 || yaw > 180 {
+		return nil, errors.New("yaw must be between -180 and 180")
+	}
+	done, err := sd.startAuto(&sd.autoYaw)
+	sd.autoYaw.target = float64(yaw)
+	return done, err
+}
+
+// CancelAutoTurn stops any AutoTurnToYaw manoeuvre
+func (sd *simDroneT) CancelAutoTurn() {
+	sd.simMu.Lock()
+	sd.autoYaw.finish(false)
+	sd.simMu.Unlock()
+}
+
+// TakePicture stores a JPEG of the current simulated view
+func (sd *simDroneT) TakePicture() error {
+	sd.simMu.RLock()
+	fd, wide := sd.fd, sd.wideVideo
+	sd.simMu.RUnlock()
+	img := image.NewRGBA(image.Rect(0, 0, simFrameWidth(wide), simVideoHeight))
+	renderSimView(img, fd)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		return err
+	}
+	sd.simMu.Lock()
+	sd.pics = append(sd.pics, buf.Bytes())
+	sd.simMu.Unlock()
+	return nil
+}
+
+// NumPics returns the number of photos awaiting saving
+func (sd *simDroneT) NumPics() int {
+	sd.simMu.RLock()
+	defer sd.simMu.RUnlock()
+	return len(sd.pics)
+}
+
+// SaveAllPics writes each waiting photo to a file named <prefix>_<n>.jpg
+func (sd *simDroneT) SaveAllPics(prefix string) (int, error) {
+	sd.simMu.Lock()
+	defer sd.simMu.Unlock()
+	for i, pic := range sd.pics {
+		f, err := os.Create(fmt.Sprintf("%s_%d.jpg", prefix, i))
+		if err != nil {
+			sd.pics = sd.pics[i:]
+			return i, err
+		}
+		_, err = f.Write(pic)
+		f.Close()
+		if err != nil {
+			sd.pics = sd.pics[i:]
+			return i, err
+		}
+	}
+	n := len(sd.pics)
+	sd.pics = nil
+	return n, nil
+}
+
+func simFrameWidth(wide bool) int {
+	if wide {
+		return simWideVideoWidth
+	}
+	return simVideoWidth
+}
+
+// VideoConnect starts the synthetic video feed, the address is ignored
+func (sd *simDroneT) VideoConnect(udpAddr string, droneUDPPort int) (<-chan []byte, error) {
+	return sd.VideoConnectDefault()
+}
+
+// VideoConnectDefault starts the synthetic video feed
+func (sd *simDroneT) VideoConnectDefault() (<-chan []byte, error) {
+	sd.simMu.Lock()
+	defer sd.simMu.Unlock()
+	if sd.videoStopChan != nil {
+		return nil, errors.New("video already connected")
+	}
+	vc := make(chan []byte, 100)
+	sd.videoStopChan = make(chan bool)
+	go sd.videoSender(vc, sd.videoStopChan, sd.stopChan)
+	return vc, nil
+}
+
+// VideoDisconnect stops the synthetic video feed
+func (sd *simDroneT) VideoDisconnect() {
+	sd.simMu.Lock()
+	defer sd.simMu.Unlock()
+	if sd.videoStopChan != nil {
+		close(sd.videoStopChan)
+		sd.videoStopChan = nil
+	}
+}
+
+// videoSender is run as a Goroutine, it renders and encodes a frame every simVideoPeriod
+// and sends it in packet-sized chunks.  A change of video mode takes effect at the next frame.
+func (sd *simDroneT) videoSender(vc chan<- []byte, videoStop, stop chan bool) {
+	var (
+		enc  *pcmEncoderT
+		img  *image.RGBA
+		wide bool
+	)
+	ticker := time.NewTicker(simVideoPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-videoStop:
+			return
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		sd.simMu.RLock()
+		fd := sd.fd
+		if enc == nil || wide != sd.wideVideo {
+			wide = sd.wideVideo
+			enc = newPCMEncoder(simFrameWidth(wide), simVideoHeight)
+			img = image.NewRGBA(image.Rect(0, 0, simFrameWidth(wide), simVideoHeight))
+		}
+		sd.simMu.RUnlock()
+		renderSimView(img, fd)
+		frame := enc.encode(img)
+		for len(frame) > 0 {
+			n := simVideoChunk
+			if n > len(frame) {
+				n = len(frame)
+			}
+			select {
+			case vc <- frame[:n]:
+			case <-videoStop:
+				return
+			case <-stop:
+				return
+			}
+			frame = frame[n:]
+		}
+	}
+}
+
+// GetVideoSpsPps does nothing as the SPS and PPS precede every simulated frame
+func (sd *simDroneT) GetVideoSpsPps() {}
+
+// SetVideoBitrate does nothing for the simulator
+func (sd *simDroneT) SetVideoBitrate(vbr tello.VBR) {}
+
+// SetVideoWide selects the 16:9 video mode
+func (sd *simDroneT) SetVideoWide() {
+	sd.simMu.Lock()
+	sd.wideVideo = true
+	sd.simMu.Unlock()
+}
+
+// SetVideoNormal selects the 4:3 video mode
+func (sd *simDroneT) SetVideoNormal() {
+	sd.simMu.Lock()
+	sd.wideVideo = false
+	sd.simMu.Unlock()
+}
+
+// The simulator always reports these values in its flight data, so the queries do nothing.
+
+// GetLowBatteryThreshold does nothing for the simulator
+func (sd *simDroneT) GetLowBatteryThreshold() {}
+
+// GetMaxHeight does nothing for the simulator
+func (sd *simDroneT) GetMaxHeight() {}
+
+// GetSSID does nothing for the simulator
+func (sd *simDroneT) GetSSID() {}
+
+// GetVersion does nothing for the simulator
+func (sd *simDroneT) GetVersion() {}
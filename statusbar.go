@@ -9,6 +9,7 @@ package main
 
 import (
 	"fmt"
+	"path/filepath"
 
 	"github.com/mattn/go-gtk/gdk"
 	"github.com/mattn/go-gtk/gtk"
@@ -17,6 +18,7 @@ import (
 type statusBarT struct {
 	*gtk.VBox
 	connectionLab, heightLab, batteryPctLab, wifiStrLab, photosLab *gtk.Label
+	recorderLab, restreamLab                                       *gtk.Label
 }
 
 func buildStatusbar() (sb *statusBarT) {
@@ -50,16 +52,37 @@ func buildStatusbar() (sb *statusBarT) {
 	plf.Add(sb.photosLab)
 	sb.Add(plf)
 
+	rlf := gtk.NewFrame("")
+	sb.recorderLab = gtk.NewLabel("Flight Recorder: Off")
+	rlf.Add(sb.recorderLab)
+	sb.Add(rlf)
+
+	slf := gtk.NewFrame("")
+	sb.restreamLab = gtk.NewLabel("Restream: Off")
+	slf.Add(sb.restreamLab)
+	sb.Add(slf)
+
 	return sb
 }
 
 func (sb *statusBarT) updateStatusBarTCB() {
-	flightDataMu.RLock()
-	if len(flightData.SSID) > 0 {
+	flightData := currentFlightData()
+	active, lost, fdAge, videoAge := linkWatchdog.status()
+	switch {
+	case lost:
+		sb.connectionLab.SetLabel(fmt.Sprintf("LINK LOST (%.0fs)", fdAge.Seconds()))
+	case len(flightData.SSID) > 0 && active && videoAge > videoLostAfter:
+		sb.connectionLab.SetLabel(fmt.Sprintf("%s - No Video (%.0fs)", flightData.SSID, videoAge.Seconds()))
+	case len(flightData.SSID) > 0:
 		sb.connectionLab.SetLabel(fmt.Sprintf("%s - Firmware: %s", flightData.SSID, flightData.Version))
-	} else {
+	default:
 		sb.connectionLab.SetLabel("Disconnected")
 	}
+	if lost || (active && videoAge > videoLostAfter) {
+		sb.connectionLab.ModifyFG(gtk.STATE_NORMAL, gdk.NewColor("red"))
+	} else {
+		sb.connectionLab.ModifyFG(gtk.STATE_NORMAL, gdk.NewColor("white"))
+	}
 	sb.heightLab.SetLabel(fmt.Sprintf("Height: %.1fm (Max: %dm)", float32(flightData.Height)/10, flightData.MaxHeight))
 	sb.batteryPctLab.SetLabel(fmt.Sprintf("Battery: %d%% (%dmV)", flightData.BatteryPercentage, flightData.BatteryMilliVolts))
 	if flightData.BatteryPercentage < 30 {
@@ -73,6 +96,15 @@ func (sb *statusBarT) updateStatusBarTCB() {
 	} else {
 		sb.wifiStrLab.ModifyFG(gtk.STATE_NORMAL, gdk.NewColor("white"))
 	}
-	flightDataMu.RUnlock()
 	sb.photosLab.SetLabel(fmt.Sprintf("Buffered Photos: %d", drone.NumPics()))
+	if rec := flightRecorder.recording(); rec != "" {
+		sb.recorderLab.SetLabel("Recording: " + filepath.Base(rec))
+	} else {
+		sb.recorderLab.SetLabel("Flight Recorder: Off")
+	}
+	if restreamer.running() {
+		sb.restreamLab.SetLabel(fmt.Sprintf("Restream: port %d, %d watching", settings.Restream.Port, restreamer.viewerCount()))
+	} else {
+		sb.restreamLab.SetLabel("Restream: Off")
+	}
 }
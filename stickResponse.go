@@ -0,0 +1,229 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/SMerrony/tellodesk/joymap"
+	"github.com/mattn/go-gtk/gdkpixbuf"
+	"github.com/mattn/go-gtk/glib"
+	"github.com/mattn/go-gtk/gtk"
+	"github.com/simulatedsimian/joystick"
+)
+
+// stickProfile returns the saved stick profile for the given joystick type, or the default.
+func (s *settingsT) stickProfile(jsType string) joymap.ProfileT {
+	if sp, ok := s.StickProfiles[jsType]; ok {
+		return sp
+	}
+	return joymap.DefaultProfile()
+}
+
+const (
+	curveSize   = 200 // pixels
+	curvePollMs = 50
+)
+
+// responseCurveT is a small chart of an axis response with the live stick position.
+type responseCurveT struct {
+	*gtk.Image
+	backingImage *image.RGBA
+	pbd          gdkpixbuf.PixbufData
+	pixBuf       *gdkpixbuf.Pixbuf
+}
+
+func buildResponseCurve() (rc *responseCurveT) {
+	rc = new(responseCurveT)
+	rc.Image = gtk.NewImage()
+	rc.backingImage = image.NewRGBA(image.Rect(0, 0, curveSize, curveSize))
+	rc.pbd.Colorspace = gdkpixbuf.GDK_COLORSPACE_RGB
+	rc.pbd.HasAlpha = true
+	rc.pbd.BitsPerSample = 8
+	rc.pbd.Width = curveSize
+	rc.pbd.Height = curveSize
+	rc.pbd.RowStride = rc.backingImage.Stride
+	rc.pbd.Data = rc.backingImage.Pix
+	rc.pixBuf = gdkpixbuf.NewPixbufFromData(rc.pbd)
+	return rc
+}
+
+func curveToOrd(v float64) int {
+	return int((v + 1) / 2 * (curveSize - 1))
+}
+
+// draw plots the response ar, and the current input if live is true.
+func (rc *responseCurveT) draw(ar joymap.AxisResponseT, live bool, input float64) {
+	img := rc.backingImage
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.ZP, draw.Src)
+	faintCol := color.RGBA{192, 192, 192, 255}
+	drawPhysLine(img, curveSize/2, 0, curveSize/2, curveSize-1, faintCol)
+	drawPhysLine(img, 0, curveSize/2, curveSize-1, curveSize/2, faintCol)
+	drawPhysLine(img, 0, curveSize-1, curveSize-1, 0, faintCol) // linear reference
+
+	lineCol := color.RGBA{255, 0, 0, 255}
+	lastX, lastY := 0, curveSize-1-curveToOrd(ar.Apply(-1))
+	for px := 1; px < curveSize; px++ {
+		v := float64(px)/(curveSize-1)*2 - 1
+		y := curveSize - 1 - curveToOrd(ar.Apply(v))
+		drawPhysLine(img, lastX, lastY, px, y, lineCol)
+		lastX, lastY = px, y
+	}
+
+	if live {
+		dotCol := color.RGBA{0, 0, 255, 255}
+		x, y := curveToOrd(input), curveSize-1-curveToOrd(ar.Apply(input))
+		drawPhysLine(img, x-4, y, x+4, y, dotCol)
+		drawPhysLine(img, x, y-4, x, y+4, dotCol)
+		drawPhysLabel(img, 5, 15, fmt.Sprintf("In: %+.2f Out: %+.2f", input, ar.Apply(input)), dotCol)
+	}
+	rc.pbd.Data = img.Pix
+	rc.SetFromPixbuf(rc.pixBuf)
+}
+
+// stickResponseCB lets the user adjust the stick profile sp for the joystick type jsType.
+// If jsid refers to a detected joystick its live position is shown on the preview.
+func stickResponseCB(sp *joymap.ProfileT, jsType string, jsid int) {
+	rd := gtk.NewDialog()
+	rd.SetTitle(appName + " Stick Response - " + jsType)
+	rd.SetIcon(iconPixbuf)
+	rd.SetPosition(gtk.WIN_POS_CENTER_ON_PARENT)
+
+	tmp := *sp
+	cur := joymap.StLx
+
+	var conf joymap.ConfigT
+	for _, k := range listKnownJoystickTypes() {
+		if k.Name == jsType {
+			conf = k.Conf
+		}
+	}
+	var rjs joystick.Joystick
+	if jsid >= 0 {
+		var err error
+		if rjs, err = joystick.Open(jsid); err != nil {
+			rjs = nil
+		}
+	}
+
+	hbox := gtk.NewHBox(false, 10)
+	curve := buildResponseCurve()
+	hbox.PackStart(curve, false, false, 5)
+
+	table := gtk.NewTable(5, 2, false)
+	table.SetColSpacings(5)
+	table.SetRowSpacings(5)
+	stickCombo := gtk.NewComboBoxText()
+	for _, n := range joymap.StickNames {
+		stickCombo.AppendText(n)
+	}
+	addRow := func(row uint, label string, w gtk.IWidget) {
+		lab := gtk.NewLabel(label)
+		lab.SetAlignment(1, 0.5)
+		table.AttachDefaults(lab, 0, 1, row, row+1)
+		table.AttachDefaults(w, 1, 2, row, row+1)
+	}
+	addRow(0, "Stick :", stickCombo)
+	dzScale := gtk.NewHScaleWithRange(0, 0.5, 0.01)
+	addRow(1, "Dead Zone :", dzScale)
+	expoScale := gtk.NewHScaleWithRange(0, 1, 0.05)
+	addRow(2, "Expo :", expoScale)
+	rateScale := gtk.NewHScaleWithRange(0.1, 1, 0.05)
+	addRow(3, "Max Rate :", rateScale)
+	invCheck := gtk.NewCheckButtonWithLabel("Inverted")
+	addRow(4, "", invCheck)
+	hbox.PackStart(table, true, true, 5)
+
+	loading := false
+	liveInput := func() (float64, bool) {
+		if rjs == nil {
+			return 0, false
+		}
+		state, err := rjs.Read()
+		if err != nil {
+			return 0, false
+		}
+		return joymap.RawStick(&conf, state, cur), true
+	}
+	redraw := func() {
+		in, live := liveInput()
+		curve.draw(tmp.Axes[cur], live, in)
+	}
+	load := func() {
+		loading = true
+		ar := tmp.Axes[cur]
+		dzScale.SetValue(ar.DeadZone)
+		expoScale.SetValue(ar.Expo)
+		rateScale.SetValue(ar.MaxRate)
+		invCheck.SetActive(ar.Invert)
+		loading = false
+		redraw()
+	}
+	store := func() {
+		if loading {
+			return
+		}
+		tmp.Axes[cur] = joymap.AxisResponseT{
+			DeadZone: dzScale.GetValue(),
+			Expo:     expoScale.GetValue(),
+			MaxRate:  rateScale.GetValue(),
+			Invert:   invCheck.GetActive(),
+		}
+		redraw()
+	}
+	stickCombo.Connect("changed", func() {
+		if ix := stickCombo.GetActive(); ix >= 0 {
+			cur = ix
+			load()
+		}
+	})
+	dzScale.Connect("value-changed", store)
+	expoScale.Connect("value-changed", store)
+	rateScale.Connect("value-changed", store)
+	invCheck.Connect("toggled", store)
+	stickCombo.SetActive(joymap.StLx)
+	load()
+
+	closed := false
+	if rjs != nil {
+		glib.TimeoutAdd(curvePollMs, func() bool {
+			if closed {
+				return false
+			}
+			redraw()
+			return true
+		})
+	}
+
+	rd.GetVBox().PackStart(hbox, true, true, 5)
+	rd.AddButton("Defaults", gtk.RESPONSE_APPLY)
+	rd.AddButton("Cancel", gtk.RESPONSE_CANCEL)
+	rd.AddButton("OK", gtk.RESPONSE_OK)
+	rd.SetDefaultResponse(gtk.RESPONSE_OK)
+	rd.ShowAll()
+	for {
+		response := rd.Run()
+		if response == gtk.RESPONSE_APPLY {
+			tmp = joymap.DefaultProfile()
+			load()
+			continue
+		}
+		if response == gtk.RESPONSE_OK {
+			*sp = tmp
+		}
+		break
+	}
+	closed = true
+	if rjs != nil {
+		rjs.Close()
+	}
+	rd.Destroy()
+}
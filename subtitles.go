@@ -0,0 +1,107 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Anty0/tello"
+)
+
+// While recording video the flight data can be sampled and saved as an SRT subtitle file
+// next to the MP4, most players (and editors) show it as an overlay when playing the video.
+
+const srtPeriod = 500 * time.Millisecond
+
+type srtCueT struct {
+	at   time.Time
+	text string
+}
+
+type telemetrySubsT struct {
+	cues     []srtCueT
+	stopChan chan bool
+	done     chan bool
+}
+
+// startTelemetrySubs starts sampling the flight data in a Goroutine until stop is called.
+func startTelemetrySubs() (ts *telemetrySubsT) {
+	ts = &telemetrySubsT{stopChan: make(chan bool), done: make(chan bool)}
+	go func() {
+		ticker := time.NewTicker(srtPeriod)
+		defer ticker.Stop()
+		defer close(ts.done)
+		for {
+			select {
+			case <-ts.stopChan:
+				return
+			case now := <-ticker.C:
+				if fd := currentFlightData(); droneResponding(fd) {
+					ts.cues = append(ts.cues, srtCueT{at: now, text: telemetryText(fd, now)})
+				}
+			}
+		}
+	}()
+	return ts
+}
+
+// stop ends the sampling, the cues may then be saved.
+func (ts *telemetrySubsT) stop() {
+	close(ts.stopChan)
+	<-ts.done
+}
+
+// telemetryText is the subtitle shown for one flight data sample.
+func telemetryText(fd tello.FlightData, at time.Time) string {
+	return fmt.Sprintf("%s  BAT %d%%\nH %.1fm  VS %dm/s  GS %dm/s\nX %.1fm  Y %.1fm  HDG %03.0f",
+		at.Format("2006-01-02 15:04:05"), fd.BatteryPercentage,
+		float32(fd.Height)/10, fd.VerticalSpeed, fd.GroundSpeed,
+		fd.MVO.PositionX, fd.MVO.PositionY, math.Mod(float64(fd.IMU.Yaw)+360, 360))
+}
+
+// srtTimestamp formats an offset into the video as hh:mm:ss,mmm
+func srtTimestamp(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d,%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// save writes the cues to an SRT file named after the video, timed from the video's first frame.
+func (ts *telemetrySubsT) save(videoFilename string, firstFrame time.Time) (filename string, err error) {
+	filename = strings.TrimSuffix(videoFilename, ".mp4") + ".srt"
+	f, err := os.Create(filename)
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriter(f)
+	n := 0
+	for i, cue := range ts.cues {
+		end := cue.at.Add(srtPeriod)
+		if i+1 < len(ts.cues) {
+			end = ts.cues[i+1].at
+		}
+		if !end.After(firstFrame) {
+			continue // before the video started
+		}
+		n++
+		fmt.Fprintf(w, "%d\n%s --> %s\n%s\n\n", n,
+			srtTimestamp(cue.at.Sub(firstFrame)), srtTimestamp(end.Sub(firstFrame)), cue.text)
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return "", err
+	}
+	return filename, f.Close()
+}
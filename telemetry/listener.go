@@ -0,0 +1,129 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+// Package telemetry consumes the flight data streamed by the drone.  It has no GUI dependencies.
+package telemetry
+
+import (
+	"sync"
+
+	"github.com/Anty0/tello"
+)
+
+// HandlerFunc is called with each flight data report as it arrives, in the listener's Goroutine.
+type HandlerFunc func(fd tello.FlightData)
+
+// ListenerT keeps the latest flight data report and passes every report to its handlers.
+// It may be started and stopped repeatedly, eg. for each connection to the drone.
+type ListenerT struct {
+	mu       sync.RWMutex
+	latest   tello.FlightData
+	ch       <-chan tello.FlightData
+	handlers []HandlerFunc
+	changed  chan bool // the stream has been replaced
+	stopChan chan bool // nil when not running
+}
+
+// NewListener returns a stopped listener with no handlers.
+func NewListener() *ListenerT {
+	return &ListenerT{changed: make(chan bool, 1)}
+}
+
+// AddHandler adds h to the funcs called for each report, in the order they were added.
+func (l *ListenerT) AddHandler(h HandlerFunc) {
+	l.mu.Lock()
+	l.handlers = append(l.handlers, h)
+	l.mu.Unlock()
+}
+
+// Start starts a Goroutine consuming the reports on ch until Stop is called.
+// If the listener is already running it switches to ch.
+func (l *ListenerT) Start(ch <-chan tello.FlightData) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.setChan(ch)
+	if l.stopChan == nil {
+		l.stopChan = make(chan bool)
+		go l.listen(l.stopChan)
+	}
+}
+
+// SetChan switches to the reports on ch, eg. when the stream has been restarted.
+func (l *ListenerT) SetChan(ch <-chan tello.FlightData) {
+	l.mu.Lock()
+	l.setChan(ch)
+	l.mu.Unlock()
+}
+
+// setChan must be called with the lock held.
+func (l *ListenerT) setChan(ch <-chan tello.FlightData) {
+	l.ch = ch
+	select {
+	case l.changed <- true:
+	default:
+	}
+}
+
+// Stop stops the Goroutine, the latest report is kept.  It is safe to call if the listener is not running.
+func (l *ListenerT) Stop() {
+	l.mu.Lock()
+	if l.stopChan != nil {
+		close(l.stopChan)
+		l.stopChan = nil
+	}
+	l.mu.Unlock()
+}
+
+// Running returns true between Start and Stop.
+func (l *ListenerT) Running() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.stopChan != nil
+}
+
+// Latest returns a copy of the most recent report.
+func (l *ListenerT) Latest() tello.FlightData {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.latest
+}
+
+// Set replaces the latest report without calling the handlers, eg. during playback.
+func (l *ListenerT) Set(fd tello.FlightData) {
+	l.mu.Lock()
+	l.latest = fd
+	l.mu.Unlock()
+}
+
+func (l *ListenerT) listen(stop chan bool) {
+	for {
+		l.mu.RLock()
+		ch := l.ch
+		l.mu.RUnlock()
+		select {
+		case fd, ok := <-ch:
+			if !ok { // the stream has ended, wait for a new one
+				l.mu.Lock()
+				if l.ch == ch {
+					l.ch = nil
+				}
+				l.mu.Unlock()
+				continue
+			}
+			l.mu.Lock()
+			l.latest = fd
+			handlers := l.handlers
+			l.mu.Unlock()
+			for _, h := range handlers {
+				h(fd)
+			}
+		case <-l.changed:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,122 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package telemetry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Anty0/tello"
+)
+
+const testWait = 2 * time.Second
+
+// send passes a report with the given height to the listener via ch, and waits for the handler to see it.
+func send(t *testing.T, ch chan tello.FlightData, seen chan int16, height int16) {
+	t.Helper()
+	select {
+	case ch <- tello.FlightData{Height: height}:
+	case <-time.After(testWait):
+		t.Fatalf("report %d was not consumed", height)
+	}
+	select {
+	case h := <-seen:
+		if h != height {
+			t.Fatalf("handler saw report %d, want %d", h, height)
+		}
+	case <-time.After(testWait):
+		t.Fatalf("handler did not see report %d", height)
+	}
+}
+
+// notConsumed checks that nothing is reading ch.
+func notConsumed(t *testing.T, ch chan tello.FlightData) {
+	t.Helper()
+	select {
+	case ch <- tello.FlightData{Height: -1}:
+		t.Fatal("a report was consumed from an old or stopped stream")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestListener(t *testing.T) {
+	l := NewListener()
+	seen := make(chan int16, 10)
+	var order []int
+	l.AddHandler(func(fd tello.FlightData) { order = append(order, 1) })
+	l.AddHandler(func(fd tello.FlightData) {
+		order = append(order, 2)
+		seen <- fd.Height
+	})
+	if l.Running() {
+		t.Fatal("a new listener is running")
+	}
+	l.Stop() // safe when not running
+
+	ch1 := make(chan tello.FlightData)
+	l.Start(ch1)
+	if !l.Running() {
+		t.Fatal("not running after Start")
+	}
+	send(t, ch1, seen, 10)
+	if got := l.Latest().Height; got != 10 {
+		t.Errorf("Latest().Height = %d, want 10", got)
+	}
+	if len(order) != 2 || order[0] != 1 || order[1] != 2 {
+		t.Errorf("handlers were called in order %v, want [1 2]", order)
+	}
+
+	// SetChan switches streams, the old one is no longer read
+	ch2 := make(chan tello.FlightData)
+	l.SetChan(ch2)
+	send(t, ch2, seen, 20)
+	notConsumed(t, ch1)
+
+	// Start while running also switches, without a second Goroutine
+	ch3 := make(chan tello.FlightData)
+	l.Start(ch3)
+	send(t, ch3, seen, 30)
+	send(t, ch3, seen, 31)
+	if len(seen) != 0 {
+		t.Errorf("%d reports were handled twice", len(seen))
+	}
+	notConsumed(t, ch2)
+
+	// a stream which ends is waited on until it is replaced
+	close(ch3)
+	time.Sleep(50 * time.Millisecond)
+	ch4 := make(chan tello.FlightData)
+	l.SetChan(ch4)
+	send(t, ch4, seen, 40)
+
+	// Set does not call the handlers
+	l.Set(tello.FlightData{Height: 41})
+	if got := l.Latest().Height; got != 41 {
+		t.Errorf("Latest().Height after Set = %d, want 41", got)
+	}
+	if len(seen) != 0 {
+		t.Error("Set called the handlers")
+	}
+
+	// Stop keeps the latest report
+	l.Stop()
+	if l.Running() {
+		t.Error("running after Stop")
+	}
+	notConsumed(t, ch4)
+	if got := l.Latest().Height; got != 41 {
+		t.Errorf("Latest().Height after Stop = %d, want 41", got)
+	}
+	l.Stop()
+
+	// and it may be started again
+	ch5 := make(chan tello.FlightData)
+	l.Start(ch5)
+	send(t, ch5, seen, 50)
+	l.Stop()
+}
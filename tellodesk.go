@@ -10,12 +10,16 @@ package main
 import (
 	"fmt"
 	"log"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/Anty0/tello"
+	"github.com/SMerrony/tellodesk/telemetry"
+	"github.com/SMerrony/tellodesk/track"
 	"github.com/mattn/go-gtk/gdkpixbuf"
 	"github.com/mattn/go-gtk/glib"
 	"github.com/mattn/go-gtk/gtk"
@@ -39,43 +43,49 @@ const (
 var appAuthors = []string{"Stephen Merrony"}
 
 var (
-	drone                                         tello.Tello
-	stickChan                                     chan<- tello.StickMessage
-	fdStopChan, vrStopChan, liveTrackStopChan     chan bool
-	fdChan                                        <-chan tello.FlightData
-	videoChan                                     <-chan []byte
-	stopFeedImageChan                             chan bool
-	videoWgt                                      *videoWgtT
-	videoWidth, videoHeight                       = normalVideoWidth, normalVideoHeight
-	win                                           *gtk.Window
-	menuBar                                       *menuBarT
-	notebook                                      *gtk.Notebook
-	videoPage, statusPage, trackPage, profilePage int // IDs of the notebook pages for each tab
-	statusBar                                     *statusBarT
-
-	flightDataMu sync.RWMutex
-	flightData   tello.FlightData
+	drone                                                      droneT = &realDrone
+	stickChan                                                  chan<- tello.StickMessage
+	vrStopChan, liveTrackStopChan                              chan bool
+	kbStopChan                                                 chan bool
+	fdListener                                                 *telemetry.ListenerT
+	videoChan                                                  <-chan []byte
+	stopFeedImageChan                                          chan bool
+	videoWgt                                                   *videoWgtT
+	videoWidth, videoHeight                                    = normalVideoWidth, normalVideoHeight
+	win                                                        *gtk.Window
+	menuBar                                                    *menuBarT
+	notebook                                                   *gtk.Notebook
+	videoPage, statusPage, trackPage, profilePage, plannerPage int // IDs of the notebook pages for each tab
+	scriptPage, galleryPage                                    int
+	statusBar                                                  *statusBarT
+
 	statusTab    *liveStatusTabT
-	liveTrack    *telloTrackT
+	liveTrack    *track.TrackT
 	trackChart   *trackChartT
 	profileChart *profileChartT
+	plannerTab   *plannerTabT
+	scriptTab    *scriptTabT
+	galleryTab   *galleryTabT
 
 	settingsLoaded bool
 	settings       settingsT
+	headless       bool // no GUI, see headless.go
 
 	blueSkyPixbuf, iconPixbuf *gdkpixbuf.Pixbuf
 )
 
 func main() {
 
+	opts := parseCommandLine()
+	initChans()
+	if headless {
+		os.Exit(runHeadless(opts))
+	}
+
 	// preload the images from generated data
 	blueSkyPixbuf = gdkpixbuf.NewPixbufFromData(blueSkyPNG)
 	iconPixbuf = gdkpixbuf.NewPixbufFromData(iconPNG)
 
-	fdStopChan = make(chan bool) // not buffered
-	vrStopChan = make(chan bool) // not buffered
-	liveTrackStopChan = make(chan bool)
-
 	gtk.Init(nil)
 	win = gtk.NewWindow(gtk.WINDOW_TOPLEVEL)
 	win.SetTitle(appName)
@@ -87,11 +97,20 @@ func main() {
 		videoWidth, videoHeight = wideVideoWidth, wideVideoHeight
 	}
 	blueSkyPixbuf = blueSkyPixbuf.ScaleSimple(videoWidth, videoHeight, gdkpixbuf.INTERP_BILINEAR)
+	if err := applyAPISettings(); err != nil {
+		messageDialog(win, gtk.MESSAGE_ERROR, "Could not start the HTTP API.\n\n"+err.Error())
+	}
+	if err := applyRestreamSettings(); err != nil {
+		messageDialog(win, gtk.MESSAGE_ERROR, "Could not start the video restreamer.\n\n"+err.Error())
+	}
 
 	win.SetResizable(true) // Gtk does the right thing and sets the size after laying out
 	win.Connect("destroy", func() {
 		exitNicely()
 	})
+	win.Connect("key-press-event", func(ctx *glib.CallbackContext) bool { return keyEventCB(ctx, true) })
+	win.Connect("key-release-event", func(ctx *glib.CallbackContext) bool { return keyEventCB(ctx, false) })
+	win.Connect("focus-out-event", keyReleaseAll)
 
 	hbox := gtk.NewHBox(false, 0)
 
@@ -112,26 +131,52 @@ func main() {
 	statusTab = buildLiveStatusTab(videoWidth, videoHeight)
 	statusPage = notebook.AppendPage(statusTab, gtk.NewLabel("Status"))
 
-	liveTrack = newTrack()
+	liveTrack = track.New()
 
 	trackChart = buildTrackChart(liveTrack, videoWidth, videoHeight, defaultTrackScale,
 		menuBar.trackShowDrone.GetActive(), menuBar.trackShowPath.GetActive())
-	trackPage = notebook.AppendPage(trackChart, gtk.NewLabel("Tracker"))
+	trackEventBox := gtk.NewEventBox() // for drawing the geofence
+	trackEventBox.Add(trackChart)
+	trackEventBox.Connect("button-press-event", fenceClickCB)
+	trackPage = notebook.AppendPage(trackEventBox, gtk.NewLabel("Tracker"))
 
 	profileChart = buildProfileChart(videoWidth, videoHeight)
 	profilePage = notebook.AppendPage(profileChart, gtk.NewLabel("Profile"))
 
+	plannerTab = buildPlannerTab(videoWidth, videoHeight)
+	plannerPage = notebook.AppendPage(plannerTab, gtk.NewLabel("Planner"))
+
+	scriptTab = buildScriptTab(videoWidth, videoHeight)
+	scriptPage = notebook.AppendPage(scriptTab, gtk.NewLabel("Script"))
+
+	galleryTab = buildGalleryTab(videoWidth, videoHeight)
+	galleryPage = notebook.AppendPage(galleryTab, gtk.NewLabel("Gallery"))
+
 	glib.TimeoutAdd(statusUpdatePeriodMs, func() bool {
 		statusBar.updateStatusBarTCB()
 		return true
 	})
 	glib.TimeoutAdd(statusUpdatePeriodMs, updateFlightDataTCB)
+	glib.TimeoutAdd(scriptUpdateMs, scriptTab.scriptTCB)
+	glib.TimeoutAdd(galleryUpdateMs, galleryTab.galleryTCB)
 
 	win.Add(hbox)
 	win.ShowAll()
 	gtk.Main()
 }
 
+// initChans makes the flight data listener and the channels used to stop the Goroutines,
+// and starts the stick relay.
+func initChans() {
+	fdListener = newFdListener()
+	vrStopChan = make(chan bool) // not buffered
+	liveTrackStopChan = make(chan bool)
+	kbStopChan = make(chan bool)
+	sticks := make(chan tello.StickMessage)
+	stickChan = sticks
+	go stickRelay(sticks)
+}
+
 func getSettings() {
 	var err error
 	settings, err = loadSettings(appSettingsFile)
@@ -150,10 +195,16 @@ func getSettings() {
 
 		settingsLoaded = true
 	}
+	settings.KeyBindings.setDefaults()
+	fenceGuard.setFence(settings.Geofence)
+	setPhotoOrigin(settings.GeoOrigin)
 }
 
 func exitNicely() {
 	log.Println("Tidying-up and exiting")
+	apiServer.stop()
+	restreamer.stop()
+	stopRecordingVideoCB() // so that the MP4 file is finished
 	if drone.NumPics() > 0 {
 		saveAllPhotosCB()
 	}
@@ -177,20 +228,29 @@ func aboutCB() {
 
 // helper funcs
 
+// dataFileName returns a new file name in the data directory, without characters
+// (such as the colons of RFC3339) which some filesystems do not allow.
+func dataFileName(prefix, ext string) string {
+	return filepath.Join(settings.DataDir, prefix+"_"+time.Now().Format("2006-01-02_15-04-05")+ext)
+}
+
 func openBrowser(url string) {
-	var err error
+	if err := openWithDesktop(url); err != nil {
+		log.Fatal(err)
+	}
+}
 
+// openWithDesktop opens a URL or file with the desktop's default application.
+func openWithDesktop(target string) (err error) {
 	switch runtime.GOOS {
 	case "linux":
-		err = exec.Command("xdg-open", url).Start()
+		err = exec.Command("xdg-open", target).Start()
 	case "windows":
-		err = exec.Command("rundll32", "url.dll,FileProtocolHandler", url).Start()
+		err = exec.Command("rundll32", "url.dll,FileProtocolHandler", target).Start()
 	case "darwin":
-		err = exec.Command("open", url).Start()
+		err = exec.Command("open", target).Start()
 	default:
 		err = fmt.Errorf("unsupported platform")
 	}
-	if err != nil {
-		log.Fatal(err)
-	}
+	return err
 }
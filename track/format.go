@@ -0,0 +1,217 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package track
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Track files are CSV with a YAML preamble held in '#' comment lines, followed by a
+// header row naming the columns.  Legacy (version 1) files are the bare CSV rows.
+const (
+	FormatName    = "tellodesk-track"
+	FormatVersion = 2
+	commentPrefix = "# "
+)
+
+// ColumnT describes one column of a track file.
+type ColumnT struct {
+	Name        string `yaml:"name"`
+	Units       string `yaml:"units"`
+	Description string `yaml:"description"`
+}
+
+// Columns are the columns written by PosT.ToStrings, in order.
+var Columns = []ColumnT{
+	{"TimeStamp", "local time, " + TimeStampFmt, "when the position was reported"},
+	{"X", "m", "MVO X position relative to the take-off point"},
+	{"Y", "m", "MVO Y position relative to the take-off point"},
+	{"Height", "m", "height above the take-off point"},
+	{"Yaw", "degrees", "IMU yaw, positive clockwise"},
+}
+
+// SettingsT records the settings in force when a track was exported.
+type SettingsT struct {
+	JoystickType       string `yaml:"joystick_type,omitempty"`
+	KeyboardControl    bool   `yaml:"keyboard_control"`
+	WideVideo          bool   `yaml:"wide_video"`
+	FlightDataPeriodMs int    `yaml:"flight_data_period_ms"`
+	Simulator          bool   `yaml:"simulator,omitempty"`
+}
+
+// HeaderT is the metadata preamble of a track file.
+type HeaderT struct {
+	Format   string    `yaml:"format"`
+	Version  int       `yaml:"version"`
+	App      string    `yaml:"app"`
+	SSID     string    `yaml:"ssid,omitempty"`
+	Firmware string    `yaml:"firmware,omitempty"`
+	Started  string    `yaml:"started,omitempty"` // RFC3339
+	Exported string    `yaml:"exported"`          // RFC3339
+	Settings SettingsT `yaml:"settings"`
+	Columns  []ColumnT `yaml:"columns"`
+}
+
+// NewHeader returns a header for a track recorded by app, the caller fills in the drone's details.
+func NewHeader(app string, settings SettingsT) *HeaderT {
+	return &HeaderT{
+		Format:   FormatName,
+		Version:  FormatVersion,
+		App:      app,
+		Settings: settings,
+		Columns:  Columns,
+	}
+}
+
+// Write writes the header and positions of tt to w, the read lock must be held if the track is live.
+// If the track was imported its original metadata is kept, otherwise th is used.
+func Write(w io.Writer, tt *TrackT, th *HeaderT) error {
+	hdr := *th
+	if tt.Header != nil {
+		hdr = *tt.Header
+		hdr.Version = FormatVersion
+		hdr.Columns = Columns
+	}
+	if hdr.Started == "" {
+		for _, tp := range tt.Positions {
+			if !tp.TimeStamp.IsZero() {
+				hdr.Started = tp.TimeStamp.Format(time.RFC3339)
+				break
+			}
+		}
+	}
+	hdr.Exported = time.Now().Format(time.RFC3339)
+	pre, err := yaml.Marshal(hdr)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	for _, line := range strings.Split(strings.TrimRight(string(pre), "\n"), "\n") {
+		bw.WriteString(commentPrefix + line + "\n")
+	}
+	cw := csv.NewWriter(bw)
+	names := make([]string, len(Columns))
+	for i, c := range Columns {
+		names[i] = c.Name
+	}
+	cw.Write(names)
+	for _, tp := range tt.Positions {
+		cw.Write(tp.ToStrings())
+	}
+	cw.Flush()
+	if err = cw.Error(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// readHeader reads the commented preamble, if any, from the start of br.
+// A nil header is returned for legacy headerless tracks.
+func readHeader(br *bufio.Reader) (th *HeaderT, err error) {
+	var pre []string
+	for {
+		b, err := br.Peek(1)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if b[0] != '#' {
+			break
+		}
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		pre = append(pre, strings.TrimPrefix(strings.TrimPrefix(line, "#"), " "))
+	}
+	if len(pre) == 0 {
+		return nil, nil
+	}
+	th = new(HeaderT)
+	if err = yaml.Unmarshal([]byte(strings.Join(pre, "\n")), th); err != nil {
+		return nil, fmt.Errorf("invalid track header: %v", err)
+	}
+	if th.Format != FormatName {
+		return nil, errors.New("not a " + FormatName + " file")
+	}
+	if th.Version > FormatVersion {
+		return nil, fmt.Errorf("track format version %d is newer than this version supports (%d)",
+			th.Version, FormatVersion)
+	}
+	return th, nil
+}
+
+// Read reads a track file in either the versioned or the legacy headerless format.
+func Read(r io.Reader) (tt *TrackT, err error) {
+	br := bufio.NewReader(r)
+	th, err := readHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	cr := csv.NewReader(br)
+	cr.FieldsPerRecord = -1
+	line := 1
+
+	// colIx maps each of Columns to its position in the file
+	colIx := make([]int, len(Columns))
+	for i := range colIx {
+		colIx[i] = i
+	}
+	if th != nil {
+		names, err := cr.Read()
+		if err != nil {
+			return nil, fmt.Errorf("missing column header row: %v", err)
+		}
+		line++
+		for i, c := range Columns {
+			colIx[i] = -1
+			for j, n := range names {
+				if strings.TrimSpace(n) == c.Name {
+					colIx[i] = j
+				}
+			}
+			if colIx[i] < 0 {
+				return nil, fmt.Errorf("missing column: %s", c.Name)
+			}
+		}
+	}
+
+	tt = New()
+	tt.Header = th
+	row := make([]string, len(Columns))
+	for ; ; line++ {
+		fields, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		for i, ix := range colIx {
+			if ix >= len(fields) {
+				return nil, fmt.Errorf("line %d: missing %s value", line, Columns[i].Name)
+			}
+			row[i] = fields[ix]
+		}
+		pos, err := ToPos(row)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		tt.append(pos)
+	}
+	return tt, nil
+}
@@ -0,0 +1,127 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package track
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testTrack() *TrackT {
+	tt := New()
+	start := time.Date(2019, 5, 4, 13, 2, 3, 0, time.Local)
+	for i, p := range []PosT{
+		{HeightDm: 0, MvoX: 0, MvoY: 0, ImuYaw: 0},
+		{HeightDm: 12, MvoX: 0.5, MvoY: 1.25, ImuYaw: 10},
+		{HeightDm: 15, MvoX: -2.125, MvoY: 3, ImuYaw: -90},
+	} {
+		p.TimeStamp = start.Add(time.Duration(i) * 250 * time.Millisecond)
+		tt.append(p)
+	}
+	return tt
+}
+
+func TestWriteReadRoundTrip(t *testing.T) {
+	tt := testTrack()
+	th := NewHeader("TelloDesk test", SettingsT{JoystickType: "DualShock4", FlightDataPeriodMs: 100})
+	th.SSID = "TELLO-123456"
+	var buf bytes.Buffer
+	if err := Write(&buf, tt, th); err != nil {
+		t.Fatalf("Write error = %v", err)
+	}
+	got, err := Read(&buf)
+	if err != nil {
+		t.Fatalf("Read error = %v", err)
+	}
+	if got.Header == nil {
+		t.Fatal("Read did not return the header")
+	}
+	if got.Header.Format != FormatName || got.Header.Version != FormatVersion || got.Header.App != th.App ||
+		got.Header.SSID != th.SSID || got.Header.Settings != th.Settings {
+		t.Errorf("header = %+v, want %+v", *got.Header, *th)
+	}
+	if want := tt.Positions[0].TimeStamp.Format(time.RFC3339); got.Header.Started != want {
+		t.Errorf("header Started = %q, want %q", got.Header.Started, want)
+	}
+	if len(got.Positions) != len(tt.Positions) {
+		t.Fatalf("read %d positions, want %d", len(got.Positions), len(tt.Positions))
+	}
+	for i, p := range got.Positions {
+		want := tt.Positions[i]
+		if !p.TimeStamp.Equal(want.TimeStamp) || p.HeightDm != want.HeightDm || p.MvoX != want.MvoX ||
+			p.MvoY != want.MvoY || p.ImuYaw != want.ImuYaw {
+			t.Errorf("position %d = %+v, want %+v", i, p, want)
+		}
+	}
+	if got.MinX != tt.MinX || got.MaxY != tt.MaxY || got.MaxHeightDm != tt.MaxHeightDm {
+		t.Errorf("bounds = %v, %v, %v, want %v, %v, %v", got.MinX, got.MaxY, got.MaxHeightDm,
+			tt.MinX, tt.MaxY, tt.MaxHeightDm)
+	}
+}
+
+// TestWriteKeepsImportedHeader checks that re-exporting an imported track keeps its metadata.
+func TestWriteKeepsImportedHeader(t *testing.T) {
+	tt := testTrack()
+	tt.Header = NewHeader("TelloDesk 0.1", SettingsT{})
+	tt.Header.Version = 1
+	tt.Header.Firmware = "01.04.92.01"
+	var buf bytes.Buffer
+	if err := Write(&buf, tt, NewHeader("TelloDesk test", SettingsT{})); err != nil {
+		t.Fatalf("Write error = %v", err)
+	}
+	got, err := Read(&buf)
+	if err != nil {
+		t.Fatalf("Read error = %v", err)
+	}
+	if got.Header.App != "TelloDesk 0.1" || got.Header.Firmware != "01.04.92.01" || got.Header.Version != FormatVersion {
+		t.Errorf("header = %+v", *got.Header)
+	}
+}
+
+func TestRead(t *testing.T) {
+	hdr := "# format: tellodesk-track\n# version: 2\n# app: test\n"
+	tests := []struct {
+		name    string
+		file    string
+		wantN   int
+		wantErr string
+	}{
+		{"legacy", "20190504130203.000,1.000,2.000,1.5,90\r\n20190504130204.000,1.500,2.000,1.5,90\n", 2, ""},
+		{"empty legacy", "", 0, ""},
+		{"versioned", hdr + "TimeStamp,X,Y,Height,Yaw\n20190504130203.000,1.000,2.000,1.5,90\n", 1, ""},
+		{"reordered columns", hdr + "Yaw,Height,Y,X,TimeStamp,Battery\n90,1.5,2.000,1.000,20190504130203.000,87\n", 1, ""},
+		{"other format", "# format: something-else\n# version: 1\nTimeStamp,X,Y,Height,Yaw\n", 0, "not a tellodesk-track file"},
+		{"newer version", "# format: tellodesk-track\n# version: 99\nTimeStamp,X,Y,Height,Yaw\n", 0, "newer than this version"},
+		{"bad header", "# format: [\n", 0, "invalid track header"},
+		{"no column row", hdr, 0, "missing column header row"},
+		{"missing column", hdr + "TimeStamp,X,Y,Height\n", 0, "missing column: Yaw"},
+		{"missing value", hdr + "TimeStamp,X,Y,Height,Yaw\n20190504130203.000,1.000,2.000,1.5\n", 0, "missing Yaw value"},
+		{"bad value", "20190504130203.000,1.000,2.000,1.5,90\n20190504130204.000,?,2.000,1.5,90\n", 0, "line 2: bad X"},
+	}
+	for _, tc := range tests {
+		tt, err := Read(strings.NewReader(tc.file))
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%s: error = %v, want %q", tc.name, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: error = %v", tc.name, err)
+			continue
+		}
+		if len(tt.Positions) != tc.wantN {
+			t.Errorf("%s: read %d positions, want %d", tc.name, len(tt.Positions), tc.wantN)
+		}
+		if tc.wantN > 0 && (tt.Positions[0].MvoX != 1 || tt.Positions[0].ImuYaw != 90 || tt.Positions[0].HeightDm != 15) {
+			t.Errorf("%s: first position = %+v", tc.name, tt.Positions[0])
+		}
+	}
+}
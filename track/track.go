@@ -0,0 +1,216 @@
+/**
+ *Copyright (c) 2018 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+// Package track holds the drone's track, the positions it reports during a flight,
+// and reads and writes track files.  It has no GUI dependencies.
+package track
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Anty0/tello"
+)
+
+// TimeStampFmt is the format of the timestamps in track files.
+const TimeStampFmt = "20060102150405.000"
+
+// zeroTimeStamp is how ToStrings writes a position with no time.
+var zeroTimeStamp = time.Time{}.Format(TimeStampFmt)
+
+// PosT defines an instantaneous position of the drone.
+type PosT struct {
+	TimeStamp  time.Time
+	HeightDm   int16
+	MvoX, MvoY float32
+	ImuYaw     int16
+}
+
+// TrackT contains a complete (or in-flight) track.  Anything reading the Positions from
+// another Goroutine than the one adding them must hold the read lock.
+type TrackT struct {
+	sync.RWMutex
+	MaxX, MaxY, MinX, MinY   float32
+	MaxHeightDm, MinHeightDm int16
+	Positions                []PosT
+	Header                   *HeaderT // metadata of an imported track, nil for a live one
+}
+
+// New returns an empty track.
+func New() (tt *TrackT) {
+	tt = new(TrackT)
+	tt.Positions = make([]PosT, 0, 1000)
+	return tt
+}
+
+// ToStrings converts a single position into an array of human-readable strings
+// suitable for CSV export etc.
+func (tp *PosT) ToStrings() (strings []string) {
+	strings = append(strings, tp.TimeStamp.Format(TimeStampFmt))
+	strings = append(strings, fmt.Sprintf("%.3f", tp.MvoX))
+	strings = append(strings, fmt.Sprintf("%.3f", tp.MvoY))
+	strings = append(strings, fmt.Sprintf("%.1f", float64(tp.HeightDm)/10))
+	strings = append(strings, fmt.Sprintf("%d", tp.ImuYaw))
+	return strings
+}
+
+// ToPos does the inverse of ToStrings, converting an array of strings into
+// a single position struct.
+func ToPos(strings []string) (tp PosT, err error) {
+	if len(strings) < len(Columns) {
+		return tp, fmt.Errorf("expected %d values, found %d", len(Columns), len(strings))
+	}
+	if strings[0] != zeroTimeStamp { // which would be parsed as year 1 here, not as the zero time
+		if tp.TimeStamp, err = time.ParseInLocation(TimeStampFmt, strings[0], time.Local); err != nil {
+			return tp, fmt.Errorf("bad TimeStamp: %q", strings[0])
+		}
+	}
+	var f64 float64
+	if f64, err = strconv.ParseFloat(strings[1], 32); err != nil {
+		return tp, fmt.Errorf("bad X: %q", strings[1])
+	}
+	tp.MvoX = float32(f64)
+	if f64, err = strconv.ParseFloat(strings[2], 32); err != nil {
+		return tp, fmt.Errorf("bad Y: %q", strings[2])
+	}
+	tp.MvoY = float32(f64)
+	if f64, err = strconv.ParseFloat(strings[3], 32); err != nil {
+		return tp, fmt.Errorf("bad Height: %q", strings[3])
+	}
+	tp.HeightDm = int16(math.Round(f64 * 10))
+	i64, err := strconv.ParseInt(strings[4], 10, 16)
+	if err != nil {
+		return tp, fmt.Errorf("bad Yaw: %q", strings[4])
+	}
+	tp.ImuYaw = int16(i64)
+	return tp, nil
+}
+
+// AddPositionIfChanged appends a new position report to the track if any of
+// the MvoX, MvoY or Yaw have changed.  If only the timestamp has changed the
+// position is not added.
+func (tt *TrackT) AddPositionIfChanged(fd tello.FlightData) {
+	tt.AddPositionIfChangedAt(fd, time.Now())
+}
+
+// AddPositionIfChangedAt is AddPositionIfChanged for a report received at time ts, eg. during playback.
+func (tt *TrackT) AddPositionIfChangedAt(fd tello.FlightData, ts time.Time) {
+	var newPos PosT
+
+	newPos.HeightDm = fd.Height
+	newPos.MvoX = fd.MVO.PositionX
+	newPos.MvoY = fd.MVO.PositionY
+	newPos.ImuYaw = fd.IMU.Yaw
+
+	if len(tt.Positions) == 0 {
+		if newPos.HeightDm == 0 && newPos.MvoX == 0 && newPos.MvoY == 0 {
+			return
+		}
+	} else {
+		lastPos := tt.Positions[len(tt.Positions)-1]
+		if lastPos.HeightDm == newPos.HeightDm && lastPos.MvoX == newPos.MvoX && lastPos.MvoY == newPos.MvoY && lastPos.ImuYaw == newPos.ImuYaw {
+			// nothing has changed - just return
+			return
+		}
+		newPos.TimeStamp = ts
+	}
+	tt.Lock()
+	tt.append(newPos)
+	tt.Unlock()
+}
+
+// append adds a position and extends the track's bounds to include it.
+func (tt *TrackT) append(pos PosT) {
+	tt.Positions = append(tt.Positions, pos)
+
+	if pos.MvoX < tt.MinX {
+		tt.MinX = pos.MvoX
+	}
+	if pos.MvoX > tt.MaxX {
+		tt.MaxX = pos.MvoX
+	}
+
+	if pos.MvoY < tt.MinY {
+		tt.MinY = pos.MvoY
+	}
+	if pos.MvoY > tt.MaxY {
+		tt.MaxY = pos.MvoY
+	}
+
+	if pos.HeightDm < tt.MinHeightDm {
+		tt.MinHeightDm = pos.HeightDm
+	}
+	if pos.HeightDm > tt.MaxHeightDm {
+		tt.MaxHeightDm = pos.HeightDm
+	}
+}
+
+// DeriveScale returns the largest X or Y value rounded up to a whole number.
+func (tt *TrackT) DeriveScale() (scale float32) {
+	scale = 1.0 // minimum scale value
+	if tt.MaxX > scale {
+		scale = tt.MaxX
+	}
+	if -tt.MinX > scale {
+		scale = -tt.MinX
+	}
+	if tt.MaxY > scale {
+		scale = tt.MaxY
+	}
+	if -tt.MinY > scale {
+		scale = -tt.MinY
+	}
+	scale = float32(math.Ceil(float64(scale)))
+	return scale
+}
+
+// DeriveHeightScale returns the largest height in metres, rounded up, plus one.
+func (tt *TrackT) DeriveHeightScale() (scale float32) {
+	var tmpScale int16 = 10 // min
+	if tt.MaxHeightDm > tmpScale {
+		tmpScale = tt.MaxHeightDm
+	}
+	if -tt.MinHeightDm > tmpScale {
+		tmpScale = -tt.MinHeightDm
+	}
+	scale = float32(tmpScale/10) + 1.0
+	return scale
+}
+
+// Simplify attempts to reduce the number of points in a track by eliminating consecutive postions that
+// are within minDist metres of the previous position.
+func (tt *TrackT) Simplify(minDist float32) {
+	if minDist < 0.1 || minDist > 2.0 {
+		log.Printf("Track simplification ignored as minDist is out of range (0.1m ~ 2.0m): %f\n", minDist)
+		return
+	}
+	if len(tt.Positions) < 3 {
+		log.Printf("Track too short to simplify (only %d points found).\n", len(tt.Positions))
+		return
+	}
+	min64 := float64(minDist)
+	lastPos := tt.Positions[0]
+	thisIx := 1
+	for thisIx < len(tt.Positions) {
+		thisPos := tt.Positions[thisIx]
+		xdiff := math.Abs(float64(lastPos.MvoX - thisPos.MvoX))
+		ydiff := math.Abs(float64(lastPos.MvoY - thisPos.MvoY))
+		zdiff := math.Abs(float64(lastPos.HeightDm)-float64(thisPos.HeightDm)) / 10.0
+		if xdiff < min64 && ydiff < min64 && zdiff < min64 {
+			tt.Positions = append(tt.Positions[:thisIx], tt.Positions[thisIx+1:]...)
+			//log.Printf("xdiff: %f, ydiff: %f, zdiff: %f ... skipping\n", xdiff, ydiff, zdiff)
+		} else {
+			lastPos = tt.Positions[thisIx]
+			thisIx++
+			//log.Printf("xdiff: %f, ydiff: %f, zdiff: %f ... keeping\n", xdiff, ydiff, zdiff)
+		}
+	}
+}
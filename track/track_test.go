@@ -0,0 +1,118 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package track
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestToStrings(t *testing.T) {
+	ts := time.Date(2019, 5, 4, 13, 2, 3, 456e6, time.Local)
+	tests := []struct {
+		pos  PosT
+		want []string
+	}{
+		{PosT{TimeStamp: ts, HeightDm: 15, MvoX: 1.25, MvoY: -0.5, ImuYaw: 90},
+			[]string{"20190504130203.456", "1.250", "-0.500", "1.5", "90"}},
+		{PosT{TimeStamp: ts, HeightDm: -3, MvoX: 0, MvoY: 0, ImuYaw: -179},
+			[]string{"20190504130203.456", "0.000", "0.000", "-0.3", "-179"}},
+	}
+	for _, tc := range tests {
+		if got := tc.pos.ToStrings(); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("ToStrings(%+v) = %q, want %q", tc.pos, got, tc.want)
+		}
+	}
+}
+
+func TestToPos(t *testing.T) {
+	ts := time.Date(2019, 5, 4, 13, 2, 3, 456e6, time.Local)
+	tests := []struct {
+		row     []string
+		want    PosT
+		wantErr string
+	}{
+		{[]string{"20190504130203.456", "1.250", "-0.500", "1.5", "90"},
+			PosT{TimeStamp: ts, HeightDm: 15, MvoX: 1.25, MvoY: -0.5, ImuYaw: 90}, ""},
+		{[]string{"20190504130203.456", "1.250", "-0.500", "1.5", "90", "extra"},
+			PosT{TimeStamp: ts, HeightDm: 15, MvoX: 1.25, MvoY: -0.5, ImuYaw: 90}, ""},
+		{[]string{"20190504130203.456", "1", "2", "3"}, PosT{}, "expected 5 values"},
+		{[]string{"2019-05-04", "1", "2", "3", "4"}, PosT{}, "bad TimeStamp"},
+		{[]string{"20190504130203.456", "x", "2", "3", "4"}, PosT{}, "bad X"},
+		{[]string{"20190504130203.456", "1", "", "3", "4"}, PosT{}, "bad Y"},
+		{[]string{"20190504130203.456", "1", "2", "high", "4"}, PosT{}, "bad Height"},
+		{[]string{"20190504130203.456", "1", "2", "3", "4.5"}, PosT{}, "bad Yaw"},
+		{[]string{"20190504130203.456", "1", "2", "3", "40000"}, PosT{}, "bad Yaw"},
+	}
+	for _, tc := range tests {
+		got, err := ToPos(tc.row)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("ToPos(%q) error = %v, want %q", tc.row, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ToPos(%q) error = %v", tc.row, err)
+			continue
+		}
+		if !got.TimeStamp.Equal(tc.want.TimeStamp) {
+			t.Errorf("ToPos(%q) TimeStamp = %v, want %v", tc.row, got.TimeStamp, tc.want.TimeStamp)
+		}
+		got.TimeStamp = tc.want.TimeStamp
+		if got != tc.want {
+			t.Errorf("ToPos(%q) = %+v, want %+v", tc.row, got, tc.want)
+		}
+	}
+}
+
+// TestToPosRoundTrip checks that ToPos reverses ToStrings to the precision of the file.
+func TestToPosRoundTrip(t *testing.T) {
+	ts := time.Date(2019, 12, 31, 23, 59, 59, 999e6, time.Local)
+	for _, pos := range []PosT{
+		{TimeStamp: ts, HeightDm: 0, MvoX: 0, MvoY: 0, ImuYaw: 0},
+		{TimeStamp: ts, HeightDm: 123, MvoX: -12.375, MvoY: 7.125, ImuYaw: -45},
+		{TimeStamp: ts, HeightDm: -1, MvoX: 100.5, MvoY: -100.5, ImuYaw: 180},
+	} {
+		got, err := ToPos(pos.ToStrings())
+		if err != nil {
+			t.Fatalf("ToPos(ToStrings(%+v)) error = %v", pos, err)
+		}
+		if !got.TimeStamp.Equal(pos.TimeStamp) {
+			t.Errorf("round trip of %+v TimeStamp = %v", pos, got.TimeStamp)
+		}
+		got.TimeStamp = pos.TimeStamp
+		if got != pos {
+			t.Errorf("round trip of %+v = %+v", pos, got)
+		}
+	}
+}
+
+// TestToPosZeroTime checks that a position with no time still has none after a round trip,
+// in a time zone where year 1 local time would not be the zero time.
+func TestToPosZeroTime(t *testing.T) {
+	defer func(loc *time.Location) { time.Local = loc }(time.Local)
+	time.Local = time.FixedZone("CEST", 2*3600)
+	pos := PosT{HeightDm: 5, MvoX: 1, MvoY: 2, ImuYaw: 3}
+	row := pos.ToStrings()
+	if row[0] != "00010101000000.000" {
+		t.Errorf("ToStrings of the zero time = %q", row[0])
+	}
+	got, err := ToPos(row)
+	if err != nil {
+		t.Fatalf("ToPos(%q) error = %v", row, err)
+	}
+	if !got.TimeStamp.IsZero() {
+		t.Errorf("ToPos(%q) TimeStamp = %v, want the zero time", row, got.TimeStamp)
+	}
+	if got != pos {
+		t.Errorf("round trip of %+v = %+v", pos, got)
+	}
+}
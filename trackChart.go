@@ -12,15 +12,17 @@ import (
 	"image"
 	"image/color"
 	"image/draw"
+	"math"
 	"strconv"
 
+	"github.com/SMerrony/tellodesk/track"
 	"github.com/mattn/go-gtk/gdkpixbuf"
 	"github.com/mattn/go-gtk/gtk"
 )
 
 type trackChartT struct {
 	*gtk.Image
-	track                                        *telloTrackT
+	track                                        *track.TrackT
 	backingImage                                 *image.RGBA
 	pbd                                          gdkpixbuf.PixbufData
 	pixBuf                                       *gdkpixbuf.Pixbuf
@@ -33,7 +35,7 @@ type trackChartT struct {
 
 const defaultTrackScale float32 = 10.0
 
-func buildTrackChart(trk *telloTrackT, w, h int, scale float32, showDrone, showPath bool) (tc *trackChartT) {
+func buildTrackChart(trk *track.TrackT, w, h int, scale float32, showDrone, showPath bool) (tc *trackChartT) {
 	tc = new(trackChartT)
 	tc.Image = gtk.NewImage()
 	tc.width, tc.height = w, h
@@ -67,7 +69,18 @@ func buildTrackChart(trk *telloTrackT, w, h int, scale float32, showDrone, showP
 }
 
 func (tc *trackChartT) calcScale() {
-	tc.maxOffset = tc.track.deriveScale()
+	scale := tc.track.DeriveScale()
+	if settings.Geofence.Enabled { // make sure the whole fence is visible
+		if ext := float32(math.Ceil(settings.Geofence.extent(fenceGuard.home()))); ext > scale {
+			scale = ext
+		}
+	}
+	tc.setMaxOffset(scale)
+}
+
+// setMaxOffset sets the extent of the chart (in metres from the origin) along the shortest axis.
+func (tc *trackChartT) setMaxOffset(maxOffset float32) {
+	tc.maxOffset = maxOffset
 	if tc.width >= tc.height { // scale to the shortest axis
 		tc.scalePPM = float32(tc.yOrigin) / tc.maxOffset
 	} else {
@@ -116,6 +129,7 @@ func (tc *trackChartT) drawEmptyChart() {
 		tc.backingImage.Set(tc.xOrigin+1, tc.yOrigin+int(y*tc.scalePPM), tc.axesCol)
 		tc.drawLabel(0, y, strconv.Itoa(int(y)))
 	}
+	tc.drawFence()
 	tc.pbd.Data = tc.backingImage.Pix
 	tc.pixBuf = gdkpixbuf.NewPixbufFromData(tc.pbd)
 	tc.SetFromPixbuf(tc.pixBuf)
@@ -127,10 +141,10 @@ func (tc *trackChartT) drawLabel(x, y float32, lab string) {
 
 func (tc *trackChartT) drawTitles() {
 	const dateFmt = "Jan 2 2006 15:04:05"
-	if len(tc.track.positions) > 1 {
+	if len(tc.track.Positions) > 1 {
 		tc.drawLabel(-tc.maxOffset-0.5, -tc.maxOffset+0.5, fmt.Sprintf("Flight from %s to %s",
-			tc.track.positions[1].timeStamp.Format(dateFmt),
-			tc.track.positions[len(tc.track.positions)-1].timeStamp.Format("15:04:05")))
+			tc.track.Positions[1].TimeStamp.Format(dateFmt),
+			tc.track.Positions[len(tc.track.Positions)-1].TimeStamp.Format("15:04:05")))
 	}
 }
 
@@ -146,6 +160,18 @@ func (tc *trackChartT) yToOrd(y float32) (yOrd int) {
 	return yOrd
 }
 
+// ordToX converts a physical horizontal position on the image to its chart equivalent
+func (tc *trackChartT) ordToX(xOrd int) (x float32) {
+	x = float32(xOrd-tc.xOrigin) / tc.scalePPM
+	return x
+}
+
+// ordToY converts a physical vertical position on the image to its chart equivalent
+func (tc *trackChartT) ordToY(yOrd int) (y float32) {
+	y = float32(tc.yOrigin-yOrd) / tc.scalePPM
+	return y
+}
+
 func (tc *trackChartT) drawPos(x, y float32, yaw int16) {
 	switch {
 	case yaw >= -45 && yaw <= 45: // N
@@ -173,24 +199,24 @@ func (tc *trackChartT) drawTrack() {
 	}
 	tc.drawEmptyChart()
 	var lastX, lastY float32
-	for _, pos := range tc.track.positions {
+	for _, pos := range tc.track.Positions {
 		if tc.showDrone {
-			tc.drawPos(pos.mvoX, pos.mvoY, pos.imuYaw)
+			tc.drawPos(pos.MvoX, pos.MvoY, pos.ImuYaw)
 		}
 		if tc.showPath {
-			tc.line(lastX, lastY, pos.mvoX, pos.mvoY, tc.droneCol)
-			lastX = pos.mvoX
-			lastY = pos.mvoY
+			tc.line(lastX, lastY, pos.MvoX, pos.MvoY, tc.droneCol)
+			lastX = pos.MvoX
+			lastY = pos.MvoY
 		}
 	}
 	drawPhysLabel(tc.backingImage,
-		tc.xToOrd(tc.track.positions[0].mvoX),
-		tc.yToOrd(tc.track.positions[0].mvoY),
+		tc.xToOrd(tc.track.Positions[0].MvoX),
+		tc.yToOrd(tc.track.Positions[0].MvoY),
 		"Start", tc.labelCol)
-	last := len(tc.track.positions) - 1
+	last := len(tc.track.Positions) - 1
 	drawPhysLabel(tc.backingImage,
-		tc.xToOrd(tc.track.positions[last].mvoX),
-		tc.yToOrd(tc.track.positions[last].mvoY),
+		tc.xToOrd(tc.track.Positions[last].MvoX),
+		tc.yToOrd(tc.track.Positions[last].MvoY),
 		"Finish", tc.labelCol)
 	tc.drawTitles()
 	tc.pbd.Data = tc.backingImage.Pix
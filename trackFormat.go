@@ -0,0 +1,35 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package main
+
+import (
+	"io"
+
+	"github.com/SMerrony/tellodesk/track"
+)
+
+// newTrackHeader builds the preamble for exporting a track from the current drone and settings.
+func newTrackHeader() (th *track.HeaderT) {
+	th = track.NewHeader(appName+" "+appVersion, track.SettingsT{
+		JoystickType:       settings.JoystickType,
+		KeyboardControl:    settings.KeyboardControl,
+		WideVideo:          settings.WideVideo,
+		FlightDataPeriodMs: fdPeriodMs,
+		Simulator:          simDrone != nil && drone == simDrone,
+	})
+	fd := currentFlightData()
+	th.SSID = fd.SSID
+	th.Firmware = fd.Version
+	return th
+}
+
+// writeTrack writes trk to w with a header describing this drone and settings, the track's
+// read lock must be held.  If the track was imported its original metadata is kept.
+func writeTrack(w io.Writer, trk *track.TrackT) error {
+	return track.Write(w, trk, newTrackHeader())
+}
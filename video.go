@@ -8,20 +8,17 @@
 package main
 
 import (
-	"fmt"
 	"image"
 
-	"io"
 	"log"
 	"os"
 
-	"os/exec"
-	"path/filepath"
 	"sync"
 	"time"
 
-	"github.com/3d0c/gmf"
 	"github.com/Anty0/tello"
+	"github.com/SMerrony/tellodesk/video"
+	"github.com/SMerrony/tellodesk/video/decoder"
 
 	"github.com/mattn/go-gtk/gdk"
 	"github.com/mattn/go-gtk/gdkpixbuf"
@@ -33,33 +30,19 @@ const (
 	videoScale                          = 1.45 //1.4125
 	normalVideoWidth, normalVideoHeight = (int)(960 * videoScale), (int)(720 * videoScale)
 	wideVideoWidth, wideVideoHeight     = (int)(1280 * videoScale), (int)(720 * videoScale)
-
-	packetQueueLimit = 5000
 )
 
-type videoPacket struct {
-	packet []byte
-	next   *videoPacket
-}
-
 var (
-	videoRecMu      sync.RWMutex
-	videoWriteRecMu sync.RWMutex
-
-	videoRecording bool
-
-	videoConverter *exec.Cmd
-	videoWriter    io.WriteCloser
-
-	firstPacket *videoPacket
-	lastPacket  *videoPacket
-	packetLen   int
+	videoRecorder = video.RecorderT{App: appName}
+	audioRec      *audioRecT
+	telemetrySubs *telemetrySubsT
 )
 
 type videoWgtT struct {
 	*gtk.Layout    // use a layout so we can overlay a message etc.
 	image          *gtk.Image
 	feedImage      *image.RGBA
+	hudImage       *image.RGBA // a copy of feedImage with the HUD drawn on it
 	newFeedImageMu sync.Mutex
 	newFeedImage   bool
 	message        *gtk.Label
@@ -86,85 +69,111 @@ func (wgt *videoWgtT) clearMessage() {
 	wgt.message.SetText("")
 }
 
+// recordVideoCB starts recording the drone's H.264 stream to an MP4 file in the data directory.
 func recordVideoCB() {
-	videoRecMu.Lock()
-	if !videoRecording {
-		videoFilename := fmt.Sprintf("%s%ctello_vid_%s", settings.DataDir, filepath.Separator, time.Now().Format(time.RFC3339))
-		videoConverter = exec.Command("ffmpeg", "-f", "pulse", "-i", "default", "-r", "30", "-i", "-", "-af", "aresample=async=1:first_pts=0", "-vcodec", "copy", videoFilename+".avi")
-
-		var err error
-
-		videoWriteRecMu.Lock()
-		videoWriter, err = videoConverter.StdinPipe()
-		videoWriteRecMu.Unlock()
-		if err != nil {
-			videoRecMu.Unlock()
-			messageDialog(win, gtk.MESSAGE_INFO, "Could not prepare video converter.")
-			return
-		}
-
-		err = videoConverter.Start()
-		if err != nil {
-			videoRecMu.Unlock()
-			messageDialog(win, gtk.MESSAGE_INFO, "Could not start video converter.")
-			return
-		}
-
-		firstPacket = nil
-		lastPacket = nil
-		packetLen = 0
-
-		videoRecording = true
+	_, audioErr, err := startVideoRecording()
+	if err != nil {
+		messageDialog(win, gtk.MESSAGE_ERROR, "Could not create video file.\n\n"+err.Error())
+		return
 	}
-	videoRecMu.Unlock()
-
-	go videoWriterLoop()
-
 	menuBar.recVidItem.SetSensitive(false)
 	menuBar.stopRecVidItem.SetSensitive(true)
-}
 
-func stopRecordingVideoCB() {
-	videoRecMu.Lock()
-	videoRecording = false
-
-	firstPacket = nil
-	lastPacket = nil
-	packetLen = 0
-
-	videoWriteRecMu.Lock()
-	videoWriter.Close()
-	videoWriteRecMu.Unlock()
-
-	videoConverter.Process.Signal(os.Interrupt)
+	if audioErr != nil {
+		messageDialog(win, gtk.MESSAGE_WARNING, "Recording video without sound.\n\n"+audioErr.Error())
+	}
+}
 
-	videoConverterDone := make(chan error)
-	go func() { videoConverterDone <- videoConverter.Wait() }()
+// startVideoRecording starts recording, with sound and subtitles if they are set up,
+// it does nothing if we are already recording.  No GTK stuff in here...
+func startVideoRecording() (filename string, audioErr, err error) {
+	if videoRecorder.Recording() {
+		return "", nil, nil
+	}
+	filename = dataFileName("tello_vid", ".mp4")
+	if err = videoRecorder.Start(filename); err != nil {
+		return "", nil, err
+	}
 
-	videoConverterTimeout := time.After(15 * time.Second)
+	audioRec = nil
+	if settings.RecordAudio {
+		if audioRec, audioErr = startAudioRecorder(filename); audioErr != nil {
+			log.Printf("Could not record sound: %v\n", audioErr)
+		}
+	}
+	telemetrySubs = nil
+	if settings.TelemetrySubs {
+		telemetrySubs = startTelemetrySubs()
+	}
+	log.Printf("Recording video to %s\n", filename)
+	return filename, audioErr, nil
+}
 
-	select {
-	case <-videoConverterTimeout:
-		// Timeout happened first, kill the process and print a message.
-		videoConverter.Process.Kill()
-		log.Println("Failed to gracefully interrupt video converter")
-	case <-videoConverterDone:
-		// Convertor exited before timeout
+func stopRecordingVideoCB() {
+	recording, err := stopVideoRecording()
+	if recording {
+		menuBar.recVidItem.SetSensitive(true)
+		menuBar.stopRecVidItem.SetSensitive(false)
 	}
-	videoRecMu.Unlock()
+	if err != nil {
+		messageDialog(win, gtk.MESSAGE_ERROR, "Could not save the video.\n\n"+err.Error())
+	}
+}
 
-	menuBar.recVidItem.SetSensitive(true)
-	menuBar.stopRecVidItem.SetSensitive(false)
+// stopVideoRecording finishes the MP4 file, recording is false if we were not recording.
+func stopVideoRecording() (recording bool, err error) {
+	mw, err := videoRecorder.Stop()
+	if mw == nil {
+		return false, nil
+	}
+	filename := mw.Filename()
+	if telemetrySubs != nil {
+		telemetrySubs.stop()
+	}
+	if err != nil {
+		log.Printf("Could not finish video file %s: %v\n", filename, err)
+		os.Remove(filename)
+		if audioRec != nil {
+			audioRec.stop()
+			os.Remove(audioRec.filename)
+		}
+	} else {
+		log.Printf("Recorded %d frames to %s\n", mw.Frames(), filename)
+		if audioRec != nil {
+			audioRec.stop()
+			audioMerges.Add(1)
+			go mergeAudio(filename, audioRec, mw.FirstFrame())
+		}
+		if telemetrySubs != nil {
+			if srt, err := telemetrySubs.save(filename, mw.FirstFrame()); err != nil {
+				log.Printf("Could not save telemetry subtitles: %v\n", err)
+			} else {
+				log.Printf("Saved telemetry subtitles to %s\n", srt)
+			}
+		}
+	}
+	audioRec = nil
+	telemetrySubs = nil
+	return true, err
 }
 
 func (wgt *videoWgtT) startVideo() {
+	if err := connectVideo(); err != nil {
+		messageDialog(win, gtk.MESSAGE_ERROR, err.Error())
+	}
 
-	var err error
+	stopFeedImageChan = make(chan bool)
 
-	videoChan, err = drone.VideoConnectDefault()
+	go wgt.videoListener()
+
+	glib.TimeoutAdd(30, wgt.updateFeed)
+}
+
+// connectVideo starts the drone's video stream and the SPS/PPS requestor.
+func connectVideo() (err error) {
+	videoChan, err = drone.VideoConnect(droneConn.Address, droneConn.VideoPort)
 	if err != nil {
 		log.Print(err.Error())
-		messageDialog(win, gtk.MESSAGE_ERROR, err.Error())
 	}
 
 	drone.SetVideoBitrate(tello.VbrAuto)
@@ -186,182 +195,35 @@ func (wgt *videoWgtT) startVideo() {
 			time.Sleep(1000 * time.Millisecond)
 		}
 	}()
-
-	stopFeedImageChan = make(chan bool)
-
-	go wgt.videoListener()
-
-	glib.TimeoutAdd(30, wgt.updateFeed)
+	return err
 }
 
 func customReader() ([]byte, int) {
 	pkt, more := <-videoChan
+	linkWatchdog.videoReceived()
 	if !more {
 		stopFeedImageChan <- true
+	} else {
+		restreamer.h264Packet(pkt)
 	}
-	videoRecMu.Lock()
-	if videoRecording {
-		if packetLen < packetQueueLimit {
-			if lastPacket == nil {
-				lastPacket = new(videoPacket)
-				firstPacket = lastPacket
-			} else {
-				lastPacket.next = new(videoPacket)
-				lastPacket = lastPacket.next
-			}
-
-			lastPacket.next = nil
-			lastPacket.packet = pkt
-
-			packetLen++
-		} else {
-			log.Println("WARNING: Recording packet queue reached it's limit.")
-		}
-	}
-	videoRecMu.Unlock()
+	queueVideoPacket(pkt)
 	return pkt, len(pkt)
 }
 
-func assert(i interface{}, err error) interface{} {
-	if err != nil {
-		log.Fatalf("Assert %v", err)
-	}
-
-	return i
+// queueVideoPacket queues a packet for the video recorder if we are recording.
+func queueVideoPacket(pkt []byte) {
+	videoRecorder.Queue(pkt)
 }
 
-func videoWriterLoop() {
-	for {
-		videoRecMu.Lock()
-
-		if !videoRecording {
-			videoRecMu.Unlock()
-			break
-		}
-
-		if firstPacket == nil {
-			videoRecMu.Unlock()
-			time.Sleep(5 * time.Millisecond)
-			continue
-		}
-
-		pkt := firstPacket.packet
-
-		firstPacket = firstPacket.next
-		if firstPacket == nil {
-			lastPacket = nil
-		}
-		packetLen--
-
-		videoRecMu.Unlock()
-
-		videoWriteRecMu.Lock()
-		videoWriter.Write(pkt)
-		videoWriteRecMu.Unlock()
-	}
-}
-
-//func (app *tdApp) videoListener() {
+// videoListener decodes the video feed, it is run as a Goroutine for each connection.
 func (wgt *videoWgtT) videoListener() {
-	iCtx := gmf.NewCtx()
-	defer iCtx.CloseInputAndRelease()
-
-	if err := iCtx.SetInputFormat("h264"); err != nil {
-		log.Fatalf("iCtx SetInputFormat %v", err)
-	}
-
-	avioCtx, err := gmf.NewAVIOContext(iCtx, &gmf.AVIOHandlers{ReadPacket: customReader})
-	defer gmf.Release(avioCtx)
-	if err != nil {
-		log.Fatalf("NewAVIOContext %v", err)
-	}
-
-	iCtx.SetPb(avioCtx)
-
-	err = iCtx.OpenInput("")
-	if err != nil {
-		log.Fatalf("iCtx OpenInput %v", err)
-	}
-
-	srcVideoStream, err := iCtx.GetBestStream(gmf.AVMEDIA_TYPE_VIDEO)
-	if err != nil {
-		log.Fatalf("GetBestStream %v", err)
-	}
-
-	codec, err := gmf.FindEncoder(gmf.AV_CODEC_ID_RAWVIDEO)
-	if err != nil {
-		log.Fatalf("FindDecoder %v", err)
-	}
-	cc := gmf.NewCodecCtx(codec)
-	defer gmf.Release(cc)
-
-	if codec.IsExperimental() {
-		cc.SetStrictCompliance(gmf.FF_COMPLIANCE_EXPERIMENTAL)
-	}
-
-	cc.SetPixFmt(gmf.AV_PIX_FMT_BGR32).
-		SetWidth(videoWidth).
-		SetHeight(videoHeight).
-		SetTimeBase(gmf.AVR{Num: 1, Den: 1})
-
-	if err := cc.Open(nil); err != nil {
-		log.Fatalf("cc Open %v", err)
-	}
-
-	swsCtx := gmf.NewSwsCtx(srcVideoStream.CodecCtx(), cc, gmf.SWS_BICUBIC)
-	defer gmf.Release(swsCtx)
-
-	dstFrame := gmf.NewFrame().
-		SetWidth(videoWidth).
-		SetHeight(videoHeight).
-		SetFormat(gmf.AV_PIX_FMT_BGR32) //SetFormat(gmf.AV_PIX_FMT_RGB32)
-	defer gmf.Release(dstFrame)
-
-	if err := dstFrame.ImgAlloc(); err != nil {
-		log.Fatalf("ImgAlloc %v", err)
-	}
-
-	ist := assert(iCtx.GetStream(srcVideoStream.Index())).(*gmf.Stream)
-	defer gmf.Release(ist)
-
-	codecCtx := ist.CodecCtx()
-	defer gmf.Release(codecCtx)
-
-	for pkt := range iCtx.GetNewPackets() {
-
-		if pkt.StreamIndex() != srcVideoStream.Index() {
-			log.Println("Skipping wrong stream packet")
-			continue
-		}
-
-		frame, err := pkt.Frames(codecCtx)
-		if err != nil {
-			log.Printf("CodeCtx %v", err)
-			continue
-		}
-
-		swsCtx.Scale(frame, dstFrame)
-
-		p, err := dstFrame.Encode(cc)
-
-		if err != nil {
-			log.Fatalf("Encode %v", err)
-		}
-		rgba := new(image.RGBA)
-		rgba.Stride = 4 * videoWidth
-		rgba.Rect = image.Rect(0, 0, videoWidth, videoHeight)
-		rgba.Pix = p.Data()
-
+	decoder.Decode(customReader, videoWidth, videoHeight, func(rgba *image.RGBA) {
 		wgt.newFeedImageMu.Lock()
 		wgt.feedImage = rgba
 		wgt.newFeedImage = true
 		wgt.newFeedImageMu.Unlock()
-
-		gmf.Release(p)
-		gmf.Release(frame)
-		gmf.Release(pkt)
-
-	}
+		restreamer.newFrame(rgba)
+	})
 }
 
 // updateFeed actually updates the video image in the feed tab.
@@ -378,7 +240,13 @@ func (wgt *videoWgtT) updateFeed() bool {
 		pbd.Height = videoHeight
 		pbd.RowStride = videoWidth * 4 // RGBA
 
-		pbd.Data = wgt.feedImage.Pix
+		// the HUD is drawn on a copy so that the restreamed frames stay clean
+		if wgt.hudImage == nil {
+			wgt.hudImage = image.NewRGBA(image.Rect(0, 0, videoWidth, videoHeight))
+		}
+		copy(wgt.hudImage.Pix, wgt.feedImage.Pix)
+		drawHUD(wgt.hudImage)
+		pbd.Data = wgt.hudImage.Pix
 
 		pb := gdkpixbuf.NewPixbufFromData(pbd)
 		//pb = pb.ScaleSimple(videoWidth, videoHeight, gdkpixbuf.INTERP_BILINEAR)
@@ -0,0 +1,133 @@
+/**
+ *Copyright (c) 2018 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+// Package decoder decodes the drone's H.264 stream into images using gmf, which needs the FFmpeg
+// libraries.  It is kept apart from package video so that the MP4 writer builds without them.
+package decoder
+
+import (
+	"image"
+	"log"
+
+	"github.com/3d0c/gmf"
+)
+
+// ReaderFunc supplies the next chunk of the H.264 stream and its length, it should block until
+// one is available.
+type ReaderFunc func() ([]byte, int)
+
+// FrameFunc receives each decoded frame, the image must not be modified.
+type FrameFunc func(rgba *image.RGBA)
+
+func assert(i interface{}, err error) interface{} {
+	if err != nil {
+		log.Fatalf("Assert %v", err)
+	}
+
+	return i
+}
+
+// Decode decodes the H.264 stream supplied by read into images of width x height, passing
+// each to frame.  It returns when the stream ends.
+func Decode(read ReaderFunc, width, height int, frame FrameFunc) {
+	iCtx := gmf.NewCtx()
+	defer iCtx.CloseInputAndRelease()
+
+	if err := iCtx.SetInputFormat("h264"); err != nil {
+		log.Fatalf("iCtx SetInputFormat %v", err)
+	}
+
+	avioCtx, err := gmf.NewAVIOContext(iCtx, &gmf.AVIOHandlers{ReadPacket: read})
+	defer gmf.Release(avioCtx)
+	if err != nil {
+		log.Fatalf("NewAVIOContext %v", err)
+	}
+
+	iCtx.SetPb(avioCtx)
+
+	err = iCtx.OpenInput("")
+	if err != nil {
+		log.Fatalf("iCtx OpenInput %v", err)
+	}
+
+	srcVideoStream, err := iCtx.GetBestStream(gmf.AVMEDIA_TYPE_VIDEO)
+	if err != nil {
+		log.Fatalf("GetBestStream %v", err)
+	}
+
+	codec, err := gmf.FindEncoder(gmf.AV_CODEC_ID_RAWVIDEO)
+	if err != nil {
+		log.Fatalf("FindDecoder %v", err)
+	}
+	cc := gmf.NewCodecCtx(codec)
+	defer gmf.Release(cc)
+
+	if codec.IsExperimental() {
+		cc.SetStrictCompliance(gmf.FF_COMPLIANCE_EXPERIMENTAL)
+	}
+
+	cc.SetPixFmt(gmf.AV_PIX_FMT_BGR32).
+		SetWidth(width).
+		SetHeight(height).
+		SetTimeBase(gmf.AVR{Num: 1, Den: 1})
+
+	if err := cc.Open(nil); err != nil {
+		log.Fatalf("cc Open %v", err)
+	}
+
+	swsCtx := gmf.NewSwsCtx(srcVideoStream.CodecCtx(), cc, gmf.SWS_BICUBIC)
+	defer gmf.Release(swsCtx)
+
+	dstFrame := gmf.NewFrame().
+		SetWidth(width).
+		SetHeight(height).
+		SetFormat(gmf.AV_PIX_FMT_BGR32) //SetFormat(gmf.AV_PIX_FMT_RGB32)
+	defer gmf.Release(dstFrame)
+
+	if err := dstFrame.ImgAlloc(); err != nil {
+		log.Fatalf("ImgAlloc %v", err)
+	}
+
+	ist := assert(iCtx.GetStream(srcVideoStream.Index())).(*gmf.Stream)
+	defer gmf.Release(ist)
+
+	codecCtx := ist.CodecCtx()
+	defer gmf.Release(codecCtx)
+
+	for pkt := range iCtx.GetNewPackets() {
+
+		if pkt.StreamIndex() != srcVideoStream.Index() {
+			log.Println("Skipping wrong stream packet")
+			continue
+		}
+
+		srcFrame, err := pkt.Frames(codecCtx)
+		if err != nil {
+			log.Printf("CodeCtx %v", err)
+			continue
+		}
+
+		swsCtx.Scale(srcFrame, dstFrame)
+
+		p, err := dstFrame.Encode(cc)
+
+		if err != nil {
+			log.Fatalf("Encode %v", err)
+		}
+		rgba := new(image.RGBA)
+		rgba.Stride = 4 * width
+		rgba.Rect = image.Rect(0, 0, width, height)
+		rgba.Pix = p.Data()
+
+		frame(rgba)
+
+		gmf.Release(p)
+		gmf.Release(srcFrame)
+		gmf.Release(pkt)
+
+	}
+}
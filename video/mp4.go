@@ -0,0 +1,477 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+// Package video records the drone's H.264 stream to MP4 files.  It has no GUI or cgo
+// dependencies, the decoder is in video/decoder.
+package video
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"time"
+)
+
+// Video is recorded by putting the drone's H.264 stream straight into an MP4 file, there is
+// no re-encoding.  Each frame is timestamped with the arrival time of its first packet.
+
+const (
+	mp4VideoTimescale = 90000
+	mp4MovieTimescale = 1000
+	mp4MinFrameTicks  = mp4VideoTimescale / 60 // frames arriving in a burst are spread out by at least this
+	mp4DefaultTicks   = mp4VideoTimescale / 30
+	mp4EpochOffset    = 2082844800 // seconds from 1904 (MP4) to 1970 (Unix)
+
+	nalSlice = 1
+	nalIDR   = 5
+	nalSPS   = 7
+	nalPPS   = 8
+)
+
+// bitReaderT reads an H.264 RBSP bit by bit, the simulator's bitWriterT does the reverse
+type bitReaderT struct {
+	buf []byte
+	pos uint
+	err error
+}
+
+var errShortRBSP = errors.New("H.264 RBSP too short")
+
+// newBitReader removes the emulation prevention bytes from a NAL unit's payload
+func newBitReader(nalPayload []byte) *bitReaderT {
+	rbsp := make([]byte, 0, len(nalPayload))
+	zeros := 0
+	for _, b := range nalPayload {
+		if zeros == 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		rbsp = append(rbsp, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return &bitReaderT{buf: rbsp}
+}
+
+func (br *bitReaderT) getBit() uint {
+	if br.pos >= uint(len(br.buf))*8 {
+		br.err = errShortRBSP
+		return 0
+	}
+	b := br.buf[br.pos/8] >> (7 - br.pos%8) & 1
+	br.pos++
+	return uint(b)
+}
+
+// getBits reads n bits, most significant first
+func (br *bitReaderT) getBits(n uint) (v uint) {
+	for ; n > 0; n-- {
+		v = v<<1 | br.getBit()
+	}
+	return v
+}
+
+// getUE reads an unsigned Exp-Golomb code
+func (br *bitReaderT) getUE() uint {
+	n := uint(0)
+	for br.getBit() == 0 && br.err == nil && n < 32 {
+		n++
+	}
+	return (1 << n) - 1 + br.getBits(n)
+}
+
+// getSE reads a signed Exp-Golomb code
+func (br *bitReaderT) getSE() int {
+	v := int(br.getUE())
+	if v&1 == 1 {
+		return (v + 1) / 2
+	}
+	return -v / 2
+}
+
+// spsDimensions returns the picture size given by a sequence parameter set NAL unit.
+func spsDimensions(sps []byte) (width, height int, err error) {
+	if len(sps) < 4 {
+		return 0, 0, errShortRBSP
+	}
+	br := newBitReader(sps[1:])
+	profile := br.getBits(8)
+	br.getBits(16) // constraint flags and level
+	br.getUE()     // seq_parameter_set_id
+	chromaFormat := uint(1)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if chromaFormat = br.getUE(); chromaFormat == 3 {
+			if br.getBit() == 1 { // separate_colour_plane_flag
+				chromaFormat = 0
+			}
+		}
+		br.getUE()            // bit_depth_luma_minus8
+		br.getUE()            // bit_depth_chroma_minus8
+		br.getBit()           // qpprime_y_zero_transform_bypass_flag
+		if br.getBit() == 1 { // seq_scaling_matrix_present_flag
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if br.getBit() == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := 8, 8
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + br.getSE() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	br.getUE()          // log2_max_frame_num_minus4
+	switch br.getUE() { // pic_order_cnt_type
+	case 0:
+		br.getUE() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		br.getBit()
+		br.getSE()
+		br.getSE()
+		for n := br.getUE(); n > 0 && br.err == nil; n-- {
+			br.getSE()
+		}
+	}
+	br.getUE()  // max_num_ref_frames
+	br.getBit() // gaps_in_frame_num_value_allowed_flag
+	mbWidth := int(br.getUE()) + 1
+	mapHeight := int(br.getUE()) + 1
+	frameMbsOnly := int(br.getBit())
+	if frameMbsOnly == 0 {
+		br.getBit() // mb_adaptive_frame_field_flag
+	}
+	br.getBit() // direct_8x8_inference_flag
+	width, height = mbWidth*16, (2-frameMbsOnly)*mapHeight*16
+	if br.getBit() == 1 { // frame_cropping_flag
+		cropX, cropY := 1, 2-frameMbsOnly
+		switch chromaFormat {
+		case 1:
+			cropX, cropY = 2, 2*(2-frameMbsOnly)
+		case 2:
+			cropX = 2
+		}
+		left, right, top, bottom := int(br.getUE()), int(br.getUE()), int(br.getUE()), int(br.getUE())
+		width -= (left + right) * cropX
+		height -= (top + bottom) * cropY
+	}
+	if br.err != nil {
+		return 0, 0, br.err
+	}
+	return width, height, nil
+}
+
+// MP4WriterT turns an H.264 Annex B stream into an MP4 file.  The frames are written to the
+// file as they arrive, the index (moov box) is written by Close().
+type MP4WriterT struct {
+	f           *os.File
+	w           *bufio.Writer
+	mdatStart   int64 // offset of the mdat box
+	offset      int64 // where the next sample will go
+	pending     []byte
+	scanned     int       // pending has been searched for start codes this far
+	synced      bool      // pending starts at a NAL unit
+	nalAt       time.Time // arrival time of the NAL unit in pending
+	sps, pps    []byte
+	width       int
+	height      int
+	sample      []byte // the frame being assembled, as length-prefixed NAL units
+	sampleAt    time.Time
+	sampleKey   bool
+	started     time.Time // arrival of the first frame
+	lastDTS     int64
+	sizes       []uint32
+	offsets     []int64
+	dts         []int64
+	keyFrames   []uint32
+	createdUnix int64
+	app         string
+}
+
+// NewMP4Writer creates the file and writes the start of the MP4 structure, app is named as its creator.
+func NewMP4Writer(filename, app string) (mw *MP4WriterT, err error) {
+	mw = &MP4WriterT{createdUnix: time.Now().Unix(), app: app}
+	if mw.f, err = os.Create(filename); err != nil {
+		return nil, err
+	}
+	mw.w = bufio.NewWriterSize(mw.f, 256*1024)
+	ftyp := mp4Box("ftyp", []byte("isom"), be32(0x200), []byte("isomiso2avc1mp41"))
+	mw.w.Write(ftyp)
+	mw.mdatStart = int64(len(ftyp))
+	// a 64-bit mdat header, its size is filled in by Close()
+	mw.w.Write(be32(1))
+	mw.w.Write([]byte("mdat"))
+	mw.w.Write(make([]byte, 8))
+	mw.offset = mw.mdatStart + 16
+	return mw, nil
+}
+
+// Write accepts a chunk of the H.264 stream which arrived at time at.
+func (mw *MP4WriterT) Write(chunk []byte, at time.Time) error {
+	mw.pending = append(mw.pending, chunk...)
+	for {
+		i := bytes.Index(mw.pending[mw.scanned:], []byte{0, 0, 1})
+		if i < 0 {
+			break
+		}
+		i += mw.scanned
+		if mw.synced {
+			if err := mw.nal(bytes.TrimRight(mw.pending[:i], "\x00"), mw.nalAt); err != nil {
+				return err
+			}
+		}
+		mw.synced = true
+		mw.pending = mw.pending[i+3:]
+		mw.nalAt = at
+		mw.scanned = 0
+	}
+	if len(mw.pending) > 2 { // a start code may straddle the next chunk
+		mw.scanned = len(mw.pending) - 2
+		if !mw.synced { // no need to keep anything before the first start code
+			mw.pending, mw.scanned = mw.pending[mw.scanned:], 0
+		}
+	}
+	return nil
+}
+
+// nal handles a complete NAL unit, building the frames from their slices.
+func (mw *MP4WriterT) nal(nal []byte, at time.Time) error {
+	if len(nal) < 2 {
+		return nil
+	}
+	switch nal[0] & 0x1f {
+	case nalSPS:
+		if mw.sps == nil {
+			w, h, err := spsDimensions(nal)
+			if err != nil {
+				return err
+			}
+			mw.width, mw.height = w, h
+			mw.sps = append([]byte(nil), nal...)
+		}
+	case nalPPS:
+		if mw.pps == nil {
+			mw.pps = append([]byte(nil), nal...)
+		}
+	case nalSlice, nalIDR:
+		isIDR := nal[0]&0x1f == nalIDR
+		firstSlice := nal[1]&0x80 != 0 // first_mb_in_slice is 0
+		if mw.sample == nil && !(isIDR && firstSlice && mw.sps != nil && mw.pps != nil) {
+			return nil // wait for a frame that can be decoded
+		}
+		if firstSlice {
+			if err := mw.flushSample(); err != nil {
+				return err
+			}
+			mw.sample, mw.sampleAt, mw.sampleKey = make([]byte, 0, len(nal)+4), at, isIDR
+		}
+		mw.sample = append(mw.sample, be32(uint32(len(nal)))...)
+		mw.sample = append(mw.sample, nal...)
+	}
+	// anything else (AUD, SEI etc.) is not needed
+	return nil
+}
+
+// flushSample writes the frame that has been assembled, if any.
+func (mw *MP4WriterT) flushSample() error {
+	if len(mw.sample) == 0 {
+		return nil
+	}
+	if mw.started.IsZero() {
+		mw.started = mw.sampleAt
+	}
+	dts := int64(mw.sampleAt.Sub(mw.started).Seconds() * mp4VideoTimescale)
+	if len(mw.dts) > 0 && dts < mw.lastDTS+mp4MinFrameTicks {
+		dts = mw.lastDTS + mp4MinFrameTicks
+	}
+	mw.lastDTS = dts
+	if _, err := mw.w.Write(mw.sample); err != nil {
+		return err
+	}
+	mw.dts = append(mw.dts, dts)
+	mw.sizes = append(mw.sizes, uint32(len(mw.sample)))
+	mw.offsets = append(mw.offsets, mw.offset)
+	if mw.sampleKey {
+		mw.keyFrames = append(mw.keyFrames, uint32(len(mw.sizes)))
+	}
+	mw.offset += int64(len(mw.sample))
+	mw.sample = mw.sample[:0]
+	return nil
+}
+
+// Filename returns the name of the file being written.
+func (mw *MP4WriterT) Filename() string {
+	return mw.f.Name()
+}
+
+// FirstFrame returns the arrival time of the first frame, zero if there is none yet.
+func (mw *MP4WriterT) FirstFrame() time.Time {
+	return mw.started
+}
+
+// Frames returns the number of frames written so far.
+func (mw *MP4WriterT) Frames() int {
+	return len(mw.sizes)
+}
+
+// Close writes the last frame and the index, and closes the file.
+func (mw *MP4WriterT) Close() error {
+	var err error
+	if mw.synced { // the last NAL unit has no start code after it
+		err = mw.nal(bytes.TrimRight(mw.pending, "\x00"), mw.nalAt)
+	}
+	if err == nil {
+		err = mw.flushSample()
+	}
+	if err == nil && len(mw.sizes) == 0 {
+		err = errors.New("no video was received")
+	}
+	if err == nil {
+		_, err = mw.w.Write(mw.moov())
+	}
+	if err == nil {
+		err = mw.w.Flush()
+	}
+	if err == nil {
+		var size [8]byte
+		binary.BigEndian.PutUint64(size[:], uint64(mw.offset-mw.mdatStart))
+		_, err = mw.f.WriteAt(size[:], mw.mdatStart+8)
+	}
+	if cerr := mw.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// durations returns the duration of each frame, the last one is given the same as the one before.
+func (mw *MP4WriterT) durations() (d []uint32, total int64) {
+	d = make([]uint32, len(mw.dts))
+	for i := range mw.dts {
+		switch {
+		case i < len(mw.dts)-1:
+			d[i] = uint32(mw.dts[i+1] - mw.dts[i])
+		case i > 0:
+			d[i] = d[i-1]
+		default:
+			d[i] = mp4DefaultTicks
+		}
+		total += int64(d[i])
+	}
+	return d, total
+}
+
+func (mw *MP4WriterT) moov() []byte {
+	durations, total := mw.durations()
+	created := uint32(mw.createdUnix + mp4EpochOffset)
+	movieDuration := uint32(total * mp4MovieTimescale / mp4VideoTimescale)
+	matrix := cat(be32(0x10000), be32(0), be32(0), be32(0), be32(0x10000), be32(0), be32(0), be32(0), be32(0x40000000))
+
+	mvhd := mp4FullBox("mvhd", 0, 0, be32(created), be32(created), be32(mp4MovieTimescale), be32(movieDuration),
+		be32(0x10000), be16(0x100), make([]byte, 10), matrix, make([]byte, 24), be32(2))
+	tkhd := mp4FullBox("tkhd", 0, 3, be32(created), be32(created), be32(1), be32(0), be32(movieDuration),
+		make([]byte, 8), be16(0), be16(0), be16(0), be16(0), matrix,
+		be32(uint32(mw.width)<<16), be32(uint32(mw.height)<<16))
+	mdhd := mp4FullBox("mdhd", 0, 0, be32(created), be32(created), be32(mp4VideoTimescale), be32(uint32(total)),
+		be16(0x55c4), be16(0)) // language "und"
+	hdlr := mp4FullBox("hdlr", 0, 0, be32(0), []byte("vide"), make([]byte, 12), []byte(mw.app+" Video\x00"))
+	vmhd := mp4FullBox("vmhd", 0, 1, make([]byte, 8))
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, be32(1), mp4FullBox("url ", 0, 1)))
+
+	avcC := mp4Box("avcC", []byte{1, mw.sps[1], mw.sps[2], mw.sps[3], 0xff, 0xe1}, be16(uint16(len(mw.sps))), mw.sps,
+		[]byte{1}, be16(uint16(len(mw.pps))), mw.pps)
+	compressor := make([]byte, 32)
+	avc1 := mp4Box("avc1", make([]byte, 6), be16(1), make([]byte, 16), be16(uint16(mw.width)), be16(uint16(mw.height)),
+		be32(0x480000), be32(0x480000), be32(0), be16(1), compressor, be16(0x18), be16(0xffff), avcC)
+	stsd := mp4FullBox("stsd", 0, 0, be32(1), avc1)
+
+	var stts [][]byte
+	entries := 0
+	for i := 0; i < len(durations); {
+		j := i
+		for j < len(durations) && durations[j] == durations[i] {
+			j++
+		}
+		stts = append(stts, be32(uint32(j-i)), be32(durations[i]))
+		entries++
+		i = j
+	}
+	sttsBox := mp4FullBox("stts", 0, 0, append([][]byte{be32(uint32(entries))}, stts...)...)
+
+	stss := [][]byte{be32(uint32(len(mw.keyFrames)))}
+	for _, k := range mw.keyFrames {
+		stss = append(stss, be32(k))
+	}
+	stsz := [][]byte{be32(0), be32(uint32(len(mw.sizes)))}
+	for _, s := range mw.sizes {
+		stsz = append(stsz, be32(s))
+	}
+	co64 := [][]byte{be32(uint32(len(mw.offsets)))}
+	for _, o := range mw.offsets {
+		co64 = append(co64, be64(uint64(o)))
+	}
+	stbl := mp4Box("stbl", stsd, sttsBox,
+		mp4FullBox("stss", 0, 0, stss...),
+		mp4FullBox("stsc", 0, 0, be32(1), be32(1), be32(1), be32(1)), // one frame per chunk
+		mp4FullBox("stsz", 0, 0, stsz...),
+		mp4FullBox("co64", 0, 0, co64...))
+
+	minf := mp4Box("minf", vmhd, dinf, stbl)
+	mdia := mp4Box("mdia", mdhd, hdlr, minf)
+	trak := mp4Box("trak", tkhd, mdia)
+	return mp4Box("moov", mvhd, trak)
+}
+
+// MP4 box helpers
+
+func cat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func mp4Box(typ string, payload ...[]byte) []byte {
+	body := cat(payload...)
+	return cat(be32(uint32(8+len(body))), []byte(typ), body)
+}
+
+func mp4FullBox(typ string, version byte, flags uint32, payload ...[]byte) []byte {
+	return mp4Box(typ, append([][]byte{be32(uint32(version)<<24 | flags&0xffffff)}, payload...)...)
+}
+
+func be16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func be32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func be64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
@@ -0,0 +1,331 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package video
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// rbspWriterT builds test RBSPs, like the simulator's bitWriterT.
+type rbspWriterT struct {
+	buf   []byte
+	cur   byte
+	nBits uint
+}
+
+func (rw *rbspWriterT) bits(v uint, n uint) {
+	for i := n; i > 0; i-- {
+		rw.cur = rw.cur<<1 | byte(v>>(i-1)&1)
+		if rw.nBits++; rw.nBits == 8 {
+			rw.buf = append(rw.buf, rw.cur)
+			rw.cur, rw.nBits = 0, 0
+		}
+	}
+}
+
+func (rw *rbspWriterT) ue(v uint) {
+	v++
+	n := uint(0)
+	for t := v; t > 1; t >>= 1 {
+		n++
+	}
+	rw.bits(0, n)
+	rw.bits(v, n+1)
+}
+
+// nal returns the NAL unit with the RBSP terminated and emulation prevention bytes inserted.
+func (rw *rbspWriterT) nal(header byte) []byte {
+	rw.bits(1, 1)
+	for rw.nBits != 0 {
+		rw.bits(0, 1)
+	}
+	nal := []byte{header}
+	zeros := 0
+	for _, b := range rw.buf {
+		if zeros == 2 && b <= 3 {
+			nal, zeros = append(nal, 3), 0
+		}
+		nal = append(nal, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return nal
+}
+
+type testSPST struct {
+	profile, level   uint
+	spsID            uint
+	chromaFormat     uint // high profiles only
+	pocType          uint
+	mbWidth, mbMapHt uint
+	frameMbsOnly     bool
+	crop             [4]uint // left, right, top, bottom
+}
+
+func (ts testSPST) nal() []byte {
+	var rw rbspWriterT
+	rw.bits(ts.profile, 8)
+	rw.bits(0, 8) // constraint flags
+	rw.bits(ts.level, 8)
+	rw.ue(ts.spsID)
+	if ts.profile == 100 {
+		rw.ue(ts.chromaFormat)
+		rw.ue(0)      // bit_depth_luma_minus8
+		rw.ue(0)      // bit_depth_chroma_minus8
+		rw.bits(0, 1) // qpprime_y_zero_transform_bypass_flag
+		rw.bits(1, 1) // seq_scaling_matrix_present_flag
+		for i := 0; i < 8; i++ {
+			rw.bits(0, 1) // no lists, so the defaults are used
+		}
+	}
+	rw.ue(0) // log2_max_frame_num_minus4
+	rw.ue(ts.pocType)
+	switch ts.pocType {
+	case 0:
+		rw.ue(0)
+	case 1:
+		rw.bits(0, 1)
+		rw.ue(0)
+		rw.ue(0)
+		rw.ue(2) // two offsets for ref frames
+		rw.ue(1)
+		rw.ue(2)
+	}
+	rw.ue(1)      // max_num_ref_frames
+	rw.bits(0, 1) // gaps_in_frame_num_value_allowed_flag
+	rw.ue(ts.mbWidth - 1)
+	rw.ue(ts.mbMapHt - 1)
+	if ts.frameMbsOnly {
+		rw.bits(1, 1)
+	} else {
+		rw.bits(0, 2) // and mb_adaptive_frame_field_flag
+	}
+	rw.bits(1, 1) // direct_8x8_inference_flag
+	if ts.crop != [4]uint{} {
+		rw.bits(1, 1)
+		for _, c := range ts.crop {
+			rw.ue(c)
+		}
+	} else {
+		rw.bits(0, 1)
+	}
+	rw.bits(0, 1) // vui_parameters_present_flag
+	return rw.nal(0x67)
+}
+
+// telloSPS is like the SPS the drone sends for 960x720 video.
+var telloSPS = testSPST{profile: 77, level: 40, mbWidth: 60, mbMapHt: 45, frameMbsOnly: true}
+
+func TestSPSDimensions(t *testing.T) {
+	tests := []struct {
+		name   string
+		sps    []byte
+		width  int
+		height int
+		err    bool
+	}{
+		{"tello", telloSPS.nal(), 960, 720, false},
+		{"baseline 720p", testSPST{profile: 66, level: 31, pocType: 2, mbWidth: 80, mbMapHt: 45, frameMbsOnly: true}.nal(), 1280, 720, false},
+		{"high cropped 1080p", testSPST{profile: 100, level: 40, chromaFormat: 1, mbWidth: 120, mbMapHt: 68, frameMbsOnly: true,
+			crop: [4]uint{0, 0, 0, 4}}.nal(), 1920, 1080, false},
+		{"poc type 1", testSPST{profile: 77, level: 30, pocType: 1, mbWidth: 40, mbMapHt: 30, frameMbsOnly: true}.nal(), 640, 480, false},
+		{"interlaced", testSPST{profile: 77, level: 30, mbWidth: 45, mbMapHt: 18}.nal(), 720, 576, false},
+		{"emulation prevention", testSPST{profile: 66, level: 0, spsID: 127, mbWidth: 60, mbMapHt: 45, frameMbsOnly: true}.nal(), 960, 720, false},
+		{"too short", []byte{0x67, 66, 0}, 0, 0, true},
+		{"truncated", telloSPS.nal()[:6], 0, 0, true},
+	}
+	for _, tc := range tests {
+		w, h, err := spsDimensions(tc.sps)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: error = %v", tc.name, err)
+			continue
+		}
+		if w != tc.width || h != tc.height {
+			t.Errorf("%s: dimensions = %dx%d, want %dx%d", tc.name, w, h, tc.width, tc.height)
+		}
+	}
+	if !bytes.Contains(tests[5].sps, []byte{0, 0, 3}) {
+		t.Error("emulation prevention: the test SPS has no emulation prevention byte")
+	}
+}
+
+// testStream returns an Annex B stream of nFrames frames (the first an IDR frame of two slices) and
+// the slices which should be in each frame.  It starts with junk and a P frame which must be skipped.
+func testStream(nFrames int) (stream [][]byte, frames [][][]byte) {
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	aud := []byte{0x09, 0xf0}
+	stream = append(stream, []byte{0xde, 0xad})
+	stream = append(stream, []byte{0x41, 0x9a, 0x11, 0x22}) // before the SPS
+	stream = append(stream, telloSPS.nal(), pps)
+	for i := 0; i < nFrames; i++ {
+		var slices [][]byte
+		if i == 0 {
+			slices = [][]byte{{0x65, 0x88, 0x84, 0x21}, {0x65, 0x40, 0x84, 0x21, 0x7f}} // the second starts mid-frame
+		} else {
+			slices = [][]byte{{0x41, 0x9a, byte(i), 0x02}}
+		}
+		stream = append(stream, aud)
+		stream = append(stream, slices...)
+		frames = append(frames, slices)
+	}
+	return stream, frames
+}
+
+// mp4Boxes returns the payloads of the boxes found along path, eg. "moov", "trak", "tkhd".
+func mp4Boxes(data []byte, path ...string) (found [][]byte) {
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data))
+		hdr := 8
+		if size == 1 {
+			size, hdr = int(binary.BigEndian.Uint64(data[8:])), 16
+		}
+		if size < hdr || size > len(data) {
+			return found
+		}
+		if string(data[4:8]) == path[0] {
+			if len(path) == 1 {
+				found = append(found, data[hdr:size])
+			} else {
+				found = append(found, mp4Boxes(data[hdr:size], path[1:]...)...)
+			}
+		}
+		data = data[size:]
+	}
+	return found
+}
+
+func TestMP4Writer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tellodesk-video")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const nFrames = 4
+	frameGap := 33 * time.Millisecond
+	start := time.Date(2019, 5, 4, 13, 2, 3, 0, time.UTC)
+	nals, frames := testStream(nFrames)
+	var annexB []byte
+	var frameOf []int // each frame arrives frameGap after the one before, from its AUD onwards
+	frame := 0
+	for _, n := range nals {
+		if n[0] == 0x09 {
+			frame++
+		}
+		annexB = append(annexB, 0, 0, 0, 1)
+		annexB = append(annexB, n...)
+		for len(frameOf) < len(annexB) {
+			frameOf = append(frameOf, frame)
+		}
+	}
+
+	for _, chunkSize := range []int{len(annexB), 7, 1} { // start codes straddle the chunks
+		filename := filepath.Join(dir, "test.mp4")
+		mw, err := NewMP4Writer(filename, "TelloDesk test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(annexB); i += chunkSize {
+			end := i + chunkSize
+			if end > len(annexB) {
+				end = len(annexB)
+			}
+			at := start.Add(time.Duration(frameOf[end-1]) * frameGap)
+			if err := mw.Write(annexB[i:end], at); err != nil {
+				t.Fatalf("chunks of %d: Write error = %v", chunkSize, err)
+			}
+		}
+		if err := mw.Close(); err != nil {
+			t.Fatalf("chunks of %d: Close error = %v", chunkSize, err)
+		}
+		if mw.Frames() != nFrames {
+			t.Errorf("chunks of %d: Frames() = %d, want %d", chunkSize, mw.Frames(), nFrames)
+		}
+		if mw.Filename() != filename {
+			t.Errorf("chunks of %d: Filename() = %q", chunkSize, mw.Filename())
+		}
+
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(mp4Boxes(data, "ftyp")) != 1 || len(mp4Boxes(data, "moov")) != 1 {
+			t.Fatalf("chunks of %d: missing ftyp or moov box", chunkSize)
+		}
+		mdat := mp4Boxes(data, "mdat")
+		if len(mdat) != 1 {
+			t.Fatalf("chunks of %d: missing mdat box, or its size is wrong", chunkSize)
+		}
+		var want []byte
+		for _, f := range frames {
+			for _, s := range f {
+				want = append(want, be32(uint32(len(s)))...)
+				want = append(want, s...)
+			}
+		}
+		if !bytes.Equal(mdat[0], want) {
+			t.Errorf("chunks of %d: mdat = % x\nwant % x", chunkSize, mdat[0], want)
+		}
+
+		stbl := []string{"moov", "trak", "mdia", "minf", "stbl"}
+		if stsz := mp4Boxes(data, append(stbl, "stsz")...); len(stsz) != 1 ||
+			binary.BigEndian.Uint32(stsz[0][8:]) != nFrames {
+			t.Errorf("chunks of %d: stsz does not list %d frames", chunkSize, nFrames)
+		}
+		if stss := mp4Boxes(data, append(stbl, "stss")...); len(stss) != 1 ||
+			!bytes.Equal(stss[0][4:], cat(be32(1), be32(1))) {
+			t.Errorf("chunks of %d: stss should list frame 1 as the only key frame", chunkSize)
+		}
+		if avcC := mp4Boxes(data, append(stbl, "stsd")...); len(avcC) != 1 || !bytes.Contains(avcC[0], telloSPS.nal()) {
+			t.Errorf("chunks of %d: stsd does not hold the SPS", chunkSize)
+		}
+		if tkhd := mp4Boxes(data, "moov", "trak", "tkhd"); len(tkhd) != 1 ||
+			!bytes.Equal(tkhd[0][len(tkhd[0])-8:], cat(be32(960<<16), be32(720<<16))) {
+			t.Errorf("chunks of %d: tkhd does not give 960x720", chunkSize)
+		}
+		if chunkSize == len(annexB) {
+			continue // every frame arrived at once
+		}
+		if !mw.FirstFrame().Equal(start.Add(frameGap)) { // frame 0 is the skipped P frame etc.
+			t.Errorf("chunks of %d: FirstFrame() = %v", chunkSize, mw.FirstFrame())
+		}
+		ticks := uint32(frameGap.Seconds() * mp4VideoTimescale)
+		if stts := mp4Boxes(data, append(stbl, "stts")...); len(stts) != 1 ||
+			!bytes.Equal(stts[0][4:], cat(be32(1), be32(nFrames), be32(ticks))) {
+			t.Errorf("chunks of %d: stts = % x, want %d frames of %d ticks", chunkSize, stts, nFrames, ticks)
+		}
+	}
+}
+
+func TestMP4WriterNoVideo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tellodesk-video")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mw, err := NewMP4Writer(filepath.Join(dir, "empty.mp4"), "TelloDesk test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mw.Write(append([]byte{0, 0, 0, 1}, telloSPS.nal()...), time.Now())
+	if err := mw.Close(); err == nil {
+		t.Error("Close of a file without frames did not fail")
+	}
+	if !mw.FirstFrame().IsZero() || mw.Frames() != 0 {
+		t.Errorf("FirstFrame() = %v, Frames() = %d", mw.FirstFrame(), mw.Frames())
+	}
+}
@@ -0,0 +1,156 @@
+/**
+ *Copyright (c) 2018 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package video
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// PacketQueueLimit is the most packets which may be waiting to be written, any more are dropped.
+const PacketQueueLimit = 5000
+
+type packetT struct {
+	packet []byte
+	at     time.Time // arrival
+	next   *packetT
+}
+
+// RecorderT queues the video packets as they arrive and writes them to an MP4 file in a
+// Goroutine, so that a slow disk does not hold up the video feed.  It may be started and
+// stopped repeatedly, one file is written each time.
+type RecorderT struct {
+	App string // named as the creator of the files
+
+	recMu      sync.RWMutex // protects the queue and recording
+	writeRecMu sync.RWMutex // protects mp4
+
+	recording bool
+	mp4       *MP4WriterT
+	done      chan bool
+
+	firstPacket *packetT
+	lastPacket  *packetT
+	packetLen   int
+}
+
+// Start starts recording to a new MP4 file.
+func (vr *RecorderT) Start(filename string) error {
+	vr.recMu.Lock()
+	defer vr.recMu.Unlock()
+	if vr.recording {
+		return errors.New("already recording")
+	}
+	mw, err := NewMP4Writer(filename, vr.App)
+	if err != nil {
+		return err
+	}
+	vr.writeRecMu.Lock()
+	vr.mp4 = mw
+	vr.writeRecMu.Unlock()
+
+	vr.firstPacket = nil
+	vr.lastPacket = nil
+	vr.packetLen = 0
+
+	vr.recording = true
+	vr.done = make(chan bool)
+	go vr.writerLoop(vr.done)
+	return nil
+}
+
+// Recording returns true between Start and Stop.
+func (vr *RecorderT) Recording() bool {
+	vr.recMu.RLock()
+	defer vr.recMu.RUnlock()
+	return vr.recording
+}
+
+// Queue queues a packet for writing if we are recording, otherwise it is ignored.
+func (vr *RecorderT) Queue(pkt []byte) {
+	vr.recMu.Lock()
+	if vr.recording {
+		if vr.packetLen < PacketQueueLimit {
+			if vr.lastPacket == nil {
+				vr.lastPacket = new(packetT)
+				vr.firstPacket = vr.lastPacket
+			} else {
+				vr.lastPacket.next = new(packetT)
+				vr.lastPacket = vr.lastPacket.next
+			}
+
+			vr.lastPacket.next = nil
+			vr.lastPacket.packet = pkt
+			vr.lastPacket.at = time.Now()
+
+			vr.packetLen++
+		} else {
+			log.Println("WARNING: Recording packet queue reached it's limit.")
+		}
+	}
+	vr.recMu.Unlock()
+}
+
+// Stop writes whatever is still queued and finishes the MP4 file, which is returned so that
+// its details may be used.  mw is nil if we were not recording.
+func (vr *RecorderT) Stop() (mw *MP4WriterT, err error) {
+	vr.recMu.Lock()
+	if !vr.recording {
+		vr.recMu.Unlock()
+		return nil, nil
+	}
+	vr.recording = false
+	vr.recMu.Unlock()
+
+	<-vr.done // the writer has written everything that was queued
+
+	vr.writeRecMu.Lock()
+	mw = vr.mp4
+	vr.mp4 = nil
+	vr.writeRecMu.Unlock()
+	return mw, mw.Close()
+}
+
+// writerLoop is run as a Goroutine while recording, it finishes writing the queue after recording stops.
+func (vr *RecorderT) writerLoop(done chan bool) {
+	var writeErr error
+	for {
+		vr.recMu.Lock()
+
+		if vr.firstPacket == nil {
+			recording := vr.recording
+			vr.recMu.Unlock()
+			if !recording {
+				break
+			}
+			time.Sleep(5 * time.Millisecond)
+			continue
+		}
+
+		pkt := vr.firstPacket
+
+		vr.firstPacket = vr.firstPacket.next
+		if vr.firstPacket == nil {
+			vr.lastPacket = nil
+		}
+		vr.packetLen--
+
+		vr.recMu.Unlock()
+
+		vr.writeRecMu.Lock()
+		if writeErr == nil {
+			if writeErr = vr.mp4.Write(pkt.packet, pkt.at); writeErr != nil {
+				log.Printf("Error writing video: %v\n", writeErr)
+			}
+		}
+		vr.writeRecMu.Unlock()
+	}
+	close(done)
+}
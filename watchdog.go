@@ -0,0 +1,288 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Anty0/tello"
+	"github.com/mattn/go-gtk/glib"
+)
+
+const (
+	watchdogPeriodMs  = 250
+	linkLostAfter     = 1500 * time.Millisecond // no FlightData for this long and the link is lost
+	videoLostAfter    = 3 * time.Second
+	reconnectAfter    = 5 * time.Second // lost for this long and we try reconnecting the control channel
+	reconnectPeriod   = 5 * time.Second
+	stickRelayTimeout = 100 * time.Millisecond
+)
+
+// linkWatchdogT tracks the age of the last FlightData and video packet received from the drone.
+// When the link is lost it tries to reconnect, and when data arrives again the streams are resumed.
+type linkWatchdogT struct {
+	wdMu              sync.Mutex
+	active            bool
+	session           int // incremented by start, so that the timer of an earlier session stops
+	lastFd, lastVideo time.Time
+	lost              bool
+	lostAt            time.Time
+	lastAttempt       time.Time
+	reconnecting      bool
+	reconnected       bool // the control channel has been reconnected, the streams need restarting
+}
+
+var linkWatchdog linkWatchdogT
+
+// start begins watching the link, it is called when we connect.
+// Headless, watchdogTCB is run by a Goroutine instead of the GTK main loop.
+func (lw *linkWatchdogT) start() {
+	lw.wdMu.Lock()
+	now := time.Now()
+	lw.active, lw.lost, lw.reconnecting, lw.reconnected = true, false, false, false
+	lw.lastFd, lw.lastVideo = now, now
+	lw.session++
+	session := lw.session
+	lw.wdMu.Unlock()
+	if headless {
+		go func() {
+			ticker := time.NewTicker(watchdogPeriodMs * time.Millisecond)
+			defer ticker.Stop()
+			for range ticker.C {
+				if !watchdogTCB(session) {
+					return
+				}
+			}
+		}()
+		return
+	}
+	glib.TimeoutAdd(watchdogPeriodMs, func() bool { return watchdogTCB(session) }) // ends after stop()
+}
+
+// stop is called when we disconnect.
+func (lw *linkWatchdogT) stop() {
+	lw.wdMu.Lock()
+	lw.active, lw.lost = false, false
+	lw.wdMu.Unlock()
+}
+
+func (lw *linkWatchdogT) fdReceived() {
+	lw.wdMu.Lock()
+	lw.lastFd = time.Now()
+	lw.wdMu.Unlock()
+}
+
+func (lw *linkWatchdogT) videoReceived() {
+	lw.wdMu.Lock()
+	lw.lastVideo = time.Now()
+	lw.wdMu.Unlock()
+}
+
+// status returns whether the link is lost and the ages of the latest FlightData and video,
+// active is false if we are not connected.
+func (lw *linkWatchdogT) status() (active, lost bool, fdAge, videoAge time.Duration) {
+	lw.wdMu.Lock()
+	defer lw.wdMu.Unlock()
+	if !lw.active {
+		return false, false, 0, 0
+	}
+	return true, lw.lost, time.Since(lw.lastFd), time.Since(lw.lastVideo)
+}
+
+// watchdogTCB is to be run at intervals (not as a goroutine), it returns false once the
+// session it was started for has been stopped.
+func watchdogTCB(session int) bool {
+	lw := &linkWatchdog
+	lw.wdMu.Lock()
+	if !lw.active || lw.session != session {
+		lw.wdMu.Unlock()
+		return false
+	}
+	now := time.Now()
+	fdAge := now.Sub(lw.lastFd)
+	restartStreams, resume := lw.reconnected, false
+	lw.reconnected = false
+	switch {
+	case !lw.lost && fdAge > linkLostAfter:
+		lw.lost, lw.lostAt = true, lw.lastFd
+		log.Printf("Watchdog: link lost, no flight data for %v\n", fdAge)
+	case lw.lost && fdAge <= linkLostAfter:
+		lw.lost, resume = false, true
+		log.Printf("Watchdog: link restored after %v\n", now.Sub(lw.lostAt).Round(time.Millisecond))
+	case lw.lost && !lw.reconnecting && now.Sub(lw.lostAt) > reconnectAfter && now.Sub(lw.lastAttempt) > reconnectPeriod:
+		lw.reconnecting, lw.lastAttempt = true, now
+		go lw.reconnect()
+	}
+	lw.wdMu.Unlock()
+
+	if restartStreams {
+		fdStream, _ := drone.StreamFlightData(false, fdPeriodMs)
+		fdListener.SetChan(fdStream)
+	}
+	if resume {
+		resumeStreams()
+	}
+	return true
+}
+
+// reconnect tries to re-establish the control channel, it is run as a goroutine.
+func (lw *linkWatchdogT) reconnect() {
+	lw.wdMu.Lock()
+	if !lw.active { // disconnected since the attempt was scheduled
+		lw.reconnecting = false
+		lw.wdMu.Unlock()
+		return
+	}
+	lw.wdMu.Unlock()
+	log.Println("Watchdog: reconnecting...")
+	drone.ControlDisconnect()
+	err := drone.ControlConnect(droneConn.Address, droneConn.ControlPort, droneConn.LocalPort)
+	lw.wdMu.Lock()
+	lw.reconnecting = false
+	if err != nil {
+		log.Printf("Watchdog: could not reconnect: %v\n", err)
+	} else {
+		lw.reconnected = lw.active
+	}
+	lw.wdMu.Unlock()
+}
+
+// resumeStreams asks the drone to restart everything it stops sending when the link drops.
+func resumeStreams() {
+	restartStickRelay()
+	drone.GetVideoSpsPps()
+	drone.SetVideoBitrate(tello.VbrAuto)
+	if settings.WideVideo {
+		drone.SetVideoWide()
+	}
+	drone.GetLowBatteryThreshold()
+	drone.GetMaxHeight()
+	drone.GetSSID()
+	drone.GetVersion()
+}
+
+// The joystick and keyboard readers, the API and scripts send to stickChan, which is relayed to the drone's stick
+// listener.  The listener can then be restarted after a link loss without the readers knowing.
+var (
+	stickRelayMu   sync.Mutex
+	stickRelayOn   bool // the session is using the sticks
+	droneStickChan chan<- tello.StickMessage
+)
+
+// stickRelay should be run as a Goroutine for the life of the program.
+func stickRelay(in <-chan tello.StickMessage) {
+	for sm := range in {
+		stickRelayMu.Lock()
+		if droneStickChan != nil {
+			select {
+			case droneStickChan <- sm:
+			case <-time.After(stickRelayTimeout): // the listener is not running
+			}
+		}
+		stickRelayMu.Unlock()
+	}
+}
+
+// The joystick and keyboard readers send continually, so anything else which moves the sticks
+// (the API or a script) claims them first, and the readers do not send while they are claimed.
+var (
+	stickClaimMu    sync.Mutex
+	stickClaimant   string    // "" if the sticks are not claimed
+	stickClaimUntil time.Time // the claim lapses then, zero if it lasts until released
+)
+
+// claimSticks claims the sticks for who, for d or until released if d is 0.
+// It fails if someone else has claimed them.
+func claimSticks(who string, d time.Duration) error {
+	stickClaimMu.Lock()
+	defer stickClaimMu.Unlock()
+	now := time.Now()
+	if stickClaimant != "" && stickClaimant != who && (stickClaimUntil.IsZero() || now.Before(stickClaimUntil)) {
+		return errors.New("the sticks are in use by " + stickClaimant)
+	}
+	stickClaimant, stickClaimUntil = who, time.Time{}
+	if d > 0 {
+		stickClaimUntil = now.Add(d)
+	}
+	return nil
+}
+
+// releaseSticks gives the sticks back to the readers, if who has claimed them.
+func releaseSticks(who string) {
+	stickClaimMu.Lock()
+	if stickClaimant == who {
+		stickClaimant = ""
+	}
+	stickClaimMu.Unlock()
+}
+
+// sticksClaimed is true while the joystick and keyboard readers must not send.
+func sticksClaimed() bool {
+	stickClaimMu.Lock()
+	defer stickClaimMu.Unlock()
+	return stickClaimant != "" && (stickClaimUntil.IsZero() || time.Now().Before(stickClaimUntil))
+}
+
+// stickOverrideLevel is how far the pilot must push a stick to take it back from a script,
+// it can be reached in slow mode.
+const stickOverrideLevel = maxVal / 4
+
+// pilotOverride is called by the joystick and keyboard readers with the sticks they would have
+// sent while the sticks are claimed.  If a script holds them and the pilot has pushed a stick
+// past stickOverrideLevel the script is aborted, so that the pilot can always take over.
+func pilotOverride(sm tello.StickMessage) {
+	pushed := false
+	for _, v := range []int16{sm.Lx, sm.Ly, sm.Rx, sm.Ry} {
+		pushed = pushed || v > stickOverrideLevel || v < -stickOverrideLevel
+	}
+	if !pushed {
+		return
+	}
+	stickClaimMu.Lock()
+	script := stickClaimant == scriptClaimant
+	stickClaimMu.Unlock()
+	if script {
+		log.Println("The pilot moved the sticks, aborting the script")
+		scripter.abort()
+	}
+}
+
+func startStickRelay() (err error) {
+	stickRelayMu.Lock()
+	defer stickRelayMu.Unlock()
+	droneStickChan, err = drone.StartStickListener()
+	stickRelayOn = err == nil
+	return err
+}
+
+// stopStickRelay stops the drone's stick listener, if it was running.
+func stopStickRelay() {
+	stickRelayMu.Lock()
+	if stickRelayOn {
+		drone.StopStickListener()
+	}
+	droneStickChan, stickRelayOn = nil, false
+	stickRelayMu.Unlock()
+}
+
+// restartStickRelay restarts the drone's stick listener, if it was running.
+func restartStickRelay() {
+	stickRelayMu.Lock()
+	defer stickRelayMu.Unlock()
+	if !stickRelayOn {
+		return
+	}
+	drone.StopStickListener()
+	var err error
+	if droneStickChan, err = drone.StartStickListener(); err != nil {
+		log.Printf("Watchdog: could not restart stick listener: %v\n", err)
+	}
+}
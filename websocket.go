@@ -0,0 +1,164 @@
+/**
+ *Copyright (c) 2019 Stephen Merrony
+ *
+ *This software is released under the MIT License.
+ *https://opensource.org/licenses/MIT
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Just enough of RFC 6455 for the API to stream telemetry to WebSocket clients.
+
+const (
+	wsGUID        = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsOpText      = 0x1
+	wsOpClose     = 0x8
+	wsOpPing      = 0x9
+	wsOpPong      = 0xa
+	wsMaxFrameLen = 64 * 1024 // we don't expect clients to send us much
+)
+
+type wsConnT struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+	wMu  sync.Mutex
+}
+
+func headerHas(h http.Header, name, token string) bool {
+	for _, v := range strings.Split(h.Get(name), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// wsUpgrade performs the WebSocket opening handshake, on failure an HTTP error has been sent.
+func wsUpgrade(w http.ResponseWriter, r *http.Request) (*wsConnT, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !headerHas(r.Header, "Connection", "upgrade") ||
+		!headerHas(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "WebSocket upgrade required", http.StatusBadRequest)
+		return nil, errors.New("not a WebSocket request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported WebSocket version")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("connection cannot be hijacked")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(key + wsGUID))
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err = rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConnT{conn: conn, rw: rw}, nil
+}
+
+// writeFrame sends a single unfragmented, unmasked frame.
+func (ws *wsConnT) writeFrame(op byte, payload []byte) error {
+	ws.wMu.Lock()
+	defer ws.wMu.Unlock()
+	hdr := []byte{0x80 | op}
+	switch l := len(payload); {
+	case l < 126:
+		hdr = append(hdr, byte(l))
+	case l < 65536:
+		hdr = append(hdr, 126, byte(l>>8), byte(l))
+	default:
+		hdr = append(hdr, 127)
+		hdr = append(hdr, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(hdr[2:], uint64(l))
+	}
+	ws.rw.Write(hdr)
+	ws.rw.Write(payload)
+	return ws.rw.Flush()
+}
+
+// readFrame reads a single frame from the client, unmasking it.
+func (ws *wsConnT) readFrame() (op byte, payload []byte, err error) {
+	var hdr [2]byte
+	if _, err = io.ReadFull(ws.rw, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	op = hdr[0] & 0x0f
+	masked := hdr[1]&0x80 != 0
+	l := uint64(hdr[1] & 0x7f)
+	switch l {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(ws.rw, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		l = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(ws.rw, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		l = binary.BigEndian.Uint64(ext[:])
+	}
+	if l > wsMaxFrameLen {
+		return 0, nil, errors.New("WebSocket frame too long")
+	}
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(ws.rw, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload = make([]byte, l)
+	if _, err = io.ReadFull(ws.rw, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return op, payload, nil
+}
+
+// readLoop answers pings and closes, it returns when the client goes away.
+func (ws *wsConnT) readLoop() {
+	for {
+		op, payload, err := ws.readFrame()
+		if err != nil {
+			return
+		}
+		switch op {
+		case wsOpPing:
+			ws.writeFrame(wsOpPong, payload)
+		case wsOpClose:
+			ws.writeFrame(wsOpClose, payload)
+			return
+		}
+	}
+}
+
+func (ws *wsConnT) close() {
+	ws.conn.Close()
+}